@@ -10,6 +10,9 @@ type MessageAccumulator struct {
 	// This is a pointer to support accumulators derived from `WithPrefix()` accumulating to
 	// the same underlying collection.
 	msgs *[]string
+	// Format strings of the accumulated messages, excluding any prefix, parallel to msgs.
+	// A format identifies the check that failed independently of the values in the message.
+	formats *[]string
 	// Optional prefix to all new messages, e.g. describing higher level context.
 	prefix string
 }
@@ -19,8 +22,9 @@ type MessageAccumulator struct {
 func (ma *MessageAccumulator) WithPrefix(format string, args ...interface{}) *MessageAccumulator {
 	ma.initialize()
 	return &MessageAccumulator{
-		msgs:   ma.msgs,
-		prefix: ma.prefix + fmt.Sprintf(format, args...),
+		msgs:    ma.msgs,
+		formats: ma.formats,
+		prefix:  ma.prefix + fmt.Sprintf(format, args...),
 	}
 }
 
@@ -35,15 +39,23 @@ func (ma *MessageAccumulator) Messages() []string {
 	return (*ma.msgs)[:]
 }
 
+// Returns the format string of each message, in the same order as Messages().
+// Messages added without a format are their own format.
+func (ma *MessageAccumulator) Formats() []string {
+	if ma.formats == nil {
+		return nil
+	}
+	return (*ma.formats)[:]
+}
+
 // Adds messages to the accumulator.
 func (ma *MessageAccumulator) Add(msg string) {
-	ma.initialize()
-	*ma.msgs = append(*ma.msgs, ma.prefix+msg)
+	ma.add(msg, msg)
 }
 
 // Adds a message to the accumulator
 func (ma *MessageAccumulator) Addf(format string, args ...interface{}) {
-	ma.Add(fmt.Sprintf(format, args...))
+	ma.add(fmt.Sprintf(format, args...), format)
 }
 
 // Adds messages from another accumulator to this one.
@@ -51,15 +63,15 @@ func (ma *MessageAccumulator) AddAll(other *MessageAccumulator) {
 	if other.msgs == nil {
 		return
 	}
-	for _, msg := range *other.msgs {
-		ma.Add(msg)
+	for i, msg := range *other.msgs {
+		ma.add(msg, (*other.formats)[i])
 	}
 }
 
 // Adds a message if predicate is false.
 func (ma *MessageAccumulator) Require(predicate bool, msg string, args ...interface{}) {
 	if !predicate {
-		ma.Add(fmt.Sprintf(msg, args...))
+		ma.add(fmt.Sprintf(msg, args...), msg)
 	}
 }
 
@@ -71,8 +83,15 @@ func (ma *MessageAccumulator) RequireNoError(err error, msg string, args ...inte
 	}
 }
 
+func (ma *MessageAccumulator) add(msg, format string) {
+	ma.initialize()
+	*ma.msgs = append(*ma.msgs, ma.prefix+msg)
+	*ma.formats = append(*ma.formats, format)
+}
+
 func (ma *MessageAccumulator) initialize() {
 	if ma.msgs == nil {
 		ma.msgs = &[]string{}
+		ma.formats = &[]string{}
 	}
 }
@@ -1,15 +1,15 @@
-package nv10_test
+package migration_test
 
 import (
 	"testing"
 
-	"github.com/filecoin-project/specs-actors/v4/actors/migration/nv10"
+	"github.com/filecoin-project/specs-actors/v4/actors/migration"
 	atesting "github.com/filecoin-project/specs-actors/v4/support/testing"
 	"github.com/stretchr/testify/require"
 )
 
 func TestMemMigrationCache(t *testing.T) {
-	cache := nv10.NewMemMigrationCache()
+	cache := migration.NewMemMigrationCache()
 	cid1 := atesting.MakeCID("foo", nil)
 	cid2 := atesting.MakeCID("bar", nil)
 	require.NoError(t, cache.Write("first", cid1))
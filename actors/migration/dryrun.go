@@ -0,0 +1,73 @@
+package migration
+
+import (
+	"sync"
+
+	block "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+)
+
+// Results of a migration run against an overlay store, leaving the underlying store untouched.
+type DryRunResult struct {
+	// Root of the migrated state tree, whose new blocks exist only in the discarded overlay.
+	ActorsRootOut cid.Cid
+	// Number and total size of the new blocks the migration wrote.
+	BlocksWritten int
+	BytesWritten  uint64
+	Report        *VerificationReport
+}
+
+// OverlayBlockstore reads through to an underlying block store, but holds all writes in memory, so that
+// operations may be rehearsed against a real store without modifying it.
+// The overlay is safe for concurrent use if the underlying store is safe for concurrent reads.
+type OverlayBlockstore struct {
+	base cbor.IpldBlockstore
+
+	mu     sync.RWMutex
+	blocks map[cid.Cid]block.Block
+	bytes  uint64
+}
+
+var _ cbor.IpldBlockstore = (*OverlayBlockstore)(nil)
+
+func NewOverlayBlockstore(base cbor.IpldBlockstore) *OverlayBlockstore {
+	return &OverlayBlockstore{
+		base:   base,
+		blocks: make(map[cid.Cid]block.Block),
+	}
+}
+
+func (o *OverlayBlockstore) Get(c cid.Cid) (block.Block, error) {
+	o.mu.RLock()
+	b, ok := o.blocks[c]
+	o.mu.RUnlock()
+	if ok {
+		return b, nil
+	}
+	return o.base.Get(c)
+}
+
+func (o *OverlayBlockstore) Put(b block.Block) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if _, ok := o.blocks[b.Cid()]; !ok {
+		o.blocks[b.Cid()] = b
+		o.bytes += uint64(len(b.RawData()))
+	}
+	return nil
+}
+
+// Returns the number of distinct blocks written to the overlay.
+func (o *OverlayBlockstore) Len() int {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return len(o.blocks)
+}
+
+// Returns the total size of the distinct blocks written to the overlay.
+func (o *OverlayBlockstore) Size() uint64 {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.bytes
+}
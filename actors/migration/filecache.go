@@ -0,0 +1,226 @@
+package migration
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	cid "github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"golang.org/x/xerrors"
+)
+
+// FileMigrationCache is a MigrationCache persisted to a file, so that cached results of a migration run
+// before a process restart (such as during a pre-migration warm-up) are available after it.
+// Entries are appended to the file as lines of key and CID, separated by a tab.
+// Writes are buffered until flushed, and entries not flushed before a crash are lost.
+type FileMigrationCache struct {
+	path string
+
+	mu      sync.Mutex
+	file    *os.File
+	w       *bufio.Writer
+	entries map[string]cid.Cid
+	// Loads in progress, so that concurrent loads of the same key compute the value once.
+	loading map[string]*cacheLoad
+}
+
+var _ MigrationCache = (*FileMigrationCache)(nil)
+
+type cacheLoad struct {
+	done chan struct{}
+	c    cid.Cid
+	err  error
+}
+
+// Opens a file-backed migration cache at path, creating it if it does not exist.
+// The cache is safe for concurrent use, but the file must not be opened by more than one cache at a time.
+func OpenFileMigrationCache(path string) (*FileMigrationCache, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	c := &FileMigrationCache{
+		path:    path,
+		file:    file,
+		entries: make(map[string]cid.Cid),
+		loading: make(map[string]*cacheLoad),
+	}
+	if err := c.load(); err != nil {
+		_ = file.Close()
+		return nil, xerrors.Errorf("failed to load migration cache %s: %w", path, err)
+	}
+	c.w = bufio.NewWriter(file)
+	return c, nil
+}
+
+func (c *FileMigrationCache) Write(key string, newCid cid.Cid) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.write(key, newCid)
+}
+
+func (c *FileMigrationCache) Read(key string) (bool, cid.Cid, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.entries[key]
+	return ok, v, nil
+}
+
+func (c *FileMigrationCache) Load(key string, loadFunc func() (cid.Cid, error)) (cid.Cid, error) {
+	c.mu.Lock()
+	if v, ok := c.entries[key]; ok {
+		c.mu.Unlock()
+		return v, nil
+	}
+	if l, ok := c.loading[key]; ok {
+		c.mu.Unlock()
+		<-l.done
+		return l.c, l.err
+	}
+	l := &cacheLoad{done: make(chan struct{})}
+	c.loading[key] = l
+	c.mu.Unlock()
+
+	l.c, l.err = loadFunc()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.loading, key)
+	if l.err == nil {
+		l.err = c.write(key, l.c)
+	}
+	close(l.done)
+	return l.c, l.err
+}
+
+// Returns the number of cached entries.
+func (c *FileMigrationCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// Removes the entries whose CIDs are not present in a block store, such as after the block store has been
+// garbage collected, and rewrites the file without them. Returns the number of entries removed.
+func (c *FileMigrationCache) Validate(bs cbor.IpldBlockstore) (removed int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, v := range c.entries { //nolint:nomaprange
+		if _, err := bs.Get(v); err != nil {
+			delete(c.entries, key)
+			removed++
+		}
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, c.rewrite()
+}
+
+// Writes buffered entries to the file and syncs it.
+func (c *FileMigrationCache) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.flush()
+}
+
+// Flushes and closes the cache.
+func (c *FileMigrationCache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.flush(); err != nil {
+		_ = c.file.Close()
+		return err
+	}
+	return c.file.Close()
+}
+
+func (c *FileMigrationCache) write(key string, v cid.Cid) error {
+	if strings.ContainsAny(key, "\t\n") {
+		return xerrors.Errorf("invalid migration cache key %q", key)
+	}
+	if old, ok := c.entries[key]; ok && old.Equals(v) {
+		return nil
+	}
+	c.entries[key] = v
+	_, err := c.w.WriteString(key + "\t" + v.String() + "\n")
+	return err
+}
+
+func (c *FileMigrationCache) flush() error {
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	return c.file.Sync()
+}
+
+// Reads all entries from the file. Later entries for a key replace earlier ones.
+// A partial last line, left by a crash while writing, is discarded.
+func (c *FileMigrationCache) load() error {
+	data, err := ioutil.ReadAll(c.file)
+	if err != nil {
+		return err
+	}
+	complete := bytes.LastIndexByte(data, '\n') + 1
+	for lineNum, line := range strings.Split(string(data[:complete]), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 2 {
+			return xerrors.Errorf("malformed line %d", lineNum+1)
+		}
+		v, err := cid.Decode(fields[1])
+		if err != nil {
+			return xerrors.Errorf("malformed CID on line %d: %w", lineNum+1, err)
+		}
+		c.entries[fields[0]] = v
+	}
+	if complete < len(data) {
+		if err := c.file.Truncate(int64(complete)); err != nil {
+			return err
+		}
+	}
+	_, err = c.file.Seek(int64(complete), io.SeekStart)
+	return err
+}
+
+// Replaces the file with one holding only the current entries.
+func (c *FileMigrationCache) rewrite() error {
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	tmpPath := c.path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for key, v := range c.entries { //nolint:nomaprange
+		if _, err := w.WriteString(key + "\t" + v.String() + "\n"); err != nil {
+			_ = tmp.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := os.Rename(tmpPath, c.path); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	_ = c.file.Close()
+	c.file = tmp
+	c.w = bufio.NewWriter(tmp)
+	return nil
+}
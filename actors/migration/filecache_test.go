@@ -0,0 +1,164 @@
+package migration_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/specs-actors/v4/actors/migration"
+	"github.com/filecoin-project/specs-actors/v4/support/ipld"
+	atesting "github.com/filecoin-project/specs-actors/v4/support/testing"
+)
+
+func TestFileMigrationCache(t *testing.T) {
+	cid1 := atesting.MakeCID("foo", nil)
+	cid2 := atesting.MakeCID("bar", nil)
+
+	t.Run("persists entries across reopening", func(t *testing.T) {
+		path := cachePath(t)
+		cache, err := migration.OpenFileMigrationCache(path)
+		require.NoError(t, err)
+		require.NoError(t, cache.Write("first", cid1))
+		require.NoError(t, cache.Write("second", cid1))
+		require.NoError(t, cache.Write("second", cid2))
+		require.NoError(t, cache.Close())
+
+		cache, err = migration.OpenFileMigrationCache(path)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, cache.Close()) }()
+		assert.Equal(t, 2, cache.Len())
+
+		found, result, err := cache.Read("first")
+		require.NoError(t, err)
+		require.True(t, found)
+		assert.Equal(t, cid1, result)
+
+		// The last write of a key wins.
+		found, result, err = cache.Read("second")
+		require.NoError(t, err)
+		require.True(t, found)
+		assert.Equal(t, cid2, result)
+
+		found, _, err = cache.Read("other")
+		require.NoError(t, err)
+		assert.False(t, found)
+	})
+
+	t.Run("rejects invalid keys", func(t *testing.T) {
+		cache, err := migration.OpenFileMigrationCache(cachePath(t))
+		require.NoError(t, err)
+		defer func() { require.NoError(t, cache.Close()) }()
+		assert.Error(t, cache.Write("a\tb", cid1))
+		assert.Error(t, cache.Write("a\nb", cid1))
+	})
+
+	t.Run("discards partial last line", func(t *testing.T) {
+		path := cachePath(t)
+		cache, err := migration.OpenFileMigrationCache(path)
+		require.NoError(t, err)
+		require.NoError(t, cache.Write("first", cid1))
+		require.NoError(t, cache.Close())
+
+		// Simulate a crash part way through writing an entry.
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+		require.NoError(t, err)
+		_, err = f.WriteString("second\tbafy")
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		cache, err = migration.OpenFileMigrationCache(path)
+		require.NoError(t, err)
+		assert.Equal(t, 1, cache.Len())
+		require.NoError(t, cache.Write("second", cid2))
+		require.NoError(t, cache.Close())
+
+		cache, err = migration.OpenFileMigrationCache(path)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, cache.Close()) }()
+		found, result, err := cache.Read("second")
+		require.NoError(t, err)
+		require.True(t, found)
+		assert.Equal(t, cid2, result)
+	})
+
+	t.Run("rejects malformed file", func(t *testing.T) {
+		path := cachePath(t)
+		require.NoError(t, ioutil.WriteFile(path, []byte("first\tnot a cid\n"), 0644))
+		_, err := migration.OpenFileMigrationCache(path)
+		assert.Error(t, err)
+	})
+
+	t.Run("concurrent loads compute once", func(t *testing.T) {
+		cache, err := migration.OpenFileMigrationCache(cachePath(t))
+		require.NoError(t, err)
+		defer func() { require.NoError(t, cache.Close()) }()
+
+		var calls int32
+		release := make(chan struct{})
+		var wg sync.WaitGroup
+		results := make([]cid.Cid, 8)
+		for i := range results {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				c, err := cache.Load("key", func() (cid.Cid, error) {
+					atomic.AddInt32(&calls, 1)
+					<-release
+					return cid1, nil
+				})
+				assert.NoError(t, err)
+				results[i] = c
+			}(i)
+		}
+		close(release)
+		wg.Wait()
+		assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+		for _, c := range results {
+			assert.Equal(t, cid1, c)
+		}
+	})
+
+	t.Run("validate removes unresolvable entries", func(t *testing.T) {
+		bs := ipld.NewBlockStoreInMemory()
+		block := blocks.NewBlock([]byte("present"))
+		require.NoError(t, bs.Put(block))
+
+		path := cachePath(t)
+		cache, err := migration.OpenFileMigrationCache(path)
+		require.NoError(t, err)
+		require.NoError(t, cache.Write("present", block.Cid()))
+		require.NoError(t, cache.Write("missing", cid1))
+
+		removed, err := cache.Validate(bs)
+		require.NoError(t, err)
+		assert.Equal(t, 1, removed)
+		assert.Equal(t, 1, cache.Len())
+		// The cache remains writable after compaction.
+		require.NoError(t, cache.Write("another", block.Cid()))
+		require.NoError(t, cache.Close())
+
+		cache, err = migration.OpenFileMigrationCache(path)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, cache.Close()) }()
+		assert.Equal(t, 2, cache.Len())
+		found, _, err := cache.Read("missing")
+		require.NoError(t, err)
+		assert.False(t, found)
+	})
+}
+
+// Returns the path of a cache file in a new temporary directory, which is removed after the test.
+func cachePath(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "migration-cache")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	return filepath.Join(dir, "cache")
+}
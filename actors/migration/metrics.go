@@ -0,0 +1,230 @@
+package migration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/filecoin-project/go-state-types/rt"
+	cid "github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+)
+
+// MetricsReporter receives the metrics of a completed state tree migration,
+// such as for forwarding to a node's metrics system.
+type MetricsReporter interface {
+	// Called once, after the migrated state tree is flushed.
+	ReportMigrationMetrics(metrics *MigrationMetrics)
+}
+
+// Summary of a state tree migration.
+type MigrationMetrics struct {
+	// Time from start of the migration to the migrated state tree being flushed.
+	WallTime time.Duration
+	// Time spent running deferred migrations, which run sequentially after all others.
+	DeferredTime time.Duration
+	ActorCount   int
+	// Metrics of the migration of actors of each prior version code CID, ordered by actor name.
+	ActorCodes []*ActorCodeMetrics
+}
+
+type ActorCodeMetrics struct {
+	// Prior version code CID, and its actor name.
+	Code      cid.Cid
+	ActorName string
+	Deferred  bool
+	// Number of actors migrated, and of those re-using their state from a prior migration.
+	Count  int
+	Reused int
+	// Time spent migrating the actors' state, in total and at the 99th percentile.
+	TotalDuration time.Duration
+	P99Duration   time.Duration
+	// Blocks read from and written to the store while migrating the actors' state.
+	BlocksRead    uint64
+	BlocksWritten uint64
+	// Reads and loads through the migration cache which found, or did not find, a cached value.
+	CacheHits   uint64
+	CacheMisses uint64
+}
+
+// Writes the metrics as indented JSON.
+func (m *MigrationMetrics) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(m)
+}
+
+// Writes the metrics as a human-readable table.
+func (m *MigrationMetrics) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "%d actors migrated in %v, %v deferred\n\n", m.ActorCount, m.WallTime, m.DeferredTime)
+	fmt.Fprintf(tw, "\tactors\treused\ttotal\tp99\tblocks read\tblocks written\tcache hits\tcache misses\t\n")
+	for _, c := range m.ActorCodes {
+		name := c.ActorName
+		if c.Deferred {
+			name += " (deferred)"
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%v\t%v\t%d\t%d\t%d\t%d\t\n", name, c.Count, c.Reused, c.TotalDuration, c.P99Duration,
+			c.BlocksRead, c.BlocksWritten, c.CacheHits, c.CacheMisses)
+	}
+	return tw.Flush()
+}
+
+// Measurements of the migration of a single actor.
+type jobStats struct {
+	duration      time.Duration
+	reused        bool
+	blocksRead    uint64
+	blocksWritten uint64
+	cacheHits     uint64
+	cacheMisses   uint64
+}
+
+// Runs a migration of one actor, counting its store and cache accesses.
+func measure(store cbor.IpldStore, cache MigrationCache, fn func(store cbor.IpldStore, cache MigrationCache) error) (jobStats, error) {
+	var stats jobStats
+	countedStore := &countingStore{IpldStore: store, reads: &stats.blocksRead, writes: &stats.blocksWritten}
+	countedCache := &countingCache{MigrationCache: cache, hits: &stats.cacheHits, misses: &stats.cacheMisses}
+	start := time.Now()
+	err := fn(countedStore, countedCache)
+	stats.duration = time.Since(start)
+	return stats, err
+}
+
+// Accumulates job measurements by actor code. Not safe for concurrent use.
+type metricsCollector struct {
+	metrics   MigrationMetrics
+	codes     map[cid.Cid]*ActorCodeMetrics
+	durations map[cid.Cid][]time.Duration
+}
+
+func newMetricsCollector() *metricsCollector {
+	return &metricsCollector{
+		codes:     make(map[cid.Cid]*ActorCodeMetrics),
+		durations: make(map[cid.Cid][]time.Duration),
+	}
+}
+
+func (c *metricsCollector) add(code cid.Cid, deferred bool, stats jobStats) {
+	m, ok := c.codes[code]
+	if !ok {
+		m = &ActorCodeMetrics{Code: code, ActorName: actorNameByCode(code), Deferred: deferred}
+		c.codes[code] = m
+	}
+	m.Count++
+	if stats.reused {
+		m.Reused++
+	}
+	m.TotalDuration += stats.duration
+	m.BlocksRead += stats.blocksRead
+	m.BlocksWritten += stats.blocksWritten
+	m.CacheHits += stats.cacheHits
+	m.CacheMisses += stats.cacheMisses
+	c.durations[code] = append(c.durations[code], stats.duration)
+	c.metrics.ActorCount++
+}
+
+// Completes the metrics with percentiles and ordering.
+func (c *metricsCollector) finish(wallTime, deferredTime time.Duration) *MigrationMetrics {
+	c.metrics.WallTime = wallTime
+	c.metrics.DeferredTime = deferredTime
+	c.metrics.ActorCodes = nil
+	for code, m := range c.codes { //nolint:nomaprange
+		m.P99Duration = percentile(c.durations[code], 99)
+		c.metrics.ActorCodes = append(c.metrics.ActorCodes, m)
+	}
+	sort.Slice(c.metrics.ActorCodes, func(i, j int) bool {
+		return c.metrics.ActorCodes[i].ActorName < c.metrics.ActorCodes[j].ActorName
+	})
+	return &c.metrics
+}
+
+// Logs and reports the metrics of a completed migration.
+func reportMetrics(metrics *MigrationMetrics, cfg Config, log Logger) {
+	for _, c := range metrics.ActorCodes {
+		log.Log(rt.INFO, "Migrated %d %s actors (%d reused) in %v total, %v p99, %d blocks read, %d written, %d cache hits, %d misses",
+			c.Count, c.ActorName, c.Reused, c.TotalDuration, c.P99Duration, c.BlocksRead, c.BlocksWritten, c.CacheHits, c.CacheMisses)
+	}
+	if cfg.Metrics != nil {
+		cfg.Metrics.ReportMigrationMetrics(metrics)
+	}
+}
+
+// Returns the nearest-rank percentile of durations, which are sorted in place.
+func percentile(durations []time.Duration, p int) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	rank := (len(durations)*p + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return durations[rank-1]
+}
+
+// A store counting the blocks read and written through it.
+type countingStore struct {
+	cbor.IpldStore
+	reads  *uint64
+	writes *uint64
+}
+
+func (s *countingStore) Get(ctx context.Context, c cid.Cid, out interface{}) error {
+	atomic.AddUint64(s.reads, 1)
+	return s.IpldStore.Get(ctx, c, out)
+}
+
+func (s *countingStore) Put(ctx context.Context, v interface{}) (cid.Cid, error) {
+	atomic.AddUint64(s.writes, 1)
+	return s.IpldStore.Put(ctx, v)
+}
+
+// A cache counting the hits and misses of reads and loads through it.
+type countingCache struct {
+	MigrationCache
+	hits   *uint64
+	misses *uint64
+}
+
+func (c *countingCache) Read(key string) (bool, cid.Cid, error) {
+	found, v, err := c.MigrationCache.Read(key)
+	if err == nil {
+		c.count(found)
+	}
+	return found, v, err
+}
+
+func (c *countingCache) Load(key string, loadFunc func() (cid.Cid, error)) (cid.Cid, error) {
+	loaded := false
+	v, err := c.MigrationCache.Load(key, func() (cid.Cid, error) {
+		loaded = true
+		return loadFunc()
+	})
+	if err == nil {
+		c.count(!loaded)
+	}
+	return v, err
+}
+
+func (c *countingCache) count(hit bool) {
+	if hit {
+		atomic.AddUint64(c.hits, 1)
+	} else {
+		atomic.AddUint64(c.misses, 1)
+	}
+}
+
+// Returns a cache which counts accesses to another cache with the counters of the input cache of a migration,
+// if it's counting.
+func countedLike(cache MigrationCache, input MigrationCache) MigrationCache {
+	if counted, ok := input.(*countingCache); ok {
+		return &countingCache{MigrationCache: cache, hits: counted.hits, misses: counted.misses}
+	}
+	return cache
+}
@@ -0,0 +1,134 @@
+package migration_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	addr "github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	cid "github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	cbg "github.com/whyrusleeping/cbor-gen"
+
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin"
+	"github.com/filecoin-project/specs-actors/v4/actors/migration"
+	"github.com/filecoin-project/specs-actors/v4/actors/states"
+	"github.com/filecoin-project/specs-actors/v4/support/ipld"
+	vm "github.com/filecoin-project/specs-actors/v4/support/vm"
+)
+
+func TestMigrationMetrics(t *testing.T) {
+	ctx := context.Background()
+	bs := ipld.NewSyncBlockStore(ipld.NewBlockStoreInMemory())
+	v := vm.NewVMWithSingletons(ctx, t, bs)
+	store := cbor.NewCborStore(bs)
+	log := migration.TestLogger{TB: t}
+	tree, err := v.GetStateTree()
+	require.NoError(t, err)
+
+	cache := migration.NewMemMigrationCache()
+	migrations := migration.Migrations{
+		Actors:   map[cid.Cid]migration.ActorMigration{},
+		Deferred: map[cid.Cid]migration.DeferredActorMigration{},
+	}
+	actorCounts := map[string]int{}
+	require.NoError(t, tree.ForEach(func(_ addr.Address, actor *states.Actor) error {
+		migrations.Actors[actor.Code] = migration.CachedMigration(cache, copyMigration{actor.Code})
+		actorCounts[builtin.ActorNameByCode(actor.Code)]++
+		return nil
+	}))
+	delete(migrations.Actors, builtin.StoragePowerActorCodeID)
+	migrations.Deferred[builtin.StoragePowerActorCodeID] = &deferredCounter{}
+
+	migrate := func() *migration.MigrationMetrics {
+		reporter := &metricsRecorder{}
+		_, err := migration.MigrateStateTree(ctx, store, tree, abi.ChainEpoch(0), migrations,
+			migration.Config{MaxWorkers: 2, Metrics: reporter}, log, cache)
+		require.NoError(t, err)
+		require.Len(t, reporter.reports, 1)
+		return reporter.reports[0]
+	}
+
+	// The first migration misses the cache, reading and writing each migrated actor's head.
+	metrics := migrate()
+	total := 0
+	for _, count := range actorCounts {
+		total += count
+	}
+	assert.Equal(t, total, metrics.ActorCount)
+	assert.Len(t, metrics.ActorCodes, len(actorCounts))
+	for i, c := range metrics.ActorCodes {
+		if i > 0 {
+			assert.Less(t, metrics.ActorCodes[i-1].ActorName, c.ActorName)
+		}
+		assert.Equal(t, builtin.ActorNameByCode(c.Code), c.ActorName)
+		assert.Equal(t, actorCounts[c.ActorName], c.Count)
+		assert.Zero(t, c.Reused)
+		assert.LessOrEqual(t, c.P99Duration, c.TotalDuration)
+		if c.Code.Equals(builtin.StoragePowerActorCodeID) {
+			assert.True(t, c.Deferred)
+			assert.Zero(t, c.CacheHits+c.CacheMisses)
+			continue
+		}
+		assert.False(t, c.Deferred)
+		assert.Equal(t, uint64(c.Count), c.BlocksRead)
+		assert.Equal(t, uint64(c.Count), c.BlocksWritten)
+		assert.Equal(t, uint64(c.Count), c.CacheMisses)
+		assert.Zero(t, c.CacheHits)
+	}
+	assert.LessOrEqual(t, metrics.DeferredTime, metrics.WallTime)
+
+	// The second migration hits the cache for every actor.
+	metrics = migrate()
+	for _, c := range metrics.ActorCodes {
+		if c.Deferred {
+			continue
+		}
+		assert.Zero(t, c.BlocksRead)
+		assert.Zero(t, c.BlocksWritten)
+		assert.Equal(t, uint64(c.Count), c.CacheHits)
+		assert.Zero(t, c.CacheMisses)
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, metrics.WriteText(&buf))
+	assert.Contains(t, buf.String(), builtin.ActorNameByCode(builtin.StoragePowerActorCodeID)+" (deferred)")
+	buf.Reset()
+	require.NoError(t, metrics.WriteJSON(&buf))
+	assert.Contains(t, buf.String(), `"ActorCount"`)
+}
+
+type metricsRecorder struct {
+	reports []*migration.MigrationMetrics
+}
+
+func (r *metricsRecorder) ReportMigrationMetrics(metrics *migration.MigrationMetrics) {
+	r.reports = append(r.reports, metrics)
+}
+
+// A migration which preserves an actor's code, and reads and re-writes its head block.
+type copyMigration struct {
+	code cid.Cid
+}
+
+func (m copyMigration) MigrateState(ctx context.Context, store cbor.IpldStore, in migration.ActorMigrationInput) (*migration.ActorMigrationResult, error) {
+	var head cbg.Deferred
+	if err := store.Get(ctx, in.Head, &head); err != nil {
+		return nil, err
+	}
+	newHead, err := store.Put(ctx, &head)
+	if err != nil {
+		return nil, err
+	}
+	return &migration.ActorMigrationResult{
+		NewCodeCID: m.code,
+		NewHead:    newHead,
+	}, nil
+}
+
+func (m copyMigration) MigratedCodeCID() cid.Cid {
+	return m.code
+}
@@ -0,0 +1,476 @@
+package migration
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	address "github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/rt"
+	cid "github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	mh "github.com/multiformats/go-multihash"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/specs-actors/v4/actors/states"
+	"github.com/filecoin-project/specs-actors/v4/actors/util/adt"
+)
+
+// Config parameterizes a state tree migration
+type Config struct {
+	// Number of migration worker goroutines to run.
+	// More workers enables higher CPU utilization doing migration computations (including state encoding)
+	MaxWorkers uint
+	// Capacity of the queue of jobs available to workers (zero for unbuffered).
+	// A queue length of hundreds to thousands improves throughput at the cost of memory.
+	JobQueueSize uint
+	// Capacity of the queue receiving migration results from workers, for persisting (zero for unbuffered).
+	// A queue length of tens to hundreds improves throughput at the cost of memory.
+	ResultQueueSize uint
+	// Time between progress logs to emit.
+	// Zero (the default) results in no progress logs.
+	ProgressLogPeriod time.Duration
+	// Receives the metrics of the migration on completion, if not nil.
+	Metrics MetricsReporter
+}
+
+type Logger interface {
+	// This is the same logging interface provided by the Runtime.
+	Log(level rt.LogLevel, msg string, args ...interface{})
+}
+
+type TestLogger struct {
+	TB testing.TB
+}
+
+func (t TestLogger) Log(_ rt.LogLevel, msg string, args ...interface{}) {
+	t.TB.Logf(msg, args...)
+}
+
+type ActorMigrationInput struct {
+	Address    address.Address // actor's address
+	Balance    abi.TokenAmount // actor's balance
+	Head       cid.Cid         // actor's state head CID
+	PriorEpoch abi.ChainEpoch  // epoch of last state transition prior to migration
+	Cache      MigrationCache  // cache of existing cid -> cid migrations for this actor
+}
+
+type ActorMigrationResult struct {
+	NewCodeCID cid.Cid
+	NewHead    cid.Cid
+}
+
+type ActorMigration interface {
+	// Loads an actor's state from an input store and writes new state to an output store.
+	// Returns the new state head CID.
+	MigrateState(ctx context.Context, store cbor.IpldStore, input ActorMigrationInput) (result *ActorMigrationResult, err error)
+	MigratedCodeCID() cid.Cid
+}
+
+// An actor migration that depends on the results of migrating other actors, such as a power actor
+// summarizing all miners' migrated claims.
+type DeferredActorMigration interface {
+	// Loads an actor's state from an input store and writes new state to an output store.
+	// The tree holds all non-deferred actors already migrated, and any deferred actors migrated before this one.
+	// Returns the new state head CID.
+	MigrateState(ctx context.Context, store cbor.IpldStore, input ActorMigrationInput, migrated *states.Tree) (result *ActorMigrationResult, err error)
+	MigratedCodeCID() cid.Cid
+}
+
+// The actor migrations making up a state tree migration, keyed by the prior version's code CIDs.
+// Every actor in the input state tree must have a code CID with exactly one migration.
+type Migrations struct {
+	// Migrations run concurrently, each independently of all other actors.
+	Actors map[cid.Cid]ActorMigration
+	// Migrations run sequentially in state tree order, after all those in Actors have completed.
+	Deferred map[cid.Cid]DeferredActorMigration
+}
+
+// The prior version state tree from which actors are migrated.
+type ActorTree interface {
+	ForEach(fn func(addr address.Address, actor *states.Actor) error) error
+}
+
+// Migrates the filecoin state tree starting from the global state tree and upgrading all actor state.
+// The store must support concurrent writes (even if the configured worker count is 1).
+func MigrateStateTree(ctx context.Context, store cbor.IpldStore, actorsIn ActorTree, priorEpoch abi.ChainEpoch,
+	migrations Migrations, cfg Config, log Logger, cache MigrationCache) (cid.Cid, error) {
+	return migrateStateTree(ctx, store, actorsIn, priorEpoch, migrations, cfg, log, cache, nil)
+}
+
+// Migrates a state tree incrementally from the migration of an earlier state tree, such as one migrated ahead of
+// an upgrade. Actors whose code and head are unchanged since the earlier tree keep their earlier migrated state,
+// taking only their new balance and call sequence number; all other actors, and all deferred actors, are migrated.
+// The earlier output tree must be the result of migrating the earlier input tree with the same migrations.
+// This relies on each non-deferred actor migration depending only on the actor's address and head, as
+// assumed also by CachedMigration.
+// The store must support concurrent writes (even if the configured worker count is 1).
+func MigrateStateTreeIncremental(ctx context.Context, store cbor.IpldStore, prevActorsIn ActorTree, prevActorsRootOut cid.Cid,
+	actorsIn ActorTree, priorEpoch abi.ChainEpoch, migrations Migrations, cfg Config, log Logger, cache MigrationCache) (cid.Cid, error) {
+	prevActorsOut, err := states.LoadTree(adt.WrapStore(ctx, store), prevActorsRootOut)
+	if err != nil {
+		return cid.Undef, xerrors.Errorf("failed to load prior migrated state tree %v: %w", prevActorsRootOut, err)
+	}
+	prior := make(map[address.Address]*priorActor)
+	if err := prevActorsIn.ForEach(func(addr address.Address, actorIn *states.Actor) error {
+		prior[addr] = &priorActor{code: actorIn.Code, head: actorIn.Head}
+		return nil
+	}); err != nil {
+		return cid.Undef, err
+	}
+	if err := prevActorsOut.ForEach(func(addr address.Address, actorOut *states.Actor) error {
+		if p, ok := prior[addr]; ok {
+			p.migrated = migratedState{code: actorOut.Code, head: actorOut.Head}
+		}
+		return nil
+	}); err != nil {
+		return cid.Undef, err
+	}
+	return migrateStateTree(ctx, store, actorsIn, priorEpoch, migrations, cfg, log, cache, prior)
+}
+
+// An actor in the input tree of an earlier migration, with its migrated code and head in the output tree.
+type priorActor struct {
+	code     cid.Cid
+	head     cid.Cid
+	migrated migratedState
+}
+
+// Migrates a state tree, re-using the migrated state of unchanged actors from a prior migration, if any.
+func migrateStateTree(ctx context.Context, store cbor.IpldStore, actorsIn ActorTree, priorEpoch abi.ChainEpoch,
+	migrations Migrations, cfg Config, log Logger, cache MigrationCache, prior map[address.Address]*priorActor) (cid.Cid, error) {
+	if cfg.MaxWorkers <= 0 {
+		return cid.Undef, xerrors.Errorf("invalid migration config with %d workers", cfg.MaxWorkers)
+	}
+	for code := range migrations.Deferred { //nolint:nomaprange
+		if _, ok := migrations.Actors[code]; ok {
+			return cid.Undef, xerrors.Errorf("code CID %v has both deferred and non-deferred migrations", code)
+		}
+	}
+	startTime := time.Now()
+
+	// Load output state tree
+	adtStore := adt.WrapStore(ctx, store)
+	actorsOut, err := states.NewTree(adtStore)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	// Setup synchronization
+	grp, grpCtx := errgroup.WithContext(ctx)
+	// Input and output queues for workers.
+	jobCh := make(chan *migrationJob, cfg.JobQueueSize)
+	jobResultCh := make(chan *migrationJobResult, cfg.ResultQueueSize)
+	// Atomically-modified counters for logging progress
+	var jobCount uint32
+	var doneCount uint32
+	// Count of jobs re-using a prior migration, written only by the job creator.
+	var keptCount int
+	// Actors deferred for explicit migration after all others, in state tree order.
+	var deferred []*deferredJob
+
+	// Iterate all actors in old state root to create migration jobs for each non-deferred actor.
+	grp.Go(func() error {
+		defer close(jobCh)
+		log.Log(rt.INFO, "Creating migration jobs")
+		if err := actorsIn.ForEach(func(addr address.Address, actorIn *states.Actor) error {
+			if m, ok := migrations.Deferred[actorIn.Code]; ok {
+				// Deferred for explicit migration later.
+				deferred = append(deferred, &deferredJob{addr, *actorIn, m})
+				return nil
+			}
+			m, ok := migrations.Actors[actorIn.Code]
+			if !ok {
+				return xerrors.Errorf("no migration for %s actor, addr %s", actorNameByCode(actorIn.Code), addr)
+			}
+			reused := false
+			if p, ok := prior[addr]; ok && p.migrated.code.Defined() && p.code.Equals(actorIn.Code) && p.head.Equals(actorIn.Head) {
+				m = p.migrated
+				reused = true
+				keptCount++
+			}
+			nextInput := &migrationJob{
+				Address:        addr,
+				Actor:          *actorIn, // Must take a copy, the pointer is not stable.
+				cache:          cache,
+				reused:         reused,
+				ActorMigration: m,
+			}
+			select {
+			case jobCh <- nextInput:
+			case <-grpCtx.Done():
+				return grpCtx.Err()
+			}
+			atomic.AddUint32(&jobCount, 1)
+			return nil
+		}); err != nil {
+			return err
+		}
+		log.Log(rt.INFO, "Done creating %d migration jobs (%d unchanged since prior migration) and deferring %d after %v",
+			jobCount, keptCount, len(deferred), time.Since(startTime))
+		return nil
+	})
+
+	// Worker threads run jobs.
+	var workerWg sync.WaitGroup
+	for i := uint(0); i < cfg.MaxWorkers; i++ {
+		workerWg.Add(1)
+		workerId := i
+		grp.Go(func() error {
+			defer workerWg.Done()
+			for job := range jobCh {
+				result, err := job.run(grpCtx, store, priorEpoch)
+				if err != nil {
+					return err
+				}
+				select {
+				case jobResultCh <- result:
+				case <-grpCtx.Done():
+					return grpCtx.Err()
+				}
+				atomic.AddUint32(&doneCount, 1)
+			}
+			log.Log(rt.INFO, "Worker %d done", workerId)
+			return nil
+		})
+	}
+	log.Log(rt.INFO, "Started %d workers", cfg.MaxWorkers)
+
+	// Monitor the job queue. This non-critical goroutine is outside the errgroup and exits when
+	// workersFinished is closed, or the context done.
+	workersFinished := make(chan struct{}) // Closed when waitgroup is emptied.
+	if cfg.ProgressLogPeriod > 0 {
+		go func() {
+			defer log.Log(rt.DEBUG, "Job queue monitor done")
+			for {
+				select {
+				case <-time.After(cfg.ProgressLogPeriod):
+					jobsNow := atomic.LoadUint32(&jobCount) // Snapshot values to avoid incorrect-looking arithmetic if they change.
+					doneNow := atomic.LoadUint32(&doneCount)
+					pendingNow := jobsNow - doneNow
+					elapsed := time.Since(startTime)
+					rate := float64(doneNow) / elapsed.Seconds()
+					log.Log(rt.INFO, "%d jobs created, %d done, %d pending after %v (%.0f/s)",
+						jobsNow, doneNow, pendingNow, elapsed, rate)
+				case <-workersFinished:
+					return
+				case <-grpCtx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	// Close result channel when workers are done sending to it.
+	grp.Go(func() error {
+		workerWg.Wait()
+		close(jobResultCh)
+		close(workersFinished)
+		log.Log(rt.INFO, "All workers done after %v", time.Since(startTime))
+		return nil
+	})
+
+	// Insert migrated records in output state tree and accumulators.
+	metrics := newMetricsCollector()
+	grp.Go(func() error {
+		log.Log(rt.INFO, "Result writer started")
+		resultCount := 0
+		for result := range jobResultCh {
+			if err := actorsOut.SetActor(result.Address, &result.Actor); err != nil {
+				return err
+			}
+			metrics.add(result.priorCode, false, result.stats)
+			resultCount++
+		}
+		log.Log(rt.INFO, "Result writer wrote %d results to state tree after %v", resultCount, time.Since(startTime))
+		return nil
+	})
+
+	if err := grp.Wait(); err != nil {
+		return cid.Undef, err
+	}
+
+	// Perform any deferred migrations explicitly here.
+	// Deferred migrations might depend on values accumulated through migration of other actors.
+	deferredStart := time.Now()
+	for _, job := range deferred {
+		result, err := job.run(ctx, store, priorEpoch, cache, actorsOut)
+		if err != nil {
+			return cid.Undef, err
+		}
+		if err := actorsOut.SetActor(result.Address, &result.Actor); err != nil {
+			return cid.Undef, err
+		}
+		metrics.add(result.priorCode, true, result.stats)
+		doneCount++
+	}
+	deferredTime := time.Since(deferredStart)
+
+	elapsed := time.Since(startTime)
+	rate := float64(doneCount) / elapsed.Seconds()
+	log.Log(rt.INFO, "All %d done after %v (%.0f/s). Flushing state tree root.", doneCount, elapsed, rate)
+	actorsRootOut, err := actorsOut.Flush()
+	if err != nil {
+		return cid.Undef, err
+	}
+	reportMetrics(metrics.finish(time.Since(startTime), deferredTime), cfg, log)
+	return actorsRootOut, nil
+}
+
+type migrationJob struct {
+	address.Address
+	states.Actor
+	ActorMigration
+	cache  MigrationCache
+	reused bool // Whether the migration re-uses the actor's state from a prior migration.
+}
+type migrationJobResult struct {
+	address.Address
+	states.Actor
+	priorCode cid.Cid
+	stats     jobStats
+}
+
+func (job *migrationJob) run(ctx context.Context, store cbor.IpldStore, priorEpoch abi.ChainEpoch) (*migrationJobResult, error) {
+	var result *ActorMigrationResult
+	stats, err := measure(store, job.cache, func(store cbor.IpldStore, cache MigrationCache) (err error) {
+		result, err = job.MigrateState(ctx, store, ActorMigrationInput{
+			Address:    job.Address,
+			Balance:    job.Actor.Balance,
+			Head:       job.Actor.Head,
+			PriorEpoch: priorEpoch,
+			Cache:      cache,
+		})
+		return err
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("state migration failed for %s actor, addr %s: %w",
+			actorNameByCode(job.Actor.Code), job.Address, err)
+	}
+	stats.reused = job.reused
+	return migratedActor(job.Address, &job.Actor, result, stats), nil
+}
+
+type deferredJob struct {
+	address.Address
+	states.Actor
+	DeferredActorMigration
+}
+
+func (job *deferredJob) run(ctx context.Context, store cbor.IpldStore, priorEpoch abi.ChainEpoch, cache MigrationCache,
+	migrated *states.Tree) (*migrationJobResult, error) {
+	var result *ActorMigrationResult
+	stats, err := measure(store, cache, func(store cbor.IpldStore, cache MigrationCache) (err error) {
+		result, err = job.MigrateState(ctx, store, ActorMigrationInput{
+			Address:    job.Address,
+			Balance:    job.Actor.Balance,
+			Head:       job.Actor.Head,
+			PriorEpoch: priorEpoch,
+			Cache:      cache,
+		}, migrated)
+		return err
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("deferred state migration failed for %s actor, addr %s: %w",
+			actorNameByCode(job.Actor.Code), job.Address, err)
+	}
+	return migratedActor(job.Address, &job.Actor, result, stats), nil
+}
+
+// Sets up a new actor record with the migrated state.
+func migratedActor(addr address.Address, actor *states.Actor, result *ActorMigrationResult, stats jobStats) *migrationJobResult {
+	return &migrationJobResult{
+		Address: addr, // Unchanged
+		Actor: states.Actor{
+			Code:       result.NewCodeCID,
+			Head:       result.NewHead,
+			CallSeqNum: actor.CallSeqNum, // Unchanged
+			Balance:    actor.Balance,    // Unchanged
+		},
+		priorCode: actor.Code,
+		stats:     stats,
+	}
+}
+
+// Migrator which preserves the head CID and provides a fixed result code CID.
+type nilMigrator struct {
+	OutCodeCID cid.Cid
+}
+
+// Returns a migration which preserves an actor's state and sets its code CID.
+func NilMigration(outCodeCID cid.Cid) ActorMigration {
+	return nilMigrator{outCodeCID}
+}
+
+func (n nilMigrator) MigrateState(_ context.Context, _ cbor.IpldStore, in ActorMigrationInput) (*ActorMigrationResult, error) {
+	return &ActorMigrationResult{
+		NewCodeCID: n.OutCodeCID,
+		NewHead:    in.Head,
+	}, nil
+}
+
+func (n nilMigrator) MigratedCodeCID() cid.Cid {
+	return n.OutCodeCID
+}
+
+// Migrator which sets the code and head resulting from a prior migration of an unchanged actor.
+type migratedState struct {
+	code cid.Cid
+	head cid.Cid
+}
+
+func (m migratedState) MigrateState(_ context.Context, _ cbor.IpldStore, _ ActorMigrationInput) (*ActorMigrationResult, error) {
+	return &ActorMigrationResult{
+		NewCodeCID: m.code,
+		NewHead:    m.head,
+	}, nil
+}
+
+func (m migratedState) MigratedCodeCID() cid.Cid {
+	return m.code
+}
+
+// Migrator that uses cached transformation if it exists
+type cachedMigrator struct {
+	cache MigrationCache
+	ActorMigration
+}
+
+// Returns a migration which caches the new head for each actor address and prior head, re-using the
+// cached head rather than repeating the migration of an unchanged actor.
+func CachedMigration(cache MigrationCache, m ActorMigration) ActorMigration {
+	return cachedMigrator{
+		ActorMigration: m,
+		cache:          cache,
+	}
+}
+
+func (c cachedMigrator) MigrateState(ctx context.Context, store cbor.IpldStore, in ActorMigrationInput) (*ActorMigrationResult, error) {
+	newHead, err := countedLike(c.cache, in.Cache).Load(ActorHeadKey(in.Address, in.Head), func() (cid.Cid, error) {
+		result, err := c.ActorMigration.MigrateState(ctx, store, in)
+		if err != nil {
+			return cid.Undef, err
+		}
+		return result.NewHead, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ActorMigrationResult{
+		NewCodeCID: c.MigratedCodeCID(),
+		NewHead:    newHead,
+	}, nil
+}
+
+// Returns the name of an actor code CID, of any actors version.
+// Builtin actor code CIDs are identity-hashed names.
+func actorNameByCode(code cid.Cid) string {
+	if decoded, err := mh.Decode(code.Hash()); err == nil && decoded.Code == mh.IDENTITY {
+		return string(decoded.Digest)
+	}
+	return code.String()
+}
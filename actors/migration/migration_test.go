@@ -0,0 +1,236 @@
+package migration_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	addr "github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	cid "github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin"
+	"github.com/filecoin-project/specs-actors/v4/actors/migration"
+	"github.com/filecoin-project/specs-actors/v4/actors/states"
+	"github.com/filecoin-project/specs-actors/v4/actors/util/adt"
+	"github.com/filecoin-project/specs-actors/v4/support/ipld"
+	vm "github.com/filecoin-project/specs-actors/v4/support/vm"
+)
+
+func TestMigrateStateTree(t *testing.T) {
+	ctx := context.Background()
+	bs := ipld.NewSyncBlockStore(ipld.NewBlockStoreInMemory())
+	v := vm.NewVMWithSingletons(ctx, t, bs)
+	store := cbor.NewCborStore(bs)
+	log := migration.TestLogger{TB: t}
+	tree, err := v.GetStateTree()
+	require.NoError(t, err)
+	root, err := tree.Flush()
+	require.NoError(t, err)
+
+	var codes []cid.Cid
+	actorCount := 0
+	require.NoError(t, tree.ForEach(func(_ addr.Address, actor *states.Actor) error {
+		codes = append(codes, actor.Code)
+		actorCount++
+		return nil
+	}))
+
+	// Migrates every actor to the same code and state, so the tree is unchanged.
+	identityMigrations := func(deferred *deferredCounter) migration.Migrations {
+		migrations := migration.Migrations{
+			Actors:   map[cid.Cid]migration.ActorMigration{},
+			Deferred: map[cid.Cid]migration.DeferredActorMigration{},
+		}
+		for _, code := range codes {
+			migrations.Actors[code] = migration.CachedMigration(migration.NewMemMigrationCache(), migration.NilMigration(code))
+		}
+		if deferred != nil {
+			delete(migrations.Actors, builtin.StoragePowerActorCodeID)
+			migrations.Deferred[builtin.StoragePowerActorCodeID] = deferred
+		}
+		return migrations
+	}
+
+	t.Run("identity migration", func(t *testing.T) {
+		for _, workers := range []uint{1, 4} {
+			newRoot, err := migration.MigrateStateTree(ctx, store, tree, abi.ChainEpoch(0), identityMigrations(nil),
+				migration.Config{MaxWorkers: workers}, log, migration.NewMemMigrationCache())
+			require.NoError(t, err)
+			assert.Equal(t, root, newRoot)
+		}
+	})
+
+	t.Run("deferred migration sees migrated actors", func(t *testing.T) {
+		deferred := &deferredCounter{}
+		newRoot, err := migration.MigrateStateTree(ctx, store, tree, abi.ChainEpoch(0), identityMigrations(deferred),
+			migration.Config{MaxWorkers: 2, JobQueueSize: 4, ResultQueueSize: 4}, log, migration.NewMemMigrationCache())
+		require.NoError(t, err)
+		assert.Equal(t, root, newRoot)
+		assert.Equal(t, 1, deferred.calls)
+		// All actors except the power actor itself were already migrated.
+		assert.Equal(t, actorCount-1, deferred.migratedCount)
+	})
+
+	t.Run("missing migration", func(t *testing.T) {
+		migrations := identityMigrations(nil)
+		delete(migrations.Actors, builtin.StorageMarketActorCodeID)
+		_, err := migration.MigrateStateTree(ctx, store, tree, abi.ChainEpoch(0), migrations,
+			migration.Config{MaxWorkers: 2}, log, migration.NewMemMigrationCache())
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "no migration for "+builtin.ActorNameByCode(builtin.StorageMarketActorCodeID)+" actor")
+	})
+
+	t.Run("invalid migrations", func(t *testing.T) {
+		migrations := identityMigrations(&deferredCounter{})
+		migrations.Actors[builtin.StoragePowerActorCodeID] = migration.NilMigration(builtin.StoragePowerActorCodeID)
+		_, err := migration.MigrateStateTree(ctx, store, tree, abi.ChainEpoch(0), migrations,
+			migration.Config{MaxWorkers: 1}, log, migration.NewMemMigrationCache())
+		assert.Error(t, err)
+
+		_, err = migration.MigrateStateTree(ctx, store, tree, abi.ChainEpoch(0), identityMigrations(nil),
+			migration.Config{MaxWorkers: 0}, log, migration.NewMemMigrationCache())
+		assert.Error(t, err)
+	})
+}
+
+// A deferred migration preserving the actor's state, which counts the actors already migrated.
+type deferredCounter struct {
+	calls         int
+	migratedCount int
+}
+
+func (d *deferredCounter) MigrateState(_ context.Context, _ cbor.IpldStore, in migration.ActorMigrationInput, migrated *states.Tree) (*migration.ActorMigrationResult, error) {
+	d.calls++
+	d.migratedCount = 0
+	if err := migrated.ForEach(func(_ addr.Address, _ *states.Actor) error {
+		d.migratedCount++
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return &migration.ActorMigrationResult{
+		NewCodeCID: d.MigratedCodeCID(),
+		NewHead:    in.Head,
+	}, nil
+}
+
+func (d *deferredCounter) MigratedCodeCID() cid.Cid {
+	return builtin.StoragePowerActorCodeID
+}
+
+func TestMigrateStateTreeIncremental(t *testing.T) {
+	ctx := context.Background()
+	bs := ipld.NewSyncBlockStore(ipld.NewBlockStoreInMemory())
+	v := vm.NewVMWithSingletons(ctx, t, bs)
+	store := cbor.NewCborStore(bs)
+	adtStore := adt.WrapStore(ctx, store)
+	log := migration.TestLogger{TB: t}
+	cfg := migration.Config{MaxWorkers: 2}
+	prevTree, err := v.GetStateTree()
+	require.NoError(t, err)
+	prevRoot, err := prevTree.Flush()
+	require.NoError(t, err)
+
+	counts := &migrationCounts{migrated: map[addr.Address]int{}}
+	migrations := migration.Migrations{
+		Actors:   map[cid.Cid]migration.ActorMigration{},
+		Deferred: map[cid.Cid]migration.DeferredActorMigration{},
+	}
+	require.NoError(t, prevTree.ForEach(func(_ addr.Address, actor *states.Actor) error {
+		migrations.Actors[actor.Code] = migrationCounter{actor.Code, counts}
+		return nil
+	}))
+	delete(migrations.Actors, builtin.StoragePowerActorCodeID)
+	deferred := &deferredCounter{}
+	migrations.Deferred[builtin.StoragePowerActorCodeID] = deferred
+
+	prevRootOut, err := migration.MigrateStateTree(ctx, store, prevTree, abi.ChainEpoch(0), migrations, cfg, log,
+		migration.NewMemMigrationCache())
+	require.NoError(t, err)
+	assert.Equal(t, prevRoot, prevRootOut)
+
+	// Change the state of one actor, the balance of another, add an actor and remove one.
+	tree, err := states.LoadTree(adtStore, prevRoot)
+	require.NoError(t, err)
+	initActor, found, err := tree.GetActor(builtin.InitActorAddr)
+	require.NoError(t, err)
+	require.True(t, found)
+	cronActor, found, err := tree.GetActor(builtin.CronActorAddr)
+	require.NoError(t, err)
+	require.True(t, found)
+	initActor.Head = cronActor.Head
+	require.NoError(t, tree.SetActor(builtin.InitActorAddr, initActor))
+	burnt, found, err := tree.GetActor(builtin.BurntFundsActorAddr)
+	require.NoError(t, err)
+	require.True(t, found)
+	burnt.Balance = big.Add(burnt.Balance, big.NewInt(1))
+	burnt.CallSeqNum++
+	require.NoError(t, tree.SetActor(builtin.BurntFundsActorAddr, burnt))
+	newAddr, err := addr.NewIDAddress(1000)
+	require.NoError(t, err)
+	require.NoError(t, tree.SetActor(newAddr, burnt))
+	require.NoError(t, tree.Map.Delete(abi.AddrKey(builtin.VerifiedRegistryActorAddr)))
+	root, err := tree.Flush()
+	require.NoError(t, err)
+
+	counts.reset()
+	deferred.calls = 0
+	reporter := &metricsRecorder{}
+	rootOut, err := migration.MigrateStateTreeIncremental(ctx, store, prevTree, prevRootOut, tree, abi.ChainEpoch(0),
+		migrations, migration.Config{MaxWorkers: 2, Metrics: reporter}, log, migration.NewMemMigrationCache())
+	require.NoError(t, err)
+	require.Len(t, reporter.reports, 1)
+	reused := 0
+	for _, c := range reporter.reports[0].ActorCodes {
+		reused += c.Reused
+	}
+	// All but the changed, added and deferred actors.
+	assert.Equal(t, reporter.reports[0].ActorCount-3, reused)
+
+	// Only the changed and added actors were migrated, and deferred migrations always run.
+	assert.Equal(t, map[addr.Address]int{builtin.InitActorAddr: 1, newAddr: 1}, counts.migrated)
+	assert.Equal(t, 1, deferred.calls)
+	// The result is the same as a full migration.
+	assert.Equal(t, root, rootOut)
+	fullRootOut, err := migration.MigrateStateTree(ctx, store, tree, abi.ChainEpoch(0), migrations, cfg, log,
+		migration.NewMemMigrationCache())
+	require.NoError(t, err)
+	assert.Equal(t, fullRootOut, rootOut)
+}
+
+// Counts of the migrations of each actor.
+type migrationCounts struct {
+	mu       sync.Mutex
+	migrated map[addr.Address]int
+}
+
+func (c *migrationCounts) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.migrated = map[addr.Address]int{}
+}
+
+// A migration preserving an actor's code and state, which counts the migrations of each actor.
+type migrationCounter struct {
+	code   cid.Cid
+	counts *migrationCounts
+}
+
+func (m migrationCounter) MigrateState(_ context.Context, _ cbor.IpldStore, in migration.ActorMigrationInput) (*migration.ActorMigrationResult, error) {
+	m.counts.mu.Lock()
+	defer m.counts.mu.Unlock()
+	m.counts.migrated[in.Address]++
+	return &migration.ActorMigrationResult{
+		NewCodeCID: m.code,
+		NewHead:    in.Head,
+	}, nil
+}
+
+func (m migrationCounter) MigratedCodeCID() cid.Cid {
+	return m.code
+}
@@ -9,13 +9,14 @@ import (
 
 	builtin3 "github.com/filecoin-project/specs-actors/v4/actors/builtin"
 	init3 "github.com/filecoin-project/specs-actors/v4/actors/builtin/init"
+	"github.com/filecoin-project/specs-actors/v4/actors/migration"
 )
 
 type initMigrator struct{}
 
-func (m initMigrator) migrateState(ctx context.Context, store cbor.IpldStore, in actorMigrationInput) (*actorMigrationResult, error) {
+func (m initMigrator) MigrateState(ctx context.Context, store cbor.IpldStore, in migration.ActorMigrationInput) (*migration.ActorMigrationResult, error) {
 	var inState init2.State
-	if err := store.Get(ctx, in.head, &inState); err != nil {
+	if err := store.Get(ctx, in.Head, &inState); err != nil {
 		return nil, err
 	}
 
@@ -30,12 +31,12 @@ func (m initMigrator) migrateState(ctx context.Context, store cbor.IpldStore, in
 		NetworkName: inState.NetworkName,
 	}
 	newHead, err := store.Put(ctx, &outState)
-	return &actorMigrationResult{
-		newCodeCID: m.migratedCodeCID(),
-		newHead:    newHead,
+	return &migration.ActorMigrationResult{
+		NewCodeCID: m.MigratedCodeCID(),
+		NewHead:    newHead,
 	}, err
 }
 
-func (m initMigrator) migratedCodeCID() cid.Cid {
+func (m initMigrator) MigratedCodeCID() cid.Cid {
 	return builtin3.InitActorCodeID
 }
@@ -11,14 +11,15 @@ import (
 
 	builtin3 "github.com/filecoin-project/specs-actors/v4/actors/builtin"
 	market3 "github.com/filecoin-project/specs-actors/v4/actors/builtin/market"
+	"github.com/filecoin-project/specs-actors/v4/actors/migration"
 	adt3 "github.com/filecoin-project/specs-actors/v4/actors/util/adt"
 )
 
 type marketMigrator struct{}
 
-func (m marketMigrator) migrateState(ctx context.Context, store cbor.IpldStore, in actorMigrationInput) (*actorMigrationResult, error) {
+func (m marketMigrator) MigrateState(ctx context.Context, store cbor.IpldStore, in migration.ActorMigrationInput) (*migration.ActorMigrationResult, error) {
 	var inState market2.State
-	if err := store.Get(ctx, in.head, &inState); err != nil {
+	if err := store.Get(ctx, in.Head, &inState); err != nil {
 		return nil, err
 	}
 
@@ -62,13 +63,13 @@ func (m marketMigrator) migrateState(ctx context.Context, store cbor.IpldStore,
 	}
 
 	newHead, err := store.Put(ctx, &outState)
-	return &actorMigrationResult{
-		newCodeCID: m.migratedCodeCID(),
-		newHead:    newHead,
+	return &migration.ActorMigrationResult{
+		NewCodeCID: m.MigratedCodeCID(),
+		NewHead:    newHead,
 	}, err
 }
 
-func (m marketMigrator) migratedCodeCID() cid.Cid {
+func (m marketMigrator) MigratedCodeCID() cid.Cid {
 	return builtin3.StorageMarketActorCodeID
 }
 
@@ -13,14 +13,15 @@ import (
 
 	builtin3 "github.com/filecoin-project/specs-actors/v4/actors/builtin"
 	miner3 "github.com/filecoin-project/specs-actors/v4/actors/builtin/miner"
+	"github.com/filecoin-project/specs-actors/v4/actors/migration"
 	adt3 "github.com/filecoin-project/specs-actors/v4/actors/util/adt"
 )
 
 type minerMigrator struct{}
 
-func (m minerMigrator) migrateState(ctx context.Context, store cbor.IpldStore, in actorMigrationInput) (*actorMigrationResult, error) {
+func (m minerMigrator) MigrateState(ctx context.Context, store cbor.IpldStore, in migration.ActorMigrationInput) (*migration.ActorMigrationResult, error) {
 	var inState miner2.State
-	if err := store.Get(ctx, in.head, &inState); err != nil {
+	if err := store.Get(ctx, in.Head, &inState); err != nil {
 		return nil, err
 	}
 
@@ -37,14 +38,14 @@ func (m minerMigrator) migrateState(ctx context.Context, store cbor.IpldStore, i
 		return nil, err
 	}
 
-	sectorsOut, err := in.cache.Load(SectorsRootKey(inState.Sectors), func() (cid.Cid, error) {
+	sectorsOut, err := in.Cache.Load(SectorsRootKey(inState.Sectors), func() (cid.Cid, error) {
 		return migrateAMTRaw(ctx, store, inState.Sectors, miner3.SectorsAmtBitwidth)
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	deadlinesOut, err := m.migrateDeadlines(ctx, store, in.cache, inState.Deadlines)
+	deadlinesOut, err := m.migrateDeadlines(ctx, store, in.Cache, inState.Deadlines)
 	if err != nil {
 		return nil, err
 	}
@@ -66,13 +67,13 @@ func (m minerMigrator) migrateState(ctx context.Context, store cbor.IpldStore, i
 		EarlyTerminations:         inState.EarlyTerminations,
 	}
 	newHead, err := store.Put(ctx, &outState)
-	return &actorMigrationResult{
-		newCodeCID: m.migratedCodeCID(),
-		newHead:    newHead,
+	return &migration.ActorMigrationResult{
+		NewCodeCID: m.MigratedCodeCID(),
+		NewHead:    newHead,
 	}, err
 }
 
-func (m minerMigrator) migratedCodeCID() cid.Cid {
+func (m minerMigrator) MigratedCodeCID() cid.Cid {
 	return builtin3.StorageMinerActorCodeID
 }
 
@@ -9,13 +9,14 @@ import (
 
 	builtin3 "github.com/filecoin-project/specs-actors/v4/actors/builtin"
 	multisig3 "github.com/filecoin-project/specs-actors/v4/actors/builtin/multisig"
+	"github.com/filecoin-project/specs-actors/v4/actors/migration"
 )
 
 type multisigMigrator struct{}
 
-func (m multisigMigrator) migrateState(ctx context.Context, store cbor.IpldStore, in actorMigrationInput) (*actorMigrationResult, error) {
+func (m multisigMigrator) MigrateState(ctx context.Context, store cbor.IpldStore, in migration.ActorMigrationInput) (*migration.ActorMigrationResult, error) {
 	var inState multisig2.State
-	if err := store.Get(ctx, in.head, &inState); err != nil {
+	if err := store.Get(ctx, in.Head, &inState); err != nil {
 		return nil, err
 	}
 
@@ -34,12 +35,12 @@ func (m multisigMigrator) migrateState(ctx context.Context, store cbor.IpldStore
 		PendingTxns:           pendingTxnsOut,
 	}
 	newHead, err := store.Put(ctx, &outState)
-	return &actorMigrationResult{
-		newCodeCID: m.migratedCodeCID(),
-		newHead:    newHead,
+	return &migration.ActorMigrationResult{
+		NewCodeCID: m.MigratedCodeCID(),
+		NewHead:    newHead,
 	}, err
 }
 
-func (m multisigMigrator) migratedCodeCID() cid.Cid {
+func (m multisigMigrator) MigratedCodeCID() cid.Cid {
 	return builtin3.MultisigActorCodeID
 }
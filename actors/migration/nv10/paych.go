@@ -9,13 +9,14 @@ import (
 
 	builtin3 "github.com/filecoin-project/specs-actors/v4/actors/builtin"
 	paych3 "github.com/filecoin-project/specs-actors/v4/actors/builtin/paych"
+	"github.com/filecoin-project/specs-actors/v4/actors/migration"
 )
 
 type paychMigrator struct{}
 
-func (m paychMigrator) migrateState(ctx context.Context, store cbor.IpldStore, in actorMigrationInput) (*actorMigrationResult, error) {
+func (m paychMigrator) MigrateState(ctx context.Context, store cbor.IpldStore, in migration.ActorMigrationInput) (*migration.ActorMigrationResult, error) {
 	var inState paych2.State
-	if err := store.Get(ctx, in.head, &inState); err != nil {
+	if err := store.Get(ctx, in.Head, &inState); err != nil {
 		return nil, err
 	}
 
@@ -33,12 +34,12 @@ func (m paychMigrator) migrateState(ctx context.Context, store cbor.IpldStore, i
 		LaneStates:      laneStatesOut,
 	}
 	newHead, err := store.Put(ctx, &outState)
-	return &actorMigrationResult{
-		newCodeCID: m.migratedCodeCID(),
-		newHead:    newHead,
+	return &migration.ActorMigrationResult{
+		NewCodeCID: m.MigratedCodeCID(),
+		NewHead:    newHead,
 	}, err
 }
 
-func (m paychMigrator) migratedCodeCID() cid.Cid {
+func (m paychMigrator) MigratedCodeCID() cid.Cid {
 	return builtin3.PaymentChannelActorCodeID
 }
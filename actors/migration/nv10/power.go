@@ -10,15 +10,16 @@ import (
 
 	builtin3 "github.com/filecoin-project/specs-actors/v4/actors/builtin"
 	power3 "github.com/filecoin-project/specs-actors/v4/actors/builtin/power"
+	"github.com/filecoin-project/specs-actors/v4/actors/migration"
 	adt3 "github.com/filecoin-project/specs-actors/v4/actors/util/adt"
 	smoothing3 "github.com/filecoin-project/specs-actors/v4/actors/util/smoothing"
 )
 
 type powerMigrator struct{}
 
-func (m powerMigrator) migrateState(ctx context.Context, store cbor.IpldStore, in actorMigrationInput) (*actorMigrationResult, error) {
+func (m powerMigrator) MigrateState(ctx context.Context, store cbor.IpldStore, in migration.ActorMigrationInput) (*migration.ActorMigrationResult, error) {
 	var inState power2.State
-	if err := store.Get(ctx, in.head, &inState); err != nil {
+	if err := store.Get(ctx, in.Head, &inState); err != nil {
 		return nil, err
 	}
 
@@ -59,13 +60,13 @@ func (m powerMigrator) migrateState(ctx context.Context, store cbor.IpldStore, i
 		ProofValidationBatch:      proofValidationBatchOut,
 	}
 	newHead, err := store.Put(ctx, &outState)
-	return &actorMigrationResult{
-		newCodeCID: m.migratedCodeCID(),
-		newHead:    newHead,
+	return &migration.ActorMigrationResult{
+		NewCodeCID: m.MigratedCodeCID(),
+		NewHead:    newHead,
 	}, err
 }
 
-func (m powerMigrator) migratedCodeCID() cid.Cid {
+func (m powerMigrator) MigratedCodeCID() cid.Cid {
 	return builtin3.StoragePowerActorCodeID
 }
 
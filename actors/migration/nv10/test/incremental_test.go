@@ -0,0 +1,89 @@
+package test_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	builtin2 "github.com/filecoin-project/specs-actors/v2/actors/builtin"
+	power2 "github.com/filecoin-project/specs-actors/v2/actors/builtin/power"
+	ipld2 "github.com/filecoin-project/specs-actors/v2/support/ipld"
+	vm2 "github.com/filecoin-project/specs-actors/v2/support/vm"
+
+	"github.com/filecoin-project/specs-actors/v4/actors/migration"
+	"github.com/filecoin-project/specs-actors/v4/actors/migration/nv10"
+)
+
+func TestIncrementalMigration(t *testing.T) {
+	ctx := context.Background()
+	log := nv10.TestLogger{TB: t}
+	cfg := nv10.Config{MaxWorkers: 2}
+	bs := ipld2.NewSyncBlockStoreInMemory()
+	store := cbor.NewCborStore(bs)
+	v := vm2.NewVMWithSingletons(ctx, t, bs)
+	addrs := vm2.CreateAccounts(ctx, t, v, 2, big.Mul(big.NewInt(10_000), vm2.FIL), 93837778)
+	createMiner := func(v *vm2.VM) {
+		vm2.ApplyOk(t, v, addrs[0], builtin2.StoragePowerActorAddr, big.Mul(big.NewInt(1_000), vm2.FIL), builtin2.MethodsPower.CreateMiner, &power2.CreateMinerParams{
+			Owner:         addrs[0],
+			Worker:        addrs[0],
+			SealProofType: abi.RegisteredSealProof_StackedDrg32GiBV1_1,
+			Peer:          abi.PeerID("not really a peer id"),
+		})
+	}
+	createMiner(v)
+	prevRoot := v.StateRoot()
+
+	dir, err := ioutil.TempDir("", "nv10-incremental")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	cachePath := filepath.Join(dir, "cache")
+
+	// Migrate ahead of the upgrade, persisting the cache.
+	cache, err := nv10.OpenFileMigrationCache(cachePath)
+	require.NoError(t, err)
+	prevRootOut, err := nv10.MigrateStateTree(ctx, store, prevRoot, v.GetEpoch(), cfg, log, cache)
+	require.NoError(t, err)
+	require.NoError(t, cache.Close())
+
+	// The chain advances, changing some actors and adding others.
+	v, err = v.WithEpoch(10)
+	require.NoError(t, err)
+	vm2.ApplyOk(t, v, addrs[0], addrs[1], big.Mul(big.NewInt(5), vm2.FIL), builtin2.MethodSend, nil)
+	createMiner(v)
+	vm2.ApplyOk(t, v, builtin2.SystemActorAddr, builtin2.CronActorAddr, big.Zero(), builtin2.MethodsCron.EpochTick, nil)
+	root := v.StateRoot()
+	priorEpoch := v.GetEpoch()
+
+	// After a restart, the prior migration is found in the cache.
+	cache, err = nv10.OpenFileMigrationCache(cachePath)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, cache.Close()) }()
+	found, cachedRootOut, err := cache.Read(migration.StateRootKey(prevRoot))
+	require.NoError(t, err)
+	require.True(t, found)
+	assert.Equal(t, prevRootOut, cachedRootOut)
+	removed, err := cache.Validate(bs)
+	require.NoError(t, err)
+	assert.Equal(t, 0, removed)
+
+	rootOut, err := nv10.MigrateStateTreeIncremental(ctx, store, prevRoot, root, priorEpoch, cfg, log, cache)
+	require.NoError(t, err)
+
+	// The result is the same as a full migration without any cache.
+	fullRootOut, err := nv10.MigrateStateTree(ctx, store, root, priorEpoch, cfg, log, nv10.NewMemMigrationCache())
+	require.NoError(t, err)
+	assert.Equal(t, fullRootOut, rootOut)
+
+	// Without a cached migration of the prior state tree, migrates in full.
+	fallbackRootOut, err := nv10.MigrateStateTreeIncremental(ctx, store, prevRoot, root, priorEpoch, cfg, log, nv10.NewMemMigrationCache())
+	require.NoError(t, err)
+	assert.Equal(t, fullRootOut, fallbackRootOut)
+}
@@ -212,7 +212,7 @@ func publishV3Deal(t *testing.T, v *vm3.VM, provider, dealClient, minerID addr.A
 			ClientSignature: crypto.Signature{},
 		}},
 	}
-	ret, code := v.ApplyMessage(provider, builtin3.StorageMarketActorAddr, big.Zero(), builtin3.MethodsMarket.PublishStorageDeals, &publishDealParams)
+	ret, code, _ := v.ApplyMessage(provider, builtin3.StorageMarketActorAddr, big.Zero(), builtin3.MethodsMarket.PublishStorageDeals, &publishDealParams)
 	require.Equal(t, exitcode.Ok, code)
 
 	expectedPublishSubinvocations := []vm3.ExpectInvocation{
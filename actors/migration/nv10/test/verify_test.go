@@ -0,0 +1,120 @@
+package test_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	builtin2 "github.com/filecoin-project/specs-actors/v2/actors/builtin"
+	power2 "github.com/filecoin-project/specs-actors/v2/actors/builtin/power"
+	ipld2 "github.com/filecoin-project/specs-actors/v2/support/ipld"
+	vm2 "github.com/filecoin-project/specs-actors/v2/support/vm"
+
+	builtin3 "github.com/filecoin-project/specs-actors/v4/actors/builtin"
+	"github.com/filecoin-project/specs-actors/v4/actors/migration"
+	"github.com/filecoin-project/specs-actors/v4/actors/migration/nv10"
+	states3 "github.com/filecoin-project/specs-actors/v4/actors/states"
+	adt3 "github.com/filecoin-project/specs-actors/v4/actors/util/adt"
+)
+
+func TestMigrationVerification(t *testing.T) {
+	ctx := context.Background()
+	log := nv10.TestLogger{TB: t}
+	bs := ipld2.NewSyncBlockStoreInMemory()
+	v := vm2.NewVMWithSingletons(ctx, t, bs)
+	addrs := vm2.CreateAccounts(ctx, t, v, 2, big.Mul(big.NewInt(10_000), vm2.FIL), 93837778)
+	worker := addrs[0]
+	ret := vm2.ApplyOk(t, v, worker, builtin2.StoragePowerActorAddr, big.Mul(big.NewInt(1_000), vm2.FIL), builtin2.MethodsPower.CreateMiner, &power2.CreateMinerParams{
+		Owner:         worker,
+		Worker:        worker,
+		SealProofType: abi.RegisteredSealProof_StackedDrg32GiBV1_1,
+		Peer:          abi.PeerID("not really a peer id"),
+	})
+	minerAddrs := ret.(*power2.CreateMinerReturn)
+	accountAddr, ok := v.NormalizeAddress(addrs[1])
+	require.True(t, ok)
+
+	// Run cron so the reward actor's state is consistent with the epoch.
+	v, err := v.WithEpoch(1)
+	require.NoError(t, err)
+	vm2.ApplyOk(t, v, builtin2.SystemActorAddr, builtin2.CronActorAddr, big.Zero(), builtin2.MethodsCron.EpochTick, nil)
+
+	store := cbor.NewCborStore(bs)
+	startRoot := v.StateRoot()
+	priorEpoch := v.GetEpoch()
+
+	t.Run("dry run", func(t *testing.T) {
+		result, err := nv10.DryRunMigration(ctx, bs, startRoot, priorEpoch, nv10.Config{MaxWorkers: 2}, log)
+		require.NoError(t, err)
+		assert.True(t, result.Report.OK(), strings.Join(result.Report.InvariantViolations, "\n"))
+		assert.Empty(t, result.Report.Discrepancies)
+		assert.Equal(t, result.Report.InputActorCount, result.Report.OutputActorCount)
+		assert.Greater(t, result.BlocksWritten, 0)
+		assert.Greater(t, result.BytesWritten, uint64(0))
+
+		// The underlying store is untouched.
+		_, err = bs.Get(result.ActorsRootOut)
+		assert.Error(t, err)
+
+		// A real migration produces the same root.
+		actorsRootOut, err := nv10.MigrateStateTree(ctx, store, startRoot, priorEpoch, nv10.Config{MaxWorkers: 1}, log, nv10.NewMemMigrationCache())
+		require.NoError(t, err)
+		assert.Equal(t, result.ActorsRootOut, actorsRootOut)
+		_, err = bs.Get(actorsRootOut)
+		assert.NoError(t, err)
+	})
+
+	t.Run("discrepancies", func(t *testing.T) {
+		actorsRootOut, err := nv10.MigrateStateTree(ctx, store, startRoot, priorEpoch, nv10.Config{MaxWorkers: 1}, log, nv10.NewMemMigrationCache())
+		require.NoError(t, err)
+
+		// Corrupt the migrated state tree.
+		tree, err := states3.LoadTree(adt3.WrapStore(ctx, store), actorsRootOut)
+		require.NoError(t, err)
+		account, found, err := tree.GetActor(accountAddr)
+		require.NoError(t, err)
+		require.True(t, found)
+		account.Balance = big.Add(account.Balance, big.NewInt(1))
+		workerAddr, ok := v.NormalizeAddress(worker)
+		require.True(t, ok)
+		workerAccount, found, err := tree.GetActor(workerAddr)
+		require.NoError(t, err)
+		require.True(t, found)
+		account.Head = workerAccount.Head
+		require.NoError(t, tree.SetActor(accountAddr, account))
+		miner, found, err := tree.GetActor(minerAddrs.IDAddress)
+		require.NoError(t, err)
+		require.True(t, found)
+		miner.Code = builtin2.StorageMinerActorCodeID
+		miner.CallSeqNum++
+		require.NoError(t, tree.SetActor(minerAddrs.IDAddress, miner))
+		require.NoError(t, tree.Map.Delete(abi.AddrKey(builtin3.CronActorAddr)))
+		corruptRoot, err := tree.Flush()
+		require.NoError(t, err)
+
+		report, err := nv10.VerifyStateTree(ctx, store, startRoot, corruptRoot, priorEpoch)
+		require.NoError(t, err)
+		assert.False(t, report.OK())
+		assert.Equal(t, report.InputActorCount-1, report.OutputActorCount)
+
+		kinds := make(map[string]string)
+		for _, d := range report.Discrepancies {
+			kinds[d.Kind] = d.Address.String()
+		}
+		assert.Equal(t, map[string]string{
+			migration.DiscrepancyMissing:    builtin3.CronActorAddr.String(),
+			migration.DiscrepancyBalance:    accountAddr.String(),
+			migration.DiscrepancyHead:       accountAddr.String(),
+			migration.DiscrepancyCode:       minerAddrs.IDAddress.String(),
+			migration.DiscrepancyCallSeqNum: minerAddrs.IDAddress.String(),
+		}, kinds)
+		// The balance total no longer matches that before migration.
+		assert.NotEmpty(t, report.InvariantViolations)
+	})
+}
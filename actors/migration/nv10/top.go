@@ -3,49 +3,31 @@ package nv10
 import (
 	"context"
 	"fmt"
-	"sync"
-	"sync/atomic"
-	"time"
 
 	address "github.com/filecoin-project/go-address"
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/go-state-types/rt"
 	cid "github.com/ipfs/go-cid"
 	cbor "github.com/ipfs/go-ipld-cbor"
-	"golang.org/x/sync/errgroup"
-	"golang.org/x/xerrors"
 
 	builtin2 "github.com/filecoin-project/specs-actors/v2/actors/builtin"
 	states2 "github.com/filecoin-project/specs-actors/v2/actors/states"
 
 	builtin3 "github.com/filecoin-project/specs-actors/v4/actors/builtin"
-	states3 "github.com/filecoin-project/specs-actors/v4/actors/states"
+	"github.com/filecoin-project/specs-actors/v4/actors/migration"
 	adt3 "github.com/filecoin-project/specs-actors/v4/actors/util/adt"
 )
 
 // Config parameterizes a state tree migration
-type Config struct {
-	// Number of migration worker goroutines to run.
-	// More workers enables higher CPU utilization doing migration computations (including state encoding)
-	MaxWorkers uint
-	// Capacity of the queue of jobs available to workers (zero for unbuffered).
-	// A queue length of hundreds to thousands improves throughput at the cost of memory.
-	JobQueueSize uint
-	// Capacity of the queue receiving migration results from workers, for persisting (zero for unbuffered).
-	// A queue length of tens to hundreds improves throughput at the cost of memory.
-	ResultQueueSize uint
-	// Time between progress logs to emit.
-	// Zero (the default) results in no progress logs.
-	ProgressLogPeriod time.Duration
-}
+type Config = migration.Config
 
-type Logger interface {
-	// This is the same logging interface provided by the Runtime.
-	Log(level rt.LogLevel, msg string, args ...interface{})
-}
+type Logger = migration.Logger
+
+// MigrationCache stores and loads cached data. Its implementation must be threadsafe
+type MigrationCache = migration.MigrationCache
 
 func ActorHeadKey(addr address.Address, head cid.Cid) string {
-	return addr.String() + "-h-" + head.String()
+	return migration.ActorHeadKey(addr, head)
 }
 
 func DeadlineKey(dlCid cid.Cid) string {
@@ -56,275 +38,85 @@ func SectorsRootKey(sCid cid.Cid) string {
 	return "s-" + sCid.String()
 }
 
-// MigrationCache stores and loads cached data. Its implementation must be threadsafe
-type MigrationCache interface {
-	Write(key string, newCid cid.Cid) error
-	Read(key string) (bool, cid.Cid, error)
-	Load(key string, loadFunc func() (cid.Cid, error)) (cid.Cid, error)
+// Returns the actor migrations from actors v2 to v3.
+func Migrations(cache MigrationCache) migration.Migrations {
+	return migration.Migrations{
+		// Maps prior version code CIDs to migration functions.
+		Actors: map[cid.Cid]migration.ActorMigration{
+			builtin2.AccountActorCodeID:          migration.NilMigration(builtin3.AccountActorCodeID),
+			builtin2.CronActorCodeID:             migration.NilMigration(builtin3.CronActorCodeID),
+			builtin2.InitActorCodeID:             migration.CachedMigration(cache, initMigrator{}),
+			builtin2.MultisigActorCodeID:         migration.CachedMigration(cache, multisigMigrator{}),
+			builtin2.PaymentChannelActorCodeID:   migration.CachedMigration(cache, paychMigrator{}),
+			builtin2.RewardActorCodeID:           migration.NilMigration(builtin3.RewardActorCodeID),
+			builtin2.StorageMarketActorCodeID:    migration.CachedMigration(cache, marketMigrator{}),
+			builtin2.StorageMinerActorCodeID:     migration.CachedMigration(cache, minerMigrator{}),
+			builtin2.StoragePowerActorCodeID:     migration.CachedMigration(cache, powerMigrator{}),
+			builtin2.SystemActorCodeID:           migration.NilMigration(builtin3.SystemActorCodeID),
+			builtin2.VerifiedRegistryActorCodeID: migration.CachedMigration(cache, verifregMigrator{}),
+		},
+		// Prior version code CIDs for actors to defer during iteration, for explicit migration afterwards.
+		Deferred: map[cid.Cid]migration.DeferredActorMigration{
+			// None
+		},
+	}
 }
 
 // Migrates the filecoin state tree starting from the global state tree and upgrading all actor state.
 // The store must support concurrent writes (even if the configured worker count is 1).
 func MigrateStateTree(ctx context.Context, store cbor.IpldStore, actorsRootIn cid.Cid, priorEpoch abi.ChainEpoch, cfg Config, log Logger, cache MigrationCache) (cid.Cid, error) {
-	if cfg.MaxWorkers <= 0 {
-		return cid.Undef, xerrors.Errorf("invalid migration config with %d workers", cfg.MaxWorkers)
+	migrations := Migrations(cache)
+	if len(migrations.Actors)+len(migrations.Deferred) != 11 {
+		panic(fmt.Sprintf("incomplete migration specification with %d code CIDs", len(migrations.Actors)+len(migrations.Deferred)))
 	}
 
-	// Maps prior version code CIDs to migration functions.
-	var migrations = map[cid.Cid]actorMigration{
-		builtin2.AccountActorCodeID:          nilMigrator{builtin3.AccountActorCodeID},
-		builtin2.CronActorCodeID:             nilMigrator{builtin3.CronActorCodeID},
-		builtin2.InitActorCodeID:             cachedMigration(cache, initMigrator{}),
-		builtin2.MultisigActorCodeID:         cachedMigration(cache, multisigMigrator{}),
-		builtin2.PaymentChannelActorCodeID:   cachedMigration(cache, paychMigrator{}),
-		builtin2.RewardActorCodeID:           nilMigrator{builtin3.RewardActorCodeID},
-		builtin2.StorageMarketActorCodeID:    cachedMigration(cache, marketMigrator{}),
-		builtin2.StorageMinerActorCodeID:     cachedMigration(cache, minerMigrator{}),
-		builtin2.StoragePowerActorCodeID:     cachedMigration(cache, powerMigrator{}),
-		builtin2.SystemActorCodeID:           nilMigrator{builtin3.SystemActorCodeID},
-		builtin2.VerifiedRegistryActorCodeID: cachedMigration(cache, verifregMigrator{}),
-	}
-	// Set of prior version code CIDs for actors to defer during iteration, for explicit migration afterwards.
-	var deferredCodeIDs = map[cid.Cid]struct{}{
-		// None
-	}
-	if len(migrations)+len(deferredCodeIDs) != 11 {
-		panic(fmt.Sprintf("incomplete migration specification with %d code CIDs", len(migrations)))
-	}
-	startTime := time.Now()
-
-	// Load input and output state trees
+	// Load input state tree
 	adtStore := adt3.WrapStore(ctx, store)
 	actorsIn, err := states2.LoadTree(adtStore, actorsRootIn)
 	if err != nil {
 		return cid.Undef, err
 	}
-	actorsOut, err := states3.NewTree(adtStore)
+	actorsRootOut, err := migration.MigrateStateTree(ctx, store, actorsIn, priorEpoch, migrations, cfg, log, cache)
 	if err != nil {
 		return cid.Undef, err
 	}
-
-	// Setup synchronization
-	grp, ctx := errgroup.WithContext(ctx)
-	// Input and output queues for workers.
-	jobCh := make(chan *migrationJob, cfg.JobQueueSize)
-	jobResultCh := make(chan *migrationJobResult, cfg.ResultQueueSize)
-	// Atomically-modified counters for logging progress
-	var jobCount uint32
-	var doneCount uint32
-
-	// Iterate all actors in old state root to create migration jobs for each non-deferred actor.
-	grp.Go(func() error {
-		defer close(jobCh)
-		log.Log(rt.INFO, "Creating migration jobs for tree %s", actorsRootIn)
-		if err = actorsIn.ForEach(func(addr address.Address, actorIn *states2.Actor) error {
-			if _, ok := deferredCodeIDs[actorIn.Code]; ok {
-				return nil // Deferred for explicit migration later.
-			}
-			nextInput := &migrationJob{
-				Address:        addr,
-				Actor:          *actorIn, // Must take a copy, the pointer is not stable.
-				cache:          cache,
-				actorMigration: migrations[actorIn.Code],
-			}
-			select {
-			case jobCh <- nextInput:
-			case <-ctx.Done():
-				return ctx.Err()
-			}
-			atomic.AddUint32(&jobCount, 1)
-			return nil
-		}); err != nil {
-			return err
-		}
-		log.Log(rt.INFO, "Done creating %d migration jobs for tree %s after %v", jobCount, actorsRootIn, time.Since(startTime))
-		return nil
-	})
-
-	// Worker threads run jobs.
-	var workerWg sync.WaitGroup
-	for i := uint(0); i < cfg.MaxWorkers; i++ {
-		workerWg.Add(1)
-		workerId := i
-		grp.Go(func() error {
-			defer workerWg.Done()
-			for job := range jobCh {
-				result, err := job.run(ctx, store, priorEpoch)
-				if err != nil {
-					return err
-				}
-				select {
-				case jobResultCh <- result:
-				case <-ctx.Done():
-					return ctx.Err()
-				}
-				atomic.AddUint32(&doneCount, 1)
-			}
-			log.Log(rt.INFO, "Worker %d done", workerId)
-			return nil
-		})
+	// Record the result for later incremental migration from this state tree.
+	if err := cache.Write(migration.StateRootKey(actorsRootIn), actorsRootOut); err != nil {
+		return cid.Undef, err
 	}
-	log.Log(rt.INFO, "Started %d workers", cfg.MaxWorkers)
+	return actorsRootOut, nil
+}
 
-	// Monitor the job queue. This non-critical goroutine is outside the errgroup and exits when
-	// workersFinished is closed, or the context done.
-	workersFinished := make(chan struct{}) // Closed when waitgroup is emptied.
-	if cfg.ProgressLogPeriod > 0 {
-		go func() {
-			defer log.Log(rt.DEBUG, "Job queue monitor done")
-			for {
-				select {
-				case <-time.After(cfg.ProgressLogPeriod):
-					jobsNow := jobCount // Snapshot values to avoid incorrect-looking arithmetic if they change.
-					doneNow := doneCount
-					pendingNow := jobsNow - doneNow
-					elapsed := time.Since(startTime)
-					rate := float64(doneNow) / elapsed.Seconds()
-					log.Log(rt.INFO, "%d jobs created, %d done, %d pending after %v (%.0f/s)",
-						jobsNow, doneNow, pendingNow, elapsed, rate)
-				case <-workersFinished:
-					return
-				case <-ctx.Done():
-					return
-				}
-			}
-		}()
+// Migrates the state tree incrementally from an earlier state tree already migrated with the cache,
+// such as during a pre-migration warm-up, re-migrating only actors that have changed since.
+// If the cache holds no migration of the earlier state tree, migrates the state tree in full.
+// The store must support concurrent writes (even if the configured worker count is 1).
+func MigrateStateTreeIncremental(ctx context.Context, store cbor.IpldStore, prevActorsRootIn, actorsRootIn cid.Cid, priorEpoch abi.ChainEpoch, cfg Config, log Logger, cache MigrationCache) (cid.Cid, error) {
+	found, prevActorsRootOut, err := cache.Read(migration.StateRootKey(prevActorsRootIn))
+	if err != nil {
+		return cid.Undef, err
+	}
+	if !found {
+		log.Log(rt.WARN, "No cached migration of prior state tree %v, migrating state tree %v in full", prevActorsRootIn, actorsRootIn)
+		return MigrateStateTree(ctx, store, actorsRootIn, priorEpoch, cfg, log, cache)
 	}
 
-	// Close result channel when workers are done sending to it.
-	grp.Go(func() error {
-		workerWg.Wait()
-		close(jobResultCh)
-		close(workersFinished)
-		log.Log(rt.INFO, "All workers done after %v", time.Since(startTime))
-		return nil
-	})
-
-	// Insert migrated records in output state tree and accumulators.
-	grp.Go(func() error {
-		log.Log(rt.INFO, "Result writer started")
-		resultCount := 0
-		for result := range jobResultCh {
-			if err := actorsOut.SetActor(result.Address, &result.Actor); err != nil {
-				return err
-			}
-			resultCount++
-		}
-		log.Log(rt.INFO, "Result writer wrote %d results to state tree after %v", resultCount, time.Since(startTime))
-		return nil
-	})
-
-	if err := grp.Wait(); err != nil {
+	adtStore := adt3.WrapStore(ctx, store)
+	prevActorsIn, err := states2.LoadTree(adtStore, prevActorsRootIn)
+	if err != nil {
 		return cid.Undef, err
 	}
-
-	// Perform any deferred migrations explicitly here.
-	// Deferred migrations might depend on values accumulated through migration of other actors.
-
-	elapsed := time.Since(startTime)
-	rate := float64(doneCount) / elapsed.Seconds()
-	log.Log(rt.INFO, "All %d done after %v (%.0f/s). Flushing state tree root.", doneCount, elapsed, rate)
-	return actorsOut.Flush()
-}
-
-type actorMigrationInput struct {
-	address    address.Address // actor's address
-	balance    abi.TokenAmount // actor's balance
-	head       cid.Cid         // actor's state head CID
-	priorEpoch abi.ChainEpoch  // epoch of last state transition prior to migration
-	cache      MigrationCache  // cache of existing cid -> cid migrations for this actor
-}
-
-type actorMigrationResult struct {
-	newCodeCID cid.Cid
-	newHead    cid.Cid
-}
-
-type actorMigration interface {
-	// Loads an actor's state from an input store and writes new state to an output store.
-	// Returns the new state head CID.
-	migrateState(ctx context.Context, store cbor.IpldStore, input actorMigrationInput) (result *actorMigrationResult, err error)
-	migratedCodeCID() cid.Cid
-}
-
-type migrationJob struct {
-	address.Address
-	states2.Actor
-	actorMigration
-	cache MigrationCache
-}
-type migrationJobResult struct {
-	address.Address
-	states3.Actor
-}
-
-func (job *migrationJob) run(ctx context.Context, store cbor.IpldStore, priorEpoch abi.ChainEpoch) (*migrationJobResult, error) {
-	result, err := job.migrateState(ctx, store, actorMigrationInput{
-		address:    job.Address,
-		balance:    job.Actor.Balance,
-		head:       job.Actor.Head,
-		priorEpoch: priorEpoch,
-		cache:      job.cache,
-	})
+	actorsIn, err := states2.LoadTree(adtStore, actorsRootIn)
 	if err != nil {
-		return nil, xerrors.Errorf("state migration failed for %s actor, addr %s: %w",
-			builtin2.ActorNameByCode(job.Actor.Code), job.Address, err)
+		return cid.Undef, err
 	}
-
-	// Set up new actor record with the migrated state.
-	return &migrationJobResult{
-		job.Address, // Unchanged
-		states3.Actor{
-			Code:       result.newCodeCID,
-			Head:       result.newHead,
-			CallSeqNum: job.Actor.CallSeqNum, // Unchanged
-			Balance:    job.Actor.Balance,    // Unchanged
-		},
-	}, nil
-}
-
-// Migrator which preserves the head CID and provides a fixed result code CID.
-type nilMigrator struct {
-	OutCodeCID cid.Cid
-}
-
-func (n nilMigrator) migrateState(_ context.Context, _ cbor.IpldStore, in actorMigrationInput) (*actorMigrationResult, error) {
-	return &actorMigrationResult{
-		newCodeCID: n.OutCodeCID,
-		newHead:    in.head,
-	}, nil
-}
-
-func (n nilMigrator) migratedCodeCID() cid.Cid {
-	return n.OutCodeCID
-}
-
-// Migrator that uses cached transformation if it exists
-type cachedMigrator struct {
-	cache MigrationCache
-	actorMigration
-}
-
-func (c cachedMigrator) migrateState(ctx context.Context, store cbor.IpldStore, in actorMigrationInput) (*actorMigrationResult, error) {
-	newHead, err := c.cache.Load(ActorHeadKey(in.address, in.head), func() (cid.Cid, error) {
-		result, err := c.actorMigration.migrateState(ctx, store, in)
-		if err != nil {
-			return cid.Undef, err
-		}
-		return result.newHead, nil
-	})
+	actorsRootOut, err := migration.MigrateStateTreeIncremental(ctx, store, prevActorsIn, prevActorsRootOut, actorsIn,
+		priorEpoch, Migrations(cache), cfg, log, cache)
 	if err != nil {
-		return nil, err
+		return cid.Undef, err
 	}
-	return &actorMigrationResult{
-		newCodeCID: c.migratedCodeCID(),
-		newHead:    newHead,
-	}, nil
-}
-
-func cachedMigration(cache MigrationCache, m actorMigration) actorMigration {
-	return cachedMigrator{
-		actorMigration: m,
-		cache:          cache,
+	if err := cache.Write(migration.StateRootKey(actorsRootIn), actorsRootOut); err != nil {
+		return cid.Undef, err
 	}
+	return actorsRootOut, nil
 }
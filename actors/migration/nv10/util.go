@@ -3,20 +3,17 @@ package nv10
 import (
 	"bytes"
 	"context"
-	"sync"
-	"testing"
 
 	amt2 "github.com/filecoin-project/go-amt-ipld/v2"
 	amt3 "github.com/filecoin-project/go-amt-ipld/v3"
 	hamt2 "github.com/filecoin-project/go-hamt-ipld/v2"
 	hamt3 "github.com/filecoin-project/go-hamt-ipld/v3"
-	"github.com/filecoin-project/go-state-types/rt"
 	adt2 "github.com/filecoin-project/specs-actors/v2/actors/util/adt"
 	cid "github.com/ipfs/go-cid"
 	cbor "github.com/ipfs/go-ipld-cbor"
 	cbg "github.com/whyrusleeping/cbor-gen"
-	"golang.org/x/xerrors"
 
+	"github.com/filecoin-project/specs-actors/v4/actors/migration"
 	adt3 "github.com/filecoin-project/specs-actors/v4/actors/util/adt"
 )
 
@@ -135,65 +132,16 @@ func migrateHAMTAMTRaw(ctx context.Context, store cbor.IpldStore, root cid.Cid,
 	return store.Put(ctx, outRootNodeOuter)
 }
 
-type MemMigrationCache struct {
-	MigrationMap sync.Map
-}
+type MemMigrationCache = migration.MemMigrationCache
 
 func NewMemMigrationCache() *MemMigrationCache {
-	return new(MemMigrationCache)
-}
-
-func (m *MemMigrationCache) Write(key string, c cid.Cid) error {
-	m.MigrationMap.Store(key, c)
-	return nil
+	return migration.NewMemMigrationCache()
 }
 
-func (m *MemMigrationCache) Read(key string) (bool, cid.Cid, error) {
-	val, found := m.MigrationMap.Load(key)
-	if !found {
-		return false, cid.Undef, nil
-	}
-	c, ok := val.(cid.Cid)
-	if !ok {
-		return false, cid.Undef, xerrors.Errorf("non cid value in cache")
-	}
+type FileMigrationCache = migration.FileMigrationCache
 
-	return true, c, nil
+func OpenFileMigrationCache(path string) (*FileMigrationCache, error) {
+	return migration.OpenFileMigrationCache(path)
 }
 
-func (m *MemMigrationCache) Load(key string, loadFunc func() (cid.Cid, error)) (cid.Cid, error) {
-	found, c, err := m.Read(key)
-	if err != nil {
-		return cid.Undef, err
-	}
-	if found {
-		return c, nil
-	}
-	c, err = loadFunc()
-	if err != nil {
-		return cid.Undef, err
-	}
-	m.MigrationMap.Store(key, c)
-	return c, nil
-}
-
-func (m *MemMigrationCache) Clone() *MemMigrationCache {
-	newCache := NewMemMigrationCache()
-	newCache.Update(m)
-	return newCache
-}
-
-func (m *MemMigrationCache) Update(other *MemMigrationCache) {
-	other.MigrationMap.Range(func(key, value interface{}) bool {
-		m.MigrationMap.Store(key, value)
-		return true
-	})
-}
-
-type TestLogger struct {
-	TB testing.TB
-}
-
-func (t TestLogger) Log(_ rt.LogLevel, msg string, args ...interface{}) {
-	t.TB.Logf(msg, args...)
-}
+type TestLogger = migration.TestLogger
@@ -0,0 +1,45 @@
+package nv10
+
+import (
+	"context"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	cid "github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"golang.org/x/xerrors"
+
+	states2 "github.com/filecoin-project/specs-actors/v2/actors/states"
+
+	"github.com/filecoin-project/specs-actors/v4/actors/migration"
+	adt3 "github.com/filecoin-project/specs-actors/v4/actors/util/adt"
+)
+
+// Verifies a state tree migrated by MigrateStateTree against the tree from which it was migrated.
+func VerifyStateTree(ctx context.Context, store cbor.IpldStore, actorsRootIn, actorsRootOut cid.Cid, priorEpoch abi.ChainEpoch) (*migration.VerificationReport, error) {
+	actorsIn, err := states2.LoadTree(adt3.WrapStore(ctx, store), actorsRootIn)
+	if err != nil {
+		return nil, err
+	}
+	return migration.VerifyMigration(ctx, store, actorsIn, actorsRootOut, priorEpoch, Migrations(NewMemMigrationCache()))
+}
+
+// Migrates and verifies the state tree, writing only to an in-memory overlay of a block store, which is discarded.
+// The block store must support concurrent reads.
+func DryRunMigration(ctx context.Context, bs cbor.IpldBlockstore, actorsRootIn cid.Cid, priorEpoch abi.ChainEpoch, cfg Config, log Logger) (*migration.DryRunResult, error) {
+	overlay := migration.NewOverlayBlockstore(bs)
+	store := cbor.NewCborStore(overlay)
+	actorsRootOut, err := MigrateStateTree(ctx, store, actorsRootIn, priorEpoch, cfg, log, NewMemMigrationCache())
+	if err != nil {
+		return nil, xerrors.Errorf("dry run migration failed: %w", err)
+	}
+	report, err := VerifyStateTree(ctx, store, actorsRootIn, actorsRootOut, priorEpoch)
+	if err != nil {
+		return nil, xerrors.Errorf("dry run verification failed: %w", err)
+	}
+	return &migration.DryRunResult{
+		ActorsRootOut: actorsRootOut,
+		BlocksWritten: overlay.Len(),
+		BytesWritten:  overlay.Size(),
+		Report:        report,
+	}, nil
+}
@@ -0,0 +1,153 @@
+package migration
+
+import (
+	"context"
+	"fmt"
+
+	address "github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	cid "github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/specs-actors/v4/actors/states"
+	"github.com/filecoin-project/specs-actors/v4/actors/util/adt"
+)
+
+// Kinds of discrepancy between an actor before and after migration.
+const (
+	// The actor is absent from the migrated state tree.
+	DiscrepancyMissing = "missing"
+	// The actor is present in the migrated state tree, but not the prior one.
+	DiscrepancyUnexpected = "unexpected"
+	// The actor's code CID is not that of its migration.
+	DiscrepancyCode       = "code"
+	DiscrepancyBalance    = "balance"
+	DiscrepancyCallSeqNum = "call sequence number"
+	// The actor's state changed, though its migration preserves state.
+	DiscrepancyHead = "head"
+)
+
+// An actor whose migration had an unexpected result.
+type Discrepancy struct {
+	Address address.Address
+	// One of the Discrepancy* kinds.
+	Kind    string
+	Message string
+}
+
+// Results of verifying a migrated state tree against the tree from which it was migrated.
+type VerificationReport struct {
+	InputActorCount  int
+	OutputActorCount int
+	// Messages from checking the state invariants of the migrated state tree, against the total balance of the
+	// prior state tree.
+	InvariantViolations []string
+	// Discrepancies in prior state tree order, followed by any unexpected actors.
+	Discrepancies []*Discrepancy
+}
+
+// Returns true if the migrated state tree violates no invariants and has no discrepancies.
+func (r *VerificationReport) OK() bool {
+	return len(r.InvariantViolations) == 0 && len(r.Discrepancies) == 0
+}
+
+// Verifies a migrated state tree against the tree from which it was migrated with some migrations.
+// Every prior actor must be present in the migrated tree, with the migration's code CID and unchanged balance and
+// call sequence number, and the state of actors with migrations that preserve state must be unchanged.
+// The migrated tree must satisfy all state invariants.
+func VerifyMigration(ctx context.Context, store cbor.IpldStore, actorsIn ActorTree, actorsRootOut cid.Cid,
+	priorEpoch abi.ChainEpoch, migrations Migrations) (*VerificationReport, error) {
+	actorsOut, err := states.LoadTree(adt.WrapStore(ctx, store), actorsRootOut)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to load migrated state tree %v: %w", actorsRootOut, err)
+	}
+
+	report := &VerificationReport{}
+	inputs := make(map[address.Address]struct{})
+	totalIn := big.Zero()
+	if err := actorsIn.ForEach(func(addr address.Address, actorIn *states.Actor) error {
+		report.InputActorCount++
+		inputs[addr] = struct{}{}
+		totalIn = big.Add(totalIn, actorIn.Balance)
+
+		actorOut, found, err := actorsOut.GetActor(addr)
+		if err != nil {
+			return xerrors.Errorf("failed to get migrated actor %v: %w", addr, err)
+		}
+		if !found {
+			report.addf(addr, DiscrepancyMissing, "%s actor missing from migrated state", actorNameByCode(actorIn.Code))
+			return nil
+		}
+		expectedCode, preserved, ok := migrations.migratedCode(actorIn.Code)
+		if !ok {
+			report.addf(addr, DiscrepancyCode, "no migration for %s actor", actorNameByCode(actorIn.Code))
+		} else if !actorOut.Code.Equals(expectedCode) {
+			report.addf(addr, DiscrepancyCode, "%s actor migrated to code %s, expected %s",
+				actorNameByCode(actorIn.Code), actorNameByCode(actorOut.Code), actorNameByCode(expectedCode))
+		}
+		if !actorOut.Balance.Equals(actorIn.Balance) {
+			report.addf(addr, DiscrepancyBalance, "balance changed from %v to %v", actorIn.Balance, actorOut.Balance)
+		}
+		if actorOut.CallSeqNum != actorIn.CallSeqNum {
+			report.addf(addr, DiscrepancyCallSeqNum, "call sequence number changed from %d to %d", actorIn.CallSeqNum, actorOut.CallSeqNum)
+		}
+		if preserved && !actorOut.Head.Equals(actorIn.Head) {
+			report.addf(addr, DiscrepancyHead, "state changed from %v to %v by state-preserving migration", actorIn.Head, actorOut.Head)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := actorsOut.ForEach(func(addr address.Address, actorOut *states.Actor) error {
+		report.OutputActorCount++
+		if _, ok := inputs[addr]; !ok {
+			report.addf(addr, DiscrepancyUnexpected, "%s actor absent from prior state", actorNameByCode(actorOut.Code))
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	// The check fails outright on states it can't interpret, such as those of unknown code CIDs.
+	// That is reported as a violation, as it is a consequence of the migrated state.
+	acc, err := states.CheckStateInvariants(actorsOut, totalIn, priorEpoch)
+	if err != nil {
+		report.InvariantViolations = []string{fmt.Sprintf("failed to check state invariants: %v", err)}
+	} else {
+		report.InvariantViolations = acc.Messages()
+	}
+	return report, nil
+}
+
+func (r *VerificationReport) addf(addr address.Address, kind string, format string, args ...interface{}) {
+	r.Discrepancies = append(r.Discrepancies, &Discrepancy{
+		Address: addr,
+		Kind:    kind,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// Returns the code CID to which actors with some prior code CID are migrated, and whether their state is preserved.
+func (m Migrations) migratedCode(code cid.Cid) (cid.Cid, bool, bool) {
+	if am, ok := m.Actors[code]; ok {
+		return am.MigratedCodeCID(), preservesState(am), true
+	}
+	if dm, ok := m.Deferred[code]; ok {
+		return dm.MigratedCodeCID(), false, true
+	}
+	return cid.Undef, false, false
+}
+
+func preservesState(m ActorMigration) bool {
+	switch m := m.(type) {
+	case nilMigrator:
+		return true
+	case cachedMigrator:
+		return preservesState(m.ActorMigration)
+	default:
+		return false
+	}
+}
@@ -0,0 +1,365 @@
+package states
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"text/tabwriter"
+
+	addr "github.com/filecoin-project/go-address"
+	hamt "github.com/filecoin-project/go-hamt-ipld/v3"
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+	cbg "github.com/whyrusleeping/cbor-gen"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin"
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/account"
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/cron"
+	init_ "github.com/filecoin-project/specs-actors/v4/actors/builtin/init"
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/market"
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/miner"
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/multisig"
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/paych"
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/power"
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/reward"
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/system"
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/verifreg"
+	"github.com/filecoin-project/specs-actors/v4/actors/util/adt"
+)
+
+// Field name attributed with an actor's head block, which holds the state object itself.
+const HeadField = "<head>"
+
+// Actor type of actors whose code is not a builtin actor.
+const UnknownActorType = "<unknown>"
+
+// Size statistics of a set of blocks.
+type BlockStats struct {
+	Blocks        uint64
+	Bytes         uint64
+	MaxBlockBytes uint64
+}
+
+func (s *BlockStats) add(size uint64) {
+	s.Blocks++
+	s.Bytes += size
+	if size > s.MaxBlockBytes {
+		s.MaxBlockBytes = size
+	}
+}
+
+// Returns the mean size of the blocks, or zero if there are none.
+func (s BlockStats) MeanBlockBytes() uint64 {
+	if s.Blocks == 0 {
+		return 0
+	}
+	return s.Bytes / s.Blocks
+}
+
+// Breakdown of the blocks reachable from a state root.
+// Every block is attributed exactly once: to the state tree itself, or to the first actor (in state tree order)
+// and field of that actor's state from which it is reachable.
+type StateAnalysis struct {
+	StateRoot  cid.Cid
+	ActorCount int
+	// All distinct blocks reachable from the state root.
+	Total BlockStats
+	// Nodes of the state tree HAMT.
+	Tree BlockStats
+	// Distinct blocks reachable from more than one actor.
+	Shared BlockStats
+	// Blocks attributed to actors of each type, ordered by type name.
+	ActorTypes []*ActorTypeAnalysis
+}
+
+type ActorTypeAnalysis struct {
+	// Short name of the actor type, e.g. "miner", or UnknownActorType.
+	ActorType  string
+	ActorCount int
+	// Blocks attributed to actors of this type.
+	Total BlockStats
+	// Blocks attributed to each field of the actor state, preceded by the head block, in state field order.
+	Fields []*FieldAnalysis
+}
+
+type FieldAnalysis struct {
+	// Name of the state field, or HeadField.
+	Field string
+	// Blocks attributed to the field.
+	Attributed BlockStats
+	// Blocks reachable from the field, but attributed to a different actor.
+	Shared BlockStats
+}
+
+// Walks all blocks reachable from a state root, attributing each to the state tree or an actor type and state field.
+// Links to sector commitments and identity-hashed CIDs are not followed.
+func AnalyzeState(store adt.Store, stateRoot cid.Cid) (*StateAnalysis, error) {
+	a := &stateAnalyzer{
+		store:    store,
+		analysis: &StateAnalysis{StateRoot: stateRoot},
+		owners:   make(map[cid.Cid]addr.Address),
+		shared:   cid.NewSet(),
+		types:    make(map[string]*ActorTypeAnalysis),
+	}
+
+	var actors []analyzedActor
+	if err := a.walkTree(stateRoot, func(key addr.Address, actor *Actor) {
+		actors = append(actors, analyzedActor{key, *actor})
+	}); err != nil {
+		return nil, err
+	}
+	for _, actor := range actors {
+		if err := a.walkActor(actor.key, &actor.actor); err != nil {
+			return nil, xerrors.Errorf("failed to analyze actor %v: %w", actor.key, err)
+		}
+	}
+
+	for _, typ := range a.types { //nolint:nomaprange
+		a.analysis.ActorTypes = append(a.analysis.ActorTypes, typ)
+	}
+	sort.Slice(a.analysis.ActorTypes, func(i, j int) bool {
+		return a.analysis.ActorTypes[i].ActorType < a.analysis.ActorTypes[j].ActorType
+	})
+	return a.analysis, nil
+}
+
+// Writes the analysis as indented JSON.
+func (s *StateAnalysis) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(s)
+}
+
+// Writes the analysis as human-readable tables.
+func (s *StateAnalysis) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "state root %v, %d actors\n\n", s.StateRoot, s.ActorCount)
+	fmt.Fprintf(tw, "\tblocks\tbytes\tmean\tmax\t\n")
+	writeStatsRow(tw, "total", s.Total)
+	writeStatsRow(tw, "state tree", s.Tree)
+	writeStatsRow(tw, "shared", s.Shared)
+	for _, typ := range s.ActorTypes {
+		writeStatsRow(tw, fmt.Sprintf("%s (%d)", typ.ActorType, typ.ActorCount), typ.Total)
+	}
+
+	fmt.Fprintf(tw, "\n\t\tblocks\tbytes\tmean\tmax\tshared blocks\tshared bytes\t\n")
+	for _, typ := range s.ActorTypes {
+		for _, field := range typ.Fields {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\t\n", typ.ActorType, field.Field,
+				field.Attributed.Blocks, field.Attributed.Bytes, field.Attributed.MeanBlockBytes(), field.Attributed.MaxBlockBytes,
+				field.Shared.Blocks, field.Shared.Bytes)
+		}
+	}
+	return tw.Flush()
+}
+
+func writeStatsRow(w io.Writer, name string, stats BlockStats) {
+	fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t\n", name, stats.Blocks, stats.Bytes, stats.MeanBlockBytes(), stats.MaxBlockBytes)
+}
+
+type analyzedActor struct {
+	key   addr.Address
+	actor Actor
+}
+
+type stateAnalyzer struct {
+	store    adt.Store
+	analysis *StateAnalysis
+	// Actor to which each block is attributed (undefined for state tree nodes).
+	owners map[cid.Cid]addr.Address
+	shared *cid.Set
+	types  map[string]*ActorTypeAnalysis
+}
+
+// Walks the state tree HAMT, calling back with each actor in tree order.
+func (a *stateAnalyzer) walkTree(c cid.Cid, fn func(key addr.Address, actor *Actor)) error {
+	raw, err := a.load(c)
+	if err != nil {
+		return err
+	}
+	a.owners[c] = addr.Undef
+	a.analysis.Total.add(uint64(len(raw)))
+	a.analysis.Tree.add(uint64(len(raw)))
+
+	var nd hamt.Node
+	if err := nd.UnmarshalCBOR(bytes.NewReader(raw)); err != nil {
+		return xerrors.Errorf("failed to decode state tree node %v: %w", c, err)
+	}
+	for _, ptr := range nd.Pointers {
+		if ptr.Link.Defined() {
+			if err := a.walkTree(ptr.Link, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, kv := range ptr.KVs {
+			key, err := addr.NewFromBytes(kv.Key)
+			if err != nil {
+				return xerrors.Errorf("invalid state tree key %x: %w", kv.Key, err)
+			}
+			var actor Actor
+			if err := actor.UnmarshalCBOR(bytes.NewReader(kv.Value.Raw)); err != nil {
+				return xerrors.Errorf("failed to decode actor %v: %w", key, err)
+			}
+			fn(key, &actor)
+		}
+	}
+	return nil
+}
+
+// Walks an actor's state, attributing the head block and then the blocks reachable from each state field.
+func (a *stateAnalyzer) walkActor(key addr.Address, actor *Actor) error {
+	a.analysis.ActorCount++
+	actorType, stateType := analyzedActorType(actor.Code)
+	typ, ok := a.types[actorType]
+	if !ok {
+		typ = &ActorTypeAnalysis{ActorType: actorType}
+		a.types[actorType] = typ
+	}
+	typ.ActorCount++
+
+	visited := cid.NewSet()
+	if !followLink(actor.Head) || !visited.Visit(actor.Head) {
+		return nil
+	}
+	raw, err := a.load(actor.Head)
+	if err != nil {
+		return err
+	}
+	a.attribute(actor.Head, uint64(len(raw)), key, typ, fieldAnalysis(typ, 0, HeadField))
+
+	// A state object is a CBOR tuple of its fields.
+	// Links in any other encoding are attributed to the head.
+	br := bytes.NewReader(raw)
+	maj, fieldCount, err := cbg.CborReadHeader(br)
+	if err != nil || maj != cbg.MajArray {
+		return a.walkLinks(actor.Head, bytes.NewReader(raw), key, visited, typ, fieldAnalysis(typ, 0, HeadField))
+	}
+	for i, name := range stateFieldNames(stateType, int(fieldCount)) {
+		if err := a.walkLinks(actor.Head, br, key, visited, typ, fieldAnalysis(typ, i+1, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Walks the blocks reachable from a link in an actor's state, attributing those not yet attributed to the field.
+func (a *stateAnalyzer) walk(c cid.Cid, key addr.Address, visited *cid.Set, typ *ActorTypeAnalysis, field *FieldAnalysis) error {
+	if !followLink(c) || !visited.Visit(c) {
+		return nil
+	}
+	raw, err := a.load(c)
+	if err != nil {
+		return err
+	}
+	a.attribute(c, uint64(len(raw)), key, typ, field)
+	return a.walkLinks(c, bytes.NewReader(raw), key, visited, typ, field)
+}
+
+// Walks the blocks reachable from the links in the next CBOR object read from a block.
+func (a *stateAnalyzer) walkLinks(c cid.Cid, br io.Reader, key addr.Address, visited *cid.Set, typ *ActorTypeAnalysis, field *FieldAnalysis) error {
+	var links []cid.Cid
+	if err := cbg.ScanForLinks(br, func(link cid.Cid) {
+		links = append(links, link)
+	}); err != nil {
+		return xerrors.Errorf("failed to scan block %v for links: %w", c, err)
+	}
+	for _, link := range links {
+		if err := a.walk(link, key, visited, typ, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *stateAnalyzer) attribute(c cid.Cid, size uint64, key addr.Address, typ *ActorTypeAnalysis, field *FieldAnalysis) {
+	if owner, ok := a.owners[c]; ok {
+		if owner != key {
+			field.Shared.add(size)
+			if a.shared.Visit(c) {
+				a.analysis.Shared.add(size)
+			}
+		}
+		return
+	}
+	a.owners[c] = key
+	a.analysis.Total.add(size)
+	typ.Total.add(size)
+	field.Attributed.add(size)
+}
+
+func (a *stateAnalyzer) load(c cid.Cid) ([]byte, error) {
+	if c.Prefix().Codec != cid.DagCBOR {
+		return nil, xerrors.Errorf("can't analyze block %v with codec %x, only DAG-CBOR is supported", c, c.Prefix().Codec)
+	}
+	// The store decodes objects, but a deferred object retains the raw block.
+	var raw cbg.Deferred
+	if err := a.store.Get(a.store.Context(), c, &raw); err != nil {
+		return nil, xerrors.Errorf("failed to get block %v: %w", c, err)
+	}
+	return raw.Raw, nil
+}
+
+// Whether a link refers to a block in the store.
+func followLink(c cid.Cid) bool {
+	prefix := c.Prefix()
+	return prefix.MhType != mh.IDENTITY && prefix.Codec != cid.FilCommitmentSealed && prefix.Codec != cid.FilCommitmentUnsealed
+}
+
+// Returns the analysis of a field, which is at some position in the type's fields (after the head), adding it if absent.
+func fieldAnalysis(typ *ActorTypeAnalysis, pos int, name string) *FieldAnalysis {
+	for len(typ.Fields) <= pos {
+		typ.Fields = append(typ.Fields, nil)
+	}
+	if typ.Fields[pos] == nil {
+		typ.Fields[pos] = &FieldAnalysis{Field: name}
+	}
+	return typ.Fields[pos]
+}
+
+// Names the fields of a state tuple, by the fields of the state type if they match in number, or else by position.
+func stateFieldNames(stateType reflect.Type, count int) []string {
+	names := make([]string, count)
+	for i := range names {
+		if stateType != nil && stateType.NumField() == count {
+			names[i] = stateType.Field(i).Name
+		} else {
+			names[i] = fmt.Sprintf("field %d", i)
+		}
+	}
+	return names
+}
+
+// Returns the short name of an actor's type, and its state type (nil if unknown).
+func analyzedActorType(code cid.Cid) (string, reflect.Type) {
+	switch code {
+	case builtin.SystemActorCodeID:
+		return "system", reflect.TypeOf(system.State{})
+	case builtin.InitActorCodeID:
+		return "init", reflect.TypeOf(init_.State{})
+	case builtin.CronActorCodeID:
+		return "cron", reflect.TypeOf(cron.State{})
+	case builtin.AccountActorCodeID:
+		return "account", reflect.TypeOf(account.State{})
+	case builtin.StoragePowerActorCodeID:
+		return "power", reflect.TypeOf(power.State{})
+	case builtin.StorageMinerActorCodeID:
+		return "miner", reflect.TypeOf(miner.State{})
+	case builtin.StorageMarketActorCodeID:
+		return "market", reflect.TypeOf(market.State{})
+	case builtin.PaymentChannelActorCodeID:
+		return "paych", reflect.TypeOf(paych.State{})
+	case builtin.MultisigActorCodeID:
+		return "multisig", reflect.TypeOf(multisig.State{})
+	case builtin.RewardActorCodeID:
+		return "reward", reflect.TypeOf(reward.State{})
+	case builtin.VerifiedRegistryActorCodeID:
+		return "verifreg", reflect.TypeOf(verifreg.State{})
+	default:
+		return UnknownActorType, nil
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"github.com/filecoin-project/specs-actors/v4/actors/builtin/paych"
 	"github.com/filecoin-project/specs-actors/v4/actors/builtin/reward"
 	"github.com/filecoin-project/specs-actors/v4/actors/builtin/verifreg"
+	"github.com/filecoin-project/specs-actors/v4/actors/util/adt"
 )
 
 // Within this code, Go errors are not expected, but are often converted to messages so that execution
@@ -28,110 +29,23 @@ import (
 func CheckStateInvariants(tree *Tree, expectedBalanceTotal abi.TokenAmount, priorEpoch abi.ChainEpoch) (*builtin.MessageAccumulator, error) {
 	acc := &builtin.MessageAccumulator{}
 	totalFIl := big.Zero()
-	var initSummary *init_.StateSummary
-	var cronSummary *cron.StateSummary
-	var verifregSummary *verifreg.StateSummary
-	var marketSummary *market.StateSummary
-	var rewardSummary *reward.StateSummary
-	var accountSummaries []*account.StateSummary
-	var powerSummary *power.StateSummary
-	var paychSummaries []*paych.StateSummary
-	var multisigSummaries []*multisig.StateSummary
-	minerSummaries := make(map[addr.Address]*miner.StateSummary)
+	summaries := newStateSummaries()
 
 	if err := tree.ForEach(func(key addr.Address, actor *Actor) error {
 		acc := acc.WithPrefix("%v ", key) // Intentional shadow
 		if key.Protocol() != addr.ID {
-			acc.Addf("unexpected address protocol in state tree root: %v", key)
+			acc.Addf(addressProtocolFormat, key)
 		}
 		totalFIl = big.Add(totalFIl, actor.Balance)
 
-		switch actor.Code {
-		case builtin.SystemActorCodeID:
-
-		case builtin.InitActorCodeID:
-			var st init_.State
-			if err := tree.Store.Get(tree.Store.Context(), actor.Head, &st); err != nil {
-				return err
-			}
-			summary, msgs := init_.CheckStateInvariants(&st, tree.Store)
-			acc.WithPrefix("init: ").AddAll(msgs)
-			initSummary = summary
-		case builtin.CronActorCodeID:
-			var st cron.State
-			if err := tree.Store.Get(tree.Store.Context(), actor.Head, &st); err != nil {
-				return err
-			}
-			summary, msgs := cron.CheckStateInvariants(&st, tree.Store)
-			acc.WithPrefix("cron: ").AddAll(msgs)
-			cronSummary = summary
-		case builtin.AccountActorCodeID:
-			var st account.State
-			if err := tree.Store.Get(tree.Store.Context(), actor.Head, &st); err != nil {
-				return err
-			}
-			summary, msgs := account.CheckStateInvariants(&st, key)
-			acc.WithPrefix("account: ").AddAll(msgs)
-			accountSummaries = append(accountSummaries, summary)
-		case builtin.StoragePowerActorCodeID:
-			var st power.State
-			if err := tree.Store.Get(tree.Store.Context(), actor.Head, &st); err != nil {
-				return err
-			}
-			summary, msgs := power.CheckStateInvariants(&st, tree.Store)
-			acc.WithPrefix("power: ").AddAll(msgs)
-			powerSummary = summary
-		case builtin.StorageMinerActorCodeID:
-			var st miner.State
-			if err := tree.Store.Get(tree.Store.Context(), actor.Head, &st); err != nil {
-				return err
-			}
-			summary, msgs := miner.CheckStateInvariants(&st, tree.Store, actor.Balance)
-			acc.WithPrefix("miner: ").AddAll(msgs)
-			minerSummaries[key] = summary
-		case builtin.StorageMarketActorCodeID:
-			var st market.State
-			if err := tree.Store.Get(tree.Store.Context(), actor.Head, &st); err != nil {
-				return err
-			}
-			summary, msgs := market.CheckStateInvariants(&st, tree.Store, actor.Balance, priorEpoch)
-			acc.WithPrefix("market: ").AddAll(msgs)
-			marketSummary = summary
-		case builtin.PaymentChannelActorCodeID:
-			var st paych.State
-			if err := tree.Store.Get(tree.Store.Context(), actor.Head, &st); err != nil {
-				return err
-			}
-			summary, msgs := paych.CheckStateInvariants(&st, tree.Store, actor.Balance)
-			acc.WithPrefix("paych: ").AddAll(msgs)
-			paychSummaries = append(paychSummaries, summary)
-		case builtin.MultisigActorCodeID:
-			var st multisig.State
-			if err := tree.Store.Get(tree.Store.Context(), actor.Head, &st); err != nil {
-				return err
-			}
-			summary, msgs := multisig.CheckStateInvariants(&st, tree.Store)
-			acc.WithPrefix("multisig: ").AddAll(msgs)
-			multisigSummaries = append(multisigSummaries, summary)
-		case builtin.RewardActorCodeID:
-			var st reward.State
-			if err := tree.Store.Get(tree.Store.Context(), actor.Head, &st); err != nil {
-				return err
-			}
-			summary, msgs := reward.CheckStateInvariants(&st, tree.Store, priorEpoch, actor.Balance)
-			acc.WithPrefix("reward: ").AddAll(msgs)
-			rewardSummary = summary
-		case builtin.VerifiedRegistryActorCodeID:
-			var st verifreg.State
-			if err := tree.Store.Get(tree.Store.Context(), actor.Head, &st); err != nil {
-				return err
-			}
-			summary, msgs := verifreg.CheckStateInvariants(&st, tree.Store)
-			acc.WithPrefix("verifreg: ").AddAll(msgs)
-			verifregSummary = summary
-		default:
-			return xerrors.Errorf("unexpected actor code CID %v for address %v", actor.Code, key)
+		result, err := checkActor(tree.Store, key, actor, priorEpoch)
+		if err != nil {
+			return err
+		}
+		if result.msgs != nil {
+			acc.WithPrefix("%s: ", result.actorType).AddAll(result.msgs)
 		}
+		summaries.add(key, result.summary)
 		return nil
 	}); err != nil {
 		return nil, err
@@ -141,22 +55,153 @@ func CheckStateInvariants(tree *Tree, expectedBalanceTotal abi.TokenAmount, prio
 	// Perform cross-actor checks from state summaries here.
 	//
 
-	CheckMinersAgainstPower(acc, minerSummaries, powerSummary)
-	CheckDealStatesAgainstSectors(acc, minerSummaries, marketSummary)
-
-	_ = initSummary
-	_ = verifregSummary
-	_ = cronSummary
-	_ = marketSummary
-	_ = rewardSummary
+	summaries.check(acc)
 
 	if !totalFIl.Equals(expectedBalanceTotal) {
-		acc.Addf("total token balance is %v, expected %v", totalFIl, expectedBalanceTotal)
+		acc.Addf(totalBalanceFormat, totalFIl, expectedBalanceTotal)
 	}
 
 	return acc, nil
 }
 
+// The outcome of checking a single actor's state.
+type actorCheckResult struct {
+	actorType string
+	summary   interface{}
+	msgs      *builtin.MessageAccumulator
+}
+
+// Loads an actor's state and checks its invariants.
+// The result's summary is a pointer to the actor type's StateSummary, or nil for the system actor.
+func checkActor(store adt.Store, key addr.Address, actor *Actor, priorEpoch abi.ChainEpoch) (*actorCheckResult, error) {
+	switch actor.Code {
+	case builtin.SystemActorCodeID:
+		return &actorCheckResult{actorType: "system"}, nil
+
+	case builtin.InitActorCodeID:
+		var st init_.State
+		if err := store.Get(store.Context(), actor.Head, &st); err != nil {
+			return nil, err
+		}
+		summary, msgs := init_.CheckStateInvariants(&st, store)
+		return &actorCheckResult{"init", summary, msgs}, nil
+	case builtin.CronActorCodeID:
+		var st cron.State
+		if err := store.Get(store.Context(), actor.Head, &st); err != nil {
+			return nil, err
+		}
+		summary, msgs := cron.CheckStateInvariants(&st, store)
+		return &actorCheckResult{"cron", summary, msgs}, nil
+	case builtin.AccountActorCodeID:
+		var st account.State
+		if err := store.Get(store.Context(), actor.Head, &st); err != nil {
+			return nil, err
+		}
+		summary, msgs := account.CheckStateInvariants(&st, key)
+		return &actorCheckResult{"account", summary, msgs}, nil
+	case builtin.StoragePowerActorCodeID:
+		var st power.State
+		if err := store.Get(store.Context(), actor.Head, &st); err != nil {
+			return nil, err
+		}
+		summary, msgs := power.CheckStateInvariants(&st, store)
+		return &actorCheckResult{"power", summary, msgs}, nil
+	case builtin.StorageMinerActorCodeID:
+		var st miner.State
+		if err := store.Get(store.Context(), actor.Head, &st); err != nil {
+			return nil, err
+		}
+		summary, msgs := miner.CheckStateInvariants(&st, store, actor.Balance)
+		return &actorCheckResult{"miner", summary, msgs}, nil
+	case builtin.StorageMarketActorCodeID:
+		var st market.State
+		if err := store.Get(store.Context(), actor.Head, &st); err != nil {
+			return nil, err
+		}
+		summary, msgs := market.CheckStateInvariants(&st, store, actor.Balance, priorEpoch)
+		return &actorCheckResult{"market", summary, msgs}, nil
+	case builtin.PaymentChannelActorCodeID:
+		var st paych.State
+		if err := store.Get(store.Context(), actor.Head, &st); err != nil {
+			return nil, err
+		}
+		summary, msgs := paych.CheckStateInvariants(&st, store, actor.Balance)
+		return &actorCheckResult{"paych", summary, msgs}, nil
+	case builtin.MultisigActorCodeID:
+		var st multisig.State
+		if err := store.Get(store.Context(), actor.Head, &st); err != nil {
+			return nil, err
+		}
+		summary, msgs := multisig.CheckStateInvariants(&st, store)
+		return &actorCheckResult{"multisig", summary, msgs}, nil
+	case builtin.RewardActorCodeID:
+		var st reward.State
+		if err := store.Get(store.Context(), actor.Head, &st); err != nil {
+			return nil, err
+		}
+		summary, msgs := reward.CheckStateInvariants(&st, store, priorEpoch, actor.Balance)
+		return &actorCheckResult{"reward", summary, msgs}, nil
+	case builtin.VerifiedRegistryActorCodeID:
+		var st verifreg.State
+		if err := store.Get(store.Context(), actor.Head, &st); err != nil {
+			return nil, err
+		}
+		summary, msgs := verifreg.CheckStateInvariants(&st, store)
+		return &actorCheckResult{"verifreg", summary, msgs}, nil
+	default:
+		return nil, xerrors.Errorf("unexpected actor code CID %v for address %v", actor.Code, key)
+	}
+}
+
+// Collects the state summaries of all actors, for cross-actor checks.
+type stateSummaries struct {
+	initSummary       *init_.StateSummary
+	cronSummary       *cron.StateSummary
+	verifregSummary   *verifreg.StateSummary
+	marketSummary     *market.StateSummary
+	rewardSummary     *reward.StateSummary
+	accountSummaries  []*account.StateSummary
+	powerSummary      *power.StateSummary
+	paychSummaries    []*paych.StateSummary
+	multisigSummaries []*multisig.StateSummary
+	minerSummaries    map[addr.Address]*miner.StateSummary
+}
+
+func newStateSummaries() *stateSummaries {
+	return &stateSummaries{minerSummaries: make(map[addr.Address]*miner.StateSummary)}
+}
+
+func (s *stateSummaries) add(key addr.Address, summary interface{}) {
+	switch summary := summary.(type) {
+	case *init_.StateSummary:
+		s.initSummary = summary
+	case *cron.StateSummary:
+		s.cronSummary = summary
+	case *account.StateSummary:
+		s.accountSummaries = append(s.accountSummaries, summary)
+	case *power.StateSummary:
+		s.powerSummary = summary
+	case *miner.StateSummary:
+		s.minerSummaries[key] = summary
+	case *market.StateSummary:
+		s.marketSummary = summary
+	case *paych.StateSummary:
+		s.paychSummaries = append(s.paychSummaries, summary)
+	case *multisig.StateSummary:
+		s.multisigSummaries = append(s.multisigSummaries, summary)
+	case *reward.StateSummary:
+		s.rewardSummary = summary
+	case *verifreg.StateSummary:
+		s.verifregSummary = summary
+	}
+}
+
+// Performs cross-actor checks from the collected summaries.
+func (s *stateSummaries) check(acc *builtin.MessageAccumulator) {
+	CheckMinersAgainstPower(acc, s.minerSummaries, s.powerSummary)
+	CheckDealStatesAgainstSectors(acc, s.minerSummaries, s.marketSummary)
+}
+
 func CheckMinersAgainstPower(acc *builtin.MessageAccumulator, minerSummaries map[addr.Address]*miner.StateSummary, powerSummary *power.StateSummary) {
 	for addr, minerSummary := range minerSummaries { // nolint:nomaprange
 		// check claim
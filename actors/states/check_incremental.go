@@ -0,0 +1,197 @@
+package states
+
+import (
+	"sort"
+
+	addr "github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin"
+	"github.com/filecoin-project/specs-actors/v4/actors/util/adt"
+)
+
+// Checks state invariants of a sequence of state trees, re-checking only the actors that have changed
+// since the previously checked tree and re-using the cached state summaries of the rest.
+// Cross-actor checks are re-run over all summaries for every tree.
+// An IncrementalChecker is not safe for concurrent use.
+type IncrementalChecker struct {
+	store adt.Store
+	// Root of the last state tree checked, or undefined if none has been.
+	root       cid.Cid
+	priorEpoch abi.ChainEpoch
+	actors     map[addr.Address]*checkedActor
+	// Number of actors whose state was checked by the last call to Check.
+	lastCheckedCount int
+}
+
+type checkedActor struct {
+	actor Actor
+	// Messages for the actor, already prefixed as by CheckStateInvariants.
+	msgs    *builtin.MessageAccumulator
+	summary interface{}
+	// Whether the actor's checks depend on the prior epoch, as well as its state and balance.
+	epochDependent bool
+}
+
+func NewIncrementalChecker(store adt.Store) *IncrementalChecker {
+	return &IncrementalChecker{
+		store: store,
+		root:  cid.Undef,
+	}
+}
+
+// Checks the same invariants as CheckStateInvariants for the state tree with some root.
+// Messages for each actor are ordered by actor address, followed by cross-actor and total balance messages.
+func (c *IncrementalChecker) Check(root cid.Cid, expectedBalanceTotal abi.TokenAmount, priorEpoch abi.ChainEpoch) (*builtin.MessageAccumulator, error) {
+	if err := c.update(root, priorEpoch); err != nil {
+		// The cache may be partially updated, so start afresh next time.
+		c.Reset()
+		return nil, err
+	}
+
+	keys := make([]addr.Address, 0, len(c.actors))
+	for key := range c.actors { //nolint:nomaprange
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return addressLess(keys[i], keys[j])
+	})
+
+	acc := &builtin.MessageAccumulator{}
+	totalFIl := big.Zero()
+	summaries := newStateSummaries()
+	for _, key := range keys {
+		checked := c.actors[key]
+		acc.AddAll(checked.msgs)
+		summaries.add(key, checked.summary)
+		totalFIl = big.Add(totalFIl, checked.actor.Balance)
+	}
+
+	summaries.check(acc)
+
+	if !totalFIl.Equals(expectedBalanceTotal) {
+		acc.Addf(totalBalanceFormat, totalFIl, expectedBalanceTotal)
+	}
+	return acc, nil
+}
+
+// Returns the number of actors whose state was checked by the last call to Check.
+func (c *IncrementalChecker) LastCheckedCount() int {
+	return c.lastCheckedCount
+}
+
+// Discards all cached results, so that the next check will check every actor.
+func (c *IncrementalChecker) Reset() {
+	c.root = cid.Undef
+	c.actors = nil
+}
+
+// Brings the cached results up to date with a new state tree.
+func (c *IncrementalChecker) update(root cid.Cid, priorEpoch abi.ChainEpoch) error {
+	tree, err := LoadTree(c.store, root)
+	if err != nil {
+		return xerrors.Errorf("failed to load state tree %v: %w", root, err)
+	}
+	c.lastCheckedCount = 0
+
+	if !c.root.Defined() {
+		c.actors = make(map[addr.Address]*checkedActor)
+		if err := tree.ForEach(func(key addr.Address, actor *Actor) error {
+			return c.checkActor(key, actor, priorEpoch)
+		}); err != nil {
+			return err
+		}
+	} else {
+		prev, err := LoadTree(c.store, c.root)
+		if err != nil {
+			return xerrors.Errorf("failed to load state tree %v: %w", c.root, err)
+		}
+		changed := make(map[addr.Address]struct{})
+		var after Actor
+		if err := adt.DiffMaps(prev.Map, tree.Map, nil, &after, adt.MapDiffFuncs{
+			Add: func(key string) error {
+				return c.checkChangedActor(key, &after, priorEpoch, changed)
+			},
+			Modify: func(key string) error {
+				return c.checkChangedActor(key, &after, priorEpoch, changed)
+			},
+			Remove: func(key string) error {
+				a, err := addr.NewFromBytes([]byte(key))
+				if err != nil {
+					return err
+				}
+				delete(c.actors, a)
+				return nil
+			},
+		}); err != nil {
+			return xerrors.Errorf("failed to diff state trees %v and %v: %w", c.root, root, err)
+		}
+
+		// Actors whose checks depend on the epoch must be re-checked when it changes, even if their state has not.
+		if priorEpoch != c.priorEpoch {
+			for key, checked := range c.actors { //nolint:nomaprange
+				if _, ok := changed[key]; ok || !checked.epochDependent {
+					continue
+				}
+				actor := checked.actor
+				if err := c.checkActor(key, &actor, priorEpoch); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	c.root = root
+	c.priorEpoch = priorEpoch
+	return nil
+}
+
+func (c *IncrementalChecker) checkChangedActor(key string, actor *Actor, priorEpoch abi.ChainEpoch, changed map[addr.Address]struct{}) error {
+	a, err := addr.NewFromBytes([]byte(key))
+	if err != nil {
+		return err
+	}
+	changed[a] = struct{}{}
+	return c.checkActor(a, actor, priorEpoch)
+}
+
+func (c *IncrementalChecker) checkActor(key addr.Address, actor *Actor, priorEpoch abi.ChainEpoch) error {
+	result, err := checkActor(c.store, key, actor, priorEpoch)
+	if err != nil {
+		return err
+	}
+	c.lastCheckedCount++
+
+	msgs := &builtin.MessageAccumulator{}
+	actorAcc := msgs.WithPrefix("%v ", key)
+	if key.Protocol() != addr.ID {
+		actorAcc.Addf(addressProtocolFormat, key)
+	}
+	if result.msgs != nil {
+		actorAcc.WithPrefix("%s: ", result.actorType).AddAll(result.msgs)
+	}
+	c.actors[key] = &checkedActor{
+		actor:          *actor,
+		msgs:           msgs,
+		summary:        result.summary,
+		epochDependent: actor.Code.Equals(builtin.StorageMarketActorCodeID) || actor.Code.Equals(builtin.RewardActorCodeID),
+	}
+	return nil
+}
+
+// Orders ID addresses by ID, before any other addresses, which are ordered by their string representation.
+func addressLess(a, b addr.Address) bool {
+	aID, aErr := addr.IDFromAddress(a)
+	bID, bErr := addr.IDFromAddress(b)
+	switch {
+	case aErr == nil && bErr == nil:
+		return aID < bID
+	case aErr == nil || bErr == nil:
+		return aErr == nil
+	default:
+		return a.String() < b.String()
+	}
+}
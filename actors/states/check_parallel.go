@@ -0,0 +1,292 @@
+package states
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	addr "github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin"
+)
+
+const (
+	addressProtocolFormat = "unexpected address protocol in state tree root: %v"
+	totalBalanceFormat    = "total token balance is %v, expected %v"
+)
+
+// Invariant IDs of checks on the state tree as a whole, rather than a single actor.
+const (
+	InvariantAddressProtocol = "state: " + addressProtocolFormat
+	InvariantTotalBalance    = "state: " + totalBalanceFormat
+)
+
+// Actor type of violations found by checks spanning multiple actors.
+const CrossActorType = "cross-actor"
+
+// CheckConfig parameterizes a parallel check of state invariants.
+type CheckConfig struct {
+	// Number of worker goroutines loading and checking actor states.
+	// Zero is treated as one.
+	MaxWorkers uint
+	// Capacity of the queue of actors available to workers (zero for unbuffered).
+	JobQueueSize uint
+	// Violations matching this list are reported as allowed, rather than as failures.
+	// May be nil.
+	AllowList *AllowList
+	// If non-nil, called with each violation as soon as it is found, before the check completes.
+	// Calls are made from a single goroutine.
+	OnViolation func(v *Violation)
+}
+
+// A single failed invariant.
+type Violation struct {
+	// Address of the actor whose state violates the invariant, or undefined for cross-actor and total balance checks.
+	Address addr.Address
+	// Short name of the actor type, e.g. "miner", or CrossActorType.
+	ActorType string
+	// Stable identifier of the invariant: the actor type and the format of the message, independent of
+	// the values it reports.
+	InvariantID string
+	// Description of the violation.
+	Message string
+	// Whether the violation matched the allow list.
+	Allowed bool
+}
+
+// Results of a parallel invariant check.
+type CheckReport struct {
+	// Number of actors checked.
+	ActorCount int
+	// All violations found, including those allowed, in state tree order followed by cross-actor violations.
+	Violations []*Violation
+}
+
+// Returns the violations not matched by the allow list.
+func (r *CheckReport) Failures() []*Violation {
+	var failures []*Violation
+	for _, v := range r.Violations {
+		if !v.Allowed {
+			failures = append(failures, v)
+		}
+	}
+	return failures
+}
+
+// Returns true if all violations (if any) were allowed.
+func (r *CheckReport) OK() bool {
+	return len(r.Failures()) == 0
+}
+
+// Writes the report as indented JSON.
+func (r *CheckReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// Reads a report previously written with WriteJSON.
+func ReadCheckReport(r io.Reader) (*CheckReport, error) {
+	var report CheckReport
+	if err := json.NewDecoder(r).Decode(&report); err != nil {
+		return nil, xerrors.Errorf("failed to decode invariant check report: %w", err)
+	}
+	return &report, nil
+}
+
+// A list of known or accepted violations.
+type AllowList struct {
+	Rules []AllowRule
+}
+
+// Matches violations. Each non-empty field of a rule must match a violation for the rule to match it.
+type AllowRule struct {
+	InvariantID string
+	ActorType   string
+	Address     addr.Address
+	// A substring of the violation's message.
+	MessageContains string
+	// Why the violation is allowed. Not used for matching.
+	Reason string
+}
+
+// Reads an allow list from JSON.
+func ReadAllowList(r io.Reader) (*AllowList, error) {
+	var list AllowList
+	if err := json.NewDecoder(r).Decode(&list); err != nil {
+		return nil, xerrors.Errorf("failed to decode invariant allow list: %w", err)
+	}
+	return &list, nil
+}
+
+// Returns true if any rule matches the violation.
+func (l *AllowList) Allows(v *Violation) bool {
+	if l == nil {
+		return false
+	}
+	for _, rule := range l.Rules {
+		if rule.Matches(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *AllowRule) Matches(v *Violation) bool {
+	return (r.InvariantID == "" || r.InvariantID == v.InvariantID) &&
+		(r.ActorType == "" || r.ActorType == v.ActorType) &&
+		(r.Address == addr.Undef || r.Address == v.Address) &&
+		(r.MessageContains == "" || strings.Contains(v.Message, r.MessageContains))
+}
+
+// Checks the same invariants as CheckStateInvariants, loading and checking actors concurrently.
+// The tree's store must be safe for concurrent reads.
+func CheckStateInvariantsParallel(ctx context.Context, tree *Tree, expectedBalanceTotal abi.TokenAmount,
+	priorEpoch abi.ChainEpoch, cfg CheckConfig) (*CheckReport, error) {
+	workerCount := int(cfg.MaxWorkers)
+	if workerCount < 1 {
+		workerCount = 1
+	}
+
+	type checkJob struct {
+		seq   int
+		key   addr.Address
+		actor Actor
+	}
+	type checkResult struct {
+		seq    int
+		key    addr.Address
+		result *actorCheckResult
+	}
+	totalFIl := big.Zero()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	jobs := make(chan *checkJob, cfg.JobQueueSize)
+	results := make(chan *checkResult, workerCount)
+	errs := make(chan error, workerCount+1)
+
+	// Enumerate the actors in the tree.
+	go func() {
+		defer close(jobs)
+		seq := 0
+		if err := tree.ForEach(func(key addr.Address, actor *Actor) error {
+			select {
+			case jobs <- &checkJob{seq, key, *actor}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			// The total is read only after all workers, and hence this enumeration, have completed.
+			totalFIl = big.Add(totalFIl, actor.Balance)
+			seq++
+			return nil
+		}); err != nil {
+			errs <- xerrors.Errorf("failed to enumerate actors: %w", err)
+		}
+	}()
+
+	// Check actors concurrently.
+	var workers sync.WaitGroup
+	workers.Add(workerCount)
+	for i := 0; i < workerCount; i++ {
+		go func() {
+			defer workers.Done()
+			for job := range jobs {
+				result, err := checkActor(tree.Store, job.key, &job.actor, priorEpoch)
+				if err != nil {
+					errs <- xerrors.Errorf("failed to check actor %v: %w", job.key, err)
+					cancel()
+					return
+				}
+				select {
+				case results <- &checkResult{job.seq, job.key, result}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+
+	// Collect violations and summaries.
+	report := &CheckReport{}
+	summaries := newStateSummaries()
+	seqs := make(map[*Violation]int)
+	for res := range results {
+		report.ActorCount++
+		summaries.add(res.key, res.result.summary)
+		if res.key.Protocol() != addr.ID {
+			v := &Violation{
+				Address:     res.key,
+				ActorType:   res.result.actorType,
+				InvariantID: InvariantAddressProtocol,
+				Message:     fmt.Sprintf(addressProtocolFormat, res.key),
+			}
+			seqs[v] = res.seq
+			report.add(v, cfg)
+		}
+		if res.result.msgs == nil {
+			continue
+		}
+		formats := res.result.msgs.Formats()
+		for i, msg := range res.result.msgs.Messages() {
+			v := &Violation{
+				Address:     res.key,
+				ActorType:   res.result.actorType,
+				InvariantID: res.result.actorType + ": " + formats[i],
+				Message:     msg,
+			}
+			seqs[v] = res.seq
+			report.add(v, cfg)
+		}
+	}
+	select {
+	case err := <-errs:
+		return nil, err
+	default:
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// Restore state tree order, independent of the order in which workers completed.
+	sort.SliceStable(report.Violations, func(i, j int) bool {
+		return seqs[report.Violations[i]] < seqs[report.Violations[j]]
+	})
+
+	crossAcc := &builtin.MessageAccumulator{}
+	summaries.check(crossAcc)
+	formats := crossAcc.Formats()
+	for i, msg := range crossAcc.Messages() {
+		report.add(&Violation{
+			ActorType:   CrossActorType,
+			InvariantID: CrossActorType + ": " + formats[i],
+			Message:     msg,
+		}, cfg)
+	}
+
+	if !totalFIl.Equals(expectedBalanceTotal) {
+		report.add(&Violation{
+			InvariantID: InvariantTotalBalance,
+			Message:     fmt.Sprintf(totalBalanceFormat, totalFIl, expectedBalanceTotal),
+		}, cfg)
+	}
+	return report, nil
+}
+
+func (r *CheckReport) add(v *Violation, cfg CheckConfig) {
+	v.Allowed = cfg.AllowList.Allows(v)
+	r.Violations = append(r.Violations, v)
+	if cfg.OnViolation != nil {
+		cfg.OnViolation(v)
+	}
+}
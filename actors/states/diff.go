@@ -0,0 +1,648 @@
+package states
+
+import (
+	"bytes"
+
+	addr "github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/cbor"
+	"github.com/ipfs/go-cid"
+	cbg "github.com/whyrusleeping/cbor-gen"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin"
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/market"
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/miner"
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/multisig"
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/power"
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/verifreg"
+	"github.com/filecoin-project/specs-actors/v4/actors/util/adt"
+)
+
+// TreeDiff describes the differences between two state trees.
+// Actors appear in no particular order.
+type TreeDiff struct {
+	Added    []*ActorChange
+	Removed  []*ActorChange
+	Modified []*ActorChange
+}
+
+// ActorChange describes an actor added, removed or modified between two state trees.
+type ActorChange struct {
+	Address addr.Address
+	Before  *Actor // Nil if the actor was added
+	After   *Actor // Nil if the actor was removed
+
+	// Semantic differences between the states of a modified builtin actor.
+	// At most one of these is set, according to the actor's code, and only if its code is unchanged.
+	Miner    *MinerDiff
+	Market   *MarketDiff
+	Power    *PowerDiff
+	VerifReg *VerifRegDiff
+	Multisig *MultisigDiff
+}
+
+// In each of the following changes, Before is nil (or zero, for amounts) for an entry that was added,
+// and After for an entry that was removed.
+// Changes to arrays are in ascending order of index, and to maps in the order of the HAMT's structure.
+
+type MinerDiff struct {
+	Sectors    []SectorChange
+	PreCommits []PreCommitChange
+	Deadlines  []DeadlineChange // Only deadlines that changed
+}
+
+type SectorChange struct {
+	Number abi.SectorNumber
+	Before *miner.SectorOnChainInfo
+	After  *miner.SectorOnChainInfo
+}
+
+type PreCommitChange struct {
+	Number abi.SectorNumber
+	Before *miner.SectorPreCommitOnChainInfo
+	After  *miner.SectorPreCommitOnChainInfo
+}
+
+type DeadlineChange struct {
+	Index      uint64
+	Before     *miner.Deadline
+	After      *miner.Deadline
+	Partitions []PartitionChange
+}
+
+type PartitionChange struct {
+	Index  uint64
+	Before *miner.Partition
+	After  *miner.Partition
+}
+
+type MarketDiff struct {
+	Proposals []DealProposalChange
+	States    []DealStateChange
+	Escrow    []BalanceChange
+	Locked    []BalanceChange
+}
+
+type DealProposalChange struct {
+	ID     abi.DealID
+	Before *market.DealProposal
+	After  *market.DealProposal
+}
+
+type DealStateChange struct {
+	ID     abi.DealID
+	Before *market.DealState
+	After  *market.DealState
+}
+
+type BalanceChange struct {
+	Address addr.Address
+	Before  abi.TokenAmount
+	After   abi.TokenAmount
+}
+
+type PowerDiff struct {
+	Claims []ClaimChange
+}
+
+type ClaimChange struct {
+	Address addr.Address
+	Before  *power.Claim
+	After   *power.Claim
+}
+
+type VerifRegDiff struct {
+	Verifiers []DataCapChange
+	Clients   []DataCapChange
+}
+
+type DataCapChange struct {
+	Address addr.Address
+	Before  *verifreg.DataCap
+	After   *verifreg.DataCap
+}
+
+type MultisigDiff struct {
+	PendingTxns []TransactionChange
+}
+
+type TransactionChange struct {
+	ID     multisig.TxnID
+	Before *multisig.Transaction
+	After  *multisig.Transaction
+}
+
+// Diff computes the differences between the state trees at two roots.
+func Diff(store adt.Store, rootA, rootB cid.Cid) (*TreeDiff, error) {
+	treeA, err := LoadTree(store, rootA)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to load tree %v: %w", rootA, err)
+	}
+	treeB, err := LoadTree(store, rootB)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to load tree %v: %w", rootB, err)
+	}
+
+	diff := &TreeDiff{}
+	err = diffMaps(treeA.Map, treeB.Map, func(key string, before, after *cbg.Deferred) error {
+		address, err := addr.NewFromBytes([]byte(key))
+		if err != nil {
+			return err
+		}
+		change := &ActorChange{Address: address}
+		if change.Before, change.After, err = decodeActors(before, after); err != nil {
+			return err
+		}
+
+		switch {
+		case before == nil:
+			diff.Added = append(diff.Added, change)
+		case after == nil:
+			diff.Removed = append(diff.Removed, change)
+		default:
+			if err := diffActorState(store, change); err != nil {
+				return xerrors.Errorf("failed to diff state of actor %v: %w", address, err)
+			}
+			diff.Modified = append(diff.Modified, change)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return diff, nil
+}
+
+func diffActorState(store adt.Store, change *ActorChange) error {
+	if !change.Before.Code.Equals(change.After.Code) || change.Before.Head.Equals(change.After.Head) {
+		return nil
+	}
+	var err error
+	switch change.After.Code {
+	case builtin.StorageMinerActorCodeID:
+		var before, after miner.State
+		if err = loadStates(store, change, &before, &after); err == nil {
+			change.Miner, err = DiffMinerStates(store, &before, &after)
+		}
+	case builtin.StorageMarketActorCodeID:
+		var before, after market.State
+		if err = loadStates(store, change, &before, &after); err == nil {
+			change.Market, err = DiffMarketStates(store, &before, &after)
+		}
+	case builtin.StoragePowerActorCodeID:
+		var before, after power.State
+		if err = loadStates(store, change, &before, &after); err == nil {
+			change.Power, err = DiffPowerStates(store, &before, &after)
+		}
+	case builtin.VerifiedRegistryActorCodeID:
+		var before, after verifreg.State
+		if err = loadStates(store, change, &before, &after); err == nil {
+			change.VerifReg, err = DiffVerifRegStates(store, &before, &after)
+		}
+	case builtin.MultisigActorCodeID:
+		var before, after multisig.State
+		if err = loadStates(store, change, &before, &after); err == nil {
+			change.Multisig, err = DiffMultisigStates(store, &before, &after)
+		}
+	}
+	return err
+}
+
+func loadStates(store adt.Store, change *ActorChange, before, after cbor.Unmarshaler) error {
+	if err := store.Get(store.Context(), change.Before.Head, before); err != nil {
+		return xerrors.Errorf("failed to load state %v: %w", change.Before.Head, err)
+	}
+	if err := store.Get(store.Context(), change.After.Head, after); err != nil {
+		return xerrors.Errorf("failed to load state %v: %w", change.After.Head, err)
+	}
+	return nil
+}
+
+// DiffMinerStates computes the differences between the sectors, pre-committed sectors and deadlines
+// of two miner states.
+func DiffMinerStates(store adt.Store, before, after *miner.State) (*MinerDiff, error) {
+	diff := &MinerDiff{}
+
+	sectorsA, err := adt.AsArray(store, before.Sectors, miner.SectorsAmtBitwidth)
+	if err != nil {
+		return nil, err
+	}
+	sectorsB, err := adt.AsArray(store, after.Sectors, miner.SectorsAmtBitwidth)
+	if err != nil {
+		return nil, err
+	}
+	if err := diffArrays(sectorsA, sectorsB, func(i uint64, b, a *cbg.Deferred) error {
+		change := SectorChange{Number: abi.SectorNumber(i)}
+		var err error
+		if change.Before, change.After, err = decodeSectorInfos(b, a); err != nil {
+			return err
+		}
+		diff.Sectors = append(diff.Sectors, change)
+		return nil
+	}); err != nil {
+		return nil, xerrors.Errorf("failed to diff sectors: %w", err)
+	}
+
+	precommitsA, err := adt.AsMap(store, before.PreCommittedSectors, builtin.DefaultHamtBitwidth)
+	if err != nil {
+		return nil, err
+	}
+	precommitsB, err := adt.AsMap(store, after.PreCommittedSectors, builtin.DefaultHamtBitwidth)
+	if err != nil {
+		return nil, err
+	}
+	if err := diffMaps(precommitsA, precommitsB, func(key string, b, a *cbg.Deferred) error {
+		number, err := abi.ParseUIntKey(key)
+		if err != nil {
+			return err
+		}
+		change := PreCommitChange{Number: abi.SectorNumber(number)}
+		if change.Before, change.After, err = decodePreCommitInfos(b, a); err != nil {
+			return err
+		}
+		diff.PreCommits = append(diff.PreCommits, change)
+		return nil
+	}); err != nil {
+		return nil, xerrors.Errorf("failed to diff precommitted sectors: %w", err)
+	}
+
+	if before.Deadlines.Equals(after.Deadlines) {
+		return diff, nil
+	}
+	deadlinesA, err := before.LoadDeadlines(store)
+	if err != nil {
+		return nil, err
+	}
+	deadlinesB, err := after.LoadDeadlines(store)
+	if err != nil {
+		return nil, err
+	}
+	for dlIdx := range deadlinesA.Due {
+		if deadlinesA.Due[dlIdx].Equals(deadlinesB.Due[dlIdx]) {
+			continue
+		}
+		change, err := diffDeadlines(store, deadlinesA, deadlinesB, uint64(dlIdx))
+		if err != nil {
+			return nil, xerrors.Errorf("failed to diff deadline %d: %w", dlIdx, err)
+		}
+		diff.Deadlines = append(diff.Deadlines, change)
+	}
+	return diff, nil
+}
+
+func diffDeadlines(store adt.Store, deadlinesA, deadlinesB *miner.Deadlines, dlIdx uint64) (DeadlineChange, error) {
+	change := DeadlineChange{Index: dlIdx}
+	var err error
+	if change.Before, err = deadlinesA.LoadDeadline(store, dlIdx); err != nil {
+		return change, err
+	}
+	if change.After, err = deadlinesB.LoadDeadline(store, dlIdx); err != nil {
+		return change, err
+	}
+
+	partitionsA, err := change.Before.PartitionsArray(store)
+	if err != nil {
+		return change, err
+	}
+	partitionsB, err := change.After.PartitionsArray(store)
+	if err != nil {
+		return change, err
+	}
+	err = diffArrays(partitionsA, partitionsB, func(i uint64, b, a *cbg.Deferred) error {
+		partChange := PartitionChange{Index: i}
+		var err error
+		if partChange.Before, partChange.After, err = decodePartitions(b, a); err != nil {
+			return err
+		}
+		change.Partitions = append(change.Partitions, partChange)
+		return nil
+	})
+	return change, err
+}
+
+// DiffMarketStates computes the differences between the deal proposals, deal states and balance tables
+// of two market states.
+func DiffMarketStates(store adt.Store, before, after *market.State) (*MarketDiff, error) {
+	diff := &MarketDiff{}
+
+	proposalsA, err := adt.AsArray(store, before.Proposals, market.ProposalsAmtBitwidth)
+	if err != nil {
+		return nil, err
+	}
+	proposalsB, err := adt.AsArray(store, after.Proposals, market.ProposalsAmtBitwidth)
+	if err != nil {
+		return nil, err
+	}
+	if err := diffArrays(proposalsA, proposalsB, func(i uint64, b, a *cbg.Deferred) error {
+		change := DealProposalChange{ID: abi.DealID(i)}
+		var err error
+		if change.Before, change.After, err = decodeDealProposals(b, a); err != nil {
+			return err
+		}
+		diff.Proposals = append(diff.Proposals, change)
+		return nil
+	}); err != nil {
+		return nil, xerrors.Errorf("failed to diff proposals: %w", err)
+	}
+
+	statesA, err := adt.AsArray(store, before.States, market.StatesAmtBitwidth)
+	if err != nil {
+		return nil, err
+	}
+	statesB, err := adt.AsArray(store, after.States, market.StatesAmtBitwidth)
+	if err != nil {
+		return nil, err
+	}
+	if err := diffArrays(statesA, statesB, func(i uint64, b, a *cbg.Deferred) error {
+		change := DealStateChange{ID: abi.DealID(i)}
+		var err error
+		if change.Before, change.After, err = decodeDealStates(b, a); err != nil {
+			return err
+		}
+		diff.States = append(diff.States, change)
+		return nil
+	}); err != nil {
+		return nil, xerrors.Errorf("failed to diff deal states: %w", err)
+	}
+
+	if diff.Escrow, err = diffBalanceTables(store, before.EscrowTable, after.EscrowTable); err != nil {
+		return nil, xerrors.Errorf("failed to diff escrow table: %w", err)
+	}
+	if diff.Locked, err = diffBalanceTables(store, before.LockedTable, after.LockedTable); err != nil {
+		return nil, xerrors.Errorf("failed to diff locked table: %w", err)
+	}
+	return diff, nil
+}
+
+func diffBalanceTables(store adt.Store, rootA, rootB cid.Cid) ([]BalanceChange, error) {
+	tableA, err := adt.AsMap(store, rootA, adt.BalanceTableBitwidth)
+	if err != nil {
+		return nil, err
+	}
+	tableB, err := adt.AsMap(store, rootB, adt.BalanceTableBitwidth)
+	if err != nil {
+		return nil, err
+	}
+	var changes []BalanceChange
+	err = diffMaps(tableA, tableB, func(key string, b, a *cbg.Deferred) error {
+		address, err := addr.NewFromBytes([]byte(key))
+		if err != nil {
+			return err
+		}
+		change := BalanceChange{Address: address}
+		if change.Before, change.After, err = decodeAmounts(b, a); err != nil {
+			return err
+		}
+		changes = append(changes, change)
+		return nil
+	})
+	return changes, err
+}
+
+// DiffPowerStates computes the differences between the claims of two power states.
+func DiffPowerStates(store adt.Store, before, after *power.State) (*PowerDiff, error) {
+	claimsA, err := adt.AsMap(store, before.Claims, builtin.DefaultHamtBitwidth)
+	if err != nil {
+		return nil, err
+	}
+	claimsB, err := adt.AsMap(store, after.Claims, builtin.DefaultHamtBitwidth)
+	if err != nil {
+		return nil, err
+	}
+	diff := &PowerDiff{}
+	if err := diffMaps(claimsA, claimsB, func(key string, b, a *cbg.Deferred) error {
+		address, err := addr.NewFromBytes([]byte(key))
+		if err != nil {
+			return err
+		}
+		change := ClaimChange{Address: address}
+		if change.Before, change.After, err = decodeClaims(b, a); err != nil {
+			return err
+		}
+		diff.Claims = append(diff.Claims, change)
+		return nil
+	}); err != nil {
+		return nil, xerrors.Errorf("failed to diff claims: %w", err)
+	}
+	return diff, nil
+}
+
+// DiffVerifRegStates computes the differences between the DataCap of verifiers and verified clients
+// of two verified registry states.
+func DiffVerifRegStates(store adt.Store, before, after *verifreg.State) (*VerifRegDiff, error) {
+	diff := &VerifRegDiff{}
+	var err error
+	if diff.Verifiers, err = diffDataCaps(store, before.Verifiers, after.Verifiers); err != nil {
+		return nil, xerrors.Errorf("failed to diff verifiers: %w", err)
+	}
+	if diff.Clients, err = diffDataCaps(store, before.VerifiedClients, after.VerifiedClients); err != nil {
+		return nil, xerrors.Errorf("failed to diff verified clients: %w", err)
+	}
+	return diff, nil
+}
+
+func diffDataCaps(store adt.Store, rootA, rootB cid.Cid) ([]DataCapChange, error) {
+	capsA, err := adt.AsMap(store, rootA, builtin.DefaultHamtBitwidth)
+	if err != nil {
+		return nil, err
+	}
+	capsB, err := adt.AsMap(store, rootB, builtin.DefaultHamtBitwidth)
+	if err != nil {
+		return nil, err
+	}
+	var changes []DataCapChange
+	err = diffMaps(capsA, capsB, func(key string, b, a *cbg.Deferred) error {
+		address, err := addr.NewFromBytes([]byte(key))
+		if err != nil {
+			return err
+		}
+		change := DataCapChange{Address: address}
+		if change.Before, change.After, err = decodeDataCaps(b, a); err != nil {
+			return err
+		}
+		changes = append(changes, change)
+		return nil
+	})
+	return changes, err
+}
+
+// DiffMultisigStates computes the differences between the pending transactions of two multisig states.
+func DiffMultisigStates(store adt.Store, before, after *multisig.State) (*MultisigDiff, error) {
+	txnsA, err := adt.AsMap(store, before.PendingTxns, builtin.DefaultHamtBitwidth)
+	if err != nil {
+		return nil, err
+	}
+	txnsB, err := adt.AsMap(store, after.PendingTxns, builtin.DefaultHamtBitwidth)
+	if err != nil {
+		return nil, err
+	}
+	diff := &MultisigDiff{}
+	if err := diffMaps(txnsA, txnsB, func(key string, b, a *cbg.Deferred) error {
+		id, err := multisig.ParseTxnIDKey(key)
+		if err != nil {
+			return err
+		}
+		change := TransactionChange{ID: id}
+		if change.Before, change.After, err = decodeTransactions(b, a); err != nil {
+			return err
+		}
+		diff.PendingTxns = append(diff.PendingTxns, change)
+		return nil
+	}); err != nil {
+		return nil, xerrors.Errorf("failed to diff pending transactions: %w", err)
+	}
+	return diff, nil
+}
+
+// Calls a function for each key whose value differs between two maps, with a nil value for an absent entry.
+func diffMaps(a, b *adt.Map, fn func(key string, before, after *cbg.Deferred) error) error {
+	var before, after cbg.Deferred
+	return adt.DiffMaps(a, b, &before, &after, adt.MapDiffFuncs{
+		Add: func(key string) error {
+			return fn(key, nil, &after)
+		},
+		Modify: func(key string) error {
+			return fn(key, &before, &after)
+		},
+		Remove: func(key string) error {
+			return fn(key, &before, nil)
+		},
+	})
+}
+
+// Calls a function for each index whose value differs between two arrays, in ascending order,
+// with a nil value for an absent entry.
+func diffArrays(a, b *adt.Array, fn func(i uint64, before, after *cbg.Deferred) error) error {
+	var before, after cbg.Deferred
+	return adt.DiffArrays(a, b, &before, &after, adt.ArrayDiffFuncs{
+		Add: func(i uint64) error {
+			return fn(i, nil, &after)
+		},
+		Modify: func(i uint64) error {
+			return fn(i, &before, &after)
+		},
+		Remove: func(i uint64) error {
+			return fn(i, &before, nil)
+		},
+	})
+}
+
+// Decodes whichever values of an entry that differs are present, as passed to a diffMaps or diffArrays function.
+func decodeChange(b, a *cbg.Deferred, before, after cbor.Unmarshaler) error {
+	if b != nil {
+		if err := decodeDeferred(b, before); err != nil {
+			return err
+		}
+	}
+	if a != nil {
+		return decodeDeferred(a, after)
+	}
+	return nil
+}
+
+// The following decode the values of an entry that differs, with nil for an absent value.
+
+func decodeActors(b, a *cbg.Deferred) (before, after *Actor, err error) {
+	if b != nil {
+		before = new(Actor)
+	}
+	if a != nil {
+		after = new(Actor)
+	}
+	return before, after, decodeChange(b, a, before, after)
+}
+
+func decodeSectorInfos(b, a *cbg.Deferred) (before, after *miner.SectorOnChainInfo, err error) {
+	if b != nil {
+		before = new(miner.SectorOnChainInfo)
+	}
+	if a != nil {
+		after = new(miner.SectorOnChainInfo)
+	}
+	return before, after, decodeChange(b, a, before, after)
+}
+
+func decodePreCommitInfos(b, a *cbg.Deferred) (before, after *miner.SectorPreCommitOnChainInfo, err error) {
+	if b != nil {
+		before = new(miner.SectorPreCommitOnChainInfo)
+	}
+	if a != nil {
+		after = new(miner.SectorPreCommitOnChainInfo)
+	}
+	return before, after, decodeChange(b, a, before, after)
+}
+
+func decodePartitions(b, a *cbg.Deferred) (before, after *miner.Partition, err error) {
+	if b != nil {
+		before = new(miner.Partition)
+	}
+	if a != nil {
+		after = new(miner.Partition)
+	}
+	return before, after, decodeChange(b, a, before, after)
+}
+
+func decodeDealProposals(b, a *cbg.Deferred) (before, after *market.DealProposal, err error) {
+	if b != nil {
+		before = new(market.DealProposal)
+	}
+	if a != nil {
+		after = new(market.DealProposal)
+	}
+	return before, after, decodeChange(b, a, before, after)
+}
+
+func decodeDealStates(b, a *cbg.Deferred) (before, after *market.DealState, err error) {
+	if b != nil {
+		before = new(market.DealState)
+	}
+	if a != nil {
+		after = new(market.DealState)
+	}
+	return before, after, decodeChange(b, a, before, after)
+}
+
+func decodeClaims(b, a *cbg.Deferred) (before, after *power.Claim, err error) {
+	if b != nil {
+		before = new(power.Claim)
+	}
+	if a != nil {
+		after = new(power.Claim)
+	}
+	return before, after, decodeChange(b, a, before, after)
+}
+
+func decodeDataCaps(b, a *cbg.Deferred) (before, after *verifreg.DataCap, err error) {
+	if b != nil {
+		before = new(verifreg.DataCap)
+	}
+	if a != nil {
+		after = new(verifreg.DataCap)
+	}
+	return before, after, decodeChange(b, a, before, after)
+}
+
+func decodeTransactions(b, a *cbg.Deferred) (before, after *multisig.Transaction, err error) {
+	if b != nil {
+		before = new(multisig.Transaction)
+	}
+	if a != nil {
+		after = new(multisig.Transaction)
+	}
+	return before, after, decodeChange(b, a, before, after)
+}
+
+// Decodes the amounts of a balance table entry that differs, with zero for an absent amount.
+func decodeAmounts(b, a *cbg.Deferred) (abi.TokenAmount, abi.TokenAmount, error) {
+	before, after := big.Zero(), big.Zero()
+	if err := decodeChange(b, a, &before, &after); err != nil {
+		return before, after, err
+	}
+	return before, after, nil
+}
+
+func decodeDeferred(d *cbg.Deferred, out cbor.Unmarshaler) error {
+	return out.UnmarshalCBOR(bytes.NewReader(d.Raw))
+}
@@ -0,0 +1,162 @@
+package states
+
+import (
+	"context"
+
+	addr "github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin"
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/market"
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/miner"
+	"github.com/filecoin-project/specs-actors/v4/actors/util/adt"
+)
+
+// An inclusion proof of an entry in the state tree: the blocks on the path from a state root to the entry,
+// through the state tree HAMT, the actor's head, and any collection in the actor's state holding the entry.
+// A proof is verified against a trusted state root without access to any other store.
+type Proof struct {
+	StateRoot cid.Cid
+	Blocks    []adt.ProofBlock
+}
+
+// Proves the actor with an ID address is present in the state tree.
+func ProveActor(store adt.Store, stateRoot cid.Cid, a addr.Address) (*Proof, error) {
+	return prove(store, stateRoot, func(s adt.Store) error {
+		_, err := lookupActor(s, stateRoot, a)
+		return err
+	})
+}
+
+// Verifies a proof of an actor against a state root, returning the proven actor.
+func VerifyActorProof(proof *Proof, stateRoot cid.Cid, a addr.Address) (*Actor, error) {
+	s, err := proofStore(proof, stateRoot)
+	if err != nil {
+		return nil, err
+	}
+	return lookupActor(s, stateRoot, a)
+}
+
+// Proves the state of a deal is present in the storage market actor's state.
+func ProveDealState(store adt.Store, stateRoot cid.Cid, dealID abi.DealID) (*Proof, error) {
+	return prove(store, stateRoot, func(s adt.Store) error {
+		_, err := lookupDealState(s, stateRoot, dealID)
+		return err
+	})
+}
+
+// Verifies a proof of a deal's state against a state root, returning the proven deal state.
+func VerifyDealStateProof(proof *Proof, stateRoot cid.Cid, dealID abi.DealID) (*market.DealState, error) {
+	s, err := proofStore(proof, stateRoot)
+	if err != nil {
+		return nil, err
+	}
+	return lookupDealState(s, stateRoot, dealID)
+}
+
+// Proves the on-chain information of a sector is present in a miner actor's state.
+func ProveSectorOnChainInfo(store adt.Store, stateRoot cid.Cid, maddr addr.Address, sectorNo abi.SectorNumber) (*Proof, error) {
+	return prove(store, stateRoot, func(s adt.Store) error {
+		_, err := lookupSectorOnChainInfo(s, stateRoot, maddr, sectorNo)
+		return err
+	})
+}
+
+// Verifies a proof of a sector's on-chain information against a state root, returning the proven information.
+func VerifySectorOnChainInfoProof(proof *Proof, stateRoot cid.Cid, maddr addr.Address, sectorNo abi.SectorNumber) (*miner.SectorOnChainInfo, error) {
+	s, err := proofStore(proof, stateRoot)
+	if err != nil {
+		return nil, err
+	}
+	return lookupSectorOnChainInfo(s, stateRoot, maddr, sectorNo)
+}
+
+// Records the blocks loaded by a lookup.
+// The same lookup run by the verifier against the proof's blocks loads exactly these blocks.
+func prove(store adt.Store, stateRoot cid.Cid, lookup func(s adt.Store) error) (*Proof, error) {
+	recorder := adt.NewProofRecorder(store)
+	if err := lookup(recorder); err != nil {
+		return nil, err
+	}
+	return &Proof{
+		StateRoot: stateRoot,
+		Blocks:    recorder.Blocks(),
+	}, nil
+}
+
+func proofStore(proof *Proof, stateRoot cid.Cid) (adt.Store, error) {
+	if !proof.StateRoot.Equals(stateRoot) {
+		return nil, xerrors.Errorf("proof is for state root %v, expected %v", proof.StateRoot, stateRoot)
+	}
+	s, err := adt.NewProofStore(context.Background(), proof.Blocks)
+	if err != nil {
+		return nil, xerrors.Errorf("invalid proof: %w", err)
+	}
+	return s, nil
+}
+
+func lookupActor(store adt.Store, stateRoot cid.Cid, a addr.Address) (*Actor, error) {
+	tree, err := LoadTree(store, stateRoot)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to load state tree %v: %w", stateRoot, err)
+	}
+	actor, found, err := tree.GetActor(a)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to get actor %v: %w", a, err)
+	}
+	if !found {
+		return nil, xerrors.Errorf("actor %v not found", a)
+	}
+	return actor, nil
+}
+
+// Loads the state of the actor at an address, which must have the expected code.
+func lookupActorState(store adt.Store, stateRoot cid.Cid, a addr.Address, code cid.Cid, out interface{}) error {
+	actor, err := lookupActor(store, stateRoot, a)
+	if err != nil {
+		return err
+	}
+	if !actor.Code.Equals(code) {
+		return xerrors.Errorf("actor %v has code %v, expected %v", a, actor.Code, code)
+	}
+	if err := store.Get(store.Context(), actor.Head, out); err != nil {
+		return xerrors.Errorf("failed to load state of actor %v: %w", a, err)
+	}
+	return nil
+}
+
+func lookupDealState(store adt.Store, stateRoot cid.Cid, dealID abi.DealID) (*market.DealState, error) {
+	var st market.State
+	if err := lookupActorState(store, stateRoot, builtin.StorageMarketActorAddr, builtin.StorageMarketActorCodeID, &st); err != nil {
+		return nil, err
+	}
+	states, err := market.AsDealStateArray(store, st.States)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to load deal states: %w", err)
+	}
+	state, found, err := states.Get(dealID)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to get state of deal %d: %w", dealID, err)
+	}
+	if !found {
+		return nil, xerrors.Errorf("state of deal %d not found", dealID)
+	}
+	return state, nil
+}
+
+func lookupSectorOnChainInfo(store adt.Store, stateRoot cid.Cid, maddr addr.Address, sectorNo abi.SectorNumber) (*miner.SectorOnChainInfo, error) {
+	var st miner.State
+	if err := lookupActorState(store, stateRoot, maddr, builtin.StorageMinerActorCodeID, &st); err != nil {
+		return nil, err
+	}
+	info, found, err := st.GetSector(store, sectorNo)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to get sector %d of miner %v: %w", sectorNo, maddr, err)
+	}
+	if !found {
+		return nil, xerrors.Errorf("sector %d of miner %v not found", sectorNo, maddr)
+	}
+	return info, nil
+}
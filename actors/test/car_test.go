@@ -0,0 +1,90 @@
+package test_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin"
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/miner"
+	"github.com/filecoin-project/specs-actors/v4/actors/states"
+	"github.com/filecoin-project/specs-actors/v4/support/ipld"
+	tutil "github.com/filecoin-project/specs-actors/v4/support/testing"
+	vm "github.com/filecoin-project/specs-actors/v4/support/vm"
+)
+
+func TestStateCAR(t *testing.T) {
+	ctx := context.Background()
+	v := vm.NewVMWithSingletons(ctx, t, ipld.NewBlockStoreInMemory())
+	addrs := vm.CreateAccounts(ctx, t, v, 1, big.Mul(big.NewInt(10_000), vm.FIL), 93837778)
+	worker := addrs[0]
+
+	minerAddrs := createMiner(t, v, worker)
+	v, err := v.WithEpoch(200)
+	require.NoError(t, err)
+	v = proveCommitSectors(t, v, worker, minerAddrs, map[abi.SectorNumber]cid.Cid{
+		100: tutil.MakeCID("100", &miner.SealedCIDPrefix),
+	})
+
+	dir, err := ioutil.TempDir("", "state-car")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	path := filepath.Join(dir, "state.car")
+
+	require.NoError(t, v.ExportCAR(path))
+	loaded, err := vm.NewVMFromCAR(ctx, path, v.GetEpoch())
+	require.NoError(t, err)
+	assert.Equal(t, v.StateRoot(), loaded.StateRoot())
+	assert.Equal(t, v.GetEpoch(), loaded.GetEpoch())
+
+	// the loaded state is complete
+	totalBalance, err := loaded.GetTotalActorBalance()
+	require.NoError(t, err)
+	tree, err := loaded.GetStateTree()
+	require.NoError(t, err)
+	acc, err := states.CheckStateInvariants(tree, totalBalance, loaded.GetEpoch())
+	require.NoError(t, err)
+	assert.True(t, acc.IsEmpty(), acc.Messages())
+
+	// and execution continues identically from it
+	changePeer := &miner.ChangePeerIDParams{NewID: abi.PeerID("new peer")}
+	vm.ApplyOk(t, v, worker, minerAddrs.RobustAddress, big.Zero(), builtin.MethodsMiner.ChangePeerID, changePeer)
+	vm.ApplyOk(t, loaded, worker, minerAddrs.RobustAddress, big.Zero(), builtin.MethodsMiner.ChangePeerID, changePeer)
+	assert.Equal(t, v.StateRoot(), loaded.StateRoot())
+
+	t.Run("export is deterministic and includes each block once", func(t *testing.T) {
+		var first, second bytes.Buffer
+		blocks, err := ipld.ExportCAR(&first, v.Store(), v.StateRoot())
+		require.NoError(t, err)
+		_, err = ipld.ExportCAR(&second, v.Store(), v.StateRoot())
+		require.NoError(t, err)
+		assert.Equal(t, first.Bytes(), second.Bytes())
+
+		bs := ipld.NewMetricsBlockStore(ipld.NewBlockStoreInMemory())
+		roots, err := ipld.ImportCAR(bytes.NewReader(first.Bytes()), bs)
+		require.NoError(t, err)
+		assert.Equal(t, []cid.Cid{v.StateRoot()}, roots)
+		assert.Equal(t, blocks, bs.WriteCount())
+	})
+
+	t.Run("import rejects corrupt blocks", func(t *testing.T) {
+		var buf bytes.Buffer
+		_, err := ipld.ExportCAR(&buf, v.Store(), v.StateRoot())
+		require.NoError(t, err)
+		data := buf.Bytes()
+		data[len(data)-1] ^= 0xff
+
+		_, err = ipld.ImportCAR(bytes.NewReader(data), ipld.NewBlockStoreInMemory())
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "hashes to")
+	})
+}
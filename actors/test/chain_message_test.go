@@ -0,0 +1,197 @@
+package test_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/exitcode"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin"
+	init_ "github.com/filecoin-project/specs-actors/v4/actors/builtin/init"
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/multisig"
+	"github.com/filecoin-project/specs-actors/v4/actors/states"
+	"github.com/filecoin-project/specs-actors/v4/support/ipld"
+	vm "github.com/filecoin-project/specs-actors/v4/support/vm"
+)
+
+func TestChainMessageFees(t *testing.T) {
+	ctx := context.Background()
+	v := vm.NewVMWithSingletons(ctx, t, ipld.NewBlockStoreInMemory())
+	initialBalance := big.Mul(big.NewInt(10_000), vm.FIL)
+	addrs := vm.CreateAccounts(ctx, t, v, 2, initialBalance, 93837778)
+	sender, receiver := addrs[0], addrs[1]
+
+	totalBalance, err := v.GetTotalActorBalance()
+	require.NoError(t, err)
+	burnt := actorBalance(t, v, builtin.BurntFundsActorAddr)
+	rewards := actorBalance(t, v, builtin.RewardActorAddr)
+
+	transfer := big.Mul(big.NewInt(10), vm.FIL)
+	msg := chainMessage(sender, 0, receiver, transfer, builtin.MethodSend, nil)
+	receipt := v.ApplyChainMessage(msg)
+	require.Equal(t, exitcode.Ok, receipt.ExitCode)
+	require.Greater(t, receipt.GasUsed, int64(0))
+
+	// fees are divided between burn, tip and refund
+	out := vm.ComputeGasOutputs(receipt.GasUsed, msg.GasLimit, v.GetBaseFee(), msg.GasFeeCap, msg.GasPremium)
+	assert.True(t, out.BaseFeeBurn.GreaterThan(big.Zero()))
+	assert.True(t, out.OverEstimationBurn.GreaterThan(big.Zero()))
+	assert.True(t, out.MinerTip.GreaterThan(big.Zero()))
+	assert.Equal(t, big.Zero(), out.MinerPenalty)
+	assert.Equal(t, big.Mul(msg.GasFeeCap, big.NewInt(msg.GasLimit)), big.Sum(out.BaseFeeBurn, out.OverEstimationBurn, out.MinerTip, out.Refund))
+
+	fees := big.Sum(out.BaseFeeBurn, out.OverEstimationBurn, out.MinerTip)
+	assert.Equal(t, big.Sub(big.Sub(initialBalance, transfer), fees), actorBalance(t, v, sender))
+	assert.Equal(t, big.Add(initialBalance, transfer), actorBalance(t, v, receiver))
+	assert.Equal(t, big.Sum(burnt, out.BaseFeeBurn, out.OverEstimationBurn), actorBalance(t, v, builtin.BurntFundsActorAddr))
+	assert.Equal(t, big.Add(rewards, out.MinerTip), actorBalance(t, v, builtin.RewardActorAddr))
+	assert.Equal(t, uint64(1), callSeqNum(t, v, sender))
+
+	// no funds are created or destroyed, so state invariants hold
+	newTotalBalance, err := v.GetTotalActorBalance()
+	require.NoError(t, err)
+	assert.Equal(t, totalBalance, newTotalBalance)
+
+	// Trigger cron to keep reward accounting correct
+	vm.ApplyOk(t, v, builtin.SystemActorAddr, builtin.CronActorAddr, big.Zero(), builtin.MethodsCron.EpochTick, nil)
+	stateTree, err := v.GetStateTree()
+	require.NoError(t, err)
+	acc, err := states.CheckStateInvariants(stateTree, newTotalBalance, v.GetEpoch())
+	require.NoError(t, err)
+	assert.True(t, acc.IsEmpty(), strings.Join(acc.Messages(), "\n"))
+}
+
+func TestChainMessageValidation(t *testing.T) {
+	ctx := context.Background()
+	v := vm.NewVMWithSingletons(ctx, t, ipld.NewBlockStoreInMemory())
+	initialBalance := big.Mul(big.NewInt(10_000), vm.FIL)
+	addrs := vm.CreateAccounts(ctx, t, v, 2, initialBalance, 93837778)
+	sender, receiver := addrs[0], addrs[1]
+
+	rejected := func(t *testing.T, msg *vm.Message, expected exitcode.ExitCode) {
+		receipt := v.ApplyChainMessage(msg)
+		assert.Equal(t, expected, receipt.ExitCode)
+		assert.Equal(t, int64(0), receipt.GasUsed)
+
+		// the message has no effect on state
+		assert.Equal(t, uint64(0), callSeqNum(t, v, sender))
+		assert.Equal(t, initialBalance, actorBalance(t, v, sender))
+	}
+
+	t.Run("nonce must match call sequence number", func(t *testing.T) {
+		rejected(t, chainMessage(sender, 1, receiver, big.Zero(), builtin.MethodSend, nil), exitcode.SysErrSenderStateInvalid)
+	})
+
+	t.Run("sender must cover gas limit at fee cap", func(t *testing.T) {
+		msg := chainMessage(sender, 0, receiver, big.Zero(), builtin.MethodSend, nil)
+		msg.GasFeeCap = big.Div(initialBalance, big.NewInt(msg.GasLimit-1))
+		rejected(t, msg, exitcode.SysErrSenderStateInvalid)
+	})
+
+	t.Run("gas limit must cover inclusion", func(t *testing.T) {
+		msg := chainMessage(sender, 0, receiver, big.Zero(), builtin.MethodSend, nil)
+		msg.GasLimit = 1
+		rejected(t, msg, exitcode.SysErrOutOfGas)
+	})
+
+	t.Run("sender must exist", func(t *testing.T) {
+		unknown, err := address.NewIDAddress(9999)
+		require.NoError(t, err)
+		receipt := v.ApplyChainMessage(chainMessage(unknown, 0, receiver, big.Zero(), builtin.MethodSend, nil))
+		assert.Equal(t, exitcode.SysErrSenderInvalid, receipt.ExitCode)
+	})
+
+	t.Run("undefined fee cap and premium are zero", func(t *testing.T) {
+		v := vm.NewVMWithSingletons(ctx, t, ipld.NewBlockStoreInMemory())
+		addrs := vm.CreateAccounts(ctx, t, v, 2, initialBalance, 93837778)
+		sender, receiver := addrs[0], addrs[1]
+
+		transfer := big.Mul(big.NewInt(10), vm.FIL)
+		msg := chainMessage(sender, 0, receiver, transfer, builtin.MethodSend, nil)
+		msg.GasFeeCap = big.Int{}
+		msg.GasPremium = big.Int{}
+		receipt := v.ApplyChainMessage(msg)
+		require.Equal(t, exitcode.Ok, receipt.ExitCode)
+
+		// the sender pays no fees
+		assert.Equal(t, big.Sub(initialBalance, transfer), actorBalance(t, v, sender))
+		assert.Equal(t, uint64(1), callSeqNum(t, v, sender))
+		assert.True(t, msg.GasFeeCap.Nil())
+	})
+
+	t.Run("failed message increments nonce and pays fees", func(t *testing.T) {
+		msg := chainMessage(sender, 0, receiver, big.Mul(initialBalance, big.NewInt(2)), builtin.MethodSend, nil)
+		receipt := v.ApplyChainMessage(msg)
+		assert.Equal(t, exitcode.SysErrInsufficientFunds, receipt.ExitCode)
+
+		out := vm.ComputeGasOutputs(receipt.GasUsed, msg.GasLimit, v.GetBaseFee(), msg.GasFeeCap, msg.GasPremium)
+		fees := big.Sum(out.BaseFeeBurn, out.OverEstimationBurn, out.MinerTip)
+		assert.Equal(t, uint64(1), callSeqNum(t, v, sender))
+		assert.Equal(t, big.Sub(initialBalance, fees), actorBalance(t, v, sender))
+		assert.Equal(t, initialBalance, actorBalance(t, v, receiver))
+	})
+}
+
+func TestChainMessageActorAddress(t *testing.T) {
+	ctx := context.Background()
+	v := vm.NewVMWithSingletons(ctx, t, ipld.NewBlockStoreInMemory())
+	initialBalance := big.Mul(big.NewInt(10_000), vm.FIL)
+	addrs := vm.CreateAccounts(ctx, t, v, 2, initialBalance, 93837778)
+	sender := addrs[0]
+
+	receipt := v.ApplyChainMessage(chainMessage(sender, 0, addrs[1], big.Zero(), builtin.MethodSend, nil))
+	require.Equal(t, exitcode.Ok, receipt.ExitCode)
+
+	var ctorParams bytes.Buffer
+	require.NoError(t, (&multisig.ConstructorParams{Signers: addrs, NumApprovalsThreshold: 1}).MarshalCBOR(&ctorParams))
+	execParams := init_.ExecParams{CodeCID: builtin.MultisigActorCodeID, ConstructorParams: ctorParams.Bytes()}
+	receipt = v.ApplyChainMessage(chainMessage(sender, 1, builtin.InitActorAddr, big.Zero(), builtin.MethodsInit.Exec, &execParams))
+	require.Equal(t, exitcode.Ok, receipt.ExitCode)
+	var execRet init_.ExecReturn
+	require.NoError(t, execRet.UnmarshalCBOR(bytes.NewReader(receipt.Return)))
+
+	// the address is derived from the sender, the message nonce and the number of actors created so far
+	var seed bytes.Buffer
+	require.NoError(t, sender.MarshalCBOR(&seed))
+	require.NoError(t, binary.Write(&seed, binary.BigEndian, uint64(1)))
+	require.NoError(t, binary.Write(&seed, binary.BigEndian, uint64(0)))
+	expected, err := address.NewActorAddress(seed.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, expected, execRet.RobustAddress)
+}
+
+func TestChainMessageBaseFeeAboveFeeCap(t *testing.T) {
+	out := vm.ComputeGasOutputs(1000, 2000, abi.NewTokenAmount(300), abi.NewTokenAmount(200), abi.NewTokenAmount(50))
+
+	// the sender pays no more than the fee cap, with the miner penalised for the difference
+	assert.Equal(t, abi.NewTokenAmount(200*1000), out.BaseFeeBurn)
+	assert.Equal(t, big.Zero(), out.MinerTip)
+	assert.Equal(t, abi.NewTokenAmount(200*out.GasBurned), out.OverEstimationBurn)
+	assert.Equal(t, abi.NewTokenAmount(100*(1000+out.GasBurned)), out.MinerPenalty)
+	assert.Equal(t, abi.NewTokenAmount(200*out.GasRefund), out.Refund)
+	assert.Equal(t, int64(1000), out.GasRefund+out.GasBurned)
+}
+
+func actorBalance(t *testing.T, v *vm.VM, a address.Address) abi.TokenAmount {
+	act, found, err := v.GetActor(a)
+	require.NoError(t, err)
+	require.True(t, found)
+	return act.Balance
+}
+
+func callSeqNum(t *testing.T, v *vm.VM, a address.Address) uint64 {
+	idAddr, found := v.NormalizeAddress(a)
+	require.True(t, found)
+	act, found, err := v.GetActor(idAddr)
+	require.NoError(t, err)
+	require.True(t, found)
+	return act.CallSeqNum
+}
@@ -0,0 +1,89 @@
+package test_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin"
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/miner"
+	"github.com/filecoin-project/specs-actors/v4/actors/states"
+	"github.com/filecoin-project/specs-actors/v4/support/ipld"
+	tutil "github.com/filecoin-project/specs-actors/v4/support/testing"
+	vm "github.com/filecoin-project/specs-actors/v4/support/vm"
+)
+
+func TestIncrementalInvariantCheck(t *testing.T) {
+	ctx := context.Background()
+	v := vm.NewVMWithSingletons(ctx, t, ipld.NewBlockStoreInMemory())
+	addrs := vm.CreateAccounts(ctx, t, v, 2, big.Mul(big.NewInt(10_000), vm.FIL), 93837778)
+	worker := addrs[0]
+
+	minerAddrs := createMiner(t, v, worker)
+	v, err := v.WithEpoch(200)
+	require.NoError(t, err)
+	v = proveCommitSectors(t, v, worker, minerAddrs, map[abi.SectorNumber]cid.Cid{
+		100: tutil.MakeCID("100", &miner.SealedCIDPrefix),
+	})
+
+	checker := states.NewIncrementalChecker(v.Store())
+
+	// Checks the VM's current state both incrementally and in full, expecting the same messages.
+	check := func(t *testing.T, v *vm.VM, priorEpoch abi.ChainEpoch) []string {
+		root := flushedRoot(t, v)
+		totalBalance, err := v.GetTotalActorBalance()
+		require.NoError(t, err)
+		tree, err := states.LoadTree(v.Store(), root)
+		require.NoError(t, err)
+
+		full, err := states.CheckStateInvariants(tree, totalBalance, priorEpoch)
+		require.NoError(t, err)
+		incremental, err := checker.Check(root, totalBalance, priorEpoch)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, full.Messages(), incremental.Messages())
+		return incremental.Messages()
+	}
+
+	actorCount := 0
+	tree, err := v.GetStateTree()
+	require.NoError(t, err)
+	require.NoError(t, tree.ForEachKey(func(_ address.Address) error {
+		actorCount++
+		return nil
+	}))
+
+	assert.Empty(t, check(t, v, v.GetEpoch()))
+	assert.Equal(t, actorCount, checker.LastCheckedCount())
+
+	// Re-checking the same state checks nothing.
+	assert.Empty(t, check(t, v, v.GetEpoch()))
+	assert.Equal(t, 0, checker.LastCheckedCount())
+
+	// Only the miner's state changes.
+	vm.ApplyOk(t, v, worker, minerAddrs.RobustAddress, big.Zero(), builtin.MethodsMiner.ChangePeerID,
+		&miner.ChangePeerIDParams{NewID: abi.PeerID("new peer")})
+	assert.Empty(t, check(t, v, v.GetEpoch()))
+	assert.Equal(t, 1, checker.LastCheckedCount())
+
+	// A violation found in a re-checked actor is reported, and resolved when re-checked again.
+	messages := check(t, v, v.GetEpoch()-1)
+	require.Len(t, messages, 1)
+	assert.Contains(t, messages[0], "reward state epoch")
+	assert.Empty(t, check(t, v, v.GetEpoch()))
+
+	// Advancing epochs runs cron, changing many but not all actors.
+	v, _ = vm.AdvanceByDeadlineTillEpoch(t, v, minerAddrs.IDAddress, v.GetEpoch()+200)
+	assert.Empty(t, check(t, v, v.GetEpoch()))
+	assert.Less(t, checker.LastCheckedCount(), actorCount)
+
+	// After a reset, everything is checked again.
+	checker.Reset()
+	assert.Empty(t, check(t, v, v.GetEpoch()))
+	assert.Equal(t, actorCount, checker.LastCheckedCount())
+}
@@ -0,0 +1,116 @@
+package test_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin"
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/miner"
+	"github.com/filecoin-project/specs-actors/v4/actors/states"
+	"github.com/filecoin-project/specs-actors/v4/support/ipld"
+	tutil "github.com/filecoin-project/specs-actors/v4/support/testing"
+	vm "github.com/filecoin-project/specs-actors/v4/support/vm"
+)
+
+func TestCheckStateInvariantsParallel(t *testing.T) {
+	ctx := context.Background()
+	v := vm.NewVMWithSingletons(ctx, t, ipld.NewBlockStoreInMemory())
+	addrs := vm.CreateAccounts(ctx, t, v, 2, big.Mul(big.NewInt(10_000), vm.FIL), 93837778)
+	worker := addrs[0]
+
+	minerAddrs := createMiner(t, v, worker)
+	v, err := v.WithEpoch(200)
+	require.NoError(t, err)
+	v = proveCommitSectors(t, v, worker, minerAddrs, map[abi.SectorNumber]cid.Cid{
+		100: tutil.MakeCID("100", &miner.SealedCIDPrefix),
+	})
+	createMultisig(t, v, addrs, 1)
+
+	totalBalance, err := v.GetTotalActorBalance()
+	require.NoError(t, err)
+	tree, err := v.GetStateTree()
+	require.NoError(t, err)
+
+	t.Run("valid state has no violations", func(t *testing.T) {
+		for _, workers := range []uint{0, 1, 4} {
+			report, err := states.CheckStateInvariantsParallel(ctx, tree, totalBalance, v.GetEpoch(), states.CheckConfig{MaxWorkers: workers})
+			require.NoError(t, err)
+			assert.Empty(t, report.Violations)
+			assert.True(t, report.OK())
+			assert.Greater(t, report.ActorCount, 10)
+		}
+	})
+
+	// A wrong prior epoch violates the reward actor's invariants, and a wrong balance total violates the tree's.
+	wrongEpoch := v.GetEpoch() - 1
+	wrongBalance := big.Add(totalBalance, big.NewInt(1))
+	sequential, err := states.CheckStateInvariants(tree, wrongBalance, wrongEpoch)
+	require.NoError(t, err)
+	require.False(t, sequential.IsEmpty())
+
+	t.Run("violations match sequential check", func(t *testing.T) {
+		var streamed []*states.Violation
+		report, err := states.CheckStateInvariantsParallel(ctx, tree, wrongBalance, wrongEpoch, states.CheckConfig{
+			MaxWorkers:   4,
+			JobQueueSize: 8,
+			OnViolation: func(v *states.Violation) {
+				streamed = append(streamed, v)
+			},
+		})
+		require.NoError(t, err)
+		assert.False(t, report.OK())
+		assert.ElementsMatch(t, report.Violations, streamed)
+
+		var messages []string
+		for _, violation := range report.Violations {
+			if violation.Address.Empty() {
+				messages = append(messages, violation.Message)
+			} else {
+				messages = append(messages, fmt.Sprintf("%v %s: %s", violation.Address, violation.ActorType, violation.Message))
+			}
+		}
+		assert.Equal(t, sequential.Messages(), messages)
+
+		reward := report.Violations[0]
+		assert.Equal(t, builtin.RewardActorAddr, reward.Address)
+		assert.Equal(t, "reward", reward.ActorType)
+		assert.Equal(t, "reward: reward state epoch %d does not match priorEpoch+1 %d", reward.InvariantID)
+		last := report.Violations[len(report.Violations)-1]
+		assert.Equal(t, states.InvariantTotalBalance, last.InvariantID)
+
+		var buf bytes.Buffer
+		require.NoError(t, report.WriteJSON(&buf))
+		decoded, err := states.ReadCheckReport(&buf)
+		require.NoError(t, err)
+		assert.Equal(t, report, decoded)
+	})
+
+	t.Run("allow list", func(t *testing.T) {
+		allowList, err := states.ReadAllowList(strings.NewReader(fmt.Sprintf(`{"Rules": [
+			{"InvariantID": %q, "Reason": "balance is deliberately wrong"},
+			{"ActorType": "reward", "Address": %q, "MessageContains": "priorEpoch+1"}
+		]}`, states.InvariantTotalBalance, builtin.RewardActorAddr)))
+		require.NoError(t, err)
+
+		report, err := states.CheckStateInvariantsParallel(ctx, tree, wrongBalance, wrongEpoch, states.CheckConfig{
+			MaxWorkers: 2,
+			AllowList:  allowList,
+		})
+		require.NoError(t, err)
+		assert.Len(t, report.Violations, len(sequential.Messages()))
+		for _, violation := range report.Violations {
+			assert.True(t, violation.Allowed, violation.Message)
+		}
+		assert.True(t, report.OK())
+		assert.Empty(t, report.Failures())
+	})
+}
@@ -217,7 +217,7 @@ func TestCommitPoStFlow(t *testing.T) {
 				PoStProof: abi.RegisteredPoStProof_StackedDrgWindow32GiBV1,
 			}},
 			ChainCommitEpoch: dlInfo.Challenge,
-			ChainCommitRand:  []byte("not really random"),
+			ChainCommitRand:  vm.PoStChainCommitRand(t, tv, dlInfo.Challenge),
 		}
 		vm.ApplyOk(t, tv, addrs[0], minerAddrs.RobustAddress, big.Zero(), builtin.MethodsMiner.SubmitWindowedPoSt, &submitParams)
 
@@ -277,10 +277,10 @@ func TestCommitPoStFlow(t *testing.T) {
 				PoStProof: abi.RegisteredPoStProof_StackedDrgWindow32GiBV1,
 			}},
 			ChainCommitEpoch: dlInfo.Challenge,
-			ChainCommitRand:  []byte("not really random"),
+			ChainCommitRand:  vm.PoStChainCommitRand(t, tv, dlInfo.Challenge),
 		}
 		// PoSt is rejected for skipping all sectors.
-		_, code := tv.ApplyMessage(addrs[0], minerAddrs.RobustAddress, big.Zero(), builtin.MethodsMiner.SubmitWindowedPoSt, &submitParams)
+		_, code, _ := tv.ApplyMessage(addrs[0], minerAddrs.RobustAddress, big.Zero(), builtin.MethodsMiner.SubmitWindowedPoSt, &submitParams)
 		assert.Equal(t, exitcode.ErrIllegalArgument, code)
 
 		vm.ExpectInvocation{
@@ -1,6 +1,7 @@
 package test_test
 
 import (
+	"sort"
 	"testing"
 
 	addr "github.com/filecoin-project/go-address"
@@ -8,10 +9,13 @@ import (
 	"github.com/filecoin-project/go-state-types/big"
 	"github.com/filecoin-project/go-state-types/crypto"
 	"github.com/filecoin-project/go-state-types/exitcode"
+	"github.com/ipfs/go-cid"
 	"github.com/stretchr/testify/require"
 
 	"github.com/filecoin-project/specs-actors/v4/actors/builtin"
 	"github.com/filecoin-project/specs-actors/v4/actors/builtin/market"
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/miner"
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/power"
 	tutil "github.com/filecoin-project/specs-actors/v4/support/testing"
 	vm "github.com/filecoin-project/specs-actors/v4/support/vm"
 )
@@ -39,7 +43,7 @@ func publishDeal(t *testing.T, v *vm.VM, provider, dealClient, minerID addr.Addr
 			ClientSignature: crypto.Signature{},
 		}},
 	}
-	ret, code := v.ApplyMessage(provider, builtin.StorageMarketActorAddr, big.Zero(), builtin.MethodsMarket.PublishStorageDeals, &publishDealParams)
+	ret, code, _ := v.ApplyMessage(provider, builtin.StorageMarketActorAddr, big.Zero(), builtin.MethodsMarket.PublishStorageDeals, &publishDealParams)
 	require.Equal(t, exitcode.Ok, code)
 
 	expectedPublishSubinvocations := []vm.ExpectInvocation{
@@ -64,3 +68,63 @@ func publishDeal(t *testing.T, v *vm.VM, provider, dealClient, minerID addr.Addr
 
 	return ret.(*market.PublishStorageDealsReturn)
 }
+
+func createMiner(t *testing.T, v *vm.VM, worker addr.Address) *power.CreateMinerReturn {
+	params := power.CreateMinerParams{
+		Owner:               worker,
+		Worker:              worker,
+		WindowPoStProofType: abi.RegisteredPoStProof_StackedDrgWindow32GiBV1,
+		Peer:                abi.PeerID("not really a peer id"),
+	}
+	ret := vm.ApplyOk(t, v, worker, builtin.StoragePowerActorAddr, big.Mul(big.NewInt(1_000), vm.FIL), builtin.MethodsPower.CreateMiner, &params)
+	minerAddrs, ok := ret.(*power.CreateMinerReturn)
+	require.True(t, ok)
+	return minerAddrs
+}
+
+// Pre-commits and prove-commits CC sectors, returning a VM after the cron that confirms the proofs.
+func proveCommitSectors(t *testing.T, v *vm.VM, worker addr.Address, minerAddrs *power.CreateMinerReturn, sealedCIDs map[abi.SectorNumber]cid.Cid) *vm.VM {
+	sealProof := abi.RegisteredSealProof_StackedDrg32GiBV1_1
+	var sectorNumbers []abi.SectorNumber
+	for sectorNumber := range sealedCIDs { //nolint:nomaprange
+		sectorNumbers = append(sectorNumbers, sectorNumber)
+	}
+	sort.Slice(sectorNumbers, func(i, j int) bool { return sectorNumbers[i] < sectorNumbers[j] })
+
+	for _, sectorNumber := range sectorNumbers {
+		preCommitParams := miner.PreCommitSectorParams{
+			SealProof:     sealProof,
+			SectorNumber:  sectorNumber,
+			SealedCID:     sealedCIDs[sectorNumber],
+			SealRandEpoch: v.GetEpoch() - 1,
+			Expiration:    v.GetEpoch() + miner.MinSectorExpiration + miner.MaxProveCommitDuration[sealProof] + 100,
+		}
+		vm.ApplyOk(t, v, worker, minerAddrs.RobustAddress, big.Zero(), builtin.MethodsMiner.PreCommitSector, &preCommitParams)
+	}
+
+	proveTime := v.GetEpoch() + miner.PreCommitChallengeDelay + 1
+	v, _ = vm.AdvanceByDeadlineTillEpoch(t, v, minerAddrs.IDAddress, proveTime)
+	v, err := v.WithEpoch(proveTime)
+	require.NoError(t, err)
+
+	for _, sectorNumber := range sectorNumbers {
+		proveCommitParams := miner.ProveCommitSectorParams{SectorNumber: sectorNumber}
+		vm.ApplyOk(t, v, worker, minerAddrs.RobustAddress, big.Zero(), builtin.MethodsMiner.ProveCommitSector, &proveCommitParams)
+	}
+	vm.ApplyOk(t, v, builtin.SystemActorAddr, builtin.CronActorAddr, big.Zero(), builtin.MethodsCron.EpochTick, nil)
+	return v
+}
+
+func chainMessage(from addr.Address, nonce uint64, to addr.Address, value abi.TokenAmount, method abi.MethodNum, params interface{}) *vm.Message {
+	return &vm.Message{
+		From:       from,
+		To:         to,
+		Nonce:      nonce,
+		Value:      value,
+		Method:     method,
+		Params:     params,
+		GasLimit:   vm.DefaultGasLimit / 100,
+		GasFeeCap:  abi.NewTokenAmount(1_000),
+		GasPremium: abi.NewTokenAmount(100),
+	}
+}
@@ -19,8 +19,6 @@ import (
 	vm "github.com/filecoin-project/specs-actors/v4/support/vm"
 )
 
-var fakeChainRandomness = []byte("not really random")
-
 func TestCronCatchedCCExpirationsAtDeadlineBoundary(t *testing.T) {
 	ctx := context.Background()
 	v := vm.NewVMWithSingletons(ctx, t, ipld.NewBlockStoreInMemory())
@@ -83,7 +81,7 @@ func TestCronCatchedCCExpirationsAtDeadlineBoundary(t *testing.T) {
 			PoStProof: abi.RegisteredPoStProof_StackedDrgWindow32GiBV1,
 		}},
 		ChainCommitEpoch: dlInfo.Challenge,
-		ChainCommitRand:  fakeChainRandomness,
+		ChainCommitRand:  vm.PoStChainCommitRand(t, v, dlInfo.Challenge),
 	}
 
 	vm.ApplyOk(t, v, addrs[0], minerAddrs.RobustAddress, big.Zero(), builtin.MethodsMiner.SubmitWindowedPoSt, &submitParams)
@@ -125,6 +123,7 @@ func TestCronCatchedCCExpirationsAtDeadlineBoundary(t *testing.T) {
 
 	// prove original sector so it won't be faulted
 	submitParams.ChainCommitEpoch = dlInfo.Challenge
+	submitParams.ChainCommitRand = vm.PoStChainCommitRand(t, v, dlInfo.Challenge)
 	vm.ApplyOk(t, v, addrs[0], minerAddrs.RobustAddress, big.Zero(), builtin.MethodsMiner.SubmitWindowedPoSt, &submitParams)
 
 	// one epoch before deadline close (i.e. Last) is where we might see a problem with cron scheduling of expirations
@@ -0,0 +1,104 @@
+package test_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/filecoin-project/go-bitfield"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin"
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/miner"
+	"github.com/filecoin-project/specs-actors/v4/actors/runtime/proof"
+	"github.com/filecoin-project/specs-actors/v4/support/ipld"
+	tutil "github.com/filecoin-project/specs-actors/v4/support/testing"
+	vm "github.com/filecoin-project/specs-actors/v4/support/vm"
+)
+
+func TestRejectedSealIsNotConfirmed(t *testing.T) {
+	ctx := context.Background()
+	injector := vm.NewFaultInjector(nil)
+	v := vm.NewVMWithSingletons(ctx, t, ipld.NewBlockStoreInMemory(), vm.WithSyscalls(injector.Syscalls))
+	addrs := vm.CreateAccounts(ctx, t, v, 1, big.Mul(big.NewInt(10_000), vm.FIL), 93837778)
+	worker := addrs[0]
+
+	minerAddrs := createMiner(t, v, worker)
+	goodCid := tutil.MakeCID("100", &miner.SealedCIDPrefix)
+	badCid := tutil.MakeCID("101", &miner.SealedCIDPrefix)
+	injector.RejectSealedCIDs(func(c cid.Cid) bool { return c.Equals(badCid) })
+
+	v, err := v.WithEpoch(200)
+	require.NoError(t, err)
+	v = proveCommitSectors(t, v, worker, minerAddrs, map[abi.SectorNumber]cid.Cid{100: goodCid, 101: badCid})
+
+	// both seals were verified in the batch, and only the bad one was rejected
+	require.Len(t, injector.SealVerifications, 2)
+	for _, verification := range injector.SealVerifications {
+		assert.Equal(t, minerAddrs.IDAddress, verification.Miner)
+		assert.Equal(t, verification.Info.SealedCID.Equals(badCid), verification.Rejected)
+	}
+
+	var minerState miner.State
+	require.NoError(t, v.GetState(minerAddrs.IDAddress, &minerState))
+	hasGood, err := minerState.HasSectorNo(v.Store(), 100)
+	require.NoError(t, err)
+	assert.True(t, hasGood)
+	_, found, err := minerState.GetSector(v.Store(), 101)
+	require.NoError(t, err)
+	assert.False(t, found)
+}
+
+func TestDisputeWindowedPoStWithInjectedFault(t *testing.T) {
+	ctx := context.Background()
+	injector := vm.NewFaultInjector(nil)
+	v := vm.NewVMWithSingletons(ctx, t, ipld.NewBlockStoreInMemory(), vm.WithSyscalls(injector.Syscalls))
+	addrs := vm.CreateAccounts(ctx, t, v, 2, big.Mul(big.NewInt(10_000), vm.FIL), 93837778)
+	worker, challenger := addrs[0], addrs[1]
+
+	minerAddrs := createMiner(t, v, worker)
+	sectorNumber := abi.SectorNumber(100)
+	v, err := v.WithEpoch(200)
+	require.NoError(t, err)
+	v = proveCommitSectors(t, v, worker, minerAddrs, map[abi.SectorNumber]cid.Cid{
+		sectorNumber: tutil.MakeCID("100", &miner.SealedCIDPrefix),
+	})
+
+	// the PoSt is accepted optimistically, without verification
+	dlInfo, pIdx, v := vm.AdvanceTillProvingDeadline(t, v, minerAddrs.IDAddress, sectorNumber)
+	injector.FailPoSt(minerAddrs.IDAddress, dlInfo.Index)
+	submitParams := miner.SubmitWindowedPoStParams{
+		Deadline:   dlInfo.Index,
+		Partitions: []miner.PoStPartition{{Index: pIdx, Skipped: bitfield.New()}},
+		Proofs: []proof.PoStProof{{
+			PoStProof: abi.RegisteredPoStProof_StackedDrgWindow32GiBV1,
+		}},
+		ChainCommitEpoch: dlInfo.Challenge,
+		ChainCommitRand:  vm.PoStChainCommitRand(t, v, dlInfo.Challenge),
+	}
+	vm.ApplyOk(t, v, worker, minerAddrs.RobustAddress, big.Zero(), builtin.MethodsMiner.SubmitWindowedPoSt, &submitParams)
+	assert.Empty(t, injector.PoStVerifications)
+
+	sectorPower := vm.PowerForMinerSector(t, v, minerAddrs.IDAddress, sectorNumber)
+	assert.Equal(t, sectorPower, vm.MinerPower(t, v, minerAddrs.IDAddress))
+
+	// move into the dispute window
+	v, _ = vm.AdvanceByDeadlineTillIndex(t, v, minerAddrs.IDAddress, (dlInfo.Index+1)%miner.WPoStPeriodDeadlines)
+	v, err = v.WithEpoch(dlInfo.Close)
+	require.NoError(t, err)
+
+	disputeParams := miner.DisputeWindowedPoStParams{Deadline: dlInfo.Index, PoStIndex: 0}
+	vm.ApplyOk(t, v, challenger, minerAddrs.RobustAddress, big.Zero(), builtin.MethodsMiner.DisputeWindowedPoSt, &disputeParams)
+
+	require.Len(t, injector.PoStVerifications, 1)
+	verification := injector.PoStVerifications[0]
+	assert.True(t, verification.Failed)
+	assert.Equal(t, minerAddrs.IDAddress, verification.Miner)
+	assert.Equal(t, dlInfo.Index, verification.Deadline)
+
+	// the disputed sector is now faulty and its power has been removed
+	assert.Equal(t, miner.NewPowerPairZero(), vm.MinerPower(t, v, minerAddrs.IDAddress))
+}
@@ -0,0 +1,108 @@
+package test_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/exitcode"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	cbg "github.com/whyrusleeping/cbor-gen"
+
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin"
+	"github.com/filecoin-project/specs-actors/v4/support/ipld"
+	vm "github.com/filecoin-project/specs-actors/v4/support/vm"
+)
+
+func TestGasAccounting(t *testing.T) {
+	ctx := context.Background()
+	initialBalance := big.Mul(big.NewInt(6), vm.FIL)
+	collateral := big.Mul(big.NewInt(3), vm.FIL)
+
+	t.Run("gas used is reported per message", func(t *testing.T) {
+		v := vm.NewVMWithSingletons(ctx, t, ipld.NewBlockStoreInMemory())
+		addrs := vm.CreateAccounts(ctx, t, v, 1, initialBalance, 93837778)
+		caller := addrs[0]
+
+		_, code, first := v.ApplyMessage(caller, builtin.StorageMarketActorAddr, collateral, builtin.MethodsMarket.AddBalance, &caller)
+		require.Equal(t, exitcode.Ok, code)
+		assert.Greater(t, first, int64(0))
+		assert.Equal(t, first, v.LastInvocation().GasUsed)
+
+		// sub-invocations account for part of the top-level gas
+		for _, sub := range v.LastInvocation().SubInvocations {
+			assert.Less(t, sub.GasUsed, first)
+		}
+
+		_, code, second := v.ApplyMessage(caller, builtin.StorageMarketActorAddr, collateral, builtin.MethodsMarket.AddBalance, &caller)
+		require.Equal(t, exitcode.Ok, code)
+		assert.Greater(t, second, int64(0))
+		assert.Equal(t, second, v.LastInvocation().GasUsed)
+	})
+
+	t.Run("zero price list charges nothing", func(t *testing.T) {
+		v := vm.NewVMWithSingletons(ctx, t, ipld.NewBlockStoreInMemory())
+		v.SetPriceList(&vm.GasPrices{})
+		addrs := vm.CreateAccounts(ctx, t, v, 1, initialBalance, 93837778)
+		caller := addrs[0]
+
+		vm.ApplyOk(t, v, caller, builtin.StorageMarketActorAddr, collateral, builtin.MethodsMarket.AddBalance, &caller)
+		assert.Equal(t, int64(0), v.LastInvocation().GasUsed)
+	})
+
+	t.Run("puts are charged by stored size", func(t *testing.T) {
+		v := vm.NewVMWithSingletons(ctx, t, ipld.NewBlockStoreInMemory())
+		v.SetPriceList(&vm.GasPrices{StorageGasMulti: 1, IpldPutPerByte: 1})
+		addrs := vm.CreateAccounts(ctx, t, v, 1, initialBalance, 93837778)
+		caller := addrs[0]
+
+		_, code, gasUsed := v.ApplyMessage(caller, builtin.StorageMarketActorAddr, collateral, builtin.MethodsMarket.AddBalance, &caller)
+		require.Equal(t, exitcode.Ok, code)
+
+		var writtenBytes func(inv *vm.Invocation) int64
+		writtenBytes = func(inv *vm.Invocation) int64 {
+			total := int64(0)
+			for _, c := range inv.Writes {
+				var blk cbg.Deferred
+				require.NoError(t, v.Store().Get(ctx, c, &blk))
+				total += int64(len(blk.Raw))
+			}
+			for _, sub := range inv.SubInvocations {
+				total += writtenBytes(sub)
+			}
+			return total
+		}
+		assert.Greater(t, gasUsed, int64(0))
+		assert.Equal(t, writtenBytes(v.LastInvocation()), gasUsed)
+	})
+
+	t.Run("out of gas rolls back message", func(t *testing.T) {
+		v := vm.NewVMWithSingletons(ctx, t, ipld.NewBlockStoreInMemory())
+		addrs := vm.CreateAccounts(ctx, t, v, 1, initialBalance, 93837778)
+		caller := addrs[0]
+
+		vm.ApplyOk(t, v, caller, builtin.StorageMarketActorAddr, collateral, builtin.MethodsMarket.AddBalance, &caller)
+		gasUsed := v.LastInvocation().GasUsed
+		rootBefore := v.StateRoot()
+
+		v.SetGasLimit(gasUsed - 1)
+		_, code, _ := v.ApplyMessage(caller, builtin.StorageMarketActorAddr, collateral, builtin.MethodsMarket.AddBalance, &caller)
+		assert.Equal(t, exitcode.SysErrOutOfGas, code)
+		assert.Equal(t, gasUsed-1, v.LastInvocation().GasUsed)
+		assert.Equal(t, rootBefore, v.StateRoot())
+
+		a, found, err := v.GetActor(caller)
+		require.NoError(t, err)
+		require.True(t, found)
+		assert.Equal(t, big.Sub(initialBalance, collateral), a.Balance)
+
+		// the gas limit is retained as the epoch advances
+		v, err = v.WithEpoch(v.GetEpoch() + 1)
+		require.NoError(t, err)
+		assert.Equal(t, gasUsed-1, v.GetGasLimit())
+
+		// the system actor is not bound by the limit
+		vm.ApplyOk(t, v, builtin.SystemActorAddr, builtin.CronActorAddr, big.Zero(), builtin.MethodsCron.EpochTick, nil)
+	})
+}
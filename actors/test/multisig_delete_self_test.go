@@ -64,7 +64,7 @@ func TestMultisigDeleteSelf2Of3RemovedIsProposer(t *testing.T) {
 	vm.ApplyOk(t, v, addrs[1], multisigAddr, big.Zero(), builtin.MethodsMultisig.Approve, &approveRemoveSignerParams)
 
 	// txnid not found when third approval gets processed indicating that the transaction has gone through successfully
-	_, code := v.ApplyMessage(addrs[2], multisigAddr, big.Zero(), builtin.MethodsMultisig.Approve, &approveRemoveSignerParams)
+	_, code, _ := v.ApplyMessage(addrs[2], multisigAddr, big.Zero(), builtin.MethodsMultisig.Approve, &approveRemoveSignerParams)
 	assert.Equal(t, exitcode.ErrNotFound, code)
 
 }
@@ -115,7 +115,7 @@ func TestMultisigDeleteSelf2Of3RemovedIsApprover(t *testing.T) {
 	vm.ApplyOk(t, v, addrs[0], multisigAddr, big.Zero(), builtin.MethodsMultisig.Approve, &approveRemoveSignerParams)
 
 	// txnid not found when third approval gets processed indicating that the transaction has gone through successfully
-	_, code := v.ApplyMessage(addrs[2], multisigAddr, big.Zero(), builtin.MethodsMultisig.Approve, &approveRemoveSignerParams)
+	_, code, _ := v.ApplyMessage(addrs[2], multisigAddr, big.Zero(), builtin.MethodsMultisig.Approve, &approveRemoveSignerParams)
 	assert.Equal(t, exitcode.ErrNotFound, code)
 
 }
@@ -165,7 +165,7 @@ func TestMultisigDeleteSelf2Of2(t *testing.T) {
 	vm.ApplyOk(t, v, addrs[1], multisigAddr, big.Zero(), builtin.MethodsMultisig.Approve, &approveRemoveSignerParams)
 
 	// txnid not found when another approval gets processed indicating that the transaction has gone through successfully
-	_, code := v.ApplyMessage(addrs[1], multisigAddr, big.Zero(), builtin.MethodsMultisig.Approve, &approveRemoveSignerParams)
+	_, code, _ := v.ApplyMessage(addrs[1], multisigAddr, big.Zero(), builtin.MethodsMultisig.Approve, &approveRemoveSignerParams)
 	assert.Equal(t, exitcode.ErrNotFound, code)
 }
 
@@ -0,0 +1,124 @@
+package test_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/crypto"
+	"github.com/filecoin-project/go-state-types/exitcode"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin"
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/miner"
+	"github.com/filecoin-project/specs-actors/v4/support/ipld"
+	tutil "github.com/filecoin-project/specs-actors/v4/support/testing"
+	vm "github.com/filecoin-project/specs-actors/v4/support/vm"
+)
+
+func TestDeterministicRandomness(t *testing.T) {
+	tag := crypto.DomainSeparationTag_WindowedPoStChallengeSeed
+	r := vm.NewDeterministicRandomness([]byte("seed"))
+
+	draw := func(src vm.RandomnessSource, tag crypto.DomainSeparationTag, epoch abi.ChainEpoch, entropy []byte) abi.Randomness {
+		rand, err := src.GetRandomnessFromBeacon(tag, epoch, entropy)
+		require.NoError(t, err)
+		return rand
+	}
+
+	base := draw(r, tag, 10, []byte("entropy"))
+	assert.Len(t, base, 32)
+	assert.Equal(t, base, draw(r, tag, 10, []byte("entropy")))
+	assert.Equal(t, base, draw(vm.NewDeterministicRandomness([]byte("seed")), tag, 10, []byte("entropy")))
+
+	assert.NotEqual(t, base, draw(r, crypto.DomainSeparationTag_SealRandomness, 10, []byte("entropy")))
+	assert.NotEqual(t, base, draw(r, tag, 11, []byte("entropy")))
+	assert.NotEqual(t, base, draw(r, tag, 10, []byte("other entropy")))
+	assert.NotEqual(t, base, draw(vm.NewDeterministicRandomness([]byte("other seed")), tag, 10, []byte("entropy")))
+
+	tickets, err := r.GetRandomnessFromTickets(tag, 10, []byte("entropy"))
+	require.NoError(t, err)
+	assert.NotEqual(t, base, tickets)
+}
+
+func TestScriptedRandomness(t *testing.T) {
+	tag := crypto.DomainSeparationTag_SealRandomness
+
+	t.Run("scripted values are returned by tag and epoch", func(t *testing.T) {
+		r := vm.NewScriptedRandomness(nil)
+		r.SetTickets(tag, 10, []byte("any entropy"))
+		r.SetTicketsWithEntropy(tag, 10, []byte("entropy"), []byte("exact entropy"))
+
+		rand, err := r.GetRandomnessFromTickets(tag, 10, []byte("entropy"))
+		require.NoError(t, err)
+		assert.Equal(t, abi.Randomness("exact entropy"), rand)
+
+		rand, err = r.GetRandomnessFromTickets(tag, 10, []byte("other entropy"))
+		require.NoError(t, err)
+		assert.Equal(t, abi.Randomness("any entropy"), rand)
+
+		_, err = r.GetRandomnessFromTickets(tag, 11, nil)
+		assert.Error(t, err)
+		_, err = r.GetRandomnessFromBeacon(tag, 10, nil)
+		assert.Error(t, err)
+	})
+
+	t.Run("unscripted values fall back", func(t *testing.T) {
+		fallback := vm.NewDeterministicRandomness(vm.DefaultRandomnessSeed)
+		r := vm.NewScriptedRandomness(fallback)
+		r.SetBeacon(tag, 10, []byte("scripted"))
+
+		rand, err := r.GetRandomnessFromBeacon(tag, 10, nil)
+		require.NoError(t, err)
+		assert.Equal(t, abi.Randomness("scripted"), rand)
+
+		expected, err := fallback.GetRandomnessFromBeacon(tag, 11, nil)
+		require.NoError(t, err)
+		rand, err = r.GetRandomnessFromBeacon(tag, 11, nil)
+		require.NoError(t, err)
+		assert.Equal(t, expected, rand)
+	})
+}
+
+func TestProveCommitDrawsRandomnessFromVM(t *testing.T) {
+	ctx := context.Background()
+	v := vm.NewVMWithSingletons(ctx, t, ipld.NewBlockStoreInMemory())
+	addrs := vm.CreateAccounts(ctx, t, v, 1, big.Mul(big.NewInt(10_000), vm.FIL), 93837778)
+	worker := addrs[0]
+
+	minerAddrs := createMiner(t, v, worker)
+	sealProof := abi.RegisteredSealProof_StackedDrg32GiBV1_1
+
+	v, err := v.WithEpoch(200)
+	require.NoError(t, err)
+
+	sectorNumber := abi.SectorNumber(100)
+	preCommitParams := miner.PreCommitSectorParams{
+		SealProof:     sealProof,
+		SectorNumber:  sectorNumber,
+		SealedCID:     tutil.MakeCID("100", &miner.SealedCIDPrefix),
+		SealRandEpoch: v.GetEpoch() - 1,
+		Expiration:    v.GetEpoch() + miner.MinSectorExpiration + miner.MaxProveCommitDuration[sealProof] + 100,
+	}
+	vm.ApplyOk(t, v, worker, minerAddrs.RobustAddress, big.Zero(), builtin.MethodsMiner.PreCommitSector, &preCommitParams)
+
+	proveTime := v.GetEpoch() + miner.PreCommitChallengeDelay + 1
+	v, _ = vm.AdvanceByDeadlineTillEpoch(t, v, minerAddrs.IDAddress, proveTime)
+	v, err = v.WithEpoch(proveTime)
+	require.NoError(t, err)
+
+	proveCommitParams := miner.ProveCommitSectorParams{SectorNumber: sectorNumber}
+
+	// without any scripted randomness the proof cannot be verified
+	v.SetRandomnessSource(vm.NewScriptedRandomness(nil))
+	_, code, _ := v.ApplyMessage(worker, minerAddrs.RobustAddress, big.Zero(), builtin.MethodsMiner.ProveCommitSector, &proveCommitParams)
+	assert.Equal(t, exitcode.SysErrorIllegalArgument, code)
+
+	// scripting the seal randomness lets the miner draw the remaining values from the fallback
+	scripted := vm.NewScriptedRandomness(vm.NewDeterministicRandomness(vm.DefaultRandomnessSeed))
+	scripted.SetTickets(crypto.DomainSeparationTag_SealRandomness, preCommitParams.SealRandEpoch, []byte("seal randomness"))
+	v.SetRandomnessSource(scripted)
+	vm.ApplyOk(t, v, worker, minerAddrs.RobustAddress, big.Zero(), builtin.MethodsMiner.ProveCommitSector, &proveCommitParams)
+}
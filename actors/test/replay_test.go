@@ -0,0 +1,115 @@
+package test_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/exitcode"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin"
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/miner"
+	"github.com/filecoin-project/specs-actors/v4/actors/runtime"
+	"github.com/filecoin-project/specs-actors/v4/support/ipld"
+	tutil "github.com/filecoin-project/specs-actors/v4/support/testing"
+	vm "github.com/filecoin-project/specs-actors/v4/support/vm"
+)
+
+func TestReplay(t *testing.T) {
+	ctx := context.Background()
+	rec := vm.NewRecorder()
+	v := vm.NewVMWithSingletons(ctx, t, ipld.NewBlockStoreInMemory(), vm.WithRecorder(rec))
+	addrs := vm.CreateAccounts(ctx, t, v, 1, big.Mul(big.NewInt(10_000), vm.FIL), 93837778)
+	worker := addrs[0]
+
+	minerAddrs := createMiner(t, v, worker)
+	v, err := v.WithEpoch(200)
+	require.NoError(t, err)
+	v = proveCommitSectors(t, v, worker, minerAddrs, map[abi.SectorNumber]cid.Cid{
+		100: tutil.MakeCID("100", &miner.SealedCIDPrefix),
+	})
+	vm.ApplyOk(t, v, worker, minerAddrs.RobustAddress, big.Zero(), builtin.MethodsMiner.ChangePeerID, &miner.ChangePeerIDParams{
+		NewID: abi.PeerID("another peer id"),
+	})
+
+	require.NotEmpty(t, rec.Messages)
+	last := rec.Messages[len(rec.Messages)-1]
+	assert.Equal(t, v.StateRoot(), last.PostRoot)
+	assert.Equal(t, v.GetEpoch(), last.Epoch)
+
+	t.Run("replay with the same actors matches", func(t *testing.T) {
+		divergence, err := vm.Replay(ctx, rec, vm.ActorsV4(), v.Store())
+		require.NoError(t, err)
+		assert.Nil(t, divergence)
+	})
+
+	t.Run("replay with v3 actors", func(t *testing.T) {
+		divergence, err := vm.ReplayWithActorsV3(ctx, rec, v.Store())
+		require.NoError(t, err)
+		assert.Nil(t, divergence)
+	})
+
+	t.Run("replay reports first divergent message", func(t *testing.T) {
+		actors := vm.ActorsV4()
+		actors[builtin.StorageMinerActorCodeID] = peerIgnoringMiner{}
+		divergence, err := vm.Replay(ctx, rec, actors, v.Store())
+		require.NoError(t, err)
+		require.NotNil(t, divergence)
+
+		assert.Equal(t, len(rec.Messages)-1, divergence.Index)
+		assert.Equal(t, builtin.MethodsMiner.ChangePeerID, divergence.Recorded.Message.Method)
+		assert.Equal(t, exitcode.Ok, divergence.ExitCode)
+		assert.NotEqual(t, divergence.Recorded.PostRoot, divergence.PostRoot)
+		assert.Contains(t, divergence.String(), "state root")
+	})
+}
+
+func TestReplayAppliesRecordedPriceListAndSyscalls(t *testing.T) {
+	ctx := context.Background()
+	rec := vm.NewRecorder()
+	injector := vm.NewFaultInjector(nil)
+	v := vm.NewVMWithSingletons(ctx, t, ipld.NewBlockStoreInMemory(), vm.WithRecorder(rec), vm.WithSyscalls(injector.Syscalls))
+	addrs := vm.CreateAccounts(ctx, t, v, 2, big.Mul(big.NewInt(10_000), vm.FIL), 93837778)
+	worker := addrs[0]
+
+	// fees at a non-default price list change the sender's balance
+	prices := vm.DefaultPriceList()
+	prices.StorageGasMulti *= 2
+	v.SetPriceList(prices)
+	receipt := v.ApplyChainMessage(chainMessage(worker, 0, addrs[1], vm.FIL, builtin.MethodSend, nil))
+	require.Equal(t, exitcode.Ok, receipt.ExitCode)
+
+	// a rejected seal leaves the sector inactive
+	minerAddrs := createMiner(t, v, worker)
+	sealedCid := tutil.MakeCID("100", &miner.SealedCIDPrefix)
+	injector.RejectSealedCIDs(func(c cid.Cid) bool { return c.Equals(sealedCid) })
+	v, err := v.WithEpoch(200)
+	require.NoError(t, err)
+	v = proveCommitSectors(t, v, worker, minerAddrs, map[abi.SectorNumber]cid.Cid{100: sealedCid})
+	require.Len(t, injector.SealVerifications, 1)
+	require.True(t, injector.SealVerifications[0].Rejected)
+
+	divergence, err := vm.Replay(ctx, rec, vm.ActorsV4(), v.Store())
+	require.NoError(t, err)
+	assert.Nil(t, divergence)
+}
+
+// A miner actor that accepts but ignores changes to its peer ID.
+type peerIgnoringMiner struct {
+	miner.Actor
+}
+
+func (a peerIgnoringMiner) Exports() []interface{} {
+	exports := a.Actor.Exports()
+	exports[builtin.MethodsMiner.ChangePeerID] = a.ChangePeerID
+	return exports
+}
+
+func (a peerIgnoringMiner) ChangePeerID(rt runtime.Runtime, _ *miner.ChangePeerIDParams) *abi.EmptyValue {
+	rt.ValidateImmediateCallerAcceptAny()
+	return nil
+}
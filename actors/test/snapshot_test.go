@@ -0,0 +1,141 @@
+package test_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/crypto"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin"
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/miner"
+	"github.com/filecoin-project/specs-actors/v4/support/ipld"
+	tutil "github.com/filecoin-project/specs-actors/v4/support/testing"
+	vm "github.com/filecoin-project/specs-actors/v4/support/vm"
+)
+
+func TestSnapshotAndFork(t *testing.T) {
+	ctx := context.Background()
+	v := vm.NewVMWithSingletons(ctx, t, ipld.NewBlockStoreInMemory())
+	addrs := vm.CreateAccounts(ctx, t, v, 2, big.Mul(big.NewInt(10_000), vm.FIL), 93837778)
+	worker, other := addrs[0], addrs[1]
+
+	minerAddrs := createMiner(t, v, worker)
+	v, err := v.WithEpoch(200)
+	require.NoError(t, err)
+	v = proveCommitSectors(t, v, worker, minerAddrs, map[abi.SectorNumber]cid.Cid{
+		100: tutil.MakeCID("100", &miner.SealedCIDPrefix),
+	})
+	supply := big.Mul(big.NewInt(2e9), vm.FIL)
+	v.SetCirculatingSupply(supply)
+
+	snapshot, err := v.Snapshot()
+	require.NoError(t, err)
+	assert.Equal(t, v.StateRoot(), snapshot.StateRoot)
+	assert.Equal(t, v.GetEpoch(), snapshot.Epoch)
+
+	peerID := func(v *vm.VM) abi.PeerID {
+		var st miner.State
+		require.NoError(t, v.GetState(minerAddrs.IDAddress, &st))
+		info, err := st.GetInfo(v.Store())
+		require.NoError(t, err)
+		return info.PeerId
+	}
+	changePeerID := func(v *vm.VM, id string) {
+		vm.ApplyOk(t, v, worker, minerAddrs.RobustAddress, big.Zero(), builtin.MethodsMiner.ChangePeerID, &miner.ChangePeerIDParams{
+			NewID: abi.PeerID(id),
+		})
+	}
+
+	forkA, err := v.Fork(snapshot)
+	require.NoError(t, err)
+	forkB, err := v.Fork(snapshot)
+	require.NoError(t, err)
+	assert.Equal(t, snapshot.Epoch, forkA.GetEpoch())
+	assert.Equal(t, supply, forkA.GetCirculatingSupply())
+
+	changePeerID(forkA, "peer A")
+	changePeerID(forkB, "peer B")
+	assert.Equal(t, abi.PeerID("peer A"), peerID(forkA))
+	assert.Equal(t, abi.PeerID("peer B"), peerID(forkB))
+	assert.Equal(t, abi.PeerID("not really a peer id"), peerID(v))
+	assert.Equal(t, snapshot.StateRoot, v.StateRoot())
+
+	// forks continue the call sequence, so create identically addressed actors
+	minerA := createMiner(t, forkA, other)
+	minerB := createMiner(t, forkB, other)
+	assert.Equal(t, minerA.RobustAddress, minerB.RobustAddress)
+	assert.Equal(t, minerA.IDAddress, minerB.IDAddress)
+
+	// the original VM continues independently of its forks
+	changePeerID(v, "original peer")
+	assert.Equal(t, abi.PeerID("peer A"), peerID(forkA))
+	_, found, err := v.GetActor(minerA.IDAddress)
+	require.NoError(t, err)
+	assert.False(t, found)
+
+	// a fork may be advanced to later epochs
+	forkA, err = forkA.WithEpoch(snapshot.Epoch + 1)
+	require.NoError(t, err)
+	assert.Equal(t, abi.PeerID("peer A"), peerID(forkA))
+}
+
+func TestForksConfiguredIndependently(t *testing.T) {
+	ctx := context.Background()
+	injector := vm.NewFaultInjector(nil)
+	v := vm.NewVMWithSingletons(ctx, t, ipld.NewBlockStoreInMemory(), vm.WithSyscalls(injector.Syscalls))
+	scripted := vm.NewScriptedRandomness(vm.NewDeterministicRandomness(vm.DefaultRandomnessSeed))
+	v.SetRandomnessSource(scripted)
+	addrs := vm.CreateAccounts(ctx, t, v, 1, big.Mul(big.NewInt(10_000), vm.FIL), 93837778)
+	worker := addrs[0]
+
+	minerAddrs := createMiner(t, v, worker)
+	v, err := v.WithEpoch(200)
+	require.NoError(t, err)
+	snapshot, err := v.Snapshot()
+	require.NoError(t, err)
+
+	// fork A rejects all seals and scripts its own randomness, fork B shares the original VM's configuration
+	injectorA := injector.Copy()
+	forkA, err := v.Fork(snapshot, vm.WithSyscalls(injectorA.Syscalls))
+	require.NoError(t, err)
+	scriptedA := scripted.Copy()
+	forkA.SetRandomnessSource(scriptedA)
+	forkB, err := v.Fork(snapshot)
+	require.NoError(t, err)
+
+	injectorA.RejectSealedCIDs(func(cid.Cid) bool { return true })
+	scriptedA.SetTickets(crypto.DomainSeparationTag_SealRandomness, 1, abi.Randomness("fork A"))
+
+	sealedCID := tutil.MakeCID("100", &miner.SealedCIDPrefix)
+	forkA = proveCommitSectors(t, forkA, worker, minerAddrs, map[abi.SectorNumber]cid.Cid{100: sealedCID})
+	forkB = proveCommitSectors(t, forkB, worker, minerAddrs, map[abi.SectorNumber]cid.Cid{100: sealedCID})
+
+	hasSector := func(v *vm.VM) bool {
+		var st miner.State
+		require.NoError(t, v.GetState(minerAddrs.IDAddress, &st))
+		found, err := st.HasSectorNo(v.Store(), 100)
+		require.NoError(t, err)
+		return found
+	}
+	assert.False(t, hasSector(forkA))
+	assert.True(t, hasSector(forkB))
+
+	// each injector records only the verifications of the VMs using it
+	require.Len(t, injectorA.SealVerifications, 1)
+	assert.True(t, injectorA.SealVerifications[0].Rejected)
+	require.Len(t, injector.SealVerifications, 1)
+	assert.False(t, injector.SealVerifications[0].Rejected)
+
+	// randomness scripted for fork A is not seen by the original VM or fork B
+	randA, err := forkA.GetRandomnessSource().GetRandomnessFromTickets(crypto.DomainSeparationTag_SealRandomness, 1, nil)
+	require.NoError(t, err)
+	assert.Equal(t, abi.Randomness("fork A"), randA)
+	randB, err := forkB.GetRandomnessSource().GetRandomnessFromTickets(crypto.DomainSeparationTag_SealRandomness, 1, nil)
+	require.NoError(t, err)
+	assert.NotEqual(t, randA, randB)
+}
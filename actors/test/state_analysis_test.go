@@ -0,0 +1,119 @@
+package test_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	addr "github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin"
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/miner"
+	"github.com/filecoin-project/specs-actors/v4/actors/states"
+	"github.com/filecoin-project/specs-actors/v4/support/ipld"
+	tutil "github.com/filecoin-project/specs-actors/v4/support/testing"
+	vm "github.com/filecoin-project/specs-actors/v4/support/vm"
+)
+
+func TestAnalyzeState(t *testing.T) {
+	ctx := context.Background()
+	v := vm.NewVMWithSingletons(ctx, t, ipld.NewBlockStoreInMemory())
+	addrs := vm.CreateAccounts(ctx, t, v, 2, big.Mul(big.NewInt(10_000), vm.FIL), 93837778)
+	worker := addrs[0]
+
+	minerAddrs := createMiner(t, v, worker)
+	v, err := v.WithEpoch(200)
+	require.NoError(t, err)
+	v = proveCommitSectors(t, v, worker, minerAddrs, map[abi.SectorNumber]cid.Cid{
+		100: tutil.MakeCID("100", &miner.SealedCIDPrefix),
+		101: tutil.MakeCID("101", &miner.SealedCIDPrefix),
+	})
+	root := flushedRoot(t, v)
+
+	analysis, err := states.AnalyzeState(v.Store(), root)
+	require.NoError(t, err)
+
+	tree, err := v.GetStateTree()
+	require.NoError(t, err)
+	actorCount, accountCount := 0, 0
+	require.NoError(t, tree.ForEach(func(_ addr.Address, actor *states.Actor) error {
+		actorCount++
+		if actor.Code.Equals(builtin.AccountActorCodeID) {
+			accountCount++
+		}
+		return nil
+	}))
+	assert.Equal(t, actorCount, analysis.ActorCount)
+
+	// Every block reachable from the root is attributed exactly once.
+	exported, err := ipld.ExportCAR(ioutil.Discard, v.Store(), root)
+	require.NoError(t, err)
+	assert.Equal(t, exported, analysis.Total.Blocks)
+	sum := analysis.Tree
+	typeActors := 0
+	for _, typ := range analysis.ActorTypes {
+		typeActors += typ.ActorCount
+		sum.Blocks += typ.Total.Blocks
+		sum.Bytes += typ.Total.Bytes
+		fieldBlocks := uint64(0)
+		for _, field := range typ.Fields {
+			fieldBlocks += field.Attributed.Blocks
+		}
+		assert.Equal(t, typ.Total.Blocks, fieldBlocks, typ.ActorType)
+	}
+	assert.Equal(t, analysis.ActorCount, typeActors)
+	assert.Equal(t, analysis.Total.Blocks, sum.Blocks)
+	assert.Equal(t, analysis.Total.Bytes, sum.Bytes)
+	assert.Greater(t, analysis.Tree.Blocks, uint64(0))
+
+	// Empty collections are shared between actors.
+	assert.Greater(t, analysis.Shared.Blocks, uint64(0))
+
+	minerAnalysis := findActorType(t, analysis, "miner")
+	assert.Equal(t, 1, minerAnalysis.ActorCount)
+	fields := make(map[string]*states.FieldAnalysis)
+	for _, field := range minerAnalysis.Fields {
+		fields[field.Field] = field
+	}
+	assert.Equal(t, uint64(1), fields[states.HeadField].Attributed.Blocks)
+	for _, name := range []string{"Info", "Sectors", "Deadlines", "PreCommittedSectors", "AllocatedSectors"} {
+		require.Contains(t, fields, name)
+	}
+	assert.Greater(t, fields["Sectors"].Attributed.Blocks, uint64(0))
+	assert.Greater(t, fields["Deadlines"].Attributed.Blocks, uint64(0))
+	assert.Equal(t, accountCount, findActorType(t, analysis, "account").ActorCount)
+
+	t.Run("json", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, analysis.WriteJSON(&buf))
+		var decoded states.StateAnalysis
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+		assert.Equal(t, analysis, &decoded)
+	})
+
+	t.Run("text", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, analysis.WriteText(&buf))
+		text := buf.String()
+		assert.Contains(t, text, root.String())
+		assert.Contains(t, text, "miner (1)")
+		assert.Contains(t, text, "PreCommittedSectors")
+	})
+}
+
+func findActorType(t *testing.T, analysis *states.StateAnalysis, actorType string) *states.ActorTypeAnalysis {
+	for _, typ := range analysis.ActorTypes {
+		if typ.ActorType == actorType {
+			return typ
+		}
+	}
+	require.Failf(t, "actor type not found", actorType)
+	return nil
+}
@@ -0,0 +1,190 @@
+package test_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	addr "github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin"
+	init_ "github.com/filecoin-project/specs-actors/v4/actors/builtin/init"
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/miner"
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/multisig"
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/verifreg"
+	"github.com/filecoin-project/specs-actors/v4/actors/states"
+	"github.com/filecoin-project/specs-actors/v4/support/ipld"
+	tutil "github.com/filecoin-project/specs-actors/v4/support/testing"
+	vm "github.com/filecoin-project/specs-actors/v4/support/vm"
+)
+
+func TestStateDiff(t *testing.T) {
+	ctx := context.Background()
+	v := vm.NewVMWithSingletons(ctx, t, ipld.NewBlockStoreInMemory())
+	addrs := vm.CreateAccounts(ctx, t, v, 3, big.Mul(big.NewInt(10_000), vm.FIL), 93837778)
+	worker, verifier, client := addrs[0], addrs[1], addrs[2]
+	workerID, _ := v.NormalizeAddress(worker)
+	verifierID, _ := v.NormalizeAddress(verifier)
+	clientID, _ := v.NormalizeAddress(client)
+
+	initial := flushedRoot(t, v)
+	diff, err := states.Diff(v.Store(), initial, initial)
+	require.NoError(t, err)
+	assert.Empty(t, diff.Added)
+	assert.Empty(t, diff.Removed)
+	assert.Empty(t, diff.Modified)
+
+	//
+	// create a miner and a multisig, register a verified client and add market escrow
+	//
+
+	minerAddrs := createMiner(t, v, worker)
+	msigAddr := createMultisig(t, v, []addr.Address{worker, verifier}, 2)
+	vm.ApplyOk(t, v, vm.VerifregRoot, builtin.VerifiedRegistryActorAddr, big.Zero(), builtin.MethodsVerifiedRegistry.AddVerifier, &verifreg.AddVerifierParams{
+		Address:   verifier,
+		Allowance: abi.NewStoragePower(32 << 40),
+	})
+	vm.ApplyOk(t, v, verifier, builtin.VerifiedRegistryActorAddr, big.Zero(), builtin.MethodsVerifiedRegistry.AddVerifiedClient, &verifreg.AddVerifiedClientParams{
+		Address:   client,
+		Allowance: abi.NewStoragePower(1 << 40),
+	})
+	escrow := big.Mul(big.NewInt(3), vm.FIL)
+	vm.ApplyOk(t, v, client, builtin.StorageMarketActorAddr, escrow, builtin.MethodsMarket.AddBalance, &client)
+
+	created := flushedRoot(t, v)
+	diff, err = states.Diff(v.Store(), initial, created)
+	require.NoError(t, err)
+	assert.Empty(t, diff.Removed)
+	require.Len(t, diff.Added, 2)
+	addedAddrs := []addr.Address{diff.Added[0].Address, diff.Added[1].Address}
+	assert.ElementsMatch(t, []addr.Address{minerAddrs.IDAddress, msigAddr}, addedAddrs)
+	for _, added := range diff.Added {
+		assert.Nil(t, added.Before)
+		assert.NotNil(t, added.After)
+	}
+
+	modified := modifiedActors(diff)
+	assert.Contains(t, modified, workerID) // paid the miner's initial balance
+	assert.Contains(t, modified, clientID) // paid escrow
+	assert.Contains(t, modified, builtin.InitActorAddr)
+
+	power := modified[builtin.StoragePowerActorAddr].Power
+	require.NotNil(t, power)
+	require.Len(t, power.Claims, 1)
+	assert.Equal(t, minerAddrs.IDAddress, power.Claims[0].Address)
+	assert.Nil(t, power.Claims[0].Before)
+	assert.Equal(t, big.Zero(), power.Claims[0].After.RawBytePower)
+
+	verifReg := modified[builtin.VerifiedRegistryActorAddr].VerifReg
+	require.NotNil(t, verifReg)
+	require.Len(t, verifReg.Verifiers, 1)
+	assert.Equal(t, verifierID, verifReg.Verifiers[0].Address)
+	assert.Nil(t, verifReg.Verifiers[0].Before)
+	assert.Equal(t, abi.NewStoragePower(32<<40-1<<40), *verifReg.Verifiers[0].After)
+	require.Len(t, verifReg.Clients, 1)
+	assert.Equal(t, clientID, verifReg.Clients[0].Address)
+	assert.Equal(t, abi.NewStoragePower(1<<40), *verifReg.Clients[0].After)
+
+	market := modified[builtin.StorageMarketActorAddr].Market
+	require.NotNil(t, market)
+	assert.Empty(t, market.Proposals)
+	assert.Empty(t, market.States)
+	assert.Empty(t, market.Locked)
+	require.Len(t, market.Escrow, 1)
+	assert.Equal(t, states.BalanceChange{Address: clientID, Before: big.Zero(), After: escrow}, market.Escrow[0])
+
+	// the reverse diff removes what was added
+	reverse, err := states.Diff(v.Store(), created, initial)
+	require.NoError(t, err)
+	assert.Empty(t, reverse.Added)
+	assert.Len(t, reverse.Removed, 2)
+	reversePower := modifiedActors(reverse)[builtin.StoragePowerActorAddr].Power
+	require.Len(t, reversePower.Claims, 1)
+	assert.Nil(t, reversePower.Claims[0].After)
+
+	//
+	// prove a sector, pre-commit another and propose a multisig transaction
+	//
+
+	v, err = v.WithEpoch(200)
+	require.NoError(t, err)
+	v = proveCommitSectors(t, v, worker, minerAddrs, map[abi.SectorNumber]cid.Cid{
+		100: tutil.MakeCID("100", &miner.SealedCIDPrefix),
+	})
+	sealProof := abi.RegisteredSealProof_StackedDrg32GiBV1_1
+	vm.ApplyOk(t, v, worker, minerAddrs.RobustAddress, big.Zero(), builtin.MethodsMiner.PreCommitSector, &miner.PreCommitSectorParams{
+		SealProof:     sealProof,
+		SectorNumber:  101,
+		SealedCID:     tutil.MakeCID("101", &miner.SealedCIDPrefix),
+		SealRandEpoch: v.GetEpoch() - 1,
+		Expiration:    v.GetEpoch() + miner.MinSectorExpiration + miner.MaxProveCommitDuration[sealProof] + 100,
+	})
+	vm.ApplyOk(t, v, worker, msigAddr, big.Zero(), builtin.MethodsMultisig.Propose, &multisig.ProposeParams{
+		To:     worker,
+		Value:  big.Zero(),
+		Method: builtin.MethodSend,
+	})
+
+	diff, err = states.Diff(v.Store(), created, flushedRoot(t, v))
+	require.NoError(t, err)
+	assert.Empty(t, diff.Added)
+	assert.Empty(t, diff.Removed)
+	modified = modifiedActors(diff)
+
+	minerDiff := modified[minerAddrs.IDAddress].Miner
+	require.NotNil(t, minerDiff)
+	require.Len(t, minerDiff.Sectors, 1)
+	assert.Equal(t, abi.SectorNumber(100), minerDiff.Sectors[0].Number)
+	assert.Nil(t, minerDiff.Sectors[0].Before)
+	assert.Equal(t, abi.SectorNumber(100), minerDiff.Sectors[0].After.SectorNumber)
+	// sector 100 was pre-committed and proven within the diff's span, so only 101 appears pre-committed
+	require.Len(t, minerDiff.PreCommits, 1)
+	assert.Equal(t, abi.SectorNumber(101), minerDiff.PreCommits[0].Number)
+	assert.Nil(t, minerDiff.PreCommits[0].Before)
+	require.Len(t, minerDiff.Deadlines, 1)
+	dlDiff := minerDiff.Deadlines[0]
+	require.Len(t, dlDiff.Partitions, 1)
+	assert.Nil(t, dlDiff.Partitions[0].Before)
+	sectors, err := dlDiff.Partitions[0].After.Sectors.All(10)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{100}, sectors)
+
+	msigDiff := modified[msigAddr].Multisig
+	require.NotNil(t, msigDiff)
+	require.Len(t, msigDiff.PendingTxns, 1)
+	assert.Equal(t, multisig.TxnID(0), msigDiff.PendingTxns[0].ID)
+	assert.Nil(t, msigDiff.PendingTxns[0].Before)
+	assert.Equal(t, worker, msigDiff.PendingTxns[0].After.To)
+}
+
+func createMultisig(t *testing.T, v *vm.VM, signers []addr.Address, threshold uint64) addr.Address {
+	var ctorParams bytes.Buffer
+	require.NoError(t, (&multisig.ConstructorParams{
+		Signers:               signers,
+		NumApprovalsThreshold: threshold,
+	}).MarshalCBOR(&ctorParams))
+	ret := vm.ApplyOk(t, v, signers[0], builtin.InitActorAddr, big.Zero(), builtin.MethodsInit.Exec, &init_.ExecParams{
+		CodeCID:           builtin.MultisigActorCodeID,
+		ConstructorParams: ctorParams.Bytes(),
+	})
+	return ret.(*init_.ExecReturn).IDAddress
+}
+
+func flushedRoot(t *testing.T, v *vm.VM) cid.Cid {
+	snapshot, err := v.Snapshot()
+	require.NoError(t, err)
+	return snapshot.StateRoot
+}
+
+func modifiedActors(diff *states.TreeDiff) map[addr.Address]*states.ActorChange {
+	modified := make(map[addr.Address]*states.ActorChange)
+	for _, change := range diff.Modified {
+		modified[change.Address] = change
+	}
+	return modified
+}
@@ -0,0 +1,168 @@
+package test_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin"
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/market"
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/miner"
+	"github.com/filecoin-project/specs-actors/v4/actors/states"
+	"github.com/filecoin-project/specs-actors/v4/actors/util/adt"
+	"github.com/filecoin-project/specs-actors/v4/support/ipld"
+	tutil "github.com/filecoin-project/specs-actors/v4/support/testing"
+	vm "github.com/filecoin-project/specs-actors/v4/support/vm"
+)
+
+func TestStateInclusionProofs(t *testing.T) {
+	ctx := context.Background()
+	v := vm.NewVMWithSingletons(ctx, t, ipld.NewBlockStoreInMemory())
+	addrs := vm.CreateAccounts(ctx, t, v, 2, big.Mul(big.NewInt(10_000), vm.FIL), 93837778)
+	worker, client := addrs[0], addrs[1]
+	minerAddrs := createMiner(t, v, worker)
+	v, err := v.WithEpoch(200)
+	require.NoError(t, err)
+
+	// Activate a deal in a sector.
+	vm.ApplyOk(t, v, client, builtin.StorageMarketActorAddr, big.Mul(big.NewInt(3), vm.FIL), builtin.MethodsMarket.AddBalance, &client)
+	vm.ApplyOk(t, v, worker, builtin.StorageMarketActorAddr, big.Mul(big.NewInt(64), vm.FIL), builtin.MethodsMarket.AddBalance, &minerAddrs.IDAddress)
+	sealProof := abi.RegisteredSealProof_StackedDrg32GiBV1_1
+	dealStart := v.GetEpoch() + miner.MaxProveCommitDuration[sealProof]
+	deals := publishDeal(t, v, worker, client, minerAddrs.IDAddress, "deal1", 1<<30, false, dealStart, 181*builtin.EpochsInDay)
+	dealID := deals.IDs[0]
+
+	sectorNumber := abi.SectorNumber(100)
+	vm.ApplyOk(t, v, worker, minerAddrs.RobustAddress, big.Zero(), builtin.MethodsMiner.PreCommitSector, &miner.PreCommitSectorParams{
+		SealProof:     sealProof,
+		SectorNumber:  sectorNumber,
+		SealedCID:     tutil.MakeCID("100", &miner.SealedCIDPrefix),
+		SealRandEpoch: v.GetEpoch() - 1,
+		DealIDs:       deals.IDs,
+		Expiration:    v.GetEpoch() + 220*builtin.EpochsInDay,
+	})
+	proveTime := v.GetEpoch() + miner.PreCommitChallengeDelay + 1
+	v, _ = vm.AdvanceByDeadlineTillEpoch(t, v, minerAddrs.IDAddress, proveTime)
+	v, err = v.WithEpoch(proveTime)
+	require.NoError(t, err)
+	vm.ApplyOk(t, v, worker, minerAddrs.RobustAddress, big.Zero(), builtin.MethodsMiner.ProveCommitSector, &miner.ProveCommitSectorParams{SectorNumber: sectorNumber})
+	vm.ApplyOk(t, v, builtin.SystemActorAddr, builtin.CronActorAddr, big.Zero(), builtin.MethodsCron.EpochTick, nil)
+
+	root := flushedRoot(t, v)
+	store := v.Store()
+
+	var marketState market.State
+	require.NoError(t, v.GetState(builtin.StorageMarketActorAddr, &marketState))
+	dealStates, err := market.AsDealStateArray(store, marketState.States)
+	require.NoError(t, err)
+	expectedDealState, found, err := dealStates.Get(dealID)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, proveTime, expectedDealState.SectorStartEpoch)
+
+	var minerState miner.State
+	require.NoError(t, v.GetState(minerAddrs.IDAddress, &minerState))
+	expectedSector, found, err := minerState.GetSector(store, sectorNumber)
+	require.NoError(t, err)
+	require.True(t, found)
+
+	t.Run("actor", func(t *testing.T) {
+		proof, err := states.ProveActor(store, root, minerAddrs.IDAddress)
+		require.NoError(t, err)
+		actor, err := states.VerifyActorProof(proof, root, minerAddrs.IDAddress)
+		require.NoError(t, err)
+		expected, found, err := v.GetActor(minerAddrs.IDAddress)
+		require.NoError(t, err)
+		require.True(t, found)
+		assert.Equal(t, expected, actor)
+
+		_, err = states.ProveActor(store, root, tutil.NewIDAddr(t, 9999))
+		assert.Error(t, err)
+	})
+
+	t.Run("deal state", func(t *testing.T) {
+		proof, err := states.ProveDealState(store, root, dealID)
+		require.NoError(t, err)
+		dealState, err := states.VerifyDealStateProof(proof, root, dealID)
+		require.NoError(t, err)
+		assert.Equal(t, expectedDealState, dealState)
+
+		// The proof survives serialization.
+		encoded, err := json.Marshal(proof)
+		require.NoError(t, err)
+		var decoded states.Proof
+		require.NoError(t, json.Unmarshal(encoded, &decoded))
+		dealState, err = states.VerifyDealStateProof(&decoded, root, dealID)
+		require.NoError(t, err)
+		assert.Equal(t, expectedDealState, dealState)
+
+		_, err = states.ProveDealState(store, root, dealID+1)
+		assert.Error(t, err)
+	})
+
+	t.Run("sector", func(t *testing.T) {
+		proof, err := states.ProveSectorOnChainInfo(store, root, minerAddrs.IDAddress, sectorNumber)
+		require.NoError(t, err)
+		sector, err := states.VerifySectorOnChainInfoProof(proof, root, minerAddrs.IDAddress, sectorNumber)
+		require.NoError(t, err)
+		assert.Equal(t, expectedSector, sector)
+
+		// A sector proof doesn't prove anything about other sectors or actors.
+		_, err = states.VerifySectorOnChainInfoProof(proof, root, minerAddrs.IDAddress, 100_000)
+		assert.Error(t, err)
+		_, err = states.VerifyDealStateProof(proof, root, dealID)
+		assert.Error(t, err)
+
+		_, err = states.ProveSectorOnChainInfo(store, root, builtin.StorageMarketActorAddr, sectorNumber)
+		assert.Error(t, err)
+	})
+
+	t.Run("proof is minimal", func(t *testing.T) {
+		// The state tree root, actor head, sectors AMT root and leaf for a small state tree and sectors array.
+		proof, err := states.ProveSectorOnChainInfo(store, root, minerAddrs.IDAddress, sectorNumber)
+		require.NoError(t, err)
+		assert.Len(t, proof.Blocks, 4)
+	})
+
+	t.Run("invalid proofs are rejected", func(t *testing.T) {
+		proof, err := states.ProveDealState(store, root, dealID)
+		require.NoError(t, err)
+
+		// Wrong root.
+		_, err = states.VerifyDealStateProof(proof, flushedRootAfterTick(t, v), dealID)
+		assert.Error(t, err)
+
+		// Missing block.
+		for i := range proof.Blocks {
+			truncated := &states.Proof{StateRoot: proof.StateRoot}
+			truncated.Blocks = append(truncated.Blocks, proof.Blocks[:i]...)
+			truncated.Blocks = append(truncated.Blocks, proof.Blocks[i+1:]...)
+			_, err = states.VerifyDealStateProof(truncated, root, dealID)
+			assert.Error(t, err)
+		}
+
+		// Tampered block.
+		tampered := &states.Proof{StateRoot: proof.StateRoot}
+		for _, b := range proof.Blocks {
+			tampered.Blocks = append(tampered.Blocks, adt.ProofBlock{Cid: b.Cid, Data: append([]byte(nil), b.Data...)})
+		}
+		last := tampered.Blocks[len(tampered.Blocks)-1]
+		last.Data[len(last.Data)-1] ^= 1
+		_, err = states.VerifyDealStateProof(tampered, root, dealID)
+		assert.Error(t, err)
+	})
+}
+
+// Returns the root of a state tree that differs from the VM's current one.
+func flushedRootAfterTick(t *testing.T, v *vm.VM) cid.Cid {
+	next, err := v.WithEpoch(v.GetEpoch() + 1)
+	require.NoError(t, err)
+	vm.ApplyOk(t, next, builtin.SystemActorAddr, builtin.CronActorAddr, big.Zero(), builtin.MethodsCron.EpochTick, nil)
+	return flushedRoot(t, next)
+}
@@ -0,0 +1,93 @@
+package test_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/exitcode"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin"
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/power"
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/reward"
+	"github.com/filecoin-project/specs-actors/v4/support/ipld"
+	vm "github.com/filecoin-project/specs-actors/v4/support/vm"
+)
+
+func TestApplyTipset(t *testing.T) {
+	ctx := context.Background()
+	v := vm.NewVMWithSingletons(ctx, t, ipld.NewBlockStoreInMemory())
+	addrs := vm.CreateAccounts(ctx, t, v, 3, big.Mul(big.NewInt(10_000), vm.FIL), 93837778)
+	worker, sender, receiver := addrs[0], addrs[1], addrs[2]
+	minerAddrs := createMiner(t, v, worker)
+
+	startEpoch := v.GetEpoch()
+
+	minerBalance := vm.GetMinerBalances(t, v, minerAddrs.IDAddress)
+	transfer := big.Mul(big.NewInt(10), vm.FIL)
+	blocks := []vm.Block{{
+		Miner:    minerAddrs.IDAddress,
+		WinCount: 2,
+		Messages: []*vm.Message{
+			chainMessage(sender, 0, receiver, transfer, builtin.MethodSend, nil),
+			chainMessage(sender, 1, builtin.StoragePowerActorAddr, big.Zero(), builtin.MethodsPower.CreateMiner, &power.CreateMinerParams{
+				Owner:               sender,
+				Worker:              sender,
+				WindowPoStProofType: abi.RegisteredPoStProof_StackedDrgWindow32GiBV1,
+			}),
+			chainMessage(sender, 2, receiver, big.Mul(big.NewInt(1_000_000), vm.FIL), builtin.MethodSend, nil),
+		},
+	}}
+
+	v, receipts, err := v.ApplyTipset(startEpoch+3, blocks)
+	require.NoError(t, err)
+	assert.Equal(t, startEpoch+3, v.GetEpoch())
+
+	// one receipt per message, in order
+	require.Len(t, receipts, 3)
+	assert.Equal(t, exitcode.Ok, receipts[0].ExitCode)
+	assert.Empty(t, receipts[0].Return)
+	assert.Equal(t, exitcode.Ok, receipts[1].ExitCode)
+	var createRet power.CreateMinerReturn
+	require.NoError(t, createRet.UnmarshalCBOR(bytes.NewReader(receipts[1].Return)))
+	assert.NotEqual(t, minerAddrs.IDAddress, createRet.IDAddress)
+	assert.Equal(t, exitcode.SysErrInsufficientFunds, receipts[2].ExitCode)
+	for _, receipt := range receipts {
+		assert.Greater(t, receipt.GasUsed, int64(0))
+	}
+
+	// the transfer was applied
+	receiverActor, found, err := v.GetActor(receiver)
+	require.NoError(t, err)
+	require.True(t, found)
+	assert.Equal(t, big.Add(big.Mul(big.NewInt(10_000), vm.FIL), transfer), receiverActor.Balance)
+
+	var rewardSt reward.State
+	// cron ran, computing the reward for the next epoch
+	require.NoError(t, v.GetState(builtin.RewardActorAddr, &rewardSt))
+	assert.Equal(t, v.GetEpoch()+1, rewardSt.Epoch)
+
+	// the block miner was rewarded, with the reward vested over time
+	newBalance := vm.GetMinerBalances(t, v, minerAddrs.IDAddress)
+	assert.True(t, newBalance.VestingBalance.GreaterThan(minerBalance.VestingBalance))
+	assert.True(t, newBalance.AvailableBalance.GreaterThan(minerBalance.AvailableBalance))
+
+	// the tipset must be after the current epoch
+	_, _, err = v.ApplyTipset(v.GetEpoch(), nil)
+	assert.Error(t, err)
+}
+
+func TestApplyTipsetFailsOnFailedImplicitMessage(t *testing.T) {
+	ctx := context.Background()
+	v := vm.NewVMWithSingletons(ctx, t, ipld.NewBlockStoreInMemory())
+	addrs := vm.CreateAccounts(ctx, t, v, 1, big.Mul(big.NewInt(10_000), vm.FIL), 93837778)
+	minerAddrs := createMiner(t, v, addrs[0])
+
+	// the reward actor rejects a block with no wins
+	_, _, err := v.ApplyTipset(v.GetEpoch()+1, []vm.Block{{Miner: minerAddrs.IDAddress, WinCount: 0}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,144 @@
+package test_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/exitcode"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin"
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/miner"
+	"github.com/filecoin-project/specs-actors/v4/support/ipld"
+	vm "github.com/filecoin-project/specs-actors/v4/support/vm"
+)
+
+func TestExecutionTrace(t *testing.T) {
+	ctx := context.Background()
+	v := vm.NewVMWithSingletons(ctx, t, ipld.NewBlockStoreInMemory())
+	addrs := vm.CreateAccounts(ctx, t, v, 1, big.Mul(big.NewInt(10_000), vm.FIL), 93837778)
+	worker := addrs[0]
+
+	v, err := v.WithEpoch(1)
+	require.NoError(t, err)
+	minerAddrs := createMiner(t, v, worker)
+
+	// a failing call logs the reason for its failure
+	_, code, _ := v.ApplyMessage(worker, minerAddrs.RobustAddress, big.Zero(), builtin.MethodsMiner.ChangePeerID, &miner.ChangePeerIDParams{
+		NewID: abi.PeerID(make([]byte, miner.MaxPeerIDLength+1)),
+	})
+	require.Equal(t, exitcode.ErrIllegalArgument, code)
+
+	trace, err := vm.NewTrace(v)
+	require.NoError(t, err)
+	assert.Equal(t, abi.ChainEpoch(1), trace.Epoch)
+	require.Len(t, trace.Calls, 2)
+
+	workerID, found := v.NormalizeAddress(worker)
+	require.True(t, found)
+	create := trace.Calls[0]
+	assert.Equal(t, workerID, create.Caller)
+	assert.Equal(t, builtin.StoragePowerActorAddr, create.Receiver)
+	assert.Equal(t, "fil/3/storagepower", create.ActorName)
+	assert.Equal(t, "CreateMiner", create.MethodName)
+	assert.Equal(t, exitcode.Ok, create.ExitCode)
+	assert.NotEmpty(t, create.Params)
+	assert.NotEmpty(t, create.Return)
+	assert.NotEmpty(t, create.Reads)
+	assert.NotEmpty(t, create.Writes)
+
+	require.Len(t, create.SubCalls, 1)
+	exec := create.SubCalls[0]
+	assert.Equal(t, "fil/3/init", exec.ActorName)
+	assert.Equal(t, "Exec", exec.MethodName)
+	require.Len(t, exec.SubCalls, 1)
+	construct := exec.SubCalls[0]
+	assert.Equal(t, minerAddrs.IDAddress, construct.Receiver)
+	assert.Equal(t, "fil/3/storageminer", construct.ActorName)
+	assert.Equal(t, "Constructor", construct.MethodName)
+	assert.NotEmpty(t, construct.Writes)
+
+	changePeer := trace.Calls[1]
+	assert.Equal(t, "ChangePeerID", changePeer.MethodName)
+	assert.Equal(t, exitcode.ErrIllegalArgument, changePeer.ExitCode)
+	assert.Empty(t, changePeer.Return)
+	assert.NotEmpty(t, changePeer.Logs)
+
+	encode := func(tr *vm.Trace) []byte {
+		var buf bytes.Buffer
+		require.NoError(t, tr.WriteCBOR(&buf))
+		return buf.Bytes()
+	}
+
+	t.Run("CBOR round trip", func(t *testing.T) {
+		data := encode(trace)
+		read, err := vm.ReadTraceCBOR(bytes.NewReader(data))
+		require.NoError(t, err)
+		assert.Equal(t, data, encode(read))
+	})
+
+	t.Run("JSON round trip", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, trace.WriteJSON(&buf, v.ActorImpls))
+		read, err := vm.ReadTraceJSON(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+		assert.Equal(t, encode(trace), encode(read))
+	})
+
+	t.Run("JSON includes decoded params and returns", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, trace.WriteJSON(&buf, v.ActorImpls))
+
+		type decodedTrace struct {
+			Calls []struct {
+				DecodedParams map[string]interface{}
+				DecodedReturn map[string]interface{}
+			}
+		}
+		var decoded decodedTrace
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+		require.Len(t, decoded.Calls, 2)
+		assert.Equal(t, worker.String(), decoded.Calls[0].DecodedParams["Worker"])
+		assert.Equal(t, minerAddrs.IDAddress.String(), decoded.Calls[0].DecodedReturn["IDAddress"])
+		assert.Nil(t, decoded.Calls[1].DecodedReturn)
+
+		// without actor implementations nothing is decoded
+		buf.Reset()
+		require.NoError(t, trace.WriteJSON(&buf, nil))
+		decoded = decodedTrace{}
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+		assert.Nil(t, decoded.Calls[0].DecodedParams)
+	})
+}
+
+func TestExecutionTraceValueParams(t *testing.T) {
+	ctx := context.Background()
+	v := vm.NewVMWithSingletons(ctx, t, ipld.NewBlockStoreInMemory())
+	addrs := vm.CreateAccounts(ctx, t, v, 1, big.Mul(big.NewInt(10_000), vm.FIL), 93837778)
+	caller := addrs[0]
+
+	vm.ApplyOk(t, v, caller, builtin.StorageMarketActorAddr, vm.FIL, builtin.MethodsMarket.AddBalance, valueAddressParams{caller})
+
+	trace, err := vm.NewTrace(v)
+	require.NoError(t, err)
+	require.Len(t, trace.Calls, 1)
+	var params bytes.Buffer
+	require.NoError(t, caller.MarshalCBOR(&params))
+	assert.Equal(t, params.Bytes(), trace.Calls[0].Params)
+}
+
+// An address parameter marshalled through a value receiver.
+type valueAddressParams struct {
+	addr address.Address
+}
+
+func (p valueAddressParams) MarshalCBOR(w io.Writer) error {
+	return p.addr.MarshalCBOR(w)
+}
@@ -1,8 +1,6 @@
 package adt
 
 import (
-	"bytes"
-
 	amt "github.com/filecoin-project/go-amt-ipld/v3"
 
 	"github.com/filecoin-project/go-state-types/cbor"
@@ -104,20 +102,36 @@ func (a *Array) BatchDelete(ix []uint64, strict bool) error {
 }
 
 // Iterates all entries in the array, deserializing each value in turn into `out` and then calling a function.
-// Iteration halts if the function returns an error.
+// Iteration halts if the function returns an error, or without error if it returns ErrStopIteration.
 // If the output parameter is nil, deserialization is skipped.
 func (a *Array) ForEach(out cbor.Unmarshaler, fn func(i int64) error) error {
-	return a.root.ForEach(a.store.Context(), func(k uint64, val *cbg.Deferred) error {
-		if out != nil {
-			if deferred, ok := out.(*cbg.Deferred); ok {
-				// fast-path deferred -> deferred to avoid re-decoding.
-				*deferred = *val
-			} else if err := out.UnmarshalCBOR(bytes.NewReader(val.Raw)); err != nil {
-				return err
-			}
+	return a.ForEachFrom(0, out, fn)
+}
+
+// Iterates entries in the array with index at least `start`, as for ForEach.
+func (a *Array) ForEachFrom(start uint64, out cbor.Unmarshaler, fn func(i int64) error) error {
+	return iterationResult(a.root.ForEachAt(a.store.Context(), start, func(k uint64, val *cbg.Deferred) error {
+		if err := decodeValue(val, out); err != nil {
+			return err
+		}
+		return fn(int64(k))
+	}))
+}
+
+// Iterates entries in the array with index at least `start` and less than `end`, as for ForEach.
+func (a *Array) ForEachRange(start, end uint64, out cbor.Unmarshaler, fn func(i int64) error) error {
+	if start >= end {
+		return nil
+	}
+	return iterationResult(a.root.ForEachAt(a.store.Context(), start, func(k uint64, val *cbg.Deferred) error {
+		if k >= end {
+			return ErrStopIteration
+		}
+		if err := decodeValue(val, out); err != nil {
+			return err
 		}
 		return fn(int64(k))
-	})
+	}))
 }
 
 func (a *Array) Length() uint64 {
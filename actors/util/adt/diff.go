@@ -0,0 +1,576 @@
+package adt
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+
+	hamt "github.com/filecoin-project/go-hamt-ipld/v3"
+	"github.com/filecoin-project/go-state-types/cbor"
+	cid "github.com/ipfs/go-cid"
+	cbg "github.com/whyrusleeping/cbor-gen"
+	"golang.org/x/xerrors"
+)
+
+// MapDiffFuncs receive the differences between two maps found by DiffMaps.
+// Nil functions are not called.
+type MapDiffFuncs struct {
+	Add    func(key string) error // The added value has been decoded into `after`
+	Modify func(key string) error // The prior and new values have been decoded into `before` and `after`
+	Remove func(key string) error // The removed value has been decoded into `before`
+}
+
+// ArrayDiffFuncs receive the differences between two arrays found by DiffArrays.
+// Nil functions are not called.
+type ArrayDiffFuncs struct {
+	Add    func(i uint64) error // The added value has been decoded into `after`
+	Modify func(i uint64) error // The prior and new values have been decoded into `before` and `after`
+	Remove func(i uint64) error // The removed value has been decoded into `before`
+}
+
+// DiffMaps finds the entries that differ between two maps, which must have the same bitwidth.
+// The HAMTs are walked together, skipping subtrees with equal CIDs, so the cost is proportional to the size
+// of the difference rather than of the maps.
+// For each entry added, modified or removed, the differing values are deserialized into `before` and/or `after`
+// and then the corresponding function called. If an output parameter is nil, deserialization is skipped.
+// Differences are visited in the order of the HAMTs' structure.
+// Iteration halts if a function returns an error.
+func DiffMaps(a, b *Map, before, after cbor.Unmarshaler, fns MapDiffFuncs) error {
+	rootA, err := a.Root()
+	if err != nil {
+		return err
+	}
+	rootB, err := b.Root()
+	if err != nil {
+		return err
+	}
+	if rootA.Equals(rootB) {
+		return nil
+	}
+
+	d := &mapDiffer{storeA: a.store, storeB: b.store, before: before, after: after, fns: fns}
+	nodeA, err := d.loadNode(d.storeA, rootA)
+	if err != nil {
+		return err
+	}
+	nodeB, err := d.loadNode(d.storeB, rootB)
+	if err != nil {
+		return err
+	}
+	return d.diffNodes(nodeA, nodeB)
+}
+
+type mapDiffer struct {
+	storeA, storeB Store
+	before, after  cbor.Unmarshaler
+	fns            MapDiffFuncs
+}
+
+func (d *mapDiffer) loadNode(s Store, c cid.Cid) (*hamt.Node, error) {
+	var nd hamt.Node
+	if err := s.Get(s.Context(), c, &nd); err != nil {
+		return nil, xerrors.Errorf("failed to load hamt node %v: %w", c, err)
+	}
+	return &nd, nil
+}
+
+// Walks the pointers of two nodes at the same position in their trees, matching them by bit position.
+// Either node may be nil.
+func (d *mapDiffer) diffNodes(a, b *hamt.Node) error {
+	bitsA, bitsB := hamtBitfield(a), hamtBitfield(b)
+	bitLen := bitsA.BitLen()
+	if bitsB.BitLen() > bitLen {
+		bitLen = bitsB.BitLen()
+	}
+
+	var idxA, idxB int
+	for bit := 0; bit < bitLen; bit++ {
+		var ptrA, ptrB *hamt.Pointer
+		if bitsA.Bit(bit) == 1 {
+			if idxA >= len(a.Pointers) {
+				return xerrors.Errorf("malformed hamt node: bitfield has more bits than %d pointers", len(a.Pointers))
+			}
+			ptrA = a.Pointers[idxA]
+			idxA++
+		}
+		if bitsB.Bit(bit) == 1 {
+			if idxB >= len(b.Pointers) {
+				return xerrors.Errorf("malformed hamt node: bitfield has more bits than %d pointers", len(b.Pointers))
+			}
+			ptrB = b.Pointers[idxB]
+			idxB++
+		}
+		if err := d.diffPointers(ptrA, ptrB); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *mapDiffer) diffPointers(a, b *hamt.Pointer) error {
+	if a == nil && b == nil {
+		return nil
+	}
+	if a != nil && b != nil && a.Link.Defined() && b.Link.Defined() {
+		if a.Link.Equals(b.Link) {
+			return nil
+		}
+		childA, err := d.loadNode(d.storeA, a.Link)
+		if err != nil {
+			return err
+		}
+		childB, err := d.loadNode(d.storeB, b.Link)
+		if err != nil {
+			return err
+		}
+		return d.diffNodes(childA, childB)
+	}
+
+	// At least one side is a bucket or absent, so holds few entries: compare them directly.
+	kvsA, err := d.entries(d.storeA, a)
+	if err != nil {
+		return err
+	}
+	kvsB, err := d.entries(d.storeB, b)
+	if err != nil {
+		return err
+	}
+	valsB := make(map[string]*cbg.Deferred, len(kvsB))
+	for _, kv := range kvsB {
+		valsB[string(kv.Key)] = kv.Value
+	}
+	for _, kv := range kvsA {
+		key := string(kv.Key)
+		valB, found := valsB[key]
+		if !found {
+			if err := d.remove(key, kv.Value); err != nil {
+				return err
+			}
+			continue
+		}
+		delete(valsB, key)
+		if !bytes.Equal(kv.Value.Raw, valB.Raw) {
+			if err := d.modify(key, kv.Value, valB); err != nil {
+				return err
+			}
+		}
+	}
+	for _, kv := range kvsB {
+		if _, added := valsB[string(kv.Key)]; added {
+			if err := d.add(string(kv.Key), kv.Value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Collects all entries beneath a pointer, which may be nil.
+func (d *mapDiffer) entries(s Store, p *hamt.Pointer) ([]*hamt.KV, error) {
+	if p == nil {
+		return nil, nil
+	}
+	if !p.Link.Defined() {
+		return p.KVs, nil
+	}
+	nd, err := d.loadNode(s, p.Link)
+	if err != nil {
+		return nil, err
+	}
+	var kvs []*hamt.KV
+	for _, child := range nd.Pointers {
+		childKVs, err := d.entries(s, child)
+		if err != nil {
+			return nil, err
+		}
+		kvs = append(kvs, childKVs...)
+	}
+	return kvs, nil
+}
+
+func (d *mapDiffer) add(key string, val *cbg.Deferred) error {
+	if d.fns.Add == nil {
+		return nil
+	}
+	if err := decodeValue(val, d.after); err != nil {
+		return err
+	}
+	return d.fns.Add(key)
+}
+
+func (d *mapDiffer) modify(key string, valA, valB *cbg.Deferred) error {
+	if d.fns.Modify == nil {
+		return nil
+	}
+	if err := decodeValue(valA, d.before); err != nil {
+		return err
+	}
+	if err := decodeValue(valB, d.after); err != nil {
+		return err
+	}
+	return d.fns.Modify(key)
+}
+
+func (d *mapDiffer) remove(key string, val *cbg.Deferred) error {
+	if d.fns.Remove == nil {
+		return nil
+	}
+	if err := decodeValue(val, d.before); err != nil {
+		return err
+	}
+	return d.fns.Remove(key)
+}
+
+func hamtBitfield(nd *hamt.Node) *big.Int {
+	if nd == nil || nd.Bitfield == nil {
+		return big.NewInt(0)
+	}
+	return nd.Bitfield
+}
+
+// DiffArrays finds the entries that differ between two arrays, which must have the same bitwidth.
+// The AMTs are walked together, skipping subtrees with equal CIDs, so the cost is proportional to the size
+// of the difference rather than of the arrays.
+// For each entry added, modified or removed, the differing values are deserialized into `before` and/or `after`
+// and then the corresponding function called. If an output parameter is nil, deserialization is skipped.
+// Differences are visited in ascending order of index.
+// Iteration halts if a function returns an error.
+func DiffArrays(a, b *Array, before, after cbor.Unmarshaler, fns ArrayDiffFuncs) error {
+	rootA, err := a.Root()
+	if err != nil {
+		return err
+	}
+	rootB, err := b.Root()
+	if err != nil {
+		return err
+	}
+	if rootA.Equals(rootB) {
+		return nil
+	}
+
+	var amtA, amtB amtRoot
+	if err := a.store.Get(a.store.Context(), rootA, &amtA); err != nil {
+		return xerrors.Errorf("failed to load amt root %v: %w", rootA, err)
+	}
+	if err := b.store.Get(b.store.Context(), rootB, &amtB); err != nil {
+		return xerrors.Errorf("failed to load amt root %v: %w", rootB, err)
+	}
+	if amtA.BitWidth != amtB.BitWidth {
+		return xerrors.Errorf("can't diff arrays with bitwidths %d and %d", amtA.BitWidth, amtB.BitWidth)
+	}
+
+	d := &arrayDiffer{
+		storeA:   a.store,
+		storeB:   b.store,
+		bitWidth: amtA.BitWidth,
+		before:   before,
+		after:    after,
+		fns:      fns,
+	}
+	nodeA, nodeB := &amtA.Node, &amtB.Node
+	// The root of a shorter tree covers the same indices as the first child of a taller tree's root,
+	// so is raised to the same height beneath virtual nodes.
+	for height := amtB.Height; height < amtA.Height; height++ {
+		nodeB = &amtNode{lifted: nodeB}
+	}
+	for height := amtA.Height; height < amtB.Height; height++ {
+		nodeA = &amtNode{lifted: nodeA}
+	}
+	height := amtA.Height
+	if amtB.Height > height {
+		height = amtB.Height
+	}
+	return d.diffNodes(nodeA, nodeB, height, 0)
+}
+
+type arrayDiffer struct {
+	storeA, storeB Store
+	bitWidth       uint64
+	before, after  cbor.Unmarshaler
+	fns            ArrayDiffFuncs
+}
+
+// Walks the slots of two nodes at the same position and height in their trees, either of which may be nil.
+func (d *arrayDiffer) diffNodes(a, b *amtNode, height, offset uint64) error {
+	width := uint64(1) << d.bitWidth
+	linksA, valuesA, err := a.expand(width)
+	if err != nil {
+		return err
+	}
+	linksB, valuesB, err := b.expand(width)
+	if err != nil {
+		return err
+	}
+
+	if height == 0 {
+		for i := uint64(0); i < width; i++ {
+			valA, valB := valuesA[i], valuesB[i]
+			var err error
+			switch {
+			case valA == nil && valB == nil:
+			case valA == nil:
+				err = d.add(offset+i, valB)
+			case valB == nil:
+				err = d.remove(offset+i, valA)
+			case !bytes.Equal(valA.Raw, valB.Raw):
+				err = d.modify(offset+i, valA, valB)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	childCount := amtNodesForHeight(d.bitWidth, height)
+	for i := uint64(0); i < width; i++ {
+		if linksA[i].Defined() && linksB[i].Defined() && linksA[i].Equals(linksB[i]) {
+			continue
+		}
+		childA, err := a.child(d.storeA, i, linksA)
+		if err != nil {
+			return err
+		}
+		childB, err := b.child(d.storeB, i, linksB)
+		if err != nil {
+			return err
+		}
+		if childA == nil && childB == nil {
+			continue
+		}
+		if err := d.diffNodes(childA, childB, height-1, offset+i*childCount); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *arrayDiffer) add(i uint64, val *cbg.Deferred) error {
+	if d.fns.Add == nil {
+		return nil
+	}
+	if err := decodeValue(val, d.after); err != nil {
+		return err
+	}
+	return d.fns.Add(i)
+}
+
+func (d *arrayDiffer) modify(i uint64, valA, valB *cbg.Deferred) error {
+	if d.fns.Modify == nil {
+		return nil
+	}
+	if err := decodeValue(valA, d.before); err != nil {
+		return err
+	}
+	if err := decodeValue(valB, d.after); err != nil {
+		return err
+	}
+	return d.fns.Modify(i)
+}
+
+func (d *arrayDiffer) remove(i uint64, val *cbg.Deferred) error {
+	if d.fns.Remove == nil {
+		return nil
+	}
+	if err := decodeValue(val, d.before); err != nil {
+		return err
+	}
+	return d.fns.Remove(i)
+}
+
+// Number of indices covered by each slot of a node at some height.
+func amtNodesForHeight(bitWidth, height uint64) uint64 {
+	if bitWidth*height >= 64 {
+		return math.MaxUint64
+	}
+	return 1 << (bitWidth * height)
+}
+
+func decodeValue(val *cbg.Deferred, out cbor.Unmarshaler) error {
+	if out == nil {
+		return nil
+	}
+	if deferred, ok := out.(*cbg.Deferred); ok {
+		*deferred = *val
+		return nil
+	}
+	return out.UnmarshalCBOR(bytes.NewReader(val.Raw))
+}
+
+//
+// AMT serialization
+// The go-amt-ipld node types are internal to that package, so are replicated here for the diff to walk.
+//
+
+// Serialized as tuple [BitWidth, Height, Count, Node].
+type amtRoot struct {
+	BitWidth uint64
+	Height   uint64
+	Count    uint64
+	Node     amtNode
+}
+
+// Serialized as tuple [Bmap, Links, Values].
+// Slot i of the node is occupied if bit i of the bitmap is set, its link or value found in the compacted
+// Links (for an interior node) or Values (for a leaf).
+type amtNode struct {
+	Bmap   []byte
+	Links  []cid.Cid
+	Values []*cbg.Deferred
+
+	// The first child of a virtual node raising a tree's root to a greater height.
+	lifted *amtNode
+}
+
+// Expands a node's compacted links and values to one per slot, undefined or nil for empty slots.
+// A nil node has all slots empty.
+func (n *amtNode) expand(width uint64) ([]cid.Cid, []*cbg.Deferred, error) {
+	links := make([]cid.Cid, width)
+	values := make([]*cbg.Deferred, width)
+	if n == nil || n.lifted != nil {
+		return links, values, nil
+	}
+	if uint64(len(n.Bmap))*8 < width {
+		return nil, nil, xerrors.Errorf("malformed amt node: bitmap of %d bytes for width %d", len(n.Bmap), width)
+	}
+	var li, vi int
+	for i := uint64(0); i < width; i++ {
+		if n.Bmap[i/8]&(1<<(i%8)) == 0 {
+			continue
+		}
+		if len(n.Links) > 0 {
+			if li >= len(n.Links) {
+				return nil, nil, xerrors.Errorf("malformed amt node: bitmap has more bits than %d links", len(n.Links))
+			}
+			links[i] = n.Links[li]
+			li++
+		} else {
+			if vi >= len(n.Values) {
+				return nil, nil, xerrors.Errorf("malformed amt node: bitmap has more bits than %d values", len(n.Values))
+			}
+			values[i] = n.Values[vi]
+			vi++
+		}
+	}
+	return links, values, nil
+}
+
+// Loads the child of a node at a slot, returning nil if the slot is empty.
+func (n *amtNode) child(s Store, i uint64, links []cid.Cid) (*amtNode, error) {
+	if n == nil {
+		return nil, nil
+	}
+	if n.lifted != nil {
+		if i == 0 {
+			return n.lifted, nil
+		}
+		return nil, nil
+	}
+	if !links[i].Defined() {
+		return nil, nil
+	}
+	var child amtNode
+	if err := s.Get(s.Context(), links[i], &child); err != nil {
+		return nil, xerrors.Errorf("failed to load amt node %v: %w", links[i], err)
+	}
+	return &child, nil
+}
+
+func (t *amtRoot) UnmarshalCBOR(r io.Reader) error {
+	*t = amtRoot{}
+	br := cbg.GetPeeker(r)
+	scratch := make([]byte, 8)
+
+	if err := readArrayHeader(br, scratch, 4); err != nil {
+		return err
+	}
+	for _, field := range []*uint64{&t.BitWidth, &t.Height, &t.Count} {
+		maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+		if err != nil {
+			return err
+		}
+		if maj != cbg.MajUnsignedInt {
+			return fmt.Errorf("wrong type for uint64 field")
+		}
+		*field = extra
+	}
+	return t.Node.UnmarshalCBOR(br)
+}
+
+func (t *amtNode) UnmarshalCBOR(r io.Reader) error {
+	*t = amtNode{}
+	br := cbg.GetPeeker(r)
+	scratch := make([]byte, 8)
+
+	if err := readArrayHeader(br, scratch, 3); err != nil {
+		return err
+	}
+
+	maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajByteString {
+		return fmt.Errorf("expected byte array")
+	}
+	if extra > cbg.ByteArrayMaxLen {
+		return fmt.Errorf("t.Bmap: byte array too large (%d)", extra)
+	}
+	t.Bmap = make([]byte, extra)
+	if _, err := io.ReadFull(br, t.Bmap); err != nil {
+		return err
+	}
+
+	maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajArray {
+		return fmt.Errorf("expected cbor array")
+	}
+	if extra > cbg.MaxLength {
+		return fmt.Errorf("t.Links: array too large (%d)", extra)
+	}
+	for i := uint64(0); i < extra; i++ {
+		c, err := cbg.ReadCid(br)
+		if err != nil {
+			return xerrors.Errorf("reading cid field t.Links failed: %w", err)
+		}
+		t.Links = append(t.Links, c)
+	}
+
+	maj, extra, err = cbg.CborReadHeaderBuf(br, scratch)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajArray {
+		return fmt.Errorf("expected cbor array")
+	}
+	if extra > cbg.MaxLength {
+		return fmt.Errorf("t.Values: array too large (%d)", extra)
+	}
+	for i := uint64(0); i < extra; i++ {
+		var v cbg.Deferred
+		if err := v.UnmarshalCBOR(br); err != nil {
+			return err
+		}
+		t.Values = append(t.Values, &v)
+	}
+	return nil
+}
+
+func readArrayHeader(br cbg.BytePeeker, scratch []byte, fields uint64) error {
+	maj, extra, err := cbg.CborReadHeaderBuf(br, scratch)
+	if err != nil {
+		return err
+	}
+	if maj != cbg.MajArray {
+		return fmt.Errorf("cbor input should be of type array")
+	}
+	if extra != fields {
+		return fmt.Errorf("cbor input had wrong number of fields")
+	}
+	return nil
+}
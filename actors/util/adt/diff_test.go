@@ -0,0 +1,257 @@
+package adt_test
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	cid "github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	cbg "github.com/whyrusleeping/cbor-gen"
+
+	"github.com/filecoin-project/specs-actors/v4/actors/util/adt"
+	"github.com/filecoin-project/specs-actors/v4/support/mock"
+)
+
+type diffResult struct {
+	added    map[string]int64
+	modified map[string][2]int64
+	removed  map[string]int64
+}
+
+func newDiffResult() *diffResult {
+	return &diffResult{
+		added:    make(map[string]int64),
+		modified: make(map[string][2]int64),
+		removed:  make(map[string]int64),
+	}
+}
+
+// Computes the expected differences between two sets of entries.
+func expectedDiff(a, b map[string]int64) *diffResult {
+	expected := newDiffResult()
+	for k, va := range a { //nolint:nomaprange
+		if vb, ok := b[k]; !ok {
+			expected.removed[k] = va
+		} else if va != vb {
+			expected.modified[k] = [2]int64{va, vb}
+		}
+	}
+	for k, vb := range b { //nolint:nomaprange
+		if _, ok := a[k]; !ok {
+			expected.added[k] = vb
+		}
+	}
+	return expected
+}
+
+func diffMaps(t *testing.T, a, b *adt.Map) *diffResult {
+	result := newDiffResult()
+	var before, after cbg.CborInt
+	require.NoError(t, adt.DiffMaps(a, b, &before, &after, adt.MapDiffFuncs{
+		Add: func(key string) error {
+			result.added[key] = int64(after)
+			return nil
+		},
+		Modify: func(key string) error {
+			result.modified[key] = [2]int64{int64(before), int64(after)}
+			return nil
+		},
+		Remove: func(key string) error {
+			result.removed[key] = int64(before)
+			return nil
+		},
+	}))
+	return result
+}
+
+func diffArrays(t *testing.T, a, b *adt.Array) *diffResult {
+	result := newDiffResult()
+	var before, after cbg.CborInt
+	lastIndex := int64(-1)
+	checkOrder := func(i uint64) {
+		require.Greater(t, int64(i), lastIndex, "indices out of order")
+		lastIndex = int64(i)
+	}
+	require.NoError(t, adt.DiffArrays(a, b, &before, &after, adt.ArrayDiffFuncs{
+		Add: func(i uint64) error {
+			checkOrder(i)
+			result.added[fmt.Sprint(i)] = int64(after)
+			return nil
+		},
+		Modify: func(i uint64) error {
+			checkOrder(i)
+			result.modified[fmt.Sprint(i)] = [2]int64{int64(before), int64(after)}
+			return nil
+		},
+		Remove: func(i uint64) error {
+			checkOrder(i)
+			result.removed[fmt.Sprint(i)] = int64(before)
+			return nil
+		},
+	}))
+	return result
+}
+
+func TestDiffMaps(t *testing.T) {
+	rt := mock.NewBuilder(address.Undef).Build(t)
+	store := adt.AsStore(rt)
+	rnd := rand.New(rand.NewSource(42))
+
+	build := func(entries map[string]int64) *adt.Map {
+		m, err := adt.MakeEmptyMap(store, 5)
+		require.NoError(t, err)
+		for k, v := range entries { //nolint:nomaprange
+			val := cbg.CborInt(v)
+			require.NoError(t, m.Put(stringKey(k), &val))
+		}
+		return m
+	}
+
+	for _, size := range []int{0, 1, 3, 10, 100, 1000} {
+		t.Run(fmt.Sprintf("size %d", size), func(t *testing.T) {
+			entriesA := make(map[string]int64)
+			for i := 0; i < size; i++ {
+				entriesA[fmt.Sprintf("key-%d", i)] = int64(i)
+			}
+			entriesB := make(map[string]int64)
+			for k, v := range entriesA { //nolint:nomaprange
+				switch rnd.Intn(10) {
+				case 0: // removed
+				case 1:
+					entriesB[k] = v + 1000
+				default:
+					entriesB[k] = v
+				}
+			}
+			for i := 0; i < size/5+1; i++ {
+				entriesB[fmt.Sprintf("new-key-%d", i)] = int64(-i)
+			}
+
+			a, b := build(entriesA), build(entriesB)
+			assert.Equal(t, expectedDiff(entriesA, entriesB), diffMaps(t, a, b))
+			assert.Equal(t, expectedDiff(entriesB, entriesA), diffMaps(t, b, a))
+			assert.Equal(t, newDiffResult(), diffMaps(t, a, a))
+		})
+	}
+}
+
+func TestDiffArrays(t *testing.T) {
+	rt := mock.NewBuilder(address.Undef).Build(t)
+	store := adt.AsStore(rt)
+	rnd := rand.New(rand.NewSource(42))
+
+	build := func(entries map[string]int64) *adt.Array {
+		arr, err := adt.MakeEmptyArray(store, 3)
+		require.NoError(t, err)
+		for k, v := range entries { //nolint:nomaprange
+			var i uint64
+			_, err := fmt.Sscan(k, &i)
+			require.NoError(t, err)
+			val := cbg.CborInt(v)
+			require.NoError(t, arr.Set(i, &val))
+		}
+		return arr
+	}
+
+	for _, size := range []int{0, 1, 8, 9, 100, 1000} {
+		t.Run(fmt.Sprintf("size %d", size), func(t *testing.T) {
+			entriesA := make(map[string]int64)
+			for i := 0; i < size; i++ {
+				entriesA[fmt.Sprint(rnd.Intn(2*size))] = int64(i)
+			}
+			entriesB := make(map[string]int64)
+			for k, v := range entriesA { //nolint:nomaprange
+				switch rnd.Intn(10) {
+				case 0: // removed
+				case 1:
+					entriesB[k] = v + 1000
+				default:
+					entriesB[k] = v
+				}
+			}
+			// add entries both within and beyond the existing range, growing the tree
+			for i := 0; i < size/5+1; i++ {
+				entriesB[fmt.Sprint(rnd.Intn(10*size+10))] = int64(-i)
+			}
+
+			a, b := build(entriesA), build(entriesB)
+			assert.Equal(t, expectedDiff(entriesA, entriesB), diffArrays(t, a, b))
+			assert.Equal(t, expectedDiff(entriesB, entriesA), diffArrays(t, b, a))
+			assert.Equal(t, newDiffResult(), diffArrays(t, a, a))
+		})
+	}
+}
+
+func TestDiffSkipsUnchangedSubtrees(t *testing.T) {
+	rt := mock.NewBuilder(address.Undef).Build(t)
+	store := &countingStore{Store: adt.AsStore(rt)}
+
+	m, err := adt.MakeEmptyMap(store, 5)
+	require.NoError(t, err)
+	arr, err := adt.MakeEmptyArray(store, 5)
+	require.NoError(t, err)
+	for i := int64(0); i < 10_000; i++ {
+		val := cbg.CborInt(i)
+		require.NoError(t, m.Put(abi.IntKey(i), &val))
+		require.NoError(t, arr.Set(uint64(i), &val))
+	}
+	mapRoot, err := m.Root()
+	require.NoError(t, err)
+	arrRoot, err := arr.Root()
+	require.NoError(t, err)
+
+	changed := cbg.CborInt(-1)
+	require.NoError(t, m.Put(abi.IntKey(5000), &changed))
+	require.NoError(t, arr.Set(5000, &changed))
+
+	before, err := adt.AsMap(store, mapRoot, 5)
+	require.NoError(t, err)
+	store.gets = 0
+	assert.Equal(t, []string{abi.IntKey(5000).Key()}, modifiedKeys(t, before, m))
+	assert.Less(t, store.gets, 20)
+
+	beforeArr, err := adt.AsArray(store, arrRoot, 5)
+	require.NoError(t, err)
+	store.gets = 0
+	var modified []uint64
+	require.NoError(t, adt.DiffArrays(beforeArr, arr, nil, nil, adt.ArrayDiffFuncs{
+		Modify: func(i uint64) error {
+			modified = append(modified, i)
+			return nil
+		},
+	}))
+	assert.Equal(t, []uint64{5000}, modified)
+	assert.Less(t, store.gets, 20)
+}
+
+func modifiedKeys(t *testing.T, a, b *adt.Map) []string {
+	var keys []string
+	require.NoError(t, adt.DiffMaps(a, b, nil, nil, adt.MapDiffFuncs{
+		Modify: func(key string) error {
+			keys = append(keys, key)
+			return nil
+		},
+	}))
+	return keys
+}
+
+type countingStore struct {
+	adt.Store
+	gets int
+}
+
+func (s *countingStore) Get(ctx context.Context, c cid.Cid, out interface{}) error {
+	s.gets++
+	return s.Store.Get(ctx, c, out)
+}
+
+type stringKey string
+
+func (k stringKey) Key() string {
+	return string(k)
+}
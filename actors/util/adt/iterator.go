@@ -0,0 +1,192 @@
+package adt
+
+import (
+	"errors"
+
+	hamt "github.com/filecoin-project/go-hamt-ipld/v3"
+	"github.com/filecoin-project/go-state-types/cbor"
+	cbg "github.com/whyrusleeping/cbor-gen"
+	"golang.org/x/xerrors"
+)
+
+// ErrStopIteration may be returned by an iteration callback to halt iteration early without error.
+var ErrStopIteration = errors.New("stop iteration")
+
+// Returns nil if an iteration error is the stop signal.
+// The signal is compared directly, rather than unwrapped, so that a stop returned by a nested iteration and
+// wrapped by the callback is reported as an error rather than halting the outer iteration.
+func iterationResult(err error) error {
+	if err == ErrStopIteration {
+		return nil
+	}
+	return err
+}
+
+// Number of entries an array iterator fetches at a time.
+const arrayIteratorBatchSize = 64
+
+// ArrayIterator pulls entries from an array in ascending index order.
+// The array must not be modified during iteration.
+//
+//	it := arr.IterateFrom(start)
+//	for it.Next() {
+//	    if err := it.Value(&v); err != nil { ... }
+//	    ... it.Index() ...
+//	}
+//	if err := it.Err(); err != nil { ... }
+type ArrayIterator struct {
+	arr *Array
+	// Index from which to fetch the next batch of entries.
+	next  uint64
+	batch []arrayIteratorEntry
+	pos   int
+	// Whether the last batch has been fetched.
+	exhausted bool
+	err       error
+}
+
+type arrayIteratorEntry struct {
+	index uint64
+	value *cbg.Deferred
+}
+
+// Returns an iterator over all entries in the array.
+func (a *Array) Iterate() *ArrayIterator {
+	return a.IterateFrom(0)
+}
+
+// Returns an iterator over the entries in the array with index at least `start`.
+func (a *Array) IterateFrom(start uint64) *ArrayIterator {
+	return &ArrayIterator{arr: a, next: start, pos: -1}
+}
+
+// Advances to the next entry, returning false when there are no more entries or an error occurred.
+func (it *ArrayIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	it.pos++
+	if it.pos < len(it.batch) {
+		return true
+	}
+	if it.exhausted {
+		return false
+	}
+
+	// Fetch the next batch, descending from the root again.
+	it.batch = it.batch[:0]
+	it.pos = 0
+	err := it.arr.root.ForEachAt(it.arr.store.Context(), it.next, func(i uint64, val *cbg.Deferred) error {
+		if len(it.batch) == arrayIteratorBatchSize {
+			it.next = i
+			return ErrStopIteration
+		}
+		it.batch = append(it.batch, arrayIteratorEntry{i, val})
+		return nil
+	})
+	if err == nil {
+		it.exhausted = true
+	} else if err != ErrStopIteration {
+		it.err = xerrors.Errorf("failed to iterate array from index %d: %w", it.next, err)
+		return false
+	}
+	return len(it.batch) > 0
+}
+
+// Returns the index of the current entry.
+func (it *ArrayIterator) Index() uint64 {
+	return it.batch[it.pos].index
+}
+
+// Deserializes the value of the current entry into `out`.
+func (it *ArrayIterator) Value(out cbor.Unmarshaler) error {
+	return decodeValue(it.batch[it.pos].value, out)
+}
+
+// Returns the error, if any, that halted iteration.
+func (it *ArrayIterator) Err() error {
+	return it.err
+}
+
+// MapIterator pulls entries from a map, in the same order as Map.ForEach.
+// The map is flushed when the iterator is created, and iteration reflects the map's content at that time.
+//
+//	it := m.Iterate()
+//	for it.Next() {
+//	    if err := it.Value(&v); err != nil { ... }
+//	    ... it.Key() ...
+//	}
+//	if err := it.Err(); err != nil { ... }
+type MapIterator struct {
+	store Store
+	// Pointers yet to be visited, as a stack of per-node lists.
+	stack [][]*hamt.Pointer
+	// Entries of the current bucket yet to be visited.
+	kvs []*hamt.KV
+	kv  *hamt.KV
+	err error
+}
+
+// Returns an iterator over all entries in the map.
+func (m *Map) Iterate() *MapIterator {
+	it := &MapIterator{store: m.store}
+	root, err := m.Root()
+	if err != nil {
+		it.err = err
+		return it
+	}
+	var nd hamt.Node
+	if err := m.store.Get(m.store.Context(), root, &nd); err != nil {
+		it.err = xerrors.Errorf("failed to load hamt node %v: %w", root, err)
+		return it
+	}
+	it.stack = [][]*hamt.Pointer{nd.Pointers}
+	return it
+}
+
+// Advances to the next entry, returning false when there are no more entries or an error occurred.
+func (it *MapIterator) Next() bool {
+	for it.err == nil {
+		if len(it.kvs) > 0 {
+			it.kv, it.kvs = it.kvs[0], it.kvs[1:]
+			return true
+		}
+		if len(it.stack) == 0 {
+			it.kv = nil
+			return false
+		}
+		top := it.stack[len(it.stack)-1]
+		if len(top) == 0 {
+			it.stack = it.stack[:len(it.stack)-1]
+			continue
+		}
+		ptr := top[0]
+		it.stack[len(it.stack)-1] = top[1:]
+		if !ptr.Link.Defined() {
+			it.kvs = ptr.KVs
+			continue
+		}
+		var nd hamt.Node
+		if err := it.store.Get(it.store.Context(), ptr.Link, &nd); err != nil {
+			it.err = xerrors.Errorf("failed to load hamt node %v: %w", ptr.Link, err)
+			return false
+		}
+		it.stack = append(it.stack, nd.Pointers)
+	}
+	return false
+}
+
+// Returns the key of the current entry.
+func (it *MapIterator) Key() string {
+	return string(it.kv.Key)
+}
+
+// Deserializes the value of the current entry into `out`.
+func (it *MapIterator) Value(out cbor.Unmarshaler) error {
+	return decodeValue(it.kv.Value, out)
+}
+
+// Returns the error, if any, that halted iteration.
+func (it *MapIterator) Err() error {
+	return it.err
+}
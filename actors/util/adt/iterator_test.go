@@ -0,0 +1,165 @@
+package adt_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	cbg "github.com/whyrusleeping/cbor-gen"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/specs-actors/v4/actors/util/adt"
+	"github.com/filecoin-project/specs-actors/v4/support/mock"
+)
+
+func TestArrayIteration(t *testing.T) {
+	rt := mock.NewBuilder(address.Undef).Build(t)
+	store := adt.AsStore(rt)
+
+	// Every third index from 0 to 897, with values equal to their index.
+	arr, err := adt.MakeEmptyArray(store, 3)
+	require.NoError(t, err)
+	var all []uint64
+	for i := uint64(0); i < 900; i += 3 {
+		val := cbg.CborInt(i)
+		require.NoError(t, arr.Set(i, &val))
+		all = append(all, i)
+	}
+
+	collect := func(iterate func(out *cbg.CborInt, fn func(i int64) error) error) []uint64 {
+		var indices []uint64
+		var val cbg.CborInt
+		require.NoError(t, iterate(&val, func(i int64) error {
+			require.Equal(t, cbg.CborInt(i), val)
+			indices = append(indices, uint64(i))
+			return nil
+		}))
+		return indices
+	}
+
+	t.Run("for each from", func(t *testing.T) {
+		for _, start := range []uint64{0, 1, 3, 400, 897, 898, 10_000} {
+			expected := filterIndices(all, start, 1<<63)
+			assert.Equal(t, expected, collect(func(out *cbg.CborInt, fn func(i int64) error) error {
+				return arr.ForEachFrom(start, out, fn)
+			}), "start %d", start)
+		}
+	})
+
+	t.Run("for each range", func(t *testing.T) {
+		for _, r := range [][2]uint64{{0, 0}, {0, 1}, {0, 900}, {1, 3}, {1, 4}, {300, 600}, {600, 300}, {890, 10_000}} {
+			expected := filterIndices(all, r[0], r[1])
+			assert.Equal(t, expected, collect(func(out *cbg.CborInt, fn func(i int64) error) error {
+				return arr.ForEachRange(r[0], r[1], out, fn)
+			}), "range %v", r)
+		}
+	})
+
+	t.Run("stop iteration", func(t *testing.T) {
+		var indices []uint64
+		require.NoError(t, arr.ForEach(nil, func(i int64) error {
+			if i > 10 {
+				return adt.ErrStopIteration
+			}
+			indices = append(indices, uint64(i))
+			return nil
+		}))
+		assert.Equal(t, []uint64{0, 3, 6, 9}, indices)
+
+		// Other errors propagate.
+		errBoom := errors.New("boom")
+		err := arr.ForEachFrom(5, nil, func(i int64) error {
+			return errBoom
+		})
+		assert.True(t, errors.Is(err, errBoom))
+
+		// A wrapped stop, such as from a nested iteration, is an error.
+		err = arr.ForEach(nil, func(i int64) error {
+			return xerrors.Errorf("nested: %w", adt.ErrStopIteration)
+		})
+		assert.True(t, errors.Is(err, adt.ErrStopIteration))
+	})
+
+	t.Run("iterator", func(t *testing.T) {
+		for _, start := range []uint64{0, 2, 192, 193, 897, 1000} {
+			var indices []uint64
+			it := arr.IterateFrom(start)
+			for it.Next() {
+				var val cbg.CborInt
+				require.NoError(t, it.Value(&val))
+				require.Equal(t, cbg.CborInt(it.Index()), val)
+				indices = append(indices, it.Index())
+			}
+			require.NoError(t, it.Err())
+			assert.False(t, it.Next())
+			assert.Equal(t, filterIndices(all, start, 1<<63), indices, "start %d", start)
+		}
+
+		empty, err := adt.MakeEmptyArray(store, 3)
+		require.NoError(t, err)
+		it := empty.Iterate()
+		assert.False(t, it.Next())
+		assert.NoError(t, it.Err())
+	})
+}
+
+func TestMapIteration(t *testing.T) {
+	rt := mock.NewBuilder(address.Undef).Build(t)
+	store := adt.AsStore(rt)
+
+	for _, size := range []int{0, 1, 10, 1000} {
+		t.Run(fmt.Sprintf("size %d", size), func(t *testing.T) {
+			m, err := adt.MakeEmptyMap(store, 3)
+			require.NoError(t, err)
+			for i := 0; i < size; i++ {
+				val := cbg.CborInt(i)
+				require.NoError(t, m.Put(abi.IntKey(int64(i)), &val))
+			}
+
+			expected := []string{}
+			require.NoError(t, m.ForEach(nil, func(key string) error {
+				expected = append(expected, key)
+				return nil
+			}))
+
+			keys := []string{}
+			it := m.Iterate()
+			for it.Next() {
+				var val cbg.CborInt
+				require.NoError(t, it.Value(&val))
+				k, err := abi.ParseIntKey(it.Key())
+				require.NoError(t, err)
+				require.Equal(t, cbg.CborInt(k), val)
+				keys = append(keys, it.Key())
+			}
+			require.NoError(t, it.Err())
+			assert.Equal(t, expected, keys)
+
+			// Stopping early visits a prefix of the same order.
+			prefix := []string{}
+			require.NoError(t, m.ForEach(nil, func(key string) error {
+				if len(prefix) == size/2 {
+					return adt.ErrStopIteration
+				}
+				prefix = append(prefix, key)
+				return nil
+			}))
+			assert.Equal(t, expected[:size/2], prefix)
+		})
+	}
+}
+
+// Returns the indices in [start, end).
+func filterIndices(indices []uint64, start, end uint64) []uint64 {
+	var filtered []uint64
+	for _, i := range indices {
+		if i >= start && i < end {
+			filtered = append(filtered, i)
+		}
+	}
+	return filtered
+}
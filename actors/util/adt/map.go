@@ -141,10 +141,10 @@ func (m *Map) Delete(k abi.Keyer) error {
 
 // Iterates all entries in the map, deserializing each value in turn into `out` and then
 // calling a function with the corresponding key.
-// Iteration halts if the function returns an error.
+// Iteration halts if the function returns an error, or without error if it returns ErrStopIteration.
 // If the output parameter is nil, deserialization is skipped.
 func (m *Map) ForEach(out cbor.Unmarshaler, fn func(key string) error) error {
-	return m.root.ForEach(m.store.Context(), func(k string, val *cbg.Deferred) error {
+	return iterationResult(m.root.ForEach(m.store.Context(), func(k string, val *cbg.Deferred) error {
 		if out != nil {
 			// Why doesn't hamt.ForEach() just return the value as bytes?
 			err := out.UnmarshalCBOR(bytes.NewReader(val.Raw))
@@ -153,7 +153,7 @@ func (m *Map) ForEach(out cbor.Unmarshaler, fn func(key string) error) error {
 			}
 		}
 		return fn(k)
-	})
+	}))
 }
 
 // Collects all the keys from the map into a slice of strings.
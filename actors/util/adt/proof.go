@@ -0,0 +1,137 @@
+package adt
+
+import (
+	"bytes"
+	"context"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+	cbg "github.com/whyrusleeping/cbor-gen"
+	"golang.org/x/xerrors"
+)
+
+// A single block of an inclusion proof: the encoded data of an object and the CID under which it's stored.
+type ProofBlock struct {
+	Cid  cid.Cid
+	Data []byte
+}
+
+// ProofRecorder is a store that records the blocks loaded through it.
+// Looking up an entry of a collection through a recorder records the chain of blocks from the collection's root
+// to the entry, which proves the entry's presence (or absence) under that root.
+// Objects put to a recorder are passed through to the underlying store and not recorded.
+type ProofRecorder struct {
+	store Store
+
+	mu     sync.Mutex
+	blocks []ProofBlock
+	seen   map[cid.Cid]struct{}
+}
+
+var _ Store = (*ProofRecorder)(nil)
+
+func NewProofRecorder(store Store) *ProofRecorder {
+	return &ProofRecorder{
+		store: store,
+		seen:  make(map[cid.Cid]struct{}),
+	}
+}
+
+func (r *ProofRecorder) Context() context.Context {
+	return r.store.Context()
+}
+
+func (r *ProofRecorder) Get(ctx context.Context, c cid.Cid, out interface{}) error {
+	if err := r.store.Get(ctx, c, out); err != nil {
+		return err
+	}
+	marshaler, ok := out.(cbg.CBORMarshaler)
+	if !ok {
+		return xerrors.Errorf("cannot record block %v for non-CBOR-marshalable %T", c, out)
+	}
+	// Objects are recorded re-encoded. The encoding is canonical, so this recovers the stored block,
+	// which is checked against its CID.
+	var buf bytes.Buffer
+	if err := marshaler.MarshalCBOR(&buf); err != nil {
+		return xerrors.Errorf("failed to encode block %v: %w", c, err)
+	}
+	if err := checkBlock(c, buf.Bytes()); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.seen[c]; !ok {
+		r.seen[c] = struct{}{}
+		r.blocks = append(r.blocks, ProofBlock{Cid: c, Data: buf.Bytes()})
+	}
+	return nil
+}
+
+func (r *ProofRecorder) Put(ctx context.Context, v interface{}) (cid.Cid, error) {
+	return r.store.Put(ctx, v)
+}
+
+// Returns the distinct blocks loaded so far, in the order they were first loaded.
+func (r *ProofRecorder) Blocks() []ProofBlock {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]ProofBlock(nil), r.blocks...)
+}
+
+// Creates a read-only store holding only the blocks of a proof.
+// Every block is checked against its CID, so a lookup from a trusted root through the store either
+// follows the same chain of blocks as in the store from which the proof was recorded, or fails.
+func NewProofStore(ctx context.Context, blocks []ProofBlock) (Store, error) {
+	ps := &proofStore{
+		ctx:    ctx,
+		blocks: make(map[cid.Cid][]byte, len(blocks)),
+	}
+	for _, b := range blocks {
+		if err := checkBlock(b.Cid, b.Data); err != nil {
+			return nil, err
+		}
+		ps.blocks[b.Cid] = b.Data
+	}
+	return ps, nil
+}
+
+type proofStore struct {
+	ctx    context.Context
+	blocks map[cid.Cid][]byte
+}
+
+func (ps *proofStore) Context() context.Context {
+	return ps.ctx
+}
+
+func (ps *proofStore) Get(_ context.Context, c cid.Cid, out interface{}) error {
+	data, ok := ps.blocks[c]
+	if !ok {
+		return xerrors.Errorf("block %v not in proof", c)
+	}
+	unmarshaler, ok := out.(cbg.CBORUnmarshaler)
+	if !ok {
+		return xerrors.Errorf("cannot decode block %v into non-CBOR-unmarshalable %T", c, out)
+	}
+	if err := unmarshaler.UnmarshalCBOR(bytes.NewReader(data)); err != nil {
+		return xerrors.Errorf("failed to decode block %v: %w", c, err)
+	}
+	return nil
+}
+
+func (ps *proofStore) Put(_ context.Context, v interface{}) (cid.Cid, error) {
+	return cid.Undef, xerrors.Errorf("cannot put %T to read-only proof store", v)
+}
+
+// Checks that data hashes to a CID.
+func checkBlock(c cid.Cid, data []byte) error {
+	actual, err := c.Prefix().Sum(data)
+	if err != nil {
+		return xerrors.Errorf("failed to hash block %v: %w", c, err)
+	}
+	if !actual.Equals(c) {
+		return xerrors.Errorf("block data hashes to %v, expected %v", actual, c)
+	}
+	return nil
+}
@@ -16,6 +16,7 @@ import (
 	"github.com/filecoin-project/specs-actors/v4/actors/builtin/system"
 	"github.com/filecoin-project/specs-actors/v4/actors/builtin/verifreg"
 	"github.com/filecoin-project/specs-actors/v4/actors/util/smoothing"
+	vm "github.com/filecoin-project/specs-actors/v4/support/vm"
 )
 
 func main() {
@@ -229,4 +230,12 @@ func main() {
 		panic(err)
 	}
 
+	// Test support
+	if err := gen.WriteTupleEncodersToFile("./support/vm/cbor_gen.go", "vm_test",
+		vm.Trace{},
+		vm.TraceCall{},
+		vm.TraceLog{},
+	); err != nil {
+		panic(err)
+	}
 }
@@ -22,7 +22,10 @@ import (
 
 	"github.com/filecoin-project/specs-actors/v4/actors/builtin"
 	"github.com/filecoin-project/specs-actors/v4/actors/builtin/exported"
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/multisig"
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/paych"
 	"github.com/filecoin-project/specs-actors/v4/actors/builtin/power"
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/verifreg"
 	"github.com/filecoin-project/specs-actors/v4/actors/migration/nv10"
 	"github.com/filecoin-project/specs-actors/v4/actors/states"
 	"github.com/filecoin-project/specs-actors/v4/actors/util/adt"
@@ -505,6 +508,115 @@ func TestCreateDeals(t *testing.T) {
 	}
 }
 
+func TestVerifiedDeals(t *testing.T) {
+	ctx := context.Background()
+	initialBalance := big.Mul(big.NewInt(1e9), big.NewInt(1e18))
+	minerCount := 3
+	clientCount := 9
+	verifierCount := 2
+
+	// set up sim
+	rnd := rand.New(rand.NewSource(42))
+	sim := agent.NewSim(ctx, t, newBlockStore, agent.SimConfig{Seed: rnd.Int63()})
+
+	// create miners
+	workerAccounts := vm_test.CreateAccounts(ctx, t, getV3VM(t, sim), minerCount, initialBalance, rnd.Int63())
+	sim.AddAgent(agent.NewMinerGenerator(
+		workerAccounts,
+		agent.MinerAgentConfig{
+			PrecommitRate:    0.1,
+			FaultRate:        0.0001,
+			RecoveryRate:     0.0001,
+			ProofType:        abi.RegisteredSealProof_StackedDrg32GiBV1_1,
+			StartingBalance:  big.Div(initialBalance, big.NewInt(2)),
+			MinMarketBalance: big.NewInt(1e18),
+			MaxMarketBalance: big.NewInt(2e18),
+		},
+		1.0, // create miner probability of 1 means a new miner is created every tick
+		rnd.Int63(),
+	))
+
+	clientAccounts := vm_test.CreateAccounts(ctx, t, getV3VM(t, sim), clientCount, initialBalance, rnd.Int63())
+	dealAgents := agent.AddDealClientsForAccounts(sim, clientAccounts, rnd.Int63(), agent.DealClientConfig{
+		DealRate:             .05,
+		MinPieceSize:         1 << 29,
+		MaxPieceSize:         32 << 30,
+		MinStoragePrice:      big.Zero(),
+		MaxStoragePrice:      abi.NewTokenAmount(200_000_000),
+		MinMarketBalance:     big.NewInt(1e18),
+		MaxMarketBalance:     big.NewInt(2e18),
+		VerifiedDealFraction: 0.5,
+	})
+
+	verifierAccounts := vm_test.CreateAccounts(ctx, t, getV3VM(t, sim), verifierCount, initialBalance, rnd.Int63())
+	rootAgent, verifierAgents := agent.AddVerifiersForAccounts(sim, vm_test.VerifregRoot, verifierAccounts, dealAgents, rnd.Int63(), agent.VerifRegConfig{
+		VerifierAllowance: abi.NewStoragePower(1 << 40),
+		ClientAllowance:   abi.NewStoragePower(64 << 30),
+		GrantRate:         0.02,
+	})
+
+	var pwrSt power.State
+	for i := 0; i < 1_000; i++ {
+		require.NoError(t, sim.Tick())
+
+		epoch := sim.GetVM().GetEpoch()
+		if epoch%100 == 0 {
+			stateTree, err := getV3VM(t, sim).GetStateTree()
+			require.NoError(t, err)
+
+			totalBalance, err := getV3VM(t, sim).GetTotalActorBalance()
+			require.NoError(t, err)
+
+			acc, err := states.CheckStateInvariants(stateTree, totalBalance, sim.GetVM().GetEpoch()-1)
+			require.NoError(t, err)
+			require.True(t, acc.IsEmpty(), strings.Join(acc.Messages(), "\n"))
+
+			require.NoError(t, sim.GetVM().GetState(builtin.StoragePowerActorAddr, &pwrSt))
+
+			// DataCap granted to clients is held by them until used by verified deals as they are published
+			granted := big.Zero()
+			for _, va := range verifierAgents {
+				granted = big.Add(granted, va.GrantedDataCap)
+			}
+			deals, verifiedDeals, used := 0, 0, big.Zero()
+			for _, da := range dealAgents {
+				deals += da.DealCount
+				verifiedDeals += da.VerifiedDealCount
+				used = big.Add(used, da.UsedDataCap)
+			}
+			held := totalClientDataCap(t, sim)
+			require.True(t, held.LessThanEqual(granted))
+			require.True(t, used.LessThanEqual(granted))
+			require.True(t, granted.LessThanEqual(rootAgent.GrantedDataCap))
+
+			// committed power includes miners below the consensus minimum
+			qaRatio := 0.0
+			if pwrSt.TotalBytesCommitted.GreaterThan(big.Zero()) {
+				qaRatio = float64(big.Div(big.Mul(pwrSt.TotalQABytesCommitted, big.NewInt(1000)), pwrSt.TotalBytesCommitted).Int64()) / 1000
+			}
+
+			fmt.Printf("Verified deals at %d: cmtRaw: %v  cmtQA: %v  qa/raw: %.3f  deals: %d  verified: %d  DataCap granted: %v  held: %v  used: %v  msgs: %d\n",
+				epoch, pwrSt.TotalBytesCommitted, pwrSt.TotalQABytesCommitted, qaRatio, deals, verifiedDeals,
+				granted, held, used, sim.MessageCount)
+		}
+	}
+}
+
+// Returns the total DataCap held by verified clients.
+func totalClientDataCap(t *testing.T, sim *agent.Sim) abi.StoragePower {
+	var st verifreg.State
+	require.NoError(t, sim.GetState(builtin.VerifiedRegistryActorAddr, &st))
+	clients, err := adt.AsMap(sim.Store(), st.VerifiedClients, builtin.DefaultHamtBitwidth)
+	require.NoError(t, err)
+	total := big.Zero()
+	var dataCap verifreg.DataCap
+	require.NoError(t, clients.ForEach(&dataCap, func(_ string) error {
+		total = big.Add(total, dataCap)
+		return nil
+	}))
+	return total
+}
+
 func TestCCUpgrades(t *testing.T) {
 	t.Skip("this is slow")
 	ctx := context.Background()
@@ -587,6 +699,144 @@ func TestCCUpgrades(t *testing.T) {
 	}
 }
 
+func TestMultisigs(t *testing.T) {
+	ctx := context.Background()
+	initialBalance := big.Mul(big.NewInt(1e6), big.NewInt(1e18))
+	accountCount := 12
+	multisigCount := 5
+
+	rnd := rand.New(rand.NewSource(42))
+	sim := agent.NewSim(ctx, t, newBlockStore, agent.SimConfig{Seed: rnd.Int63()})
+	accounts := vm_test.CreateAccounts(ctx, t, getV3VM(t, sim), accountCount, initialBalance, rnd.Int63())
+	multisigAgents := agent.AddMultisigsForAccounts(sim, accounts, multisigCount, rnd.Int63(), agent.MultisigConfig{
+		SignerCount:       4,
+		Threshold:         3,
+		InitialBalance:    big.Mul(big.NewInt(1e4), big.NewInt(1e18)),
+		LockedBalance:     big.Mul(big.NewInt(5e3), big.NewInt(1e18)),
+		VestingDuration:   200,
+		TransferRate:      0.2,
+		MaxTransfer:       big.Mul(big.NewInt(100), big.NewInt(1e18)),
+		SignerChangeRate:  0.02,
+		CancelProbability: 0.2,
+		MaxApprovalDelay:  10,
+	})
+
+	for i := 0; i < 500; i++ {
+		require.NoError(t, sim.Tick())
+
+		epoch := sim.GetVM().GetEpoch()
+		if epoch%100 == 0 {
+			stateTree, err := getV3VM(t, sim).GetStateTree()
+			require.NoError(t, err)
+
+			totalBalance, err := getV3VM(t, sim).GetTotalActorBalance()
+			require.NoError(t, err)
+
+			acc, err := states.CheckStateInvariants(stateTree, totalBalance, sim.GetVM().GetEpoch()-1)
+			require.NoError(t, err)
+			require.True(t, acc.IsEmpty(), strings.Join(acc.Messages(), "\n"))
+
+			// each wallet's state matches its agent's expectations
+			proposals, executed, cancelled, signerChanges := 0, 0, 0, 0
+			for _, ma := range multisigAgents {
+				var st multisig.State
+				require.NoError(t, sim.GetState(ma.IDAddress, &st))
+				require.Equal(t, len(ma.Signers()), len(st.Signers))
+				for _, signer := range ma.Signers() {
+					signerID, found := getV3VM(t, sim).NormalizeAddress(signer)
+					require.True(t, found)
+					require.True(t, st.IsSigner(signerID))
+				}
+				require.Equal(t, ma.Threshold(), st.NumApprovalsThreshold)
+				require.Equal(t, uint64(ma.PendingCount()), countPendingTxns(t, sim, &st))
+				require.NotZero(t, st.UnlockDuration)
+
+				proposals += ma.ProposalCount
+				executed += ma.ExecutedCount
+				cancelled += ma.CancelCount
+				signerChanges += ma.SignerChangeCount
+			}
+
+			fmt.Printf("Multisigs at %d: proposals: %d  executed: %d  cancelled: %d  signer changes: %d  msgs: %d\n",
+				epoch, proposals, executed, cancelled, signerChanges, sim.MessageCount)
+		}
+	}
+}
+
+func TestPaymentChannels(t *testing.T) {
+	ctx := context.Background()
+	initialBalance := big.Mul(big.NewInt(1e6), big.NewInt(1e18))
+	accountCount := 12
+	paychCount := 6
+
+	rnd := rand.New(rand.NewSource(42))
+	sim := agent.NewSim(ctx, t, newBlockStore, agent.SimConfig{Seed: rnd.Int63()})
+	accounts := vm_test.CreateAccounts(ctx, t, getV3VM(t, sim), accountCount, initialBalance, rnd.Int63())
+	paychAgents := agent.AddPaychsForAccounts(sim, accounts, paychCount, rnd.Int63(), agent.PaychConfig{
+		ChannelFunds:       big.Mul(big.NewInt(1e3), big.NewInt(1e18)),
+		ChannelDuration:    400,
+		VoucherRate:        0.5,
+		MaxPayment:         big.Mul(big.NewInt(5), big.NewInt(1e18)),
+		MaxLanes:           4,
+		NewLaneProbability: 0.1,
+		MergeProbability:   0.05,
+		RedeemRate:         0.05,
+	})
+
+	// channels settle after the settle delay following their payments
+	for i := 0; i < 2000; i++ {
+		require.NoError(t, sim.Tick())
+
+		epoch := sim.GetVM().GetEpoch()
+		if epoch%100 == 0 {
+			stateTree, err := getV3VM(t, sim).GetStateTree()
+			require.NoError(t, err)
+
+			totalBalance, err := getV3VM(t, sim).GetTotalActorBalance()
+			require.NoError(t, err)
+
+			acc, err := states.CheckStateInvariants(stateTree, totalBalance, sim.GetVM().GetEpoch()-1)
+			require.NoError(t, err)
+			require.True(t, acc.IsEmpty(), strings.Join(acc.Messages(), "\n"))
+
+			// each channel's redeemed value matches its agent's expectations until collected
+			vouchers, redeemed, merged, collected := 0, 0, 0, 0
+			for _, pa := range paychAgents {
+				_, found, err := stateTree.GetActor(pa.IDAddress)
+				require.NoError(t, err)
+				require.Equal(t, !pa.Collected, found)
+				if found {
+					var st paych.State
+					require.NoError(t, sim.GetState(pa.IDAddress, &st))
+					require.Equal(t, pa.ToSend(), st.ToSend)
+				} else {
+					collected++
+				}
+
+				vouchers += pa.VoucherCount
+				redeemed += pa.RedeemCount
+				merged += pa.MergeCount
+			}
+
+			fmt.Printf("Payment channels at %d: vouchers: %d  redeemed: %d  merged: %d  collected: %d  msgs: %d\n",
+				epoch, vouchers, redeemed, merged, collected, sim.MessageCount)
+		}
+	}
+
+	for _, pa := range paychAgents {
+		assert.True(t, pa.Collected)
+		assert.NotZero(t, pa.RedeemCount)
+	}
+}
+
+func countPendingTxns(t *testing.T, sim *agent.Sim, st *multisig.State) uint64 {
+	txns, err := adt.AsMap(sim.Store(), st.PendingTxns, builtin.DefaultHamtBitwidth)
+	require.NoError(t, err)
+	keys, err := txns.CollectKeys()
+	require.NoError(t, err)
+	return uint64(len(keys))
+}
+
 func newBlockStore() cbor.IpldBlockstore {
 	return ipld.NewBlockStoreInMemory()
 }
@@ -16,6 +16,7 @@ import (
 	"github.com/filecoin-project/specs-actors/v4/actors/builtin/market"
 	"github.com/filecoin-project/specs-actors/v4/actors/builtin/power"
 	"github.com/filecoin-project/specs-actors/v4/actors/builtin/reward"
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/verifreg"
 	"github.com/ipfs/go-cid"
 )
 
@@ -27,10 +28,15 @@ type DealClientConfig struct {
 	MaxStoragePrice  abi.TokenAmount // maximum price per epoch a client will pay for storage
 	MinMarketBalance abi.TokenAmount // balance below which client will top up funds in market actor
 	MaxMarketBalance abi.TokenAmount // balance to which client will top up funds in market actor
+
+	VerifiedDealFraction float64 // fraction of deals made verified, when the client has sufficient DataCap
 }
 
 type DealClientAgent struct {
-	DealCount int
+	DealCount         int
+	VerifiedDealCount int
+	// DataCap used by verified deals
+	UsedDataCap abi.StoragePower
 
 	account    address.Address
 	config     DealClientConfig
@@ -39,6 +45,8 @@ type DealClientAgent struct {
 
 	// tracks funds expected to be locked for client deal payment
 	expectedMarketBalance abi.TokenAmount
+	// tracks DataCap expected to be available for verified deals, which never exceeds the client's actual DataCap
+	expectedDataCap abi.StoragePower
 }
 
 func AddDealClientsForAccounts(s SimState, accounts []address.Address, seed int64, config DealClientConfig) []*DealClientAgent {
@@ -59,6 +67,8 @@ func NewDealClientAgent(account address.Address, seed int64, config DealClientCo
 		config:                config,
 		rnd:                   rnd,
 		expectedMarketBalance: big.Zero(),
+		expectedDataCap:       big.Zero(),
+		UsedDataCap:           big.Zero(),
 		dealEvents:            NewRateIterator(config.DealRate, rnd.Int63()),
 	}
 }
@@ -123,7 +133,14 @@ func (dca *DealClientAgent) createDeal(s SimState, provider DealProvider) error
 		pieceSize = 1 << bits.Len64(pieceSize)
 	}
 
-	providerCollateral, err := calculateProviderCollateral(s, abi.PaddedPieceSize(pieceSize))
+	// only draw a random number for verification when verified deals are configured, so other simulations are unchanged
+	verified := false
+	if dca.config.VerifiedDealFraction > 0 {
+		verified = dca.rnd.Float64() < dca.config.VerifiedDealFraction &&
+			dca.expectedDataCap.GreaterThanEqual(big.NewIntUnsigned(pieceSize))
+	}
+
+	providerCollateral, err := calculateProviderCollateral(s, abi.PaddedPieceSize(pieceSize), verified)
 	if err != nil {
 		return err
 	}
@@ -153,11 +170,14 @@ func (dca *DealClientAgent) createDeal(s SimState, provider DealProvider) error
 	}
 
 	dca.expectedMarketBalance = big.Sub(dca.expectedMarketBalance, storageFee)
+	if verified {
+		dca.useDataCap(big.NewIntUnsigned(pieceSize))
+	}
 
 	proposal := market.DealProposal{
 		PieceCID:             pieceCid,
 		PieceSize:            abi.PaddedPieceSize(pieceSize),
-		VerifiedDeal:         false,
+		VerifiedDeal:         verified,
 		Client:               dca.account,
 		Provider:             provider.Address(),
 		Label:                dca.account.String() + ":" + strconv.Itoa(dca.DealCount),
@@ -176,6 +196,23 @@ func (dca *DealClientAgent) createDeal(s SimState, provider DealProvider) error
 	return nil
 }
 
+// Reserves DataCap for a verified deal.
+func (dca *DealClientAgent) useDataCap(size abi.StoragePower) {
+	dca.expectedDataCap = big.Sub(dca.expectedDataCap, size)
+	// The verified registry forgets a client when its remaining DataCap falls below the minimum deal size.
+	// Forfeit the remainder so that expected DataCap never exceeds what is on chain.
+	if dca.expectedDataCap.LessThan(verifreg.MinVerifiedDealSize) {
+		dca.expectedDataCap = big.Zero()
+	}
+	dca.UsedDataCap = big.Add(dca.UsedDataCap, size)
+	dca.VerifiedDealCount++
+}
+
+// Records DataCap granted to this client by a verifier.
+func (dca *DealClientAgent) addDataCap(allowance abi.StoragePower) {
+	dca.expectedDataCap = big.Add(dca.expectedDataCap, allowance)
+}
+
 func (dca *DealClientAgent) generatePieceCID() (cid.Cid, error) {
 	data := make([]byte, 10)
 	if _, err := dca.rnd.Read(data); err != nil {
@@ -192,7 +229,7 @@ func (dca *DealClientAgent) generatePieceCID() (cid.Cid, error) {
 
 // Always choose the minimum collateral. This appears to be realistic, and there's is not an obvious way to model a
 // more complex distribution.
-func calculateProviderCollateral(s SimState, pieceSize abi.PaddedPieceSize) (abi.TokenAmount, error) {
+func calculateProviderCollateral(s SimState, pieceSize abi.PaddedPieceSize, verified bool) (abi.TokenAmount, error) {
 	var powerSt power.State
 	if err := s.GetState(builtin.StoragePowerActorAddr, &powerSt); err != nil {
 		return big.Zero(), err
@@ -203,7 +240,7 @@ func calculateProviderCollateral(s SimState, pieceSize abi.PaddedPieceSize) (abi
 		return big.Zero(), err
 	}
 
-	min, _ := market.DealProviderCollateralBounds(pieceSize, false, powerSt.TotalRawBytePower,
+	min, _ := market.DealProviderCollateralBounds(pieceSize, verified, powerSt.TotalRawBytePower,
 		powerSt.TotalQualityAdjPower, rewardSt.ThisEpochBaselinePower, s.NetworkCirculatingSupply())
 	return min, nil
 }
@@ -11,6 +11,7 @@ import (
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/go-state-types/big"
 	"github.com/filecoin-project/go-state-types/cbor"
+	"github.com/filecoin-project/go-state-types/crypto"
 	"github.com/filecoin-project/go-state-types/dline"
 	"github.com/ipfs/go-cid"
 	mh "github.com/multiformats/go-multihash"
@@ -441,6 +442,12 @@ func (ma *MinerAgent) submitPoStForDeadline(v SimState, dlIdx uint64) ([]message
 		return nil, err
 	}
 
+	chainCommitEpoch := v.GetEpoch() - 1
+	chainCommitRand, err := v.GetRandomnessFromTickets(crypto.DomainSeparationTag_PoStChainCommit, chainCommitEpoch, nil)
+	if err != nil {
+		return nil, err
+	}
+
 	params := miner.SubmitWindowedPoStParams{
 		Deadline:   dlIdx,
 		Partitions: partitions,
@@ -448,8 +455,8 @@ func (ma *MinerAgent) submitPoStForDeadline(v SimState, dlIdx uint64) ([]message
 			PoStProof:  postProofType,
 			ProofBytes: []byte{},
 		}},
-		ChainCommitEpoch: v.GetEpoch() - 1,
-		ChainCommitRand:  []byte("not really random"),
+		ChainCommitEpoch: chainCommitEpoch,
+		ChainCommitRand:  chainCommitRand,
 	}
 
 	return []message{{
@@ -0,0 +1,499 @@
+package agent
+
+import (
+	"bytes"
+	"math/rand"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/cbor"
+	"github.com/filecoin-project/go-state-types/exitcode"
+	"github.com/pkg/errors"
+
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin"
+	initactor "github.com/filecoin-project/specs-actors/v4/actors/builtin/init"
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/multisig"
+)
+
+type MultisigConfig struct {
+	SignerCount       int             // number of signers of a new wallet
+	Threshold         uint64          // number of approvals required to execute a transaction in a new wallet
+	InitialBalance    abi.TokenAmount // funds sent to a new wallet by its creator
+	LockedBalance     abi.TokenAmount // funds locked by the wallet after creation to vest linearly (may be zero)
+	VestingDuration   abi.ChainEpoch  // epochs over which locked funds vest
+	TransferRate      float64         // transfers proposed per epoch
+	MaxTransfer       abi.TokenAmount // maximum value of a transfer
+	SignerChangeRate  float64         // signer additions, removals and swaps proposed per epoch
+	CancelProbability float64         // probability that the proposer of a transaction cancels it before enough approvals
+	MaxApprovalDelay  abi.ChainEpoch  // maximum epochs between proposal and each approval (at least 1)
+}
+
+type MultisigAgent struct {
+	Config    MultisigConfig
+	IDAddress address.Address // address of the wallet, undefined until created
+
+	// Stats
+	ProposalCount     int
+	ExecutedCount     int
+	CancelCount       int
+	SignerChangeCount int
+
+	// signers of the wallet and approval threshold, expected to match its state
+	signers   []address.Address
+	threshold uint64
+	// accounts from which new signers and transfer recipients are chosen
+	accounts []address.Address
+	// balance of the wallet less the value of executed transfers
+	expectedBalance abi.TokenAmount
+	// value of proposed transfers not yet executed or cancelled
+	pendingValue abi.TokenAmount
+	// proposed transactions not yet executed or cancelled, by transaction ID
+	pendingTxns map[multisig.TxnID]*pendingTxn
+	// whether a transaction changing the wallet itself is pending, during which no other transactions are proposed
+	adminPending bool
+	// whether the wallet has locked funds
+	locked bool
+	// whether the message creating the wallet has been sent
+	creating bool
+
+	// priority queue used to trigger actions at future epochs
+	operationSchedule *opQueue
+	// iterator to time transfer proposals according to rate
+	transferEvents *RateIterator
+	// iterator to time signer changes according to rate
+	signerChangeEvents *RateIterator
+	rnd                *rand.Rand
+}
+
+// Creates a multisig agent for each group of signers drawn at random from the accounts.
+// The signers of each wallet may later be swapped for others of the accounts.
+func AddMultisigsForAccounts(s SimState, accounts []address.Address, count int, seed int64, config MultisigConfig) []*MultisigAgent {
+	rnd := rand.New(rand.NewSource(seed))
+	var agents []*MultisigAgent
+	for i := 0; i < count; i++ {
+		var signers []address.Address
+		for _, idx := range rnd.Perm(len(accounts))[:config.SignerCount] {
+			signers = append(signers, accounts[idx])
+		}
+		agent := NewMultisigAgent(signers, accounts, rnd.Int63(), config)
+		agents = append(agents, agent)
+		s.AddAgent(agent)
+	}
+	return agents
+}
+
+// Creates an agent for a multisig wallet with the given signers, the first of which creates the wallet.
+func NewMultisigAgent(signers []address.Address, accounts []address.Address, seed int64, config MultisigConfig) *MultisigAgent {
+	rnd := rand.New(rand.NewSource(seed))
+	return &MultisigAgent{
+		Config:             config,
+		signers:            append([]address.Address(nil), signers...),
+		threshold:          config.Threshold,
+		accounts:           accounts,
+		expectedBalance:    big.Zero(),
+		pendingValue:       big.Zero(),
+		pendingTxns:        make(map[multisig.TxnID]*pendingTxn),
+		operationSchedule:  &opQueue{},
+		transferEvents:     NewRateIterator(config.TransferRate, rnd.Int63()),
+		signerChangeEvents: NewRateIterator(config.SignerChangeRate, rnd.Int63()),
+		rnd:                rnd,
+	}
+}
+
+// Returns the signers the wallet is expected to have.
+func (ma *MultisigAgent) Signers() []address.Address {
+	return append([]address.Address(nil), ma.signers...)
+}
+
+// Returns the approval threshold the wallet is expected to have.
+func (ma *MultisigAgent) Threshold() uint64 {
+	return ma.threshold
+}
+
+// Returns the number of transactions the wallet is expected to have pending.
+func (ma *MultisigAgent) PendingCount() int {
+	return len(ma.pendingTxns)
+}
+
+func (ma *MultisigAgent) Tick(s SimState) ([]message, error) {
+	// create the wallet, then wait for it to exist
+	if ma.IDAddress == address.Undef {
+		if ma.creating {
+			return nil, nil
+		}
+		msg, err := ma.createWallet()
+		if err != nil {
+			return nil, err
+		}
+		ma.creating = true
+		return []message{msg}, nil
+	}
+
+	var messages []message
+
+	// act on scheduled operations
+	for _, op := range ma.operationSchedule.PopOpsUntil(s.GetEpoch()) {
+		switch o := op.action.(type) {
+		case multisigApproveAction:
+			messages = append(messages, ma.approve(o.txnID, o.signer))
+		case multisigCancelAction:
+			messages = append(messages, ma.cancel(o.txnID, o.proposer))
+		}
+	}
+
+	// lock funds as soon as the wallet is idle, until a lock is executed
+	if !ma.locked && ma.Config.VestingDuration > 0 && ma.Config.LockedBalance.GreaterThan(big.Zero()) && ma.idle() {
+		msg, err := ma.proposeLockBalance(s)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+
+	// Propose transfers. Transfers are not proposed while a change to the wallet is pending.
+	if err := ma.transferEvents.Tick(func() error {
+		if ma.adminPending {
+			return nil
+		}
+		msg, ok, err := ma.proposeTransfer(s)
+		if err != nil {
+			return err
+		}
+		if ok {
+			messages = append(messages, msg)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	// Propose signer changes. Changes are proposed only when no other transaction is pending, so that
+	// scheduled approvals remain valid.
+	if err := ma.signerChangeEvents.Tick(func() error {
+		if !ma.idle() {
+			return nil
+		}
+		msg, ok, err := ma.proposeSignerChange()
+		if err != nil {
+			return err
+		}
+		if ok {
+			messages = append(messages, msg)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+func (ma *MultisigAgent) createWallet() (message, error) {
+	ctorParams, err := serializeParams(&multisig.ConstructorParams{
+		Signers:               ma.signers,
+		NumApprovalsThreshold: ma.threshold,
+	})
+	if err != nil {
+		return message{}, err
+	}
+	return message{
+		From:   ma.signers[0],
+		To:     builtin.InitActorAddr,
+		Value:  ma.Config.InitialBalance,
+		Method: builtin.MethodsInit.Exec,
+		Params: &initactor.ExecParams{
+			CodeCID:           builtin.MultisigActorCodeID,
+			ConstructorParams: ctorParams,
+		},
+		ReturnHandler: func(_ SimState, _ message, ret cbor.Marshaler) error {
+			execRet, ok := ret.(*initactor.ExecReturn)
+			if !ok {
+				return errors.Errorf("exec return has wrong type: %v", ret)
+			}
+			ma.IDAddress = execRet.IDAddress
+			ma.expectedBalance = ma.Config.InitialBalance
+			return nil
+		},
+	}, nil
+}
+
+// Proposes a transfer of a random amount no greater than the funds available after pending transfers.
+// Returns false if no funds are available.
+func (ma *MultisigAgent) proposeTransfer(s SimState) (message, bool, error) {
+	var st multisig.State
+	if err := s.GetState(ma.IDAddress, &st); err != nil {
+		return message{}, false, err
+	}
+	available := big.Sub(big.Sub(ma.expectedBalance, ma.pendingValue), st.AmountLocked(s.GetEpoch()-st.StartEpoch))
+	if available.GreaterThan(ma.Config.MaxTransfer) {
+		available = ma.Config.MaxTransfer
+	}
+	// transfer a uniformly random fraction of the available funds
+	value := big.Div(big.Mul(available, big.NewInt(ma.rnd.Int63n(1000)+1)), big.NewInt(1000))
+	if value.LessThanEqual(big.Zero()) {
+		return message{}, false, nil
+	}
+	recipient := ma.accounts[ma.rnd.Intn(len(ma.accounts))]
+
+	ma.pendingValue = big.Add(ma.pendingValue, value)
+	msg := ma.propose(&multisig.ProposeParams{
+		To:     recipient,
+		Value:  value,
+		Method: builtin.MethodSend,
+	}, &pendingTxn{
+		value: value,
+		onExecuted: func() {
+			ma.expectedBalance = big.Sub(ma.expectedBalance, value)
+		},
+	})
+	return msg, true, nil
+}
+
+// Proposes that the wallet lock funds to vest from the current epoch.
+func (ma *MultisigAgent) proposeLockBalance(s SimState) (message, error) {
+	params, err := serializeParams(&multisig.LockBalanceParams{
+		StartEpoch:     s.GetEpoch(),
+		UnlockDuration: ma.Config.VestingDuration,
+		Amount:         ma.Config.LockedBalance,
+	})
+	if err != nil {
+		return message{}, err
+	}
+	return ma.proposeAdmin(builtin.MethodsMultisig.LockBalance, params, func() {
+		ma.locked = true
+	}), nil
+}
+
+// Proposes adding, removing or swapping a signer, chosen at random among those changes possible.
+// Returns false if no change is possible.
+func (ma *MultisigAgent) proposeSignerChange() (message, bool, error) {
+	var candidates []address.Address
+	for _, a := range ma.accounts {
+		if !ma.isSigner(a) {
+			candidates = append(candidates, a)
+		}
+	}
+
+	var choices []abi.MethodNum
+	if len(candidates) > 0 && len(ma.signers) < multisig.SignersMax {
+		choices = append(choices, builtin.MethodsMultisig.AddSigner)
+	}
+	if len(ma.signers) > 1 {
+		choices = append(choices, builtin.MethodsMultisig.RemoveSigner)
+	}
+	if len(candidates) > 0 {
+		choices = append(choices, builtin.MethodsMultisig.SwapSigner)
+	}
+	if len(choices) == 0 {
+		return message{}, false, nil
+	}
+
+	method := choices[ma.rnd.Intn(len(choices))]
+	var params cbor.Marshaler
+	var onExecuted func()
+	switch method {
+	case builtin.MethodsMultisig.AddSigner:
+		added := candidates[ma.rnd.Intn(len(candidates))]
+		params = &multisig.AddSignerParams{Signer: added}
+		onExecuted = func() {
+			ma.signers = append(ma.signers, added)
+		}
+	case builtin.MethodsMultisig.RemoveSigner:
+		removed := ma.signers[ma.rnd.Intn(len(ma.signers))]
+		// the threshold must be decreased if it would otherwise exceed the number of signers
+		decrease := uint64(len(ma.signers)-1) < ma.threshold
+		params = &multisig.RemoveSignerParams{Signer: removed, Decrease: decrease}
+		onExecuted = func() {
+			ma.signers = removeAddress(ma.signers, removed)
+			if decrease {
+				ma.threshold--
+			}
+		}
+	case builtin.MethodsMultisig.SwapSigner:
+		from := ma.signers[ma.rnd.Intn(len(ma.signers))]
+		to := candidates[ma.rnd.Intn(len(candidates))]
+		params = &multisig.SwapSignerParams{From: from, To: to}
+		onExecuted = func() {
+			ma.signers = append(removeAddress(ma.signers, from), to)
+		}
+	}
+
+	serialized, err := serializeParams(params)
+	if err != nil {
+		return message{}, false, err
+	}
+	return ma.proposeAdmin(method, serialized, func() {
+		onExecuted()
+		ma.SignerChangeCount++
+	}), true, nil
+}
+
+// Proposes a transaction calling the wallet itself.
+func (ma *MultisigAgent) proposeAdmin(method abi.MethodNum, params []byte, onExecuted func()) message {
+	ma.adminPending = true
+	return ma.propose(&multisig.ProposeParams{
+		To:     ma.IDAddress,
+		Value:  big.Zero(),
+		Method: method,
+		Params: params,
+	}, &pendingTxn{
+		value:      big.Zero(),
+		admin:      true,
+		onExecuted: onExecuted,
+	})
+}
+
+// Proposes a transaction from a random signer. Once proposed, approvals by enough other signers are scheduled
+// at random delays or, with the configured probability, approvals by too few signers followed by cancellation.
+func (ma *MultisigAgent) propose(params *multisig.ProposeParams, txn *pendingTxn) message {
+	order := ma.rnd.Perm(len(ma.signers))
+	proposer := ma.signers[order[0]]
+	var approvers []address.Address
+	for _, idx := range order[1:ma.threshold] {
+		approvers = append(approvers, ma.signers[idx])
+	}
+	cancel := len(approvers) > 0 && ma.rnd.Float64() < ma.Config.CancelProbability
+	if cancel {
+		approvers = approvers[:ma.rnd.Intn(len(approvers))]
+	}
+	ma.ProposalCount++
+
+	return message{
+		From:   proposer,
+		To:     ma.IDAddress,
+		Value:  big.Zero(),
+		Method: builtin.MethodsMultisig.Propose,
+		Params: params,
+		ReturnHandler: func(s SimState, _ message, ret cbor.Marshaler) error {
+			proposeRet, ok := ret.(*multisig.ProposeReturn)
+			if !ok {
+				return errors.Errorf("propose return has wrong type: %v", ret)
+			}
+			if proposeRet.Applied {
+				return ma.executed(txn, proposeRet.Code)
+			}
+			ma.pendingTxns[proposeRet.TxnID] = txn
+
+			for _, approver := range approvers {
+				ma.operationSchedule.ScheduleOp(s.GetEpoch()+ma.approvalDelay(), multisigApproveAction{proposeRet.TxnID, approver})
+			}
+			if cancel {
+				// cancel after all approvals
+				ma.operationSchedule.ScheduleOp(s.GetEpoch()+ma.Config.MaxApprovalDelay+1, multisigCancelAction{proposeRet.TxnID, proposer})
+			}
+			return nil
+		},
+	}
+}
+
+func (ma *MultisigAgent) approve(txnID multisig.TxnID, signer address.Address) message {
+	return message{
+		From:   signer,
+		To:     ma.IDAddress,
+		Value:  big.Zero(),
+		Method: builtin.MethodsMultisig.Approve,
+		Params: &multisig.TxnIDParams{ID: txnID},
+		ReturnHandler: func(_ SimState, _ message, ret cbor.Marshaler) error {
+			approveRet, ok := ret.(*multisig.ApproveReturn)
+			if !ok {
+				return errors.Errorf("approve return has wrong type: %v", ret)
+			}
+			if !approveRet.Applied {
+				return nil
+			}
+			txn := ma.pendingTxns[txnID]
+			delete(ma.pendingTxns, txnID)
+			return ma.executed(txn, approveRet.Code)
+		},
+	}
+}
+
+func (ma *MultisigAgent) cancel(txnID multisig.TxnID, proposer address.Address) message {
+	return message{
+		From:   proposer,
+		To:     ma.IDAddress,
+		Value:  big.Zero(),
+		Method: builtin.MethodsMultisig.Cancel,
+		Params: &multisig.TxnIDParams{ID: txnID},
+		ReturnHandler: func(_ SimState, _ message, _ cbor.Marshaler) error {
+			txn := ma.pendingTxns[txnID]
+			delete(ma.pendingTxns, txnID)
+			ma.settled(txn)
+			ma.CancelCount++
+			return nil
+		},
+	}
+}
+
+// Records the execution of a transaction.
+func (ma *MultisigAgent) executed(txn *pendingTxn, code exitcode.ExitCode) error {
+	if code != exitcode.Ok {
+		return errors.Errorf("multisig %v transaction failed with exit code %d", ma.IDAddress, code)
+	}
+	ma.settled(txn)
+	txn.onExecuted()
+	ma.ExecutedCount++
+	return nil
+}
+
+// Releases the funds and any lock on proposals held by a transaction that is no longer pending.
+func (ma *MultisigAgent) settled(txn *pendingTxn) {
+	ma.pendingValue = big.Sub(ma.pendingValue, txn.value)
+	if txn.admin {
+		ma.adminPending = false
+	}
+}
+
+// Returns whether the wallet has no pending transactions, including any not yet proposed.
+func (ma *MultisigAgent) idle() bool {
+	return !ma.adminPending && ma.pendingValue.IsZero() && len(ma.pendingTxns) == 0
+}
+
+func (ma *MultisigAgent) approvalDelay() abi.ChainEpoch {
+	return 1 + abi.ChainEpoch(ma.rnd.Int63n(int64(ma.Config.MaxApprovalDelay)))
+}
+
+func (ma *MultisigAgent) isSigner(a address.Address) bool {
+	for _, s := range ma.signers {
+		if s == a {
+			return true
+		}
+	}
+	return false
+}
+
+func removeAddress(addrs []address.Address, toRemove address.Address) []address.Address {
+	var result []address.Address
+	for _, a := range addrs {
+		if a != toRemove {
+			result = append(result, a)
+		}
+	}
+	return result
+}
+
+func serializeParams(params cbor.Marshaler) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := params.MarshalCBOR(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// A transaction proposed by a multisig agent.
+type pendingTxn struct {
+	value      abi.TokenAmount // value transferred by the transaction
+	admin      bool            // whether the transaction calls the wallet itself
+	onExecuted func()          // updates the agent's model of the wallet on execution
+}
+
+type multisigApproveAction struct {
+	txnID  multisig.TxnID
+	signer address.Address
+}
+
+type multisigCancelAction struct {
+	txnID    multisig.TxnID
+	proposer address.Address
+}
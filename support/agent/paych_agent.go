@@ -0,0 +1,365 @@
+package agent
+
+import (
+	"math/rand"
+	"sort"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/cbor"
+	"github.com/filecoin-project/go-state-types/crypto"
+	"github.com/pkg/errors"
+
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin"
+	initactor "github.com/filecoin-project/specs-actors/v4/actors/builtin/init"
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/paych"
+)
+
+type PaychConfig struct {
+	ChannelFunds       abi.TokenAmount // funds sent to a new channel by its payer
+	ChannelDuration    abi.ChainEpoch  // epochs after creation at which payments stop and the channel is settled
+	VoucherRate        float64         // vouchers sent off-chain per epoch
+	MaxPayment         abi.TokenAmount // maximum value paid by a single voucher
+	MaxLanes           int             // maximum number of lanes in use at once
+	NewLaneProbability float64         // probability that a payment opens a new lane, if fewer than the maximum are in use
+	MergeProbability   float64         // probability that a payment merges another fully redeemed lane into its lane
+	RedeemRate         float64         // rate at which vouchers are redeemed (redemptions per lane with an unredeemed voucher per epoch)
+}
+
+// PaychAgent models both parties to a payment channel: the payer, who creates and funds the channel and sends
+// vouchers off-chain, and the payee, who redeems the vouchers on chain and finally collects the redeemed funds.
+type PaychAgent struct {
+	Config    PaychConfig
+	From      address.Address // payer
+	To        address.Address // payee
+	IDAddress address.Address // address of the channel, undefined until created
+
+	// Stats
+	VoucherCount int
+	RedeemCount  int
+	MergeCount   int
+	Collected    bool
+
+	// lanes in use, by lane ID
+	lanes map[uint64]*paychLane
+	// lane ID for the next new lane
+	nextLane uint64
+	// value of the latest vouchers of all lanes in use, which must not exceed the channel's funds
+	committed abi.TokenAmount
+	// value redeemed and not merged into another lane, expected to match the channel's state
+	toSend abi.TokenAmount
+
+	createdAt  abi.ChainEpoch
+	creating   bool
+	settling   bool
+	settlingAt abi.ChainEpoch
+
+	// iterator to time vouchers according to rate
+	voucherEvents *RateIterator
+	// iterator to time redemptions according to rate
+	redeemEvents *RateIterator
+	rnd          *rand.Rand
+}
+
+// Creates a payment channel agent for each of a number of pairs of distinct accounts chosen at random.
+func AddPaychsForAccounts(s SimState, accounts []address.Address, count int, seed int64, config PaychConfig) []*PaychAgent {
+	rnd := rand.New(rand.NewSource(seed))
+	var agents []*PaychAgent
+	for i := 0; i < count; i++ {
+		pair := rnd.Perm(len(accounts))[:2]
+		agent := NewPaychAgent(accounts[pair[0]], accounts[pair[1]], rnd.Int63(), config)
+		agents = append(agents, agent)
+		s.AddAgent(agent)
+	}
+	return agents
+}
+
+func NewPaychAgent(from, to address.Address, seed int64, config PaychConfig) *PaychAgent {
+	rnd := rand.New(rand.NewSource(seed))
+	return &PaychAgent{
+		Config:        config,
+		From:          from,
+		To:            to,
+		lanes:         make(map[uint64]*paychLane),
+		committed:     big.Zero(),
+		toSend:        big.Zero(),
+		voucherEvents: NewRateIterator(config.VoucherRate, rnd.Int63()),
+		// redemption rate is the configured rate times the number of lanes with unredeemed vouchers or zero.
+		redeemEvents: NewRateIterator(0.0, rnd.Int63()),
+		rnd:          rnd,
+	}
+}
+
+// Returns the redeemed amount the channel is expected to send to the payee on collection.
+func (pa *PaychAgent) ToSend() abi.TokenAmount {
+	return pa.toSend
+}
+
+func (pa *PaychAgent) Tick(s SimState) ([]message, error) {
+	// create the channel, then wait for it to exist
+	if pa.IDAddress == address.Undef {
+		if pa.creating {
+			return nil, nil
+		}
+		msg, err := pa.createChannel()
+		if err != nil {
+			return nil, err
+		}
+		pa.creating = true
+		return []message{msg}, nil
+	}
+	if pa.Collected {
+		return nil, nil
+	}
+
+	var messages []message
+	if s.GetEpoch() < pa.createdAt+pa.Config.ChannelDuration {
+		// Send vouchers off-chain.
+		if err := pa.voucherEvents.Tick(func() error {
+			pa.pay()
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+
+		// Redeem vouchers on chain.
+		redeemRate := pa.Config.RedeemRate * float64(len(pa.redeemableLanes()))
+		if err := pa.redeemEvents.TickWithRate(redeemRate, func() error {
+			// each lane may be redeemed at most once at a time, so there may be no lane left to redeem this epoch
+			if lanes := pa.redeemableLanes(); len(lanes) > 0 {
+				messages = append(messages, pa.redeem(lanes[pa.rnd.Intn(len(lanes))]))
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+		return messages, nil
+	}
+
+	// Payments are done. Redeem all outstanding vouchers, then settle and collect.
+	if lanes := pa.redeemableLanes(); len(lanes) > 0 {
+		for _, laneID := range lanes {
+			messages = append(messages, pa.redeem(laneID))
+		}
+		return messages, nil
+	}
+	if pa.redeeming() || pa.settling {
+		return nil, nil
+	}
+	if pa.settlingAt == 0 {
+		return []message{pa.settle()}, nil
+	}
+	if s.GetEpoch() >= pa.settlingAt {
+		return []message{pa.collect()}, nil
+	}
+	return nil, nil
+}
+
+func (pa *PaychAgent) createChannel() (message, error) {
+	ctorParams, err := serializeParams(&paych.ConstructorParams{
+		From: pa.From,
+		To:   pa.To,
+	})
+	if err != nil {
+		return message{}, err
+	}
+	return message{
+		From:   pa.From,
+		To:     builtin.InitActorAddr,
+		Value:  pa.Config.ChannelFunds,
+		Method: builtin.MethodsInit.Exec,
+		Params: &initactor.ExecParams{
+			CodeCID:           builtin.PaymentChannelActorCodeID,
+			ConstructorParams: ctorParams,
+		},
+		ReturnHandler: func(s SimState, _ message, ret cbor.Marshaler) error {
+			execRet, ok := ret.(*initactor.ExecReturn)
+			if !ok {
+				return errors.Errorf("exec return has wrong type: %v", ret)
+			}
+			pa.IDAddress = execRet.IDAddress
+			pa.createdAt = s.GetEpoch()
+			return nil
+		},
+	}, nil
+}
+
+// Sends a voucher paying a random amount on a random lane, possibly opening a new lane or merging another lane
+// into the lane. The voucher supersedes any earlier unredeemed voucher on the lane.
+func (pa *PaychAgent) pay() {
+	available := big.Sub(pa.Config.ChannelFunds, pa.committed)
+	if available.GreaterThan(pa.Config.MaxPayment) {
+		available = pa.Config.MaxPayment
+	}
+	// pay a uniformly random fraction of the maximum payment or available funds
+	payment := big.Div(big.Mul(available, big.NewInt(pa.rnd.Int63n(1000)+1)), big.NewInt(1000))
+	if payment.LessThanEqual(big.Zero()) {
+		return
+	}
+
+	laneIDs := pa.laneIDs()
+	var laneID uint64
+	if len(laneIDs) == 0 || (len(laneIDs) < pa.Config.MaxLanes && pa.rnd.Float64() < pa.Config.NewLaneProbability) {
+		laneID = pa.nextLane
+		pa.nextLane++
+		pa.lanes[laneID] = &paychLane{
+			amount:         big.Zero(),
+			redeemedAmount: big.Zero(),
+			mergedRedeemed: big.Zero(),
+		}
+	} else {
+		laneID = laneIDs[pa.rnd.Intn(len(laneIDs))]
+	}
+	lane := pa.lanes[laneID]
+
+	if !lane.redeeming && pa.rnd.Float64() < pa.Config.MergeProbability {
+		pa.merge(laneID)
+	}
+
+	lane.amount = big.Add(lane.amount, payment)
+	lane.nonce++
+	pa.committed = big.Add(pa.committed, payment)
+	pa.VoucherCount++
+}
+
+// Merges a random fully redeemed lane into another lane, which is not being redeemed.
+// The merged lane's redeemed value is carried by the lane's next voucher, and the merged lane is no longer used.
+func (pa *PaychAgent) merge(laneID uint64) {
+	var candidates []uint64
+	for _, id := range pa.laneIDs() {
+		other := pa.lanes[id]
+		if id != laneID && !other.redeeming && other.redeemedNonce > 0 && other.nonce == other.redeemedNonce {
+			candidates = append(candidates, id)
+		}
+	}
+	if len(candidates) == 0 {
+		return
+	}
+	mergedID := candidates[pa.rnd.Intn(len(candidates))]
+	merged := pa.lanes[mergedID]
+	delete(pa.lanes, mergedID)
+
+	lane := pa.lanes[laneID]
+	lane.merges = append(lane.merges, paych.Merge{Lane: mergedID, Nonce: merged.redeemedNonce + 1})
+	lane.mergedRedeemed = big.Add(lane.mergedRedeemed, merged.redeemedAmount)
+	lane.amount = big.Add(lane.amount, merged.redeemedAmount)
+	pa.MergeCount++
+}
+
+// Redeems the latest voucher of a lane.
+func (pa *PaychAgent) redeem(laneID uint64) message {
+	lane := pa.lanes[laneID]
+	lane.redeeming = true
+	sv := paych.SignedVoucher{
+		ChannelAddr: pa.IDAddress,
+		Lane:        laneID,
+		Nonce:       lane.nonce,
+		Amount:      lane.amount,
+		Merges:      lane.merges,
+		Signature: &crypto.Signature{
+			Type: crypto.SigTypeBLS,
+			Data: []byte("not really a signature"),
+		},
+	}
+	return message{
+		From:   pa.To,
+		To:     pa.IDAddress,
+		Value:  big.Zero(),
+		Method: builtin.MethodsPaych.UpdateChannelState,
+		Params: &paych.UpdateChannelStateParams{Sv: sv},
+		ReturnHandler: func(_ SimState, _ message, _ cbor.Marshaler) error {
+			// the redeemed value of merged lanes is already included in the amount sent
+			pa.toSend = big.Add(pa.toSend, big.Sub(sv.Amount, big.Add(lane.redeemedAmount, lane.mergedRedeemed)))
+			lane.redeemedAmount = sv.Amount
+			lane.redeemedNonce = sv.Nonce
+			lane.mergedRedeemed = big.Zero()
+			lane.merges = nil
+			lane.redeeming = false
+			pa.RedeemCount++
+			return nil
+		},
+	}
+}
+
+func (pa *PaychAgent) settle() message {
+	pa.settling = true
+	return message{
+		From:   pa.From,
+		To:     pa.IDAddress,
+		Value:  big.Zero(),
+		Method: builtin.MethodsPaych.Settle,
+		Params: nil,
+		ReturnHandler: func(s SimState, _ message, _ cbor.Marshaler) error {
+			var st paych.State
+			if err := s.GetState(pa.IDAddress, &st); err != nil {
+				return err
+			}
+			pa.settlingAt = st.SettlingAt
+			pa.settling = false
+			return nil
+		},
+	}
+}
+
+func (pa *PaychAgent) collect() message {
+	pa.settling = true
+	return message{
+		From:   pa.To,
+		To:     pa.IDAddress,
+		Value:  big.Zero(),
+		Method: builtin.MethodsPaych.Collect,
+		Params: nil,
+		ReturnHandler: func(_ SimState, _ message, _ cbor.Marshaler) error {
+			pa.Collected = true
+			return nil
+		},
+	}
+}
+
+// Returns the IDs of lanes in use, in order.
+func (pa *PaychAgent) laneIDs() []uint64 {
+	ids := make([]uint64, 0, len(pa.lanes))
+	for id := range pa.lanes { //nolint:nomaprange
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// Returns the IDs of lanes with a voucher that is not redeemed nor being redeemed, in order.
+func (pa *PaychAgent) redeemableLanes() []uint64 {
+	var ids []uint64
+	for _, id := range pa.laneIDs() {
+		lane := pa.lanes[id]
+		if !lane.redeeming && lane.nonce > lane.redeemedNonce {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Returns whether any lane is being redeemed.
+func (pa *PaychAgent) redeeming() bool {
+	for _, lane := range pa.lanes { //nolint:nomaprange
+		if lane.redeeming {
+			return true
+		}
+	}
+	return false
+}
+
+// A lane of a payment channel, as known to both parties.
+type paychLane struct {
+	// amount and nonce of the latest voucher sent off-chain
+	amount abi.TokenAmount
+	nonce  uint64
+	// amount and nonce of the latest voucher redeemed on chain
+	redeemedAmount abi.TokenAmount
+	redeemedNonce  uint64
+	// lanes to be merged into this lane by its next redeemed voucher, and their total redeemed value
+	merges         []paych.Merge
+	mergedRedeemed abi.TokenAmount
+	// whether a voucher for the lane is being redeemed
+	redeeming bool
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/go-state-types/big"
 	"github.com/filecoin-project/go-state-types/cbor"
+	"github.com/filecoin-project/go-state-types/crypto"
 	"github.com/filecoin-project/go-state-types/dline"
 	"github.com/filecoin-project/go-state-types/exitcode"
 	"github.com/filecoin-project/go-state-types/rt"
@@ -132,6 +133,31 @@ func (s *Sim) SwapVM(v SimVM, vmFactory VMFactoryFunc, minerStateFactory func(co
 	s.CreateMinerParamsFunc = createMinerParams
 }
 
+// Records all messages subsequently applied by the simulation, so that they may be replayed with vm.Replay.
+// The simulation must be running v4 VMs, and must not checkpoint its state to new blockstores while recording.
+func (s *Sim) Record(rec *vm.Recorder) error {
+	v, ok := s.v.(*vm.VM)
+	if !ok {
+		return errors.Errorf("cannot record messages applied to VM of type %T", s.v)
+	}
+	v.SetRecorder(rec)
+
+	factory := s.vmFactory
+	s.vmFactory = func(ctx context.Context, impl vm2.ActorImplLookup, store adt.Store, stateRoot cid.Cid, epoch abi.ChainEpoch) (SimVM, error) {
+		next, err := factory(ctx, impl, store, stateRoot, epoch)
+		if err != nil {
+			return nil, err
+		}
+		nextV4, ok := next.(*vm.VM)
+		if !ok {
+			return nil, errors.Errorf("cannot record messages applied to VM of type %T", next)
+		}
+		nextV4.SetRecorder(rec)
+		return next, nil
+	}
+	return nil
+}
+
 //////////////////////////////////////////
 //
 //  Sim execution
@@ -168,7 +194,7 @@ func (s *Sim) Tick() error {
 
 	// run messages
 	for _, msg := range blockMessages {
-		ret, code := s.v.ApplyMessage(msg.From, msg.To, msg.Value, msg.Method, msg.Params)
+		ret, code := s.applyMessage(msg.From, msg.To, msg.Value, msg.Method, msg.Params)
 
 		// for now, assume everything should work
 		if code != exitcode.Ok {
@@ -198,7 +224,7 @@ func (s *Sim) Tick() error {
 	}
 
 	// run cron
-	_, code := s.v.ApplyMessage(builtin.SystemActorAddr, builtin.CronActorAddr, big.Zero(), builtin.MethodsCron.EpochTick, nil)
+	_, code := s.applyMessage(builtin.SystemActorAddr, builtin.CronActorAddr, big.Zero(), builtin.MethodsCron.EpochTick, nil)
 	if code != exitcode.Ok {
 		return errors.Errorf("exitcode %d: cron message failed:\n%s\n", code, strings.Join(s.v.GetLogs(), "\n"))
 	}
@@ -301,12 +327,34 @@ func (s *Sim) CreateMinerParams(worker, owner address.Address, sealProof abi.Reg
 	return s.CreateMinerParamsFunc(worker, owner, sealProof)
 }
 
+// Returns the ticket randomness actors will draw for the given parameters.
+// VMs without a randomness source (prior versions) always provide the same fake randomness.
+func (s *Sim) GetRandomnessFromTickets(tag crypto.DomainSeparationTag, epoch abi.ChainEpoch, entropy []byte) (abi.Randomness, error) {
+	if rv, ok := s.v.(randomnessVM); ok {
+		return rv.GetRandomnessSource().GetRandomnessFromTickets(tag, epoch, entropy)
+	}
+	return []byte("not really random"), nil
+}
+
 //////////////////////////////////////////////////
 //
 //  Misc Methods
 //
 //////////////////////////////////////////////////
 
+// Applies a message with a VM of either the current or a prior version, which differ in reporting gas used.
+func (s *Sim) applyMessage(from, to address.Address, value abi.TokenAmount, method abi.MethodNum, params interface{}) (cbor.Marshaler, exitcode.ExitCode) {
+	switch v := s.v.(type) {
+	case gasReportingVM:
+		ret, code, _ := v.ApplyMessage(from, to, value, method, params)
+		return ret, code
+	case legacyVM:
+		return v.ApplyMessage(from, to, value, method, params)
+	default:
+		panic(fmt.Sprintf("VM %T cannot apply messages", s.v))
+	}
+}
+
 func (s *Sim) rewardMiner(addr address.Address, wins uint64) error {
 	if wins < 1 {
 		return nil
@@ -318,7 +366,7 @@ func (s *Sim) rewardMiner(addr address.Address, wins uint64) error {
 		GasReward: big.Zero(),
 		WinCount:  int64(wins),
 	}
-	_, code := s.v.ApplyMessage(builtin.SystemActorAddr, builtin.RewardActorAddr, big.Zero(), builtin.MethodsReward.AwardBlockReward, &rewardParams)
+	_, code := s.applyMessage(builtin.SystemActorAddr, builtin.RewardActorAddr, big.Zero(), builtin.MethodsReward.AwardBlockReward, &rewardParams)
 	if code != exitcode.Ok {
 		return errors.Errorf("exitcode %d: reward message failed:\n%s\n", code, strings.Join(s.v.GetLogs(), "\n"))
 	}
@@ -447,6 +495,7 @@ type SimState interface {
 	NetworkCirculatingSupply() abi.TokenAmount
 	MinerState(addr address.Address) (SimMinerState, error)
 	CreateMinerParams(worker, owner address.Address, sealProof abi.RegisteredSealProof) (interface{}, error)
+	GetRandomnessFromTickets(tag crypto.DomainSeparationTag, epoch abi.ChainEpoch, entropy []byte) (abi.Randomness, error)
 
 	// randomly select an agent capable of making deals.
 	// Returns nil if no providers exist.
@@ -494,9 +543,9 @@ type PowerTable struct {
 	minerPower   []minerPowerTable
 }
 
-// VM interface allowing a simulation to operate over multiple VM versions
+// VM interface allowing a simulation to operate over multiple VM versions.
+// A SimVM must also be either a gasReportingVM or a legacyVM.
 type SimVM interface {
-	ApplyMessage(from, to address.Address, value abi.TokenAmount, method abi.MethodNum, params interface{}) (cbor.Marshaler, exitcode.ExitCode)
 	GetCirculatingSupply() abi.TokenAmount
 	GetLogs() []string
 	GetState(addr address.Address, out cbor.Unmarshaler) error
@@ -515,6 +564,26 @@ type SimVM interface {
 var _ SimVM = (*vm.VM)(nil)
 var _ SimVM = (*vm2.VM)(nil)
 
+// VM reporting the gas used by each message
+type gasReportingVM interface {
+	ApplyMessage(from, to address.Address, value abi.TokenAmount, method abi.MethodNum, params interface{}) (cbor.Marshaler, exitcode.ExitCode, int64)
+}
+
+// VM of a prior version, which doesn't report gas used
+type legacyVM interface {
+	ApplyMessage(from, to address.Address, value abi.TokenAmount, method abi.MethodNum, params interface{}) (cbor.Marshaler, exitcode.ExitCode)
+}
+
+var _ gasReportingVM = (*vm.VM)(nil)
+var _ legacyVM = (*vm2.VM)(nil)
+
+// VM with a configurable source of randomness
+type randomnessVM interface {
+	GetRandomnessSource() vm.RandomnessSource
+}
+
+var _ randomnessVM = (*vm.VM)(nil)
+
 type SimMinerState interface {
 	HasSectorNo(adt.Store, abi.SectorNumber) (bool, error)
 	FindSector(adt.Store, abi.SectorNumber) (uint64, uint64, error)
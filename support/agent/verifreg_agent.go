@@ -0,0 +1,163 @@
+package agent
+
+import (
+	"math/rand"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/cbor"
+
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin"
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/verifreg"
+)
+
+type VerifRegConfig struct {
+	VerifierAllowance abi.StoragePower // DataCap granted to a verifier by the root key, whenever it runs low
+	ClientAllowance   abi.StoragePower // DataCap granted to a verified client by a verifier at a time
+	GrantRate         float64          // grants of DataCap to clients per verifier per epoch
+}
+
+// VerifRegRootAgent plays the verified registry's root key, adding verifiers and topping up their DataCap whenever
+// it falls too low for them to grant DataCap to a client.
+type VerifRegRootAgent struct {
+	Config  VerifRegConfig
+	RootKey address.Address
+
+	// Stats
+	// DataCap granted to verifiers
+	GrantedDataCap abi.StoragePower
+
+	verifiers []*VerifierAgent
+}
+
+// VerifierAgent plays a verifier, granting DataCap to deal clients at random.
+type VerifierAgent struct {
+	Config  VerifRegConfig
+	Address address.Address
+
+	// Stats
+	// DataCap granted to clients
+	GrantedDataCap abi.StoragePower
+
+	// tracks DataCap expected to be available to grant
+	expectedDataCap abi.StoragePower
+	// true while the root key is adding DataCap for this verifier
+	adding bool
+	// number of grants to clients not yet applied
+	granting    int
+	clients     []*DealClientAgent
+	grantEvents *RateIterator
+	rnd         *rand.Rand
+}
+
+// Creates a root key agent and a verifier for each account, granting DataCap to the given clients.
+// The accounts must not include the root key nor any of the clients.
+func AddVerifiersForAccounts(s SimState, rootKey address.Address, accounts []address.Address, clients []*DealClientAgent,
+	seed int64, config VerifRegConfig) (*VerifRegRootAgent, []*VerifierAgent) {
+	rnd := rand.New(rand.NewSource(seed))
+	var verifiers []*VerifierAgent
+	for _, account := range accounts {
+		verifier := NewVerifierAgent(account, clients, rnd.Int63(), config)
+		verifiers = append(verifiers, verifier)
+		s.AddAgent(verifier)
+	}
+	root := NewVerifRegRootAgent(rootKey, verifiers, config)
+	s.AddAgent(root)
+	return root, verifiers
+}
+
+func NewVerifRegRootAgent(rootKey address.Address, verifiers []*VerifierAgent, config VerifRegConfig) *VerifRegRootAgent {
+	return &VerifRegRootAgent{
+		Config:         config,
+		RootKey:        rootKey,
+		GrantedDataCap: big.Zero(),
+		verifiers:      verifiers,
+	}
+}
+
+func (ra *VerifRegRootAgent) Tick(_ SimState) ([]message, error) {
+	var messages []message
+	for _, verifier := range ra.verifiers {
+		// A verifier doesn't grant DataCap it doesn't expect to have, so it's safe to replace its remaining DataCap
+		// while it can't make a grant and none of its grants are pending.
+		if verifier.adding || verifier.granting > 0 || verifier.expectedDataCap.GreaterThanEqual(ra.Config.ClientAllowance) {
+			continue
+		}
+		messages = append(messages, ra.addVerifier(verifier))
+	}
+	return messages, nil
+}
+
+func (ra *VerifRegRootAgent) addVerifier(verifier *VerifierAgent) message {
+	verifier.adding = true
+	allowance := ra.Config.VerifierAllowance
+	return message{
+		From:   ra.RootKey,
+		To:     builtin.VerifiedRegistryActorAddr,
+		Value:  big.Zero(),
+		Method: builtin.MethodsVerifiedRegistry.AddVerifier,
+		Params: &verifreg.AddVerifierParams{
+			Address:   verifier.Address,
+			Allowance: allowance,
+		},
+		ReturnHandler: func(_ SimState, _ message, _ cbor.Marshaler) error {
+			// adding a verifier replaces any DataCap it has left
+			ra.GrantedDataCap = big.Add(ra.GrantedDataCap, big.Sub(allowance, verifier.expectedDataCap))
+			verifier.expectedDataCap = allowance
+			verifier.adding = false
+			return nil
+		},
+	}
+}
+
+func NewVerifierAgent(account address.Address, clients []*DealClientAgent, seed int64, config VerifRegConfig) *VerifierAgent {
+	rnd := rand.New(rand.NewSource(seed))
+	return &VerifierAgent{
+		Config:          config,
+		Address:         account,
+		GrantedDataCap:  big.Zero(),
+		expectedDataCap: big.Zero(),
+		clients:         clients,
+		grantEvents:     NewRateIterator(config.GrantRate, rnd.Int63()),
+		rnd:             rnd,
+	}
+}
+
+func (va *VerifierAgent) Tick(_ SimState) ([]message, error) {
+	var messages []message
+	if err := va.grantEvents.Tick(func() error {
+		// skip the grant if there are no clients, or the verifier is waiting for more DataCap
+		if len(va.clients) == 0 || va.adding || va.expectedDataCap.LessThan(va.Config.ClientAllowance) {
+			return nil
+		}
+		messages = append(messages, va.grant(va.clients[va.rnd.Intn(len(va.clients))]))
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+func (va *VerifierAgent) grant(client *DealClientAgent) message {
+	allowance := va.Config.ClientAllowance
+	// lower expected DataCap immediately so the verifier doesn't grant more than it has
+	va.expectedDataCap = big.Sub(va.expectedDataCap, allowance)
+	va.granting++
+	return message{
+		From:   va.Address,
+		To:     builtin.VerifiedRegistryActorAddr,
+		Value:  big.Zero(),
+		Method: builtin.MethodsVerifiedRegistry.AddVerifiedClient,
+		Params: &verifreg.AddVerifiedClientParams{
+			Address:   client.account,
+			Allowance: allowance,
+		},
+		ReturnHandler: func(_ SimState, _ message, _ cbor.Marshaler) error {
+			va.GrantedDataCap = big.Add(va.GrantedDataCap, allowance)
+			client.addDataCap(allowance)
+			va.granting--
+			return nil
+		},
+	}
+}
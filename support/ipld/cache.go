@@ -0,0 +1,291 @@
+package ipld
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"math/big"
+	"reflect"
+	"sync"
+
+	amt "github.com/filecoin-project/go-amt-ipld/v3"
+	hamt "github.com/filecoin-project/go-hamt-ipld/v3"
+	block "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ipldcbor "github.com/ipfs/go-ipld-cbor"
+	cbg "github.com/whyrusleeping/cbor-gen"
+)
+
+//
+// Read-through caching IPLD store.
+//
+// Caches objects read from a block store by CID and Go type in an LRU bounded by the total size of the cached
+// objects' encoded blocks. The store sits under an ADT store, e.g. adt.WrapStore(ctx, NewCachingStore(bs, n)).
+//
+// Callers may mutate the objects they load (the HAMT does), so a decoded object is cached only for types with
+// an explicit copy function, which copies it into and out of the cache. These are the HAMT and AMT nodes, whose
+// decoding dominates loading of collections. Objects of other types are cached as their encoded block and
+// decoded on each hit.
+// Objects are cached only when read, not when written, so that writes (such as of a migrated state tree)
+// don't evict frequently read objects.
+//
+type CachingStore struct {
+	bs       ipldcbor.IpldBlockstore
+	cbor     ipldcbor.IpldStore
+	metrics  *MetricsBlockStore // Underlying metrics store, if any, which also counts cache hits and misses
+	maxBytes int64
+
+	mu      sync.Mutex
+	lru     *list.List // Of *cacheEntry, most recently used at the front
+	entries map[cacheKey]*list.Element
+	bytes   int64
+	stats   CacheStats
+}
+
+var _ ipldcbor.IpldStore = (*CachingStore)(nil)
+
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	// Number of objects currently cached, and the total size of their encoded blocks.
+	Entries int
+	Bytes   int64
+}
+
+type cacheKey struct {
+	c   cid.Cid
+	typ reflect.Type
+}
+
+type cacheEntry struct {
+	key  cacheKey
+	size int64
+	obj  interface{} // Decoded object, for types with a copy function
+	blk  block.Block // Encoded object, for other types
+}
+
+// Wraps a block store with a cache of objects totalling at most maxBytes of encoded data.
+// Objects larger than maxBytes are never cached.
+// If the block store is a MetricsBlockStore, cache hits and misses are also counted there, alongside its reads
+// and writes (which are then made only for misses).
+// The caching store is safe for concurrent use if the underlying store is.
+func NewCachingStore(bs ipldcbor.IpldBlockstore, maxBytes int64) *CachingStore {
+	metrics, _ := bs.(*MetricsBlockStore)
+	return &CachingStore{
+		bs:       bs,
+		cbor:     ipldcbor.NewCborStore(bs),
+		metrics:  metrics,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[cacheKey]*list.Element),
+	}
+}
+
+func (cs *CachingStore) Get(_ context.Context, c cid.Cid, out interface{}) error {
+	key := cacheKey{c, reflect.TypeOf(out)}
+	copyObject := objectCopiers[key.typ]
+	if entry, ok := cs.lookup(key); ok {
+		if copyObject != nil {
+			copyObject(out, entry.obj)
+			return nil
+		}
+		return decodeBlock(entry.blk, out)
+	}
+
+	blk, err := cs.bs.Get(c)
+	if err != nil {
+		return err
+	}
+	if err := decodeBlock(blk, out); err != nil {
+		return err
+	}
+	entry := &cacheEntry{key: key, size: int64(len(blk.RawData()))}
+	if entry.size > cs.maxBytes {
+		return nil
+	}
+	if copyObject != nil {
+		// Copy outside the lock. Cached objects are never mutated, so may be copied from concurrently.
+		entry.obj = reflect.New(key.typ.Elem()).Interface()
+		copyObject(entry.obj, out)
+	} else {
+		entry.blk = blk
+	}
+	cs.insert(entry)
+	return nil
+}
+
+func (cs *CachingStore) Put(ctx context.Context, v interface{}) (cid.Cid, error) {
+	return cs.cbor.Put(ctx, v)
+}
+
+// Returns a snapshot of the cache's statistics.
+func (cs *CachingStore) Stats() CacheStats {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	stats := cs.stats
+	stats.Entries = cs.lru.Len()
+	stats.Bytes = cs.bytes
+	return stats
+}
+
+func (cs *CachingStore) HitCount() uint64 {
+	return cs.Stats().Hits
+}
+
+func (cs *CachingStore) MissCount() uint64 {
+	return cs.Stats().Misses
+}
+
+// Looks up a cached object, counting a hit or miss.
+// The returned entry must not be mutated.
+func (cs *CachingStore) lookup(key cacheKey) (*cacheEntry, bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	elem, ok := cs.entries[key]
+	if !ok {
+		cs.stats.Misses++
+		if cs.metrics != nil {
+			cs.metrics.CacheMisses++
+		}
+		return nil, false
+	}
+	cs.stats.Hits++
+	if cs.metrics != nil {
+		cs.metrics.CacheHits++
+	}
+	cs.lru.MoveToFront(elem)
+	return elem.Value.(*cacheEntry), true
+}
+
+// Caches an object, evicting the least recently used objects until the cache is within its size bound.
+func (cs *CachingStore) insert(entry *cacheEntry) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if elem, ok := cs.entries[entry.key]; ok {
+		cs.lru.MoveToFront(elem)
+		return
+	}
+	cs.entries[entry.key] = cs.lru.PushFront(entry)
+	cs.bytes += entry.size
+	for cs.bytes > cs.maxBytes {
+		oldest := cs.lru.Back()
+		evicted := oldest.Value.(*cacheEntry)
+		cs.lru.Remove(oldest)
+		delete(cs.entries, evicted.key)
+		cs.bytes -= evicted.size
+		cs.stats.Evictions++
+	}
+}
+
+// Decodes a block as does the go-ipld-cbor store.
+func decodeBlock(blk block.Block, out interface{}) error {
+	if cu, ok := out.(cbg.CBORUnmarshaler); ok {
+		if err := cu.UnmarshalCBOR(bytes.NewReader(blk.RawData())); err != nil {
+			return ipldcbor.NewSerializationError(err)
+		}
+		return nil
+	}
+	return ipldcbor.DecodeInto(blk.RawData(), out)
+}
+
+//
+// Copy functions for cached objects.
+//
+// Each copies a decoded object into a zero-valued object of the same type, such that the copy may be mutated
+// without affecting the original.
+//
+
+var objectCopiers = makeObjectCopiers()
+
+func makeObjectCopiers() map[reflect.Type]func(dst, src interface{}) {
+	amtRoot, amtNode := amtTypes()
+	return map[reflect.Type]func(dst, src interface{}){
+		reflect.TypeOf(&hamt.Node{}): copyHAMTNode,
+		amtRoot:                      copyAMTNode,
+		amtNode:                      copyAMTNode,
+	}
+}
+
+// The HAMT modifies a loaded node's pointers and their KV slices in place, so these are copied.
+// Keys and values are replaced, never modified in place, so are shared.
+func copyHAMTNode(dst, src interface{}) {
+	to, from := dst.(*hamt.Node), src.(*hamt.Node)
+	if from.Bitfield != nil {
+		to.Bitfield = new(big.Int).Set(from.Bitfield)
+	}
+	if from.Pointers != nil {
+		to.Pointers = make([]*hamt.Pointer, len(from.Pointers))
+	}
+	for i, p := range from.Pointers {
+		pointer := &hamt.Pointer{Link: p.Link}
+		if p.KVs != nil {
+			pointer.KVs = make([]*hamt.KV, len(p.KVs))
+		}
+		for j, kv := range p.KVs {
+			pointer.KVs[j] = &hamt.KV{Key: kv.Key, Value: kv.Value}
+		}
+		to.Pointers[i] = pointer
+	}
+}
+
+// The AMT copies a loaded root or node's links and values into its own in-memory node without modifying it,
+// so a copy only needs slices of its own.
+// The AMT's root and node types are internal to its package, so are copied by reflection.
+func copyAMTNode(dst, src interface{}) {
+	to := reflect.ValueOf(dst).Elem()
+	to.Set(reflect.ValueOf(src).Elem())
+	copySlices(to)
+}
+
+// Replaces each slice in an exported field of a struct, or of a struct within it, with a copy.
+func copySlices(v reflect.Value) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if !field.CanSet() {
+			continue
+		}
+		switch field.Kind() {
+		case reflect.Slice:
+			if !field.IsNil() {
+				copied := reflect.MakeSlice(field.Type(), field.Len(), field.Len())
+				reflect.Copy(copied, field)
+				field.Set(copied)
+			}
+		case reflect.Struct:
+			copySlices(field)
+		}
+	}
+}
+
+// Discovers the (pointer) types of the AMT's root and node by loading an empty AMT.
+func amtTypes() (root, node reflect.Type) {
+	ctx := context.Background()
+	store := &typeRecordingStore{IpldStore: ipldcbor.NewCborStore(NewBlockStoreInMemory())}
+	empty, err := amt.NewAMT(store)
+	if err != nil {
+		panic(err)
+	}
+	c, err := empty.Flush(ctx)
+	if err != nil {
+		panic(err)
+	}
+	if _, err := amt.LoadAMT(ctx, store, c); err != nil {
+		panic(err)
+	}
+	nodeField, ok := store.lastGet.Elem().FieldByName("Node")
+	if !ok {
+		panic("AMT root has no node")
+	}
+	return store.lastGet, reflect.PtrTo(nodeField.Type)
+}
+
+type typeRecordingStore struct {
+	ipldcbor.IpldStore
+	lastGet reflect.Type
+}
+
+func (s *typeRecordingStore) Get(ctx context.Context, c cid.Cid, out interface{}) error {
+	s.lastGet = reflect.TypeOf(out)
+	return s.IpldStore.Get(ctx, c, out)
+}
@@ -0,0 +1,293 @@
+package ipld_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/filecoin-project/go-bitfield"
+	hamt "github.com/filecoin-project/go-hamt-ipld/v3"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	cbg "github.com/whyrusleeping/cbor-gen"
+
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/miner"
+	"github.com/filecoin-project/specs-actors/v4/actors/util/adt"
+	"github.com/filecoin-project/specs-actors/v4/support/ipld"
+	tutil "github.com/filecoin-project/specs-actors/v4/support/testing"
+)
+
+func TestCachingStore(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("objects are cached when read", func(t *testing.T) {
+		cs := ipld.NewCachingStore(ipld.NewBlockStoreInMemory(), 1<<10)
+		store := adt.WrapStore(ctx, cs)
+		val := cbg.CborInt(42)
+		c, err := store.Put(ctx, &val)
+		require.NoError(t, err)
+		assert.Equal(t, 0, cs.Stats().Entries)
+
+		var loaded cbg.CborInt
+		require.NoError(t, store.Get(ctx, c, &loaded))
+		require.NoError(t, store.Get(ctx, c, &loaded))
+		assert.Equal(t, val, loaded)
+		assert.Equal(t, uint64(1), cs.MissCount())
+		assert.Equal(t, uint64(1), cs.HitCount())
+
+		// The same block decoded into another type is cached separately.
+		var raw cbg.Deferred
+		require.NoError(t, store.Get(ctx, c, &raw))
+		assert.Equal(t, uint64(2), cs.MissCount())
+		assert.Equal(t, 2, cs.Stats().Entries)
+		assert.Equal(t, int64(2*len(raw.Raw)), cs.Stats().Bytes)
+	})
+
+	t.Run("cached HAMT nodes are not mutated through loaded copies", func(t *testing.T) {
+		cs := ipld.NewCachingStore(ipld.NewBlockStoreInMemory(), 1<<20)
+		store := adt.WrapStore(ctx, cs)
+		m, err := adt.MakeEmptyMap(store, 3)
+		require.NoError(t, err)
+		for i := int64(0); i < 10; i++ {
+			val := cbg.CborInt(i)
+			require.NoError(t, m.Put(abi.IntKey(i), &val))
+		}
+		root, err := m.Root()
+		require.NoError(t, err)
+
+		var first hamt.Node
+		require.NoError(t, store.Get(ctx, root, &first))
+		require.NotEmpty(t, first.Pointers)
+		require.NotEmpty(t, first.Pointers[0].KVs)
+		first.Bitfield.SetInt64(0)
+		first.Pointers[0].KVs[0] = nil
+		first.Pointers[0] = nil
+
+		var second hamt.Node
+		require.NoError(t, store.Get(ctx, root, &second))
+		assert.Equal(t, uint64(1), cs.HitCount())
+		require.NotNil(t, second.Pointers[0])
+		assert.NotNil(t, second.Pointers[0].KVs[0])
+		assert.NotZero(t, second.Bitfield.Sign())
+	})
+
+	t.Run("objects larger than the bound are not cached", func(t *testing.T) {
+		cs := ipld.NewCachingStore(ipld.NewBlockStoreInMemory(), 4)
+		store := adt.WrapStore(ctx, cs)
+		val := cbg.CborCid(tutil.MakeCID("large", nil))
+		c, err := store.Put(ctx, &val)
+		require.NoError(t, err)
+
+		var loaded cbg.CborCid
+		require.NoError(t, store.Get(ctx, c, &loaded))
+		require.NoError(t, store.Get(ctx, c, &loaded))
+		assert.Equal(t, uint64(2), cs.MissCount())
+		assert.Equal(t, 0, cs.Stats().Entries)
+	})
+
+	t.Run("hits and misses are counted by an underlying metrics store", func(t *testing.T) {
+		metrics := ipld.NewMetricsBlockStore(ipld.NewBlockStoreInMemory())
+		store := adt.WrapStore(ctx, ipld.NewCachingStore(metrics, 1<<10))
+		val := cbg.CborInt(42)
+		c, err := store.Put(ctx, &val)
+		require.NoError(t, err)
+
+		var loaded cbg.CborInt
+		for i := 0; i < 3; i++ {
+			require.NoError(t, store.Get(ctx, c, &loaded))
+		}
+		assert.Equal(t, uint64(1), metrics.ReadCount())
+		assert.Equal(t, uint64(1), metrics.CacheMissCount())
+		assert.Equal(t, uint64(2), metrics.CacheHitCount())
+	})
+
+	// Builds and repeatedly modifies a HAMT and AMT in both a caching and an uncached store, checking they match.
+	exerciseCollections := func(t *testing.T, maxBytes int64) ipld.CacheStats {
+		cached := ipld.NewCachingStore(ipld.NewBlockStoreInMemory(), maxBytes)
+		store := adt.WrapStore(ctx, cached)
+		base := ipld.NewADTStore(ctx)
+		build := func(s adt.Store) (*adt.Map, *adt.Array) {
+			m, err := adt.MakeEmptyMap(s, 3)
+			require.NoError(t, err)
+			arr, err := adt.MakeEmptyArray(s, 3)
+			require.NoError(t, err)
+			for i := int64(0); i < 1000; i++ {
+				val := cbg.CborInt(i)
+				require.NoError(t, m.Put(abi.IntKey(i), &val))
+				require.NoError(t, arr.Set(uint64(i*3), &val))
+			}
+			return m, arr
+		}
+		cachedMap, cachedArr := build(store)
+		plainMap, plainArr := build(base)
+
+		// Repeatedly reload from the flushed roots, reading many entries and modifying a few.
+		for round := int64(0); round < 5; round++ {
+			for _, pair := range []struct {
+				m   *adt.Map
+				arr *adt.Array
+			}{{cachedMap, cachedArr}, {plainMap, plainArr}} {
+				for i := int64(0); i < 1000; i += 7 {
+					var val cbg.CborInt
+					found, err := pair.m.Get(abi.IntKey(i), &val)
+					require.NoError(t, err)
+					require.True(t, found)
+					if i%70 != 0 {
+						continue
+					}
+					val += cbg.CborInt(round)
+					require.NoError(t, pair.m.Put(abi.IntKey(i), &val))
+					require.NoError(t, pair.arr.Set(uint64(i*3), &val))
+				}
+			}
+			cachedRoot, err := cachedMap.Root()
+			require.NoError(t, err)
+			plainRoot, err := plainMap.Root()
+			require.NoError(t, err)
+			require.Equal(t, plainRoot, cachedRoot)
+			cachedArrRoot, err := cachedArr.Root()
+			require.NoError(t, err)
+			plainArrRoot, err := plainArr.Root()
+			require.NoError(t, err)
+			require.Equal(t, plainArrRoot, cachedArrRoot)
+
+			cachedMap, err = adt.AsMap(store, cachedRoot, 3)
+			require.NoError(t, err)
+			cachedArr, err = adt.AsArray(store, cachedArrRoot, 3)
+			require.NoError(t, err)
+		}
+
+		return cached.Stats()
+	}
+
+	t.Run("HAMT and AMT operations match an uncached store", func(t *testing.T) {
+		stats := exerciseCollections(t, 1<<30)
+		assert.Greater(t, stats.Hits, uint64(0))
+		assert.Equal(t, uint64(0), stats.Evictions)
+	})
+
+	t.Run("size is bounded by bytes", func(t *testing.T) {
+		stats := exerciseCollections(t, 1<<10)
+		assert.Greater(t, stats.Evictions, uint64(0))
+		assert.LessOrEqual(t, stats.Bytes, int64(1<<10))
+		assert.Greater(t, stats.Bytes, int64(0))
+	})
+
+	t.Run("concurrent use", func(t *testing.T) {
+		cs := ipld.NewCachingStore(ipld.NewSyncBlockStore(ipld.NewBlockStoreInMemory()), 64)
+		store := adt.WrapStore(ctx, cs)
+		var wg sync.WaitGroup
+		for w := 0; w < 8; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < 100; i++ {
+					val := cbg.CborInt(i % 20)
+					c, err := store.Put(ctx, &val)
+					assert.NoError(t, err)
+					var loaded cbg.CborInt
+					assert.NoError(t, store.Get(ctx, c, &loaded))
+					assert.Equal(t, val, loaded)
+				}
+			}(w)
+		}
+		wg.Wait()
+		stats := cs.Stats()
+		assert.Equal(t, uint64(800), stats.Hits+stats.Misses)
+		assert.LessOrEqual(t, stats.Bytes, int64(64))
+	})
+}
+
+// Compares loading a miner's sectors and deadlines from a file-backed store with and without a cache, and
+// from memory.
+func BenchmarkCachingStore(b *testing.B) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "caching-store")
+	require.NoError(b, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	fileStore, err := ipld.OpenFileBlockStore(filepath.Join(dir, "blocks"))
+	require.NoError(b, err)
+	defer func() { _ = fileStore.Close() }()
+
+	const sectorCount = 10_000
+	st, allSectors := newBenchmarkMinerState(b, adt.WrapBlockStore(ctx, fileStore), sectorCount)
+	require.NoError(b, fileStore.Flush())
+
+	loadMinerState := func(b *testing.B, store adt.Store) {
+		infos, err := st.LoadSectorInfos(store, allSectors)
+		require.NoError(b, err)
+		require.Len(b, infos, sectorCount)
+		deadlines, err := st.LoadDeadlines(store)
+		require.NoError(b, err)
+		for dlIdx := uint64(0); dlIdx < miner.WPoStPeriodDeadlines; dlIdx++ {
+			_, err := deadlines.LoadDeadline(store, dlIdx)
+			require.NoError(b, err)
+		}
+	}
+
+	b.Run("memory", func(b *testing.B) {
+		// the same state, built deterministically
+		store := adt.WrapBlockStore(ctx, ipld.NewBlockStoreInMemory())
+		memSt, _ := newBenchmarkMinerState(b, store, sectorCount)
+		require.Equal(b, st.Sectors, memSt.Sectors)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			loadMinerState(b, store)
+		}
+	})
+
+	b.Run("uncached", func(b *testing.B) {
+		store := adt.WrapBlockStore(ctx, fileStore)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			loadMinerState(b, store)
+		}
+	})
+
+	b.Run("cached", func(b *testing.B) {
+		cached := ipld.NewCachingStore(fileStore, 64<<20)
+		store := adt.WrapStore(ctx, cached)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			loadMinerState(b, store)
+		}
+		b.StopTimer()
+		stats := cached.Stats()
+		b.ReportMetric(float64(stats.Hits)/float64(stats.Hits+stats.Misses), "hit-ratio")
+	})
+}
+
+// Creates a miner state with the given number of sectors, returning the state and a bitfield of all its sectors.
+func newBenchmarkMinerState(b *testing.B, store adt.Store, sectorCount uint64) (*miner.State, bitfield.BitField) {
+	// the miner info is not loaded
+	info := cbg.CborInt(0)
+	infoCid, err := store.Put(store.Context(), &info)
+	require.NoError(b, err)
+	st, err := miner.ConstructState(store, infoCid, 0, 0)
+	require.NoError(b, err)
+
+	var sectors []*miner.SectorOnChainInfo
+	var numbers []uint64
+	for i := uint64(0); i < sectorCount; i++ {
+		sectors = append(sectors, &miner.SectorOnChainInfo{
+			SectorNumber:          abi.SectorNumber(i),
+			SealProof:             abi.RegisteredSealProof_StackedDrg32GiBV1_1,
+			SealedCID:             tutil.MakeCID("sector", &miner.SealedCIDPrefix),
+			Expiration:            abi.ChainEpoch(1_000_000),
+			DealWeight:            big.Zero(),
+			VerifiedDealWeight:    big.Zero(),
+			InitialPledge:         big.NewInt(1e18),
+			ExpectedDayReward:     big.NewInt(1e16),
+			ExpectedStoragePledge: big.NewInt(1e17),
+			ReplacedDayReward:     big.Zero(),
+		})
+		numbers = append(numbers, i)
+	}
+	require.NoError(b, st.PutSectors(store, sectors...))
+	return st, bitfield.NewFromSet(numbers)
+}
@@ -0,0 +1,272 @@
+package ipld
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	block "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ipldcbor "github.com/ipfs/go-ipld-cbor"
+	mh "github.com/multiformats/go-multihash"
+	cbg "github.com/whyrusleeping/cbor-gen"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/specs-actors/v4/actors/util/adt"
+)
+
+//
+// Import and export of DAGs as CAR (content addressable archive) files, in the CARv1 format.
+// A CAR file is a header naming the root CIDs, followed by each block of the DAGs beneath them.
+// Each section is prefixed by its length as an unsigned varint.
+//
+
+const carVersion = 1
+
+// Maximum size of a single section of a CAR file, bounding allocation when reading.
+const maxCARSectionSize = 32 << 20
+
+// ExportCAR writes the roots and all blocks reachable from them, each exactly once, to a CAR file.
+// Blocks are written in depth-first order, parents before children.
+// Only DAG-CBOR blocks are supported; links to sector commitments and identity-hashed CIDs are not followed.
+func ExportCAR(w io.Writer, store adt.Store, roots ...cid.Cid) (blocks uint64, err error) {
+	bw := bufio.NewWriter(w)
+	if err := writeCARHeader(bw, roots); err != nil {
+		return 0, err
+	}
+	seen := cid.NewSet()
+	for _, root := range roots {
+		if err := exportRec(bw, store, root, seen, &blocks); err != nil {
+			return 0, err
+		}
+	}
+	return blocks, bw.Flush()
+}
+
+// ExportCARFile writes the roots and all blocks reachable from them to a CAR file at path.
+func ExportCARFile(path string, store adt.Store, roots ...cid.Cid) (blocks uint64, err error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	if blocks, err = ExportCAR(f, store, roots...); err != nil {
+		_ = f.Close()
+		return 0, err
+	}
+	return blocks, f.Close()
+}
+
+// ImportCAR reads all blocks from a CAR file into a block store, verifying that each block matches its CID,
+// and returns the CAR's roots.
+func ImportCAR(r io.Reader, bs ipldcbor.IpldBlockstore) ([]cid.Cid, error) {
+	br := bufio.NewReader(r)
+	header, err := readCARSection(br)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read CAR header: %w", err)
+	}
+	if header == nil {
+		return nil, xerrors.Errorf("empty CAR file")
+	}
+	roots, err := readCARHeader(header)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		section, err := readCARSection(br)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to read CAR block: %w", err)
+		}
+		if section == nil {
+			return roots, nil
+		}
+		n, c, err := cid.CidFromBytes(section)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to read CAR block CID: %w", err)
+		}
+		data := section[n:]
+		if expected, err := c.Prefix().Sum(data); err != nil {
+			return nil, err
+		} else if !expected.Equals(c) {
+			return nil, xerrors.Errorf("CAR block data for %v hashes to %v", c, expected)
+		}
+		blk, err := block.NewBlockWithCid(data, c)
+		if err != nil {
+			return nil, err
+		}
+		if err := bs.Put(blk); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// ImportCARFile reads all blocks from a CAR file at path into a block store, and returns the CAR's roots.
+func ImportCARFile(path string, bs ipldcbor.IpldBlockstore) ([]cid.Cid, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	return ImportCAR(f, bs)
+}
+
+func exportRec(w io.Writer, store adt.Store, c cid.Cid, seen *cid.Set, blocks *uint64) error {
+	prefix := c.Prefix()
+	if prefix.MhType == mh.IDENTITY || prefix.Codec == cid.FilCommitmentSealed || prefix.Codec == cid.FilCommitmentUnsealed {
+		return nil
+	}
+	if !seen.Visit(c) {
+		return nil
+	}
+	if prefix.Codec != cid.DagCBOR {
+		return xerrors.Errorf("can't export block %v with codec %x, only DAG-CBOR is supported", c, prefix.Codec)
+	}
+
+	// The store decodes objects, but a deferred object retains the raw block.
+	var raw cbg.Deferred
+	if err := store.Get(store.Context(), c, &raw); err != nil {
+		return xerrors.Errorf("failed to get block %v: %w", c, err)
+	}
+	if err := writeCARSection(w, c.Bytes(), raw.Raw); err != nil {
+		return err
+	}
+	*blocks++
+
+	var links []cid.Cid
+	if err := cbg.ScanForLinks(bytes.NewReader(raw.Raw), func(link cid.Cid) {
+		links = append(links, link)
+	}); err != nil {
+		return xerrors.Errorf("failed to scan block %v for links: %w", c, err)
+	}
+	for _, link := range links {
+		if err := exportRec(w, store, link, seen, blocks); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The header is the DAG-CBOR map {"roots": [CID...], "version": 1}.
+func writeCARHeader(w io.Writer, roots []cid.Cid) error {
+	var buf bytes.Buffer
+	if err := cbg.WriteMajorTypeHeader(&buf, cbg.MajMap, 2); err != nil {
+		return err
+	}
+	if err := writeCBORString(&buf, "roots"); err != nil {
+		return err
+	}
+	if err := cbg.WriteMajorTypeHeader(&buf, cbg.MajArray, uint64(len(roots))); err != nil {
+		return err
+	}
+	for _, root := range roots {
+		if err := cbg.WriteCid(&buf, root); err != nil {
+			return err
+		}
+	}
+	if err := writeCBORString(&buf, "version"); err != nil {
+		return err
+	}
+	if err := cbg.WriteMajorTypeHeader(&buf, cbg.MajUnsignedInt, carVersion); err != nil {
+		return err
+	}
+	return writeCARSection(w, buf.Bytes())
+}
+
+func readCARHeader(data []byte) ([]cid.Cid, error) {
+	br := bytes.NewReader(data)
+	maj, fields, err := cbg.CborReadHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	if maj != cbg.MajMap {
+		return nil, xerrors.Errorf("CAR header should be a map")
+	}
+
+	var roots []cid.Cid
+	version := uint64(0)
+	for i := uint64(0); i < fields; i++ {
+		key, err := cbg.ReadString(br)
+		if err != nil {
+			return nil, err
+		}
+		switch key {
+		case "roots":
+			maj, count, err := cbg.CborReadHeader(br)
+			if err != nil {
+				return nil, err
+			}
+			if maj != cbg.MajArray {
+				return nil, xerrors.Errorf("CAR roots should be an array")
+			}
+			for j := uint64(0); j < count; j++ {
+				root, err := cbg.ReadCid(br)
+				if err != nil {
+					return nil, err
+				}
+				roots = append(roots, root)
+			}
+		case "version":
+			maj, val, err := cbg.CborReadHeader(br)
+			if err != nil {
+				return nil, err
+			}
+			if maj != cbg.MajUnsignedInt {
+				return nil, xerrors.Errorf("CAR version should be an unsigned integer")
+			}
+			version = val
+		default:
+			return nil, xerrors.Errorf("unexpected CAR header field %q", key)
+		}
+	}
+	if version != carVersion {
+		return nil, xerrors.Errorf("unsupported CAR version %d", version)
+	}
+	return roots, nil
+}
+
+func writeCBORString(w io.Writer, s string) error {
+	if err := cbg.WriteMajorTypeHeader(w, cbg.MajTextString, uint64(len(s))); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, s)
+	return err
+}
+
+func writeCARSection(w io.Writer, parts ...[]byte) error {
+	length := 0
+	for _, part := range parts {
+		length += len(part)
+	}
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, uint64(length))
+	if _, err := w.Write(buf[:n]); err != nil {
+		return err
+	}
+	for _, part := range parts {
+		if _, err := w.Write(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reads a length-prefixed section, returning nil at the end of the input.
+func readCARSection(br *bufio.Reader) ([]byte, error) {
+	length, err := binary.ReadUvarint(br)
+	if err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if length > maxCARSectionSize {
+		return nil, fmt.Errorf("CAR section of %d bytes exceeds maximum %d", length, maxCARSectionSize)
+	}
+	section := make([]byte, length)
+	if _, err := io.ReadFull(br, section); err != nil {
+		return nil, err
+	}
+	return section, nil
+}
@@ -0,0 +1,439 @@
+package ipld
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	block "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ipldcbor "github.com/ipfs/go-ipld-cbor"
+	mh "github.com/multiformats/go-multihash"
+	cbg "github.com/whyrusleeping/cbor-gen"
+	"golang.org/x/xerrors"
+)
+
+//
+// File-backed block store.
+//
+// Blocks are appended to a log file, each as a length-prefixed record of CID and data (the same framing
+// as the blocks of a CAR file). An index from CID to location is held in memory, and written alongside
+// the log when flushed so that re-opening a large store needn't scan the whole log.
+// Each block is written through to the log when put, so reads of the log never wait on buffered writes.
+// The log is never modified in place. Garbage collection writes a new log of the reachable blocks.
+//
+type FileBlockStore struct {
+	path string
+
+	mu    sync.RWMutex
+	file  *os.File
+	w     *bufio.Writer // Frames each block's record into a single write
+	index map[cid.Cid]fileBlockLocation
+	size  int64 // Length of the log
+}
+
+var _ ipldcbor.IpldBlockstore = (*FileBlockStore)(nil)
+
+// Location of a block's data in the log.
+type fileBlockLocation struct {
+	offset int64
+	length int64
+}
+
+const fileBlockStoreBufferSize = 1 << 20
+
+// Opens a file-backed block store at path, creating it if it does not exist.
+// The store is safe for concurrent use, with reads proceeding in parallel, but the file must not be opened by
+// more than one store at a time.
+func OpenFileBlockStore(path string) (*FileBlockStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s := &FileBlockStore{
+		path:  path,
+		file:  file,
+		index: make(map[cid.Cid]fileBlockLocation),
+	}
+	if err := s.load(); err != nil {
+		_ = file.Close()
+		return nil, xerrors.Errorf("failed to load block store %s: %w", path, err)
+	}
+	s.w = bufio.NewWriterSize(&offsetWriter{file, s.size}, fileBlockStoreBufferSize)
+	return s, nil
+}
+
+// Returns a block store factory, as for agent.NewSim, creating each new store in a new file in dir.
+// Each store is closed and its file removed when the next-but-one store is created, since a simulation
+// discards a store after copying state from it to a new one.
+func FileBlockStoreFactory(dir string) func() ipldcbor.IpldBlockstore {
+	var stores []*FileBlockStore
+	count := 0
+	return func() ipldcbor.IpldBlockstore {
+		if len(stores) >= 2 {
+			old := stores[0]
+			stores = stores[1:]
+			if err := old.Close(); err != nil {
+				panic(err)
+			}
+			_ = os.Remove(old.path)
+			_ = os.Remove(old.indexPath())
+		}
+		s, err := OpenFileBlockStore(filepath.Join(dir, fmt.Sprintf("blocks-%d.log", count)))
+		if err != nil {
+			panic(err)
+		}
+		count++
+		stores = append(stores, s)
+		return s
+	}
+}
+
+func (s *FileBlockStore) Get(c cid.Cid) (block.Block, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	loc, ok := s.index[c]
+	if !ok {
+		return nil, fmt.Errorf("not found")
+	}
+	data, err := s.read(loc)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to read block %v: %w", c, err)
+	}
+	return block.NewBlockWithCid(data, c)
+}
+
+func (s *FileBlockStore) Put(b block.Block) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.index[b.Cid()]; ok {
+		return nil
+	}
+	if err := s.append(b.Cid(), b.RawData()); err != nil {
+		return err
+	}
+	return s.w.Flush()
+}
+
+// Returns the number of blocks in the store.
+func (s *FileBlockStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.index)
+}
+
+// Returns the size in bytes of the log file.
+func (s *FileBlockStore) Size() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.size
+}
+
+// Writes the index.
+func (s *FileBlockStore) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flush()
+}
+
+// Flushes and closes the store.
+func (s *FileBlockStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.flush(); err != nil {
+		_ = s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
+
+// Removes all blocks not reachable from the roots, returning the number removed.
+// Links are followed through DAG-CBOR blocks only, and links to sector commitments and identity-hashed CIDs
+// are ignored. All other linked blocks must be present.
+func (s *FileBlockStore) GC(roots ...cid.Cid) (removed int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reachable := cid.NewSet()
+	for _, root := range roots {
+		if err := s.mark(root, reachable); err != nil {
+			return 0, err
+		}
+	}
+
+	// Copy reachable blocks to a new log, preserving their order.
+	keep := make([]cid.Cid, 0, reachable.Len())
+	_ = reachable.ForEach(func(c cid.Cid) error {
+		keep = append(keep, c)
+		return nil
+	})
+	sort.Slice(keep, func(i, j int) bool {
+		return s.index[keep[i]].offset < s.index[keep[j]].offset
+	})
+
+	tmpPath := s.path + ".gc"
+	for _, stale := range []string{tmpPath, tmpPath + ".idx"} {
+		if err := os.Remove(stale); err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+	}
+	next, err := OpenFileBlockStore(tmpPath)
+	if err != nil {
+		return 0, err
+	}
+	for _, c := range keep {
+		data, err := s.read(s.index[c])
+		if err != nil {
+			_ = next.Close()
+			return 0, err
+		}
+		if err := next.append(c, data); err != nil {
+			_ = next.Close()
+			return 0, err
+		}
+	}
+	if err := next.w.Flush(); err != nil {
+		_ = next.Close()
+		return 0, err
+	}
+	if err := next.file.Sync(); err != nil {
+		_ = next.Close()
+		return 0, err
+	}
+	if err := next.file.Close(); err != nil {
+		return 0, err
+	}
+
+	// Replace the log. The index is removed first, so that a failure leaves a log that will be re-scanned.
+	if err := os.Remove(s.indexPath()); err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	if err := s.file.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return 0, err
+	}
+	removed = len(s.index) - len(next.index)
+	s.file, err = os.OpenFile(s.path, os.O_RDWR, 0644)
+	if err != nil {
+		return 0, err
+	}
+	s.index = next.index
+	s.size = next.size
+	s.w = bufio.NewWriterSize(&offsetWriter{s.file, s.size}, fileBlockStoreBufferSize)
+	return removed, s.flush()
+}
+
+// Adds the blocks reachable from a root to a set. Links are followed with an explicit stack, since a chain of
+// links (such as through a deep HAMT, or a long linked list) may be arbitrarily long.
+func (s *FileBlockStore) mark(root cid.Cid, reachable *cid.Set) error {
+	stack := []cid.Cid{root}
+	for len(stack) > 0 {
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		prefix := c.Prefix()
+		if prefix.MhType == mh.IDENTITY || prefix.Codec == cid.FilCommitmentSealed || prefix.Codec == cid.FilCommitmentUnsealed {
+			continue
+		}
+		if !reachable.Visit(c) {
+			continue
+		}
+		loc, ok := s.index[c]
+		if !ok {
+			return xerrors.Errorf("block %v is reachable but not found", c)
+		}
+		if prefix.Codec != cid.DagCBOR {
+			continue
+		}
+		data, err := s.read(loc)
+		if err != nil {
+			return err
+		}
+		if err := cbg.ScanForLinks(bytes.NewReader(data), func(link cid.Cid) {
+			stack = append(stack, link)
+		}); err != nil {
+			return xerrors.Errorf("failed to scan block %v for links: %w", c, err)
+		}
+	}
+	return nil
+}
+
+func (s *FileBlockStore) append(c cid.Cid, data []byte) error {
+	key := c.Bytes()
+	n := uvarintSize(uint64(len(key) + len(data)))
+	if err := writeCARSection(s.w, key, data); err != nil {
+		return err
+	}
+	s.index[c] = fileBlockLocation{
+		offset: s.size + int64(n+len(key)),
+		length: int64(len(data)),
+	}
+	s.size += int64(n + len(key) + len(data))
+	return nil
+}
+
+// Reads a block's data from the log. Reads are positional, so may proceed concurrently.
+func (s *FileBlockStore) read(loc fileBlockLocation) ([]byte, error) {
+	data := make([]byte, loc.length)
+	if _, err := s.file.ReadAt(data, loc.offset); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (s *FileBlockStore) flush() error {
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	return s.writeIndex()
+}
+
+func (s *FileBlockStore) indexPath() string {
+	return s.path + ".idx"
+}
+
+// The index file is a sequence of records (each framed as for the log): first the length of the log
+// it covers, then a CID, offset and length for each block.
+func (s *FileBlockStore) writeIndex() error {
+	tmpPath := s.indexPath() + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	buf := make([]byte, 2*binary.MaxVarintLen64)
+	err = writeCARSection(w, buf[:binary.PutUvarint(buf, uint64(s.size))])
+	for c, loc := range s.index { //nolint:nomaprange
+		if err != nil {
+			break
+		}
+		n := binary.PutUvarint(buf, uint64(loc.offset))
+		n += binary.PutUvarint(buf[n:], uint64(loc.length))
+		err = writeCARSection(w, c.Bytes(), buf[:n])
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, s.indexPath())
+}
+
+// Loads the index, if present, and then scans any part of the log it doesn't cover.
+func (s *FileBlockStore) load() error {
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	logSize := info.Size()
+
+	if covered, err := s.readIndex(logSize); err != nil {
+		// An unreadable index is rebuilt from the log.
+		s.index = make(map[cid.Cid]fileBlockLocation)
+		s.size = 0
+	} else {
+		s.size = covered
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(s.file, s.size, logSize-s.size))
+	for s.size < logSize {
+		length, err := binary.ReadUvarint(r)
+		if err != nil {
+			break
+		}
+		section := make([]byte, length)
+		if _, err := io.ReadFull(r, section); err != nil {
+			break
+		}
+		n, c, err := cid.CidFromBytes(section)
+		if err != nil {
+			break
+		}
+		header := int64(uvarintSize(length))
+		s.index[c] = fileBlockLocation{
+			offset: s.size + header + int64(n),
+			length: int64(length) - int64(n),
+		}
+		s.size += header + int64(length)
+	}
+	if s.size < logSize {
+		// Discard a partially written final record.
+		if err := s.file.Truncate(s.size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reads the index file, returning the length of the log it covers.
+func (s *FileBlockStore) readIndex(logSize int64) (int64, error) {
+	f, err := os.Open(s.indexPath())
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer func() { _ = f.Close() }()
+	r := bufio.NewReader(f)
+
+	section, err := readCARSection(r)
+	if err != nil || section == nil {
+		return 0, xerrors.Errorf("missing index header")
+	}
+	covered, n := binary.Uvarint(section)
+	if n <= 0 || int64(covered) > logSize {
+		return 0, xerrors.Errorf("invalid index header")
+	}
+	for {
+		section, err := readCARSection(r)
+		if err != nil {
+			return 0, err
+		}
+		if section == nil {
+			return int64(covered), nil
+		}
+		n, c, err := cid.CidFromBytes(section)
+		if err != nil {
+			return 0, err
+		}
+		offset, m := binary.Uvarint(section[n:])
+		if m <= 0 {
+			return 0, xerrors.Errorf("invalid index entry for %v", c)
+		}
+		length, l := binary.Uvarint(section[n+m:])
+		if l <= 0 {
+			return 0, xerrors.Errorf("invalid index entry for %v", c)
+		}
+		s.index[c] = fileBlockLocation{int64(offset), int64(length)}
+	}
+}
+
+func uvarintSize(x uint64) int {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return binary.PutUvarint(buf, x)
+}
+
+// Writes sequentially to a file from an offset, independent of the file's own offset (used by ReadAt).
+type offsetWriter struct {
+	file   *os.File
+	offset int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.file.WriteAt(p, w.offset)
+	w.offset += int64(n)
+	return n, err
+}
@@ -0,0 +1,193 @@
+package ipld_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	cbg "github.com/whyrusleeping/cbor-gen"
+
+	"github.com/filecoin-project/specs-actors/v4/actors/util/adt"
+	"github.com/filecoin-project/specs-actors/v4/support/ipld"
+)
+
+func TestFileBlockStore(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "file-block-store")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	// Builds a map of n entries in a store, returning its root.
+	buildMap := func(t *testing.T, store adt.Store, n int64, offset int64) *adt.Map {
+		m, err := adt.MakeEmptyMap(store, 5)
+		require.NoError(t, err)
+		for i := int64(0); i < n; i++ {
+			val := cbg.CborInt(i + offset)
+			require.NoError(t, m.Put(abi.IntKey(i), &val))
+		}
+		_, err = m.Root()
+		require.NoError(t, err)
+		return m
+	}
+	checkMap := func(t *testing.T, store adt.Store, m *adt.Map, n int64, offset int64) {
+		root, err := m.Root()
+		require.NoError(t, err)
+		loaded, err := adt.AsMap(store, root, 5)
+		require.NoError(t, err)
+		count := int64(0)
+		var val cbg.CborInt
+		require.NoError(t, loaded.ForEach(&val, func(key string) error {
+			k, err := abi.ParseIntKey(key)
+			require.NoError(t, err)
+			assert.Equal(t, cbg.CborInt(k+offset), val)
+			count++
+			return nil
+		}))
+		assert.Equal(t, n, count)
+	}
+
+	t.Run("blocks persist across re-opening", func(t *testing.T) {
+		path := filepath.Join(dir, "persist.log")
+		bs, err := ipld.OpenFileBlockStore(path)
+		require.NoError(t, err)
+		m := buildMap(t, adt.WrapBlockStore(ctx, bs), 1000, 0)
+		// Blocks are readable before being flushed.
+		checkMap(t, adt.WrapBlockStore(ctx, bs), m, 1000, 0)
+		count, size := bs.Len(), bs.Size()
+		require.NoError(t, bs.Close())
+
+		bs, err = ipld.OpenFileBlockStore(path)
+		require.NoError(t, err)
+		assert.Equal(t, count, bs.Len())
+		assert.Equal(t, size, bs.Size())
+		checkMap(t, adt.WrapBlockStore(ctx, bs), m, 1000, 0)
+
+		// Blocks added without flushing the index are recovered by scanning the log.
+		m2 := buildMap(t, adt.WrapBlockStore(ctx, bs), 100, 7)
+		require.NoError(t, bs.Flush())
+		m3 := buildMap(t, adt.WrapBlockStore(ctx, bs), 100, 11)
+		count = bs.Len()
+		require.NoError(t, os.Remove(path+".idx"))
+		require.NoError(t, bs.Close())
+
+		bs, err = ipld.OpenFileBlockStore(path)
+		require.NoError(t, err)
+		assert.Equal(t, count, bs.Len())
+		store := adt.WrapBlockStore(ctx, bs)
+		checkMap(t, store, m, 1000, 0)
+		checkMap(t, store, m2, 100, 7)
+		checkMap(t, store, m3, 100, 11)
+		require.NoError(t, bs.Close())
+	})
+
+	t.Run("duplicate blocks are stored once", func(t *testing.T) {
+		bs, err := ipld.OpenFileBlockStore(filepath.Join(dir, "dedupe.log"))
+		require.NoError(t, err)
+		defer func() { _ = bs.Close() }()
+		buildMap(t, adt.WrapBlockStore(ctx, bs), 100, 0)
+		count, size := bs.Len(), bs.Size()
+		buildMap(t, adt.WrapBlockStore(ctx, bs), 100, 0)
+		assert.Equal(t, count, bs.Len())
+		assert.Equal(t, size, bs.Size())
+	})
+
+	t.Run("a partially written block is discarded", func(t *testing.T) {
+		path := filepath.Join(dir, "truncated.log")
+		bs, err := ipld.OpenFileBlockStore(path)
+		require.NoError(t, err)
+		store := adt.WrapBlockStore(ctx, bs)
+		val := cbg.CborInt(1)
+		first, err := store.Put(ctx, &val)
+		require.NoError(t, err)
+		require.NoError(t, bs.Flush())
+		size := bs.Size()
+		val = 2
+		_, err = store.Put(ctx, &val)
+		require.NoError(t, err)
+		require.NoError(t, bs.Close())
+		require.NoError(t, os.Remove(path+".idx"))
+		require.NoError(t, os.Truncate(path, bs.Size()-1))
+
+		bs, err = ipld.OpenFileBlockStore(path)
+		require.NoError(t, err)
+		defer func() { _ = bs.Close() }()
+		assert.Equal(t, 1, bs.Len())
+		assert.Equal(t, size, bs.Size())
+		var loaded cbg.CborInt
+		require.NoError(t, adt.WrapBlockStore(ctx, bs).Get(ctx, first, &loaded))
+		assert.Equal(t, cbg.CborInt(1), loaded)
+	})
+
+	t.Run("garbage collection keeps reachable blocks", func(t *testing.T) {
+		path := filepath.Join(dir, "gc.log")
+		bs, err := ipld.OpenFileBlockStore(path)
+		require.NoError(t, err)
+		store := adt.WrapBlockStore(ctx, bs)
+		kept := buildMap(t, store, 1000, 0)
+		keptRoot, err := kept.Root()
+		require.NoError(t, err)
+		buildMap(t, store, 1000, 1)
+		before := bs.Len()
+
+		removed, err := bs.GC(keptRoot)
+		require.NoError(t, err)
+		assert.Greater(t, removed, 0)
+		assert.Equal(t, before-removed, bs.Len())
+		checkMap(t, store, kept, 1000, 0)
+
+		// Writes continue after collection, and survive re-opening.
+		extra := buildMap(t, store, 10, 3)
+		require.NoError(t, bs.Close())
+		bs, err = ipld.OpenFileBlockStore(path)
+		require.NoError(t, err)
+		defer func() { _ = bs.Close() }()
+		store = adt.WrapBlockStore(ctx, bs)
+		checkMap(t, store, kept, 1000, 0)
+		checkMap(t, store, extra, 10, 3)
+	})
+
+	t.Run("concurrent use", func(t *testing.T) {
+		bs, err := ipld.OpenFileBlockStore(filepath.Join(dir, "concurrent.log"))
+		require.NoError(t, err)
+		defer func() { _ = bs.Close() }()
+		store := adt.WrapBlockStore(ctx, bs)
+		var wg sync.WaitGroup
+		for w := int64(0); w < 8; w++ {
+			wg.Add(1)
+			go func(w int64) {
+				defer wg.Done()
+				for i := int64(0); i < 100; i++ {
+					val := cbg.CborInt(w*1000 + i%50)
+					c, err := store.Put(ctx, &val)
+					assert.NoError(t, err)
+					var loaded cbg.CborInt
+					assert.NoError(t, store.Get(ctx, c, &loaded))
+					assert.Equal(t, val, loaded)
+				}
+			}(w)
+		}
+		wg.Wait()
+		assert.Equal(t, 8*50, bs.Len())
+	})
+
+	t.Run("factory", func(t *testing.T) {
+		factoryDir := filepath.Join(dir, "factory")
+		require.NoError(t, os.Mkdir(factoryDir, 0755))
+		factory := ipld.FileBlockStoreFactory(factoryDir)
+		for i := 0; i < 4; i++ {
+			bs := factory()
+			store := adt.WrapBlockStore(ctx, bs)
+			checkMap(t, store, buildMap(t, store, 10, int64(i)), 10, int64(i))
+		}
+		// Only the two most recent stores are retained.
+		files, err := filepath.Glob(filepath.Join(factoryDir, "*.log"))
+		require.NoError(t, err)
+		assert.Len(t, files, 2)
+	})
+}
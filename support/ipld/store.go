@@ -80,6 +80,9 @@ type MetricsBlockStore struct {
 	WriteBytes uint64
 	Reads      uint64
 	ReadBytes  uint64
+	// Counted by a CachingStore over this store.
+	CacheHits   uint64
+	CacheMisses uint64
 }
 var _ ipldcbor.IpldBlockstore = (*MetricsBlockStore)(nil)
 
@@ -118,3 +121,11 @@ func (ms *MetricsBlockStore) ReadSize() uint64 {
 func (ms *MetricsBlockStore) WriteSize() uint64 {
 	return ms.WriteBytes
 }
+
+func (ms *MetricsBlockStore) CacheHitCount() uint64 {
+	return ms.CacheHits
+}
+
+func (ms *MetricsBlockStore) CacheMissCount() uint64 {
+	return ms.CacheMisses
+}
@@ -0,0 +1,71 @@
+// Command stateanalysis reports how the blocks of a state tree are distributed between the state tree itself
+// and each actor type and state field.
+//
+// The state is read from a CAR file, such as one written by ipld.ExportCARFile:
+//
+//	stateanalysis [-root <cid>] [-json] <state.car>
+//
+// The state root defaults to the CAR file's single root.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/specs-actors/v4/actors/states"
+	"github.com/filecoin-project/specs-actors/v4/actors/util/adt"
+	"github.com/filecoin-project/specs-actors/v4/support/ipld"
+)
+
+func main() {
+	rootFlag := flag.String("root", "", "state root to analyze, if not the CAR file's single root")
+	jsonFlag := flag.Bool("json", false, "write the analysis as JSON")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [-root <cid>] [-json] <state.car>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(flag.Arg(0), *rootFlag, *jsonFlag); err != nil {
+		fmt.Fprintf(os.Stderr, "stateanalysis: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(path, rootStr string, asJSON bool) error {
+	bs := ipld.NewBlockStoreInMemory()
+	roots, err := ipld.ImportCARFile(path, bs)
+	if err != nil {
+		return xerrors.Errorf("failed to import %s: %w", path, err)
+	}
+
+	var root cid.Cid
+	if rootStr != "" {
+		if root, err = cid.Decode(rootStr); err != nil {
+			return xerrors.Errorf("invalid state root %s: %w", rootStr, err)
+		}
+	} else if len(roots) == 1 {
+		root = roots[0]
+	} else {
+		return xerrors.Errorf("%s has %d roots, specify one with -root", path, len(roots))
+	}
+
+	store := adt.WrapBlockStore(context.Background(), bs)
+	analysis, err := states.AnalyzeState(store, root)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		return analysis.WriteJSON(os.Stdout)
+	}
+	return analysis.WriteText(os.Stdout)
+}
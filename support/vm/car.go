@@ -0,0 +1,36 @@
+package vm_test
+
+import (
+	"context"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/specs-actors/v4/actors/util/adt"
+	"github.com/filecoin-project/specs-actors/v4/support/ipld"
+)
+
+// NewVMFromCAR creates a VM with the builtin actors at an epoch, with state loaded from a CAR file
+// into a new in-memory store. The CAR file must have a single root, that of the state tree.
+func NewVMFromCAR(ctx context.Context, path string, epoch abi.ChainEpoch, opts ...VMOption) (*VM, error) {
+	bs := ipld.NewBlockStoreInMemory()
+	roots, err := ipld.ImportCARFile(path, bs)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to import %s: %w", path, err)
+	}
+	if len(roots) != 1 {
+		return nil, xerrors.Errorf("expected a single state root in %s, found %d", path, len(roots))
+	}
+	return NewVMAtEpoch(ctx, ActorsV4(), adt.WrapBlockStore(ctx, bs), roots[0], epoch, opts...)
+}
+
+// ExportCAR flushes any pending state changes and writes the state tree to a CAR file, from which
+// a VM may be recreated with NewVMFromCAR.
+func (vm *VM) ExportCAR(path string) error {
+	root, err := vm.checkpoint()
+	if err != nil {
+		return err
+	}
+	_, err = ipld.ExportCARFile(path, vm.store, root)
+	return err
+}
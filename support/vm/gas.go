@@ -0,0 +1,337 @@
+package vm_test
+
+import (
+	"fmt"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/crypto"
+
+	"github.com/filecoin-project/specs-actors/v4/actors/runtime/proof"
+)
+
+// DefaultGasLimit is the gas limit applied to messages sent by non-system actors.
+// It matches the block gas limit of the network.
+const DefaultGasLimit = int64(10_000_000_000)
+
+// ImplicitMessageGasLimit is the gas limit applied to implicit messages sent by the system actor
+// (e.g. cron ticks and block rewards), which are not bounded by a block's gas limit.
+const ImplicitMessageGasLimit = DefaultGasLimit * 10000
+
+// GasCharge is a single charge of compute and storage gas.
+type GasCharge struct {
+	Name       string
+	ComputeGas int64
+	StorageGas int64
+}
+
+func newGasCharge(name string, computeGas int64, storageGas int64) GasCharge {
+	return GasCharge{
+		Name:       name,
+		ComputeGas: computeGas,
+		StorageGas: storageGas,
+	}
+}
+
+// Total is the gas charged to a message's budget.
+func (g GasCharge) Total() int64 {
+	return g.ComputeGas + g.StorageGas
+}
+
+func (g GasCharge) String() string {
+	return fmt.Sprintf("%s(compute=%d, storage=%d)", g.Name, g.ComputeGas, g.StorageGas)
+}
+
+// PriceList provides prices for the operations performed during message execution.
+type PriceList interface {
+	// OnChainMessage returns the gas used for storing a message of a given size in the chain.
+	OnChainMessage(msgSize int) GasCharge
+	// OnChainReturnValue returns the gas used for storing the response of a message in the chain.
+	OnChainReturnValue(dataSize int) GasCharge
+
+	// OnMethodInvocation returns the gas used when invoking a method.
+	OnMethodInvocation(value abi.TokenAmount, methodNum abi.MethodNum) GasCharge
+
+	// OnIpldGet returns the gas used for loading an object from the store.
+	OnIpldGet() GasCharge
+	// OnIpldPut returns the gas used for storing an object of a given size.
+	OnIpldPut(dataSize int) GasCharge
+
+	// OnCreateActor returns the gas used for creating an actor.
+	OnCreateActor() GasCharge
+	// OnDeleteActor returns the gas used for deleting an actor.
+	OnDeleteActor() GasCharge
+
+	// Syscalls
+	OnVerifySignature(sigType crypto.SigType, planTextSize int) GasCharge
+	OnHashing(dataSize int) GasCharge
+	OnComputeUnsealedSectorCid(proofType abi.RegisteredSealProof, pieces []abi.PieceInfo) GasCharge
+	OnVerifySeal(info proof.SealVerifyInfo) GasCharge
+	OnVerifyPost(info proof.WindowPoStVerifyInfo) GasCharge
+	OnVerifyConsensusFault() GasCharge
+}
+
+// ScalingCost is a flat cost plus a cost scaling with the number of items processed.
+type ScalingCost struct {
+	Flat  int64
+	Scale int64
+}
+
+// GasPrices is a PriceList computing charges from a table of configurable unit prices.
+// The zero value charges no gas for any operation.
+type GasPrices struct {
+	StorageGasMulti int64
+
+	OnChainMessageComputeBase    int64
+	OnChainMessageStorageBase    int64
+	OnChainMessageStoragePerByte int64
+	OnChainReturnValuePerByte    int64
+
+	SendBase                int64
+	SendTransferFunds       int64
+	SendTransferOnlyPremium int64
+	SendInvokeMethod        int64
+
+	IpldGetBase    int64
+	IpldPutBase    int64
+	IpldPutPerByte int64
+
+	CreateActorCompute int64
+	CreateActorStorage int64
+	DeleteActor        int64
+
+	VerifySignature map[crypto.SigType]int64
+
+	HashingBase                  int64
+	ComputeUnsealedSectorCidBase int64
+	VerifySealBase               int64
+	VerifyPostLookup             map[abi.RegisteredPoStProof]ScalingCost
+	VerifyConsensusFault         int64
+}
+
+var _ PriceList = (*GasPrices)(nil)
+
+// DefaultPriceList returns the prices charged by the network at the current version.
+func DefaultPriceList() *GasPrices {
+	return &GasPrices{
+		StorageGasMulti: 1300,
+
+		OnChainMessageComputeBase:    38863,
+		OnChainMessageStorageBase:    36,
+		OnChainMessageStoragePerByte: 1,
+		OnChainReturnValuePerByte:    1,
+
+		SendBase:                29233,
+		SendTransferFunds:       27500,
+		SendTransferOnlyPremium: 159672,
+		SendInvokeMethod:        -5377,
+
+		IpldGetBase:    114617,
+		IpldPutBase:    353640,
+		IpldPutPerByte: 1,
+
+		CreateActorCompute: 1108454,
+		CreateActorStorage: 36 + 40,
+		DeleteActor:        -(36 + 40), // -createActorStorage
+
+		VerifySignature: map[crypto.SigType]int64{
+			crypto.SigTypeBLS:       16598605,
+			crypto.SigTypeSecp256k1: 1637292,
+		},
+
+		HashingBase:                  31355,
+		ComputeUnsealedSectorCidBase: 98647,
+		VerifySealBase:               2000, // the VerifySeal syscall is not used by the builtin actors
+		VerifyPostLookup: map[abi.RegisteredPoStProof]ScalingCost{
+			abi.RegisteredPoStProof_StackedDrgWindow512MiBV1: {Flat: 117680921, Scale: 43780},
+			abi.RegisteredPoStProof_StackedDrgWindow32GiBV1:  {Flat: 117680921, Scale: 43780},
+			abi.RegisteredPoStProof_StackedDrgWindow64GiBV1:  {Flat: 117680921, Scale: 43780},
+		},
+		VerifyConsensusFault: 495422,
+	}
+}
+
+// OnChainMessage implements PriceList.
+func (pl *GasPrices) OnChainMessage(msgSize int) GasCharge {
+	return newGasCharge("OnChainMessage", pl.OnChainMessageComputeBase,
+		(pl.OnChainMessageStorageBase+pl.OnChainMessageStoragePerByte*int64(msgSize))*pl.StorageGasMulti)
+}
+
+// OnChainReturnValue implements PriceList.
+func (pl *GasPrices) OnChainReturnValue(dataSize int) GasCharge {
+	return newGasCharge("OnChainReturnValue", 0, int64(dataSize)*pl.OnChainReturnValuePerByte*pl.StorageGasMulti)
+}
+
+// OnMethodInvocation implements PriceList.
+func (pl *GasPrices) OnMethodInvocation(value abi.TokenAmount, methodNum abi.MethodNum) GasCharge {
+	ret := pl.SendBase
+	if !value.NilOrZero() {
+		ret += pl.SendTransferFunds
+		if methodNum == 0 { // builtin.MethodSend
+			ret += pl.SendTransferOnlyPremium
+		}
+	}
+	if methodNum != 0 {
+		ret += pl.SendInvokeMethod
+	}
+	return newGasCharge("OnMethodInvocation", ret, 0)
+}
+
+// OnIpldGet implements PriceList.
+func (pl *GasPrices) OnIpldGet() GasCharge {
+	return newGasCharge("OnIpldGet", pl.IpldGetBase, 0)
+}
+
+// OnIpldPut implements PriceList.
+func (pl *GasPrices) OnIpldPut(dataSize int) GasCharge {
+	return newGasCharge("OnIpldPut", pl.IpldPutBase, int64(dataSize)*pl.IpldPutPerByte*pl.StorageGasMulti)
+}
+
+// OnCreateActor implements PriceList.
+func (pl *GasPrices) OnCreateActor() GasCharge {
+	return newGasCharge("OnCreateActor", pl.CreateActorCompute, pl.CreateActorStorage*pl.StorageGasMulti)
+}
+
+// OnDeleteActor implements PriceList.
+func (pl *GasPrices) OnDeleteActor() GasCharge {
+	return newGasCharge("OnDeleteActor", 0, pl.DeleteActor*pl.StorageGasMulti)
+}
+
+// OnVerifySignature implements PriceList.
+// Signatures of unknown type, such as the empty signatures used throughout tests, are not charged.
+func (pl *GasPrices) OnVerifySignature(sigType crypto.SigType, _ int) GasCharge {
+	return newGasCharge("OnVerifySignature", pl.VerifySignature[sigType], 0)
+}
+
+// OnHashing implements PriceList.
+func (pl *GasPrices) OnHashing(_ int) GasCharge {
+	return newGasCharge("OnHashing", pl.HashingBase, 0)
+}
+
+// OnComputeUnsealedSectorCid implements PriceList.
+func (pl *GasPrices) OnComputeUnsealedSectorCid(_ abi.RegisteredSealProof, _ []abi.PieceInfo) GasCharge {
+	return newGasCharge("OnComputeUnsealedSectorCid", pl.ComputeUnsealedSectorCidBase, 0)
+}
+
+// OnVerifySeal implements PriceList.
+func (pl *GasPrices) OnVerifySeal(_ proof.SealVerifyInfo) GasCharge {
+	return newGasCharge("OnVerifySeal", pl.VerifySealBase, 0)
+}
+
+// OnVerifyPost implements PriceList.
+func (pl *GasPrices) OnVerifyPost(info proof.WindowPoStVerifyInfo) GasCharge {
+	sectorSize := "unknown"
+	var proofType abi.RegisteredPoStProof
+	if len(info.Proofs) != 0 {
+		proofType = info.Proofs[0].PoStProof
+		ss, err := info.Proofs[0].PoStProof.SectorSize()
+		if err == nil {
+			sectorSize = ss.ShortString()
+		}
+	}
+
+	cost, ok := pl.VerifyPostLookup[proofType]
+	if !ok {
+		cost = pl.VerifyPostLookup[abi.RegisteredPoStProof_StackedDrgWindow512MiBV1]
+	}
+
+	gasUsed := cost.Flat + int64(len(info.ChallengedSectors))*cost.Scale
+	return newGasCharge("OnVerifyPost-"+sectorSize, gasUsed, 0)
+}
+
+// OnVerifyConsensusFault implements PriceList.
+func (pl *GasPrices) OnVerifyConsensusFault() GasCharge {
+	return newGasCharge("OnVerifyConsensusFault", pl.VerifyConsensusFault, 0)
+}
+
+/////////////////////////////////////////////
+//          Gas fees
+/////////////////////////////////////////////
+
+// DefaultBaseFee is the base fee per unit of gas paid by chain messages, the network's minimum base fee.
+var DefaultBaseFee = abi.NewTokenAmount(100)
+
+// Numerator and denominator of the fraction of gas used that a message's gas limit may exceed without
+// being penalised for overestimation.
+const gasOveruseNum, gasOveruseDenom = 11, 10
+
+// GasOutputs is the division of a message's gas fees between the parties paid by it.
+type GasOutputs struct {
+	BaseFeeBurn        abi.TokenAmount // Base fee for gas used, sent to the burnt funds actor
+	OverEstimationBurn abi.TokenAmount // Base fee for overestimated gas, sent to the burnt funds actor
+	MinerPenalty       abi.TokenAmount // Penalty to the block miner for base fee not covered by the fee cap
+	MinerTip           abi.TokenAmount // Premium paid to the block miner, sent to the reward actor
+	Refund             abi.TokenAmount // Remainder of the prepaid gas returned to the sender
+
+	GasRefund int64 // Unused gas refunded to the sender
+	GasBurned int64 // Unused gas for which the base fee is burned as a penalty for overestimation
+}
+
+// Returns gas outputs with all amounts zero.
+func ZeroGasOutputs() GasOutputs {
+	return GasOutputs{
+		BaseFeeBurn:        big.Zero(),
+		OverEstimationBurn: big.Zero(),
+		MinerPenalty:       big.Zero(),
+		MinerTip:           big.Zero(),
+		Refund:             big.Zero(),
+	}
+}
+
+// ComputeGasOutputs divides the fees for a message between burn, miner tip and sender refund,
+// following the rules of EIP-1559 as implemented by Filecoin nodes.
+// The sender is expected to have prepaid the gas limit at the fee cap, which the outputs sum to.
+func ComputeGasOutputs(gasUsed, gasLimit int64, baseFee, feeCap, gasPremium abi.TokenAmount) GasOutputs {
+	gasUsedBig := big.NewInt(gasUsed)
+	out := ZeroGasOutputs()
+
+	baseFeeToPay := baseFee
+	if baseFee.GreaterThan(feeCap) {
+		baseFeeToPay = feeCap
+		out.MinerPenalty = big.Mul(big.Sub(baseFee, feeCap), gasUsedBig)
+	}
+	out.BaseFeeBurn = big.Mul(baseFeeToPay, gasUsedBig)
+
+	minerTip := gasPremium
+	if big.Add(baseFeeToPay, minerTip).GreaterThan(feeCap) {
+		minerTip = big.Sub(feeCap, baseFeeToPay)
+	}
+	out.MinerTip = big.Mul(minerTip, big.NewInt(gasLimit))
+
+	out.GasRefund, out.GasBurned = computeGasOverestimationBurn(gasUsed, gasLimit)
+	if out.GasBurned != 0 {
+		gasBurnedBig := big.NewInt(out.GasBurned)
+		out.OverEstimationBurn = big.Mul(baseFeeToPay, gasBurnedBig)
+		minerPenalty := big.Mul(big.Sub(baseFee, baseFeeToPay), gasBurnedBig)
+		out.MinerPenalty = big.Add(out.MinerPenalty, minerPenalty)
+	}
+
+	requiredFunds := big.Mul(big.NewInt(gasLimit), feeCap)
+	refund := big.Sub(requiredFunds, out.BaseFeeBurn)
+	refund = big.Sub(refund, out.MinerTip)
+	out.Refund = big.Sub(refund, out.OverEstimationBurn)
+	return out
+}
+
+// Computes the gas to be refunded and the gas to be burned for overestimating a message's gas limit.
+func computeGasOverestimationBurn(gasUsed, gasLimit int64) (int64, int64) {
+	if gasUsed == 0 {
+		return 0, gasLimit
+	}
+
+	// over = gasLimit/gasUsed - 1 - 0.1
+	// over = min(over, 1)
+	// gasToBurn = (gasLimit - gasUsed) * over
+	over := gasLimit - (gasOveruseNum*gasUsed)/gasOveruseDenom
+	if over < 0 {
+		return gasLimit - gasUsed, 0
+	}
+	if over > gasUsed {
+		over = gasUsed
+	}
+
+	gasToBurn := big.NewInt(gasLimit - gasUsed)
+	gasToBurn = big.Mul(gasToBurn, big.NewInt(over))
+	gasToBurn = big.Div(gasToBurn, big.NewInt(gasUsed))
+	return gasLimit - gasUsed - gasToBurn.Int64(), gasToBurn.Int64()
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"reflect"
 	"runtime/debug"
 
@@ -56,6 +57,9 @@ type topLevelContext struct {
 	newActorAddressCount    uint64          // Count of calls to NewActorAddress (mutable).
 	statsSource             StatsSource     // optional source of external statistics that can be used to profile calls
 	circSupply              abi.TokenAmount // default or externally specified circulating FIL supply
+	priceList               PriceList       // prices for gas charged during execution
+	gasLimit                int64           // Gas limit of the top-level message.
+	gasUsed                 int64           // Gas charged so far (mutable).
 }
 
 func newInvocationContext(rt *VM, topLevel *topLevelContext, msg InternalMessage, fromActor *states.Actor, emptyObject cid.Cid) invocationContext {
@@ -84,6 +88,8 @@ func (ic *invocationContext) loadState(obj cbor.Unmarshaler) cid.Cid {
 	if !c.Defined() {
 		ic.Abortf(exitcode.SysErrorIllegalActor, "failed to load undefined state, must construct first")
 	}
+	ic.chargeGas(ic.topLevel.priceList.OnIpldGet())
+	ic.rt.recordRead(c)
 	err := ic.rt.store.Get(ic.rt.ctx, c, obj)
 	if err != nil {
 		panic(errors.Wrapf(err, "failed to load state for actor %s, CID %s", ic.msg.to, c))
@@ -117,13 +123,19 @@ var _ runtime.Runtime = (*invocationContext)(nil)
 
 // Store implements runtime.Runtime.
 func (ic *invocationContext) StoreGet(c cid.Cid, o cbor.Unmarshaler) bool {
+	ic.chargeGas(ic.topLevel.priceList.OnIpldGet())
+	ic.rt.recordRead(c)
 	sw := &storeWrapper{s: ic.rt.store, rt: ic.rt}
 	return sw.StoreGet(c, o)
 }
 
 func (ic *invocationContext) StorePut(x cbor.Marshaler) cid.Cid {
+	sized := &sizedMarshaler{inner: x}
 	sw := &storeWrapper{s: ic.rt.store, rt: ic.rt}
-	return sw.StorePut(x)
+	c := sw.StorePut(sized)
+	ic.chargeIpldPut(sized)
+	ic.rt.recordWrite(c)
+	return c
 }
 
 // These methods implement
@@ -147,10 +159,13 @@ func (ic *invocationContext) StateCreate(obj cbor.Marshaler) {
 	if actr.Head.Defined() && !ic.emptyObject.Equals(actr.Head) {
 		ic.Abortf(exitcode.SysErrorIllegalActor, "failed to construct actor state: already initialized")
 	}
-	c, err := ic.rt.store.Put(ic.rt.ctx, obj)
+	sized := &sizedMarshaler{inner: obj}
+	c, err := ic.rt.store.Put(ic.rt.ctx, sized)
 	if err != nil {
 		ic.Abortf(exitcode.ErrIllegalState, "failed to create actor state")
 	}
+	ic.chargeIpldPut(sized)
+	ic.rt.recordWrite(c)
 	actr.Head = c
 	ic.storeActor(actr)
 	ic.stateUsedObjs[obj] = c // Track the expected CID of the object.
@@ -183,18 +198,22 @@ func (ic *invocationContext) StateTransaction(obj cbor.Er, f func()) {
 }
 
 func (ic *invocationContext) VerifySignature(signature crypto.Signature, signer address.Address, plaintext []byte) error {
+	ic.chargeGas(ic.topLevel.priceList.OnVerifySignature(signature.Type, len(plaintext)))
 	return ic.Syscalls().VerifySignature(signature, signer, plaintext)
 }
 
 func (ic *invocationContext) HashBlake2b(data []byte) [32]byte {
+	ic.chargeGas(ic.topLevel.priceList.OnHashing(len(data)))
 	return ic.Syscalls().HashBlake2b(data)
 }
 
 func (ic *invocationContext) ComputeUnsealedSectorCID(reg abi.RegisteredSealProof, pieces []abi.PieceInfo) (cid.Cid, error) {
+	ic.chargeGas(ic.topLevel.priceList.OnComputeUnsealedSectorCid(reg, pieces))
 	return ic.Syscalls().ComputeUnsealedSectorCID(reg, pieces)
 }
 
 func (ic *invocationContext) VerifySeal(vi proof.SealVerifyInfo) error {
+	ic.chargeGas(ic.topLevel.priceList.OnVerifySeal(vi))
 	return ic.Syscalls().VerifySeal(vi)
 }
 
@@ -203,10 +222,12 @@ func (ic *invocationContext) BatchVerifySeals(vis map[address.Address][]proof.Se
 }
 
 func (ic *invocationContext) VerifyPoSt(vi proof.WindowPoStVerifyInfo) error {
+	ic.chargeGas(ic.topLevel.priceList.OnVerifyPost(vi))
 	return ic.Syscalls().VerifyPoSt(vi)
 }
 
 func (ic *invocationContext) VerifyConsensusFault(h1, h2, extra []byte) (*runtime.ConsensusFault, error) {
+	ic.chargeGas(ic.topLevel.priceList.OnVerifyConsensusFault())
 	return ic.Syscalls().VerifyConsensusFault(h1, h2, extra)
 }
 
@@ -240,12 +261,34 @@ func (ic *invocationContext) GetActorCodeCID(a address.Address) (cid.Cid, bool)
 	return entry.Code, true
 }
 
-func (ic *invocationContext) GetRandomnessFromBeacon(_ crypto.DomainSeparationTag, _ abi.ChainEpoch, _ []byte) abi.Randomness {
-	return []byte("not really random")
+func (ic *invocationContext) GetRandomnessFromBeacon(tag crypto.DomainSeparationTag, randEpoch abi.ChainEpoch, entropy []byte) abi.Randomness {
+	ic.checkRandomnessEpoch(randEpoch)
+	rand, err := ic.rt.randomness.GetRandomnessFromBeacon(tag, randEpoch, entropy)
+	if err != nil {
+		ic.Abortf(exitcode.SysErrorIllegalArgument, "failed to get beacon randomness: %v", err)
+	}
+	if ic.rt.recorder != nil {
+		ic.rt.recorder.recordRandomness(true, tag, randEpoch, entropy, rand)
+	}
+	return rand
 }
 
-func (ic *invocationContext) GetRandomnessFromTickets(_ crypto.DomainSeparationTag, _ abi.ChainEpoch, _ []byte) abi.Randomness {
-	return []byte("not really random")
+func (ic *invocationContext) GetRandomnessFromTickets(tag crypto.DomainSeparationTag, randEpoch abi.ChainEpoch, entropy []byte) abi.Randomness {
+	ic.checkRandomnessEpoch(randEpoch)
+	rand, err := ic.rt.randomness.GetRandomnessFromTickets(tag, randEpoch, entropy)
+	if err != nil {
+		ic.Abortf(exitcode.SysErrorIllegalArgument, "failed to get ticket randomness: %v", err)
+	}
+	if ic.rt.recorder != nil {
+		ic.rt.recorder.recordRandomness(false, tag, randEpoch, entropy, rand)
+	}
+	return rand
+}
+
+func (ic *invocationContext) checkRandomnessEpoch(randEpoch abi.ChainEpoch) {
+	if randEpoch > ic.rt.currentEpoch {
+		ic.Abortf(exitcode.SysErrorIllegalArgument, "cannot draw randomness from future epoch %d at epoch %d", randEpoch, ic.rt.currentEpoch)
+	}
 }
 
 func (ic *invocationContext) ValidateImmediateCallerAcceptAny() {
@@ -292,11 +335,8 @@ func (ic *invocationContext) ResolveAddress(address address.Address) (address.Ad
 func (ic *invocationContext) NewActorAddress() address.Address {
 	var buf bytes.Buffer
 
-	b1, err := ic.topLevel.originatorStableAddress.Marshal()
-	if err != nil {
-		panic(err)
-	}
-	_, err = buf.Write(b1)
+	// The address is encoded as a CBOR byte string, as by a node.
+	err := ic.topLevel.originatorStableAddress.MarshalCBOR(&buf)
 	if err != nil {
 		panic(err)
 	}
@@ -315,6 +355,7 @@ func (ic *invocationContext) NewActorAddress() address.Address {
 	if err != nil {
 		panic(err)
 	}
+	ic.topLevel.newActorAddressCount++
 	return actorAddress
 }
 
@@ -343,6 +384,11 @@ func (ic *invocationContext) Send(toAddr address.Address, methodNum abi.MethodNu
 	newCtx := newInvocationContext(ic.rt, ic.topLevel, newMsg, fromActor, ic.emptyObject)
 	ret, code := newCtx.invoke()
 
+	// running out of gas aborts the whole message, not just the sub-call
+	if code == exitcode.SysErrOutOfGas {
+		ic.Abortf(code, "out of gas in send to %s method %d", toAddr, methodNum)
+	}
+
 	ic.stats.MergeSubStat(newCtx.toActor.Code, newMsg.method, newCtx.stats)
 
 	err = ret.Into(out)
@@ -363,6 +409,8 @@ func (ic *invocationContext) CreateActor(codeID cid.Cid, addr address.Address) {
 		ic.Abortf(exitcode.SysErrorIllegalArgument, "Can only have one instance of singleton actors.")
 	}
 
+	ic.chargeGas(ic.topLevel.priceList.OnCreateActor())
+
 	ic.rt.Log(rt.DEBUG, "creating actor, friendly-name: %s, Exitcode: %s, addr: %s\n", builtin.ActorNameByCode(codeID), codeID, addr)
 
 	// Check existing address. If nothing there, create empty actor.
@@ -396,6 +444,7 @@ func (ic *invocationContext) DeleteActor(beneficiary address.Address) {
 	if !found {
 		ic.Abortf(exitcode.SysErrorIllegalActor, "delete non-existent actor %v", receiverActor)
 	}
+	ic.chargeGas(ic.topLevel.priceList.OnDeleteActor())
 
 	// Transfer any remaining balance to the beneficiary.
 	// This looks like it could cause a problem with gas refund going to a non-existent actor, but the gas payer
@@ -417,8 +466,8 @@ func (ic *invocationContext) Context() context.Context {
 	return ic.rt.ctx
 }
 
-func (ic *invocationContext) ChargeGas(_ string, _ int64, _ int64) {
-	// no-op
+func (ic *invocationContext) ChargeGas(name string, gas int64, _ int64) {
+	ic.chargeGas(newGasCharge(name, gas, 0))
 }
 
 // Starts a new tracing span. The span must be End()ed explicitly, typically with a deferred invocation.
@@ -428,7 +477,7 @@ func (ic *invocationContext) StartSpan(_ string) func() {
 
 // Provides the system call interface.
 func (ic *invocationContext) Syscalls() runtime.Syscalls {
-	return fakeSyscalls{receiver: ic.msg.to, epoch: ic.rt.currentEpoch}
+	return ic.rt.syscalls(ic.rt, ic.msg.to)
 }
 
 // Note events that may make debugging easier
@@ -451,6 +500,82 @@ func (r returnWrapper) Into(o cbor.Unmarshaler) error {
 	return o.UnmarshalCBOR(&b)
 }
 
+/////////////////////////////////////////////
+//          Gas
+/////////////////////////////////////////////
+
+// Charges gas to the top-level message, aborting with SysErrOutOfGas if its limit is exceeded.
+func (ic *invocationContext) chargeGas(charge GasCharge) {
+	toUse := charge.Total()
+	used := ic.topLevel.gasUsed + toUse
+	if used > ic.topLevel.gasLimit {
+		ic.topLevel.gasUsed = ic.topLevel.gasLimit
+		ic.Abortf(exitcode.SysErrOutOfGas, "not enough gas: used=%d, limit=%d, charge=%s", used, ic.topLevel.gasLimit, charge)
+	}
+	ic.topLevel.gasUsed = used
+}
+
+// Charges for an object that has been put to the store.
+func (ic *invocationContext) chargeIpldPut(obj *sizedMarshaler) {
+	ic.chargeGas(ic.topLevel.priceList.OnIpldPut(obj.size))
+}
+
+// Wraps an object put to the store to record the size of the serialization the store stores,
+// so that the object isn't serialized again to charge for it.
+type sizedMarshaler struct {
+	inner cbor.Marshaler
+	size  int
+}
+
+func (m *sizedMarshaler) MarshalCBOR(w io.Writer) error {
+	cw := &countingWriter{w: w}
+	err := m.inner.MarshalCBOR(cw)
+	m.size = cw.count
+	return err
+}
+
+type countingWriter struct {
+	w     io.Writer
+	count int
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.count += n
+	return n, err
+}
+
+// Approximates the serialized size of a message with the given fields.
+func messageSize(from, to address.Address, value abi.TokenAmount, method abi.MethodNum, params interface{}) int {
+	size := len(from.Bytes()) + len(to.Bytes()) + binary.Size(uint64(method))
+	if valueBytes, err := value.Bytes(); err == nil {
+		size += len(valueBytes)
+	}
+	switch p := params.(type) {
+	case []byte:
+		size += len(p)
+	case builtin.CBORBytes:
+		size += len(p)
+	case cbor.Marshaler:
+		if v := reflect.ValueOf(p); v.Kind() != reflect.Ptr || !v.IsNil() {
+			size += returnSize(p)
+		}
+	}
+	return size
+}
+
+// Computes the serialized size of a return value.
+func returnSize(ret cbor.Marshaler) int {
+	if ret == nil {
+		return 0
+	}
+	buf := bytes.Buffer{}
+	if err := ret.MarshalCBOR(&buf); err != nil {
+		panic(err)
+	}
+	return buf.Len()
+}
+
 /////////////////////////////////////////////
 //          Fake syscalls
 /////////////////////////////////////////////
@@ -545,6 +670,7 @@ func (ic *invocationContext) invoke() (ret returnWrapper, errcode exitcode.ExitC
 	}
 
 	ic.rt.startInvocation(&ic.msg)
+	gasStart := ic.topLevel.gasUsed
 
 	// Install handler for abort, which rolls back all state changes from this and any nested invocations.
 	// This is the only path by which a non-OK exit code may be returned.
@@ -559,7 +685,7 @@ func (ic *invocationContext) invoke() (ret returnWrapper, errcode exitcode.ExitC
 			case abort:
 				ic.rt.Log(rt.WARN, "Abort during actor execution. errMsg: %v exitCode: %d sender: %v receiver; %v method: %d value %v",
 					r, r.code, ic.msg.from, ic.msg.to, ic.msg.method, ic.msg.value)
-				ic.rt.endInvocation(r.code, abi.Empty)
+				ic.rt.endInvocation(r.code, abi.Empty, ic.topLevel.gasUsed-gasStart)
 				ret = returnWrapper{abi.Empty} // The Empty here should never be used, but slightly safer than zero value.
 				errcode = r.code
 				return
@@ -582,9 +708,13 @@ func (ic *invocationContext) invoke() (ret returnWrapper, errcode exitcode.ExitC
 		panic("bad Exitcode: sender address MUST be an ID address at invocation time")
 	}
 
+	// 1. charge for the invocation
+	ic.chargeGas(ic.topLevel.priceList.OnMethodInvocation(ic.msg.value, ic.msg.method))
+
 	// 2. load target actor
 	// Note: we replace the "to" address with the normalized version
 	ic.toActor, ic.msg.to = ic.resolveTarget(ic.msg.to)
+	ic.rt.currentInvocation().Code = ic.toActor.Code
 
 	// 3. transfer funds carried by the msg
 	if !ic.msg.value.NilOrZero() {
@@ -601,7 +731,7 @@ func (ic *invocationContext) invoke() (ret returnWrapper, errcode exitcode.ExitC
 
 	// 4. if we are just sending funds, there is nothing else to do.
 	if ic.msg.method == builtin.MethodSend {
-		ic.rt.endInvocation(exitcode.Ok, abi.Empty)
+		ic.rt.endInvocation(exitcode.Ok, abi.Empty, ic.topLevel.gasUsed-gasStart)
 		return returnWrapper{abi.Empty}, exitcode.Ok
 	}
 
@@ -628,7 +758,7 @@ func (ic *invocationContext) invoke() (ret returnWrapper, errcode exitcode.ExitC
 	ic.checkStateObjectsUnmodified()
 
 	// 3. success!
-	ic.rt.endInvocation(exitcode.Ok, marsh)
+	ic.rt.endInvocation(exitcode.Ok, marsh, ic.topLevel.gasUsed-gasStart)
 	return ret, exitcode.Ok
 }
 
@@ -669,6 +799,17 @@ func (ic *invocationContext) dispatch(actor runtime.VMActor, method abi.MethodNu
 			return nil, err
 		}
 		args = append(args, reflect.ValueOf(obj))
+	} else if m, ok := arg.(cbor.Marshaler); ok && !reflect.TypeOf(arg).AssignableTo(t) {
+		// parameters sent by an actor of a different version, e.g. another version's CBORBytes
+		buf := new(bytes.Buffer)
+		if err := m.MarshalCBOR(buf); err != nil {
+			return nil, err
+		}
+		obj, err := decodeBytes(t, buf.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, reflect.ValueOf(obj))
 	} else {
 		args = append(args, reflect.ValueOf(arg))
 	}
@@ -791,10 +932,13 @@ func (ic *invocationContext) replace(obj cbor.Marshaler) cid.Cid {
 	if !found {
 		ic.rt.Abortf(exitcode.ErrIllegalState, "failed to find actor %s for state", ic.msg.to)
 	}
-	c, err := ic.rt.store.Put(ic.rt.ctx, obj)
+	sized := &sizedMarshaler{inner: obj}
+	c, err := ic.rt.store.Put(ic.rt.ctx, sized)
 	if err != nil {
 		ic.rt.Abortf(exitcode.ErrIllegalState, "could not save new state")
 	}
+	ic.chargeIpldPut(sized)
+	ic.rt.recordWrite(c)
 	actr.Head = c
 	err = ic.rt.setActor(ic.rt.ctx, ic.msg.to, actr)
 	if err != nil {
@@ -0,0 +1,163 @@
+package vm_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/crypto"
+	"github.com/minio/blake2b-simd"
+)
+
+// RandomnessSource provides the beacon and ticket randomness drawn by actors.
+// The VM checks that the requested epoch is not in the future before consulting the source.
+type RandomnessSource interface {
+	GetRandomnessFromBeacon(tag crypto.DomainSeparationTag, epoch abi.ChainEpoch, entropy []byte) (abi.Randomness, error)
+	GetRandomnessFromTickets(tag crypto.DomainSeparationTag, epoch abi.ChainEpoch, entropy []byte) (abi.Randomness, error)
+}
+
+// DefaultRandomnessSeed seeds the randomness source of newly created VMs.
+var DefaultRandomnessSeed = []byte("specs-actors test vm")
+
+//
+// Deterministic randomness
+//
+
+// DeterministicRandomness derives randomness by hashing the tag, epoch and entropy together with a seed,
+// so that the same request always produces the same value and distinct requests produce distinct values.
+type DeterministicRandomness struct {
+	seed []byte
+}
+
+var _ RandomnessSource = (*DeterministicRandomness)(nil)
+
+func NewDeterministicRandomness(seed []byte) *DeterministicRandomness {
+	return &DeterministicRandomness{seed: seed}
+}
+
+func (r *DeterministicRandomness) GetRandomnessFromBeacon(tag crypto.DomainSeparationTag, epoch abi.ChainEpoch, entropy []byte) (abi.Randomness, error) {
+	return drawRandomness(r.base("beacon"), tag, epoch, entropy), nil
+}
+
+func (r *DeterministicRandomness) GetRandomnessFromTickets(tag crypto.DomainSeparationTag, epoch abi.ChainEpoch, entropy []byte) (abi.Randomness, error) {
+	return drawRandomness(r.base("tickets"), tag, epoch, entropy), nil
+}
+
+// Distinguishes the beacon and ticket chains drawn from the same seed.
+func (r *DeterministicRandomness) base(chain string) []byte {
+	return append([]byte(chain), r.seed...)
+}
+
+// Draws randomness the same way as a node: blake2b(tag || blake2b(base) || epoch || entropy).
+func drawRandomness(base []byte, tag crypto.DomainSeparationTag, epoch abi.ChainEpoch, entropy []byte) abi.Randomness {
+	// writes to a hash never return an error
+	h := blake2b.New256()
+	_ = binary.Write(h, binary.BigEndian, int64(tag))
+	vrfDigest := blake2b.Sum256(base)
+	_, _ = h.Write(vrfDigest[:])
+	_ = binary.Write(h, binary.BigEndian, int64(epoch))
+	_, _ = h.Write(entropy)
+	return h.Sum(nil)
+}
+
+//
+// Scripted randomness
+//
+
+type randomnessKey struct {
+	tag   crypto.DomainSeparationTag
+	epoch abi.ChainEpoch
+}
+
+type scriptedValue struct {
+	entropy    []byte // nil matches any entropy
+	randomness abi.Randomness
+}
+
+// ScriptedRandomness returns exact values set up by a test for each (tag, epoch).
+// Requests that have not been scripted are delegated to a fallback source, or fail if there is none.
+type ScriptedRandomness struct {
+	beacon   map[randomnessKey][]scriptedValue
+	tickets  map[randomnessKey][]scriptedValue
+	fallback RandomnessSource
+}
+
+var _ RandomnessSource = (*ScriptedRandomness)(nil)
+
+// Creates a scripted source. The fallback may be nil.
+func NewScriptedRandomness(fallback RandomnessSource) *ScriptedRandomness {
+	return &ScriptedRandomness{
+		beacon:   make(map[randomnessKey][]scriptedValue),
+		tickets:  make(map[randomnessKey][]scriptedValue),
+		fallback: fallback,
+	}
+}
+
+// Scripts the beacon randomness returned for a tag and epoch, regardless of entropy.
+func (r *ScriptedRandomness) SetBeacon(tag crypto.DomainSeparationTag, epoch abi.ChainEpoch, randomness abi.Randomness) {
+	r.SetBeaconWithEntropy(tag, epoch, nil, randomness)
+}
+
+// Scripts the beacon randomness returned for a tag and epoch when requested with exactly the given entropy.
+// A nil entropy matches any request.
+func (r *ScriptedRandomness) SetBeaconWithEntropy(tag crypto.DomainSeparationTag, epoch abi.ChainEpoch, entropy []byte, randomness abi.Randomness) {
+	key := randomnessKey{tag, epoch}
+	r.beacon[key] = append(r.beacon[key], scriptedValue{entropy, randomness})
+}
+
+// Scripts the ticket randomness returned for a tag and epoch, regardless of entropy.
+func (r *ScriptedRandomness) SetTickets(tag crypto.DomainSeparationTag, epoch abi.ChainEpoch, randomness abi.Randomness) {
+	r.SetTicketsWithEntropy(tag, epoch, nil, randomness)
+}
+
+// Scripts the ticket randomness returned for a tag and epoch when requested with exactly the given entropy.
+// A nil entropy matches any request.
+func (r *ScriptedRandomness) SetTicketsWithEntropy(tag crypto.DomainSeparationTag, epoch abi.ChainEpoch, entropy []byte, randomness abi.Randomness) {
+	key := randomnessKey{tag, epoch}
+	r.tickets[key] = append(r.tickets[key], scriptedValue{entropy, randomness})
+}
+
+func (r *ScriptedRandomness) GetRandomnessFromBeacon(tag crypto.DomainSeparationTag, epoch abi.ChainEpoch, entropy []byte) (abi.Randomness, error) {
+	if rand, ok := lookupScripted(r.beacon, tag, epoch, entropy); ok {
+		return rand, nil
+	}
+	if r.fallback == nil {
+		return nil, fmt.Errorf("no beacon randomness scripted for tag %d, epoch %d, entropy %x", tag, epoch, entropy)
+	}
+	return r.fallback.GetRandomnessFromBeacon(tag, epoch, entropy)
+}
+
+func (r *ScriptedRandomness) GetRandomnessFromTickets(tag crypto.DomainSeparationTag, epoch abi.ChainEpoch, entropy []byte) (abi.Randomness, error) {
+	if rand, ok := lookupScripted(r.tickets, tag, epoch, entropy); ok {
+		return rand, nil
+	}
+	if r.fallback == nil {
+		return nil, fmt.Errorf("no ticket randomness scripted for tag %d, epoch %d, entropy %x", tag, epoch, entropy)
+	}
+	return r.fallback.GetRandomnessFromTickets(tag, epoch, entropy)
+}
+
+// Returns a copy of the scripted source, which may be scripted further independently of this one.
+// The copy shares this source's fallback.
+func (r *ScriptedRandomness) Copy() *ScriptedRandomness {
+	c := NewScriptedRandomness(r.fallback)
+	for key, values := range r.beacon { //nolint:nomaprange
+		c.beacon[key] = append([]scriptedValue(nil), values...)
+	}
+	for key, values := range r.tickets { //nolint:nomaprange
+		c.tickets[key] = append([]scriptedValue(nil), values...)
+	}
+	return c
+}
+
+// Finds the most recently scripted value matching the request.
+func lookupScripted(script map[randomnessKey][]scriptedValue, tag crypto.DomainSeparationTag, epoch abi.ChainEpoch, entropy []byte) (abi.Randomness, bool) {
+	values := script[randomnessKey{tag, epoch}]
+	for i := len(values) - 1; i >= 0; i-- {
+		if values[i].entropy == nil || bytes.Equal(values[i].entropy, entropy) {
+			return values[i].randomness, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,265 @@
+package vm_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/crypto"
+	"github.com/filecoin-project/go-state-types/exitcode"
+	"github.com/filecoin-project/go-state-types/network"
+	exported3 "github.com/filecoin-project/specs-actors/v3/actors/builtin/exported"
+	"github.com/ipfs/go-cid"
+	"github.com/pkg/errors"
+
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/exported"
+	"github.com/filecoin-project/specs-actors/v4/actors/util/adt"
+)
+
+// Recorder records the inputs to and results of messages applied to VMs, so that they may be replayed
+// against different actor implementations.
+// Recording starts from the state prior to the first recorded message. Thereafter state must be changed
+// only by applying messages for a recording to be replayable.
+type Recorder struct {
+	StartRoot  cid.Cid
+	StartEpoch abi.ChainEpoch
+	Messages   []*RecordedMessage
+
+	started      bool
+	callSequence uint64           // VM call sequence prior to the message currently being applied
+	draws        []RandomnessDraw // Randomness drawn by the message currently being applied
+}
+
+// RecordedMessage is a message applied to a VM, together with the VM's configuration and the message's results.
+// The price list and syscalls provider are recorded by reference, so a replay observes any later changes to them,
+// such as rules added to a FaultInjector, and any verifications the replay requests are recorded by the injector.
+type RecordedMessage struct {
+	Epoch          abi.ChainEpoch
+	NetworkVersion network.Version
+	CircSupply     abi.TokenAmount
+	BaseFee        abi.TokenAmount
+	GasLimit       int64  // The VM's gas limit, ignored for chain messages.
+	CallSequence   uint64 // The VM's internal call sequence, from which new actor addresses are derived.
+	Randomness     []RandomnessDraw
+	PriceList      PriceList
+	Syscalls       SyscallsProvider
+
+	Message *Message // Params are CBOR-encoded
+	Chain   bool     // Whether the message was applied as a chain message, with nonce checks and fees
+
+	ExitCode exitcode.ExitCode
+	Return   []byte
+	PostRoot cid.Cid
+}
+
+// RandomnessDraw is randomness drawn by an actor.
+type RandomnessDraw struct {
+	Beacon  bool // Drawn from the beacon, otherwise from tickets
+	Tag     crypto.DomainSeparationTag
+	Epoch   abi.ChainEpoch
+	Entropy []byte
+	Value   abi.Randomness
+}
+
+// WithRecorder configures the VM to record applied messages to a recorder.
+func WithRecorder(r *Recorder) VMOption {
+	return func(v *VM) {
+		v.recorder = r
+	}
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+func (r *Recorder) begin(v *VM) {
+	root, err := v.checkpoint()
+	if err != nil {
+		panic(err)
+	}
+	if !r.started {
+		r.started = true
+		r.StartRoot = root
+		r.StartEpoch = v.GetEpoch()
+	}
+	r.callSequence = v.callSequence
+	r.draws = nil
+}
+
+func (r *Recorder) record(v *VM, msg *Message, chain bool, code exitcode.ExitCode, ret interface{}) {
+	params, err := serializeTraceValue(msg.Params)
+	if err != nil {
+		panic(errors.Wrapf(err, "failed to serialize params of message to %s", msg.To))
+	}
+	retBytes, err := serializeTraceValue(ret)
+	if err != nil {
+		panic(errors.Wrapf(err, "failed to serialize return of message to %s", msg.To))
+	}
+	postRoot, err := v.checkpoint()
+	if err != nil {
+		panic(err)
+	}
+
+	recorded := *msg
+	recorded.Params = params
+	r.Messages = append(r.Messages, &RecordedMessage{
+		Epoch:          v.GetEpoch(),
+		NetworkVersion: v.networkVersion,
+		CircSupply:     v.GetCirculatingSupply(),
+		BaseFee:        v.GetBaseFee(),
+		GasLimit:       v.GetGasLimit(),
+		CallSequence:   r.callSequence,
+		Randomness:     r.draws,
+		PriceList:      v.GetPriceList(),
+		Syscalls:       v.GetSyscallsProvider(),
+		Message:        &recorded,
+		Chain:          chain,
+		ExitCode:       code,
+		Return:         retBytes,
+		PostRoot:       postRoot,
+	})
+	r.draws = nil
+}
+
+func (r *Recorder) recordRandomness(beacon bool, tag crypto.DomainSeparationTag, epoch abi.ChainEpoch, entropy []byte, value abi.Randomness) {
+	r.draws = append(r.draws, RandomnessDraw{
+		Beacon:  beacon,
+		Tag:     tag,
+		Epoch:   epoch,
+		Entropy: entropy,
+		Value:   value,
+	})
+}
+
+// Divergence describes a replayed message whose results differ from those recorded.
+type Divergence struct {
+	Index    int // Index of the message in the recording
+	Recorded *RecordedMessage
+
+	ExitCode exitcode.ExitCode
+	Return   []byte
+	PostRoot cid.Cid
+}
+
+func (d *Divergence) String() string {
+	var diffs []string
+	if d.ExitCode != d.Recorded.ExitCode {
+		diffs = append(diffs, fmt.Sprintf("exit code %d, recorded %d", d.ExitCode, d.Recorded.ExitCode))
+	}
+	if !bytes.Equal(d.Return, d.Recorded.Return) {
+		diffs = append(diffs, fmt.Sprintf("return %x, recorded %x", d.Return, d.Recorded.Return))
+	}
+	if !d.PostRoot.Equals(d.Recorded.PostRoot) {
+		diffs = append(diffs, fmt.Sprintf("state root %s, recorded %s", d.PostRoot, d.Recorded.PostRoot))
+	}
+	msg := d.Recorded.Message
+	return fmt.Sprintf("message %d at epoch %d from %s to %s method %d diverged: %s",
+		d.Index, d.Recorded.Epoch, msg.From, msg.To, msg.Method, strings.Join(diffs, "; "))
+}
+
+// Replay applies recorded messages to a VM with the given actor implementations, starting from the recorded
+// initial state, and returns the first message whose exit code, return value or resulting state root differs
+// from that recorded. It returns nil if all messages match.
+// The store must contain the recorded initial state.
+func Replay(ctx context.Context, r *Recorder, actorImpls ActorImplLookup, store adt.Store) (*Divergence, error) {
+	if !r.started {
+		return nil, nil
+	}
+	v, err := NewVMAtEpoch(ctx, actorImpls, store, r.StartRoot, r.StartEpoch)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, rec := range r.Messages {
+		if rec.Epoch != v.GetEpoch() {
+			if v, err = v.WithEpoch(rec.Epoch); err != nil {
+				return nil, err
+			}
+		}
+		if rec.NetworkVersion != v.networkVersion {
+			if v, err = v.WithNetworkVersion(rec.NetworkVersion); err != nil {
+				return nil, err
+			}
+		}
+		v.SetCirculatingSupply(rec.CircSupply)
+		v.SetBaseFee(rec.BaseFee)
+		v.SetGasLimit(rec.GasLimit)
+		v.SetRandomnessSource(recordedRandomness(rec.Randomness))
+		v.SetPriceList(rec.PriceList)
+		v.syscalls = rec.Syscalls
+
+		msg := *rec.Message
+		if params, ok := msg.Params.([]byte); ok && len(params) == 0 {
+			msg.Params = nil
+		}
+		v.callSequence = rec.CallSequence
+
+		var code exitcode.ExitCode
+		var ret []byte
+		if rec.Chain {
+			receipt := v.ApplyChainMessage(&msg)
+			code, ret = receipt.ExitCode, receipt.Return
+		} else {
+			var retVal interface{}
+			retVal, code, _ = v.ApplyMessage(msg.From, msg.To, msg.Value, msg.Method, msg.Params)
+			if code == exitcode.Ok {
+				if ret, err = serializeTraceValue(retVal); err != nil {
+					return nil, err
+				}
+			}
+		}
+		postRoot, err := v.checkpoint()
+		if err != nil {
+			return nil, err
+		}
+
+		if code != rec.ExitCode || !bytes.Equal(ret, rec.Return) || !postRoot.Equals(rec.PostRoot) {
+			return &Divergence{
+				Index:    i,
+				Recorded: rec,
+				ExitCode: code,
+				Return:   ret,
+				PostRoot: postRoot,
+			}, nil
+		}
+	}
+	return nil, nil
+}
+
+// Returns a randomness source providing exactly the recorded draws.
+func recordedRandomness(draws []RandomnessDraw) RandomnessSource {
+	r := NewScriptedRandomness(nil)
+	for _, d := range draws {
+		if d.Beacon {
+			r.SetBeaconWithEntropy(d.Tag, d.Epoch, d.Entropy, d.Value)
+		} else {
+			r.SetTicketsWithEntropy(d.Tag, d.Epoch, d.Entropy, d.Value)
+		}
+	}
+	return r
+}
+
+// ActorsV3 returns the builtin actors of version 3, which share their code CIDs with version 4.
+func ActorsV3() ActorImplLookup {
+	lookup := ActorImplLookup{}
+	for _, ba := range exported3.BuiltinActors() {
+		lookup[ba.Code()] = ba
+	}
+	return lookup
+}
+
+// ActorsV4 returns the builtin actors of version 4.
+func ActorsV4() ActorImplLookup {
+	lookup := ActorImplLookup{}
+	for _, ba := range exported.BuiltinActors() {
+		lookup[ba.Code()] = ba
+	}
+	return lookup
+}
+
+// ReplayWithActorsV3 replays a recording of messages applied to version 4 actors against version 3 actors.
+func ReplayWithActorsV3(ctx context.Context, r *Recorder, store adt.Store) (*Divergence, error) {
+	return Replay(ctx, r, ActorsV3(), store)
+}
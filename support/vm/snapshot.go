@@ -0,0 +1,79 @@
+package vm_test
+
+import (
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/network"
+	"github.com/ipfs/go-cid"
+
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin"
+	"github.com/filecoin-project/specs-actors/v4/actors/util/adt"
+)
+
+// Snapshot is a handle to the state of a VM at some point, from which any number of independent VMs may be forked.
+// Taking a snapshot copies no state: the state tree remains in the VM's store, which forks share.
+type Snapshot struct {
+	StateRoot      cid.Cid
+	Epoch          abi.ChainEpoch
+	NetworkVersion network.Version
+	CircSupply     abi.TokenAmount
+	BaseFee        abi.TokenAmount
+	CallSequence   uint64
+}
+
+// Snapshot flushes any pending state changes and returns a handle to the VM's current state.
+func (vm *VM) Snapshot() (*Snapshot, error) {
+	root, err := vm.checkpoint()
+	if err != nil {
+		return nil, err
+	}
+	return &Snapshot{
+		StateRoot:      root,
+		Epoch:          vm.currentEpoch,
+		NetworkVersion: vm.networkVersion,
+		CircSupply:     vm.circSupply,
+		BaseFee:        vm.baseFee,
+		CallSequence:   vm.callSequence,
+	}, nil
+}
+
+// Fork creates a new VM continuing from a snapshot, which need not have been taken from this VM but
+// must be of state in its store.
+// The fork takes its actor implementations, gas, randomness, syscalls and stats configuration from this VM,
+// subject to any options, but does not share its recorder, invocations or logs.
+// Messages applied to the fork do not affect this VM or any other fork of the snapshot, and vice versa.
+//
+// The randomness source and syscalls provider are shared, not copied: randomness scripted or faults injected
+// through them after forking apply to this VM and all forks sharing them. To configure a fork independently,
+// give it its own copy, e.g. v.Fork(s, WithSyscalls(injector.Copy().Syscalls)) and
+// fork.SetRandomnessSource(scripted.Copy()).
+func (vm *VM) Fork(s *Snapshot, opts ...VMOption) (*VM, error) {
+	actors, err := adt.AsMap(vm.store, s.StateRoot, builtin.DefaultHamtBitwidth)
+	if err != nil {
+		return nil, err
+	}
+
+	fork := &VM{
+		ctx:            vm.ctx,
+		ActorImpls:     vm.ActorImpls,
+		store:          vm.store,
+		actors:         actors,
+		stateRoot:      s.StateRoot,
+		actorsDirty:    false,
+		emptyObject:    vm.emptyObject,
+		currentEpoch:   s.Epoch,
+		networkVersion: s.NetworkVersion,
+		callSequence:   s.CallSequence,
+		statsSource:    vm.statsSource,
+		statsByMethod:  make(StatsByCall),
+		priceList:      vm.priceList,
+		gasLimit:       vm.gasLimit,
+		randomness:     vm.randomness,
+		syscalls:       vm.syscalls,
+		circSupply:     s.CircSupply,
+		baseFee:        s.BaseFee,
+	}
+	for _, opt := range opts {
+		opt(fork)
+	}
+	return fork, nil
+}
@@ -0,0 +1,226 @@
+package vm_test
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/ipfs/go-cid"
+
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/miner"
+	"github.com/filecoin-project/specs-actors/v4/actors/runtime"
+	"github.com/filecoin-project/specs-actors/v4/actors/runtime/proof"
+)
+
+// SyscallsProvider creates the syscalls available to an invocation of the receiver actor.
+type SyscallsProvider func(v *VM, receiver address.Address) runtime.Syscalls
+
+// DefaultSyscalls provides fake syscalls with which all signatures and proofs verify.
+func DefaultSyscalls(v *VM, receiver address.Address) runtime.Syscalls {
+	return fakeSyscalls{receiver: receiver, epoch: v.GetEpoch()}
+}
+
+// VMOption configures a VM at construction.
+type VMOption func(*VM)
+
+// WithSyscalls configures the VM to provide syscalls to actors from the given provider.
+func WithSyscalls(provider SyscallsProvider) VMOption {
+	return func(v *VM) {
+		v.syscalls = provider
+	}
+}
+
+/////////////////////////////////////////////
+//          Fault injecting verifier
+/////////////////////////////////////////////
+
+// PoStVerification records a request to verify a window PoSt.
+type PoStVerification struct {
+	Epoch    abi.ChainEpoch // Epoch at which verification was requested
+	Miner    address.Address
+	Deadline uint64 // Deadline of the challenged sectors, valid only if DeadlineFound
+	// False if the challenged sectors could not be located in the miner's state
+	DeadlineFound bool
+	Info          proof.WindowPoStVerifyInfo
+	Failed        bool
+}
+
+// SealVerification records a request to verify a seal proof.
+type SealVerification struct {
+	Epoch    abi.ChainEpoch // Epoch at which verification was requested
+	Miner    address.Address
+	Info     proof.SealVerifyInfo
+	Rejected bool
+}
+
+// FaultInjector provides syscalls that fail proof verification according to configured rules,
+// delegating all other syscalls to an underlying provider.
+// Every proof verification request is recorded, whether or not it fails.
+type FaultInjector struct {
+	base      SyscallsProvider
+	postRules []func(PoStVerification) bool
+	sealRules []func(SealVerification) bool
+
+	PoStVerifications []PoStVerification
+	SealVerifications []SealVerification
+}
+
+// Creates a fault injector delegating to the given syscalls provider, or DefaultSyscalls if nil.
+func NewFaultInjector(base SyscallsProvider) *FaultInjector {
+	if base == nil {
+		base = DefaultSyscalls
+	}
+	return &FaultInjector{base: base}
+}
+
+// Fails verification of window PoSts submitted by a miner for a deadline.
+// The miner address must be an ID address.
+func (f *FaultInjector) FailPoSt(minerAddr address.Address, dlIdx uint64) {
+	f.FailPoStIf(func(v PoStVerification) bool {
+		return v.Miner == minerAddr && v.DeadlineFound && v.Deadline == dlIdx
+	})
+}
+
+// Fails verification of window PoSts for which the predicate is true.
+func (f *FaultInjector) FailPoStIf(pred func(PoStVerification) bool) {
+	f.postRules = append(f.postRules, pred)
+}
+
+// Rejects seal proofs whose sealed CID matches the predicate.
+func (f *FaultInjector) RejectSealedCIDs(pred func(cid.Cid) bool) {
+	f.RejectSealIf(func(v SealVerification) bool {
+		return pred(v.Info.SealedCID)
+	})
+}
+
+// Rejects seal proofs for which the predicate is true.
+func (f *FaultInjector) RejectSealIf(pred func(SealVerification) bool) {
+	f.sealRules = append(f.sealRules, pred)
+}
+
+// Returns a copy of the injector, with the same rules and recorded verifications, to which rules may be added
+// independently of this one. The copy shares this injector's underlying syscalls provider.
+func (f *FaultInjector) Copy() *FaultInjector {
+	return &FaultInjector{
+		base:              f.base,
+		postRules:         append([]func(PoStVerification) bool(nil), f.postRules...),
+		sealRules:         append([]func(SealVerification) bool(nil), f.sealRules...),
+		PoStVerifications: append([]PoStVerification(nil), f.PoStVerifications...),
+		SealVerifications: append([]SealVerification(nil), f.SealVerifications...),
+	}
+}
+
+// Syscalls implements SyscallsProvider.
+func (f *FaultInjector) Syscalls(v *VM, receiver address.Address) runtime.Syscalls {
+	return &faultInjectingSyscalls{
+		Syscalls: f.base(v, receiver),
+		injector: f,
+		vm:       v,
+	}
+}
+
+var _ SyscallsProvider = (*FaultInjector)(nil).Syscalls
+
+type faultInjectingSyscalls struct {
+	runtime.Syscalls
+	injector *FaultInjector
+	vm       *VM
+}
+
+func (s *faultInjectingSyscalls) VerifySeal(info proof.SealVerifyInfo) error {
+	minerAddr, err := address.NewIDAddress(uint64(info.SectorID.Miner))
+	if err != nil {
+		return err
+	}
+	if s.injector.checkSeal(s.vm, minerAddr, info) {
+		return fmt.Errorf("injected seal verification failure for sector %d of miner %s", info.SectorID.Number, minerAddr)
+	}
+	return s.Syscalls.VerifySeal(info)
+}
+
+func (s *faultInjectingSyscalls) BatchVerifySeals(vis map[address.Address][]proof.SealVerifyInfo) (map[address.Address][]bool, error) {
+	res, err := s.Syscalls.BatchVerifySeals(vis)
+	if err != nil {
+		return nil, err
+	}
+
+	// visit miners in a deterministic order so that recorded verifications are reproducible
+	miners := make([]address.Address, 0, len(vis))
+	for minerAddr := range vis { //nolint:nomaprange
+		miners = append(miners, minerAddr)
+	}
+	sort.Slice(miners, func(i, j int) bool {
+		return bytes.Compare(miners[i].Bytes(), miners[j].Bytes()) < 0
+	})
+
+	for _, minerAddr := range miners {
+		for i, info := range vis[minerAddr] {
+			if s.injector.checkSeal(s.vm, minerAddr, info) {
+				res[minerAddr][i] = false
+			}
+		}
+	}
+	return res, nil
+}
+
+func (s *faultInjectingSyscalls) VerifyPoSt(info proof.WindowPoStVerifyInfo) error {
+	minerAddr, err := address.NewIDAddress(uint64(info.Prover))
+	if err != nil {
+		return err
+	}
+
+	verification := PoStVerification{
+		Epoch: s.vm.GetEpoch(),
+		Miner: minerAddr,
+		Info:  info,
+	}
+	verification.Deadline, verification.DeadlineFound = challengedDeadline(s.vm, minerAddr, info.ChallengedSectors)
+
+	for _, rule := range s.injector.postRules {
+		if rule(verification) {
+			verification.Failed = true
+			break
+		}
+	}
+	s.injector.PoStVerifications = append(s.injector.PoStVerifications, verification)
+
+	if verification.Failed {
+		return fmt.Errorf("injected PoSt verification failure for miner %s", minerAddr)
+	}
+	return s.Syscalls.VerifyPoSt(info)
+}
+
+// Records a seal verification and returns whether it should be rejected.
+func (f *FaultInjector) checkSeal(v *VM, minerAddr address.Address, info proof.SealVerifyInfo) bool {
+	verification := SealVerification{
+		Epoch: v.GetEpoch(),
+		Miner: minerAddr,
+		Info:  info,
+	}
+	for _, rule := range f.sealRules {
+		if rule(verification) {
+			verification.Rejected = true
+			break
+		}
+	}
+	f.SealVerifications = append(f.SealVerifications, verification)
+	return verification.Rejected
+}
+
+// Finds the deadline to which a miner has assigned the challenged sectors.
+func challengedDeadline(v *VM, minerAddr address.Address, sectors []proof.SectorInfo) (uint64, bool) {
+	if len(sectors) == 0 {
+		return 0, false
+	}
+	var st miner.State
+	if err := v.GetState(minerAddr, &st); err != nil {
+		return 0, false
+	}
+	dlIdx, _, err := st.FindSector(v.Store(), sectors[0].SectorNumber)
+	if err != nil {
+		return 0, false
+	}
+	return dlIdx, true
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/filecoin-project/go-state-types/abi"
 	"github.com/filecoin-project/go-state-types/big"
 	"github.com/filecoin-project/go-state-types/cbor"
+	"github.com/filecoin-project/go-state-types/crypto"
 	"github.com/filecoin-project/go-state-types/dline"
 	"github.com/filecoin-project/go-state-types/exitcode"
 	"github.com/ipfs/go-cid"
@@ -51,14 +52,14 @@ func init() {
 //
 
 // Creates a new VM and initializes all singleton actors plus a root verifier account.
-func NewVMWithSingletons(ctx context.Context, t testing.TB, bs ipldcbor.IpldBlockstore) *VM {
+func NewVMWithSingletons(ctx context.Context, t testing.TB, bs ipldcbor.IpldBlockstore, opts ...VMOption) *VM {
 	lookup := map[cid.Cid]runtime.VMActor{}
 	for _, ba := range exported.BuiltinActors() {
 		lookup[ba.Code()] = ba
 	}
 
 	store := adt.WrapBlockStore(ctx, bs)
-	vm := NewVM(ctx, lookup, store)
+	vm := NewVM(ctx, lookup, store, opts...)
 
 	initializeActor(ctx, t, vm, &system.State{}, builtin.SystemActorCodeID, builtin.SystemActorAddr, big.Zero())
 
@@ -296,7 +297,7 @@ func AdvanceByDeadline(t *testing.T, v *VM, minerIDAddr address.Address, predica
 		v, err = v.WithEpoch(dlInfo.Last())
 		require.NoError(t, err)
 
-		_, code := v.ApplyMessage(builtin.SystemActorAddr, builtin.CronActorAddr, big.Zero(), builtin.MethodsCron.EpochTick, nil)
+		_, code, _ := v.ApplyMessage(builtin.SystemActorAddr, builtin.CronActorAddr, big.Zero(), builtin.MethodsCron.EpochTick, nil)
 		require.Equal(t, exitcode.Ok, code)
 
 		dlInfo = MinerDLInfo(t, v, minerIDAddr)
@@ -471,8 +472,15 @@ func GetDealState(t *testing.T, vm *VM, dealID abi.DealID) (*market.DealState, b
 // Misc. helpers
 //
 
+// Returns the chain commitment randomness expected with a PoSt committing to the given epoch.
+func PoStChainCommitRand(t *testing.T, v *VM, epoch abi.ChainEpoch) abi.Randomness {
+	rand, err := v.GetRandomnessSource().GetRandomnessFromTickets(crypto.DomainSeparationTag_PoStChainCommit, epoch, nil)
+	require.NoError(t, err)
+	return rand
+}
+
 func ApplyOk(t *testing.T, v *VM, from, to address.Address, value abi.TokenAmount, method abi.MethodNum, params interface{}) cbor.Marshaler {
-	ret, code := v.ApplyMessage(from, to, value, method, params)
+	ret, code, _ := v.ApplyMessage(from, to, value, method, params)
 	require.Equal(t, exitcode.Ok, code)
 	return ret
 }
@@ -0,0 +1,114 @@
+package vm_test
+
+import (
+	"strings"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/big"
+	"github.com/filecoin-project/go-state-types/cbor"
+	"github.com/filecoin-project/go-state-types/exitcode"
+	"github.com/pkg/errors"
+
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin"
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin/reward"
+)
+
+// Message is a message to be included in a block.
+type Message struct {
+	From   address.Address
+	To     address.Address
+	Nonce  uint64 // Must match the sender's call sequence number
+	Value  abi.TokenAmount
+	Method abi.MethodNum
+	Params interface{}
+
+	GasLimit   int64
+	GasFeeCap  abi.TokenAmount // Maximum price per unit of gas the sender will pay, including premium
+	GasPremium abi.TokenAmount // Price per unit of gas paid to the block miner, in addition to the base fee
+}
+
+// Receipt is the result of applying a message, as it would be recorded on chain.
+type Receipt struct {
+	ExitCode exitcode.ExitCode
+	Return   []byte
+	GasUsed  int64
+}
+
+// Block is the content of a block relevant to state transition: the miner that won it and its messages.
+type Block struct {
+	Miner    address.Address
+	WinCount int64
+	Messages []*Message
+}
+
+// ApplyTipset creates a new VM at the given epoch and applies a tipset comprising the given blocks to it.
+// The current epoch of the VM is taken to be that of the parent tipset, whose state has been fully computed.
+// Cron is run for each null round between the parent and the new tipset.
+// The messages of each block are applied in order as chain messages, after which the block's miner is awarded
+// the block reward together with the block's gas tips, less any penalties for the block's messages.
+// Finally cron is run for the new tipset's epoch.
+// Receipts are returned for all messages, in order of application.
+// An error is returned if any implicit message (reward or cron) fails.
+func (vm *VM) ApplyTipset(epoch abi.ChainEpoch, blocks []Block) (*VM, []Receipt, error) {
+	if epoch <= vm.currentEpoch {
+		return nil, nil, errors.Errorf("tipset epoch %d must be after current epoch %d", epoch, vm.currentEpoch)
+	}
+
+	v := vm
+	var err error
+	for nullRound := vm.currentEpoch + 1; nullRound < epoch; nullRound++ {
+		if v, err = v.WithEpoch(nullRound); err != nil {
+			return nil, nil, err
+		}
+		if err := v.applyCron(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if v, err = v.WithEpoch(epoch); err != nil {
+		return nil, nil, err
+	}
+
+	var receipts []Receipt
+	for _, blk := range blocks {
+		gasReward, penalty := big.Zero(), big.Zero()
+		for _, msg := range blk.Messages {
+			receipt, out := v.applyChainMessage(msg)
+			receipts = append(receipts, receipt)
+			gasReward = big.Add(gasReward, out.MinerTip)
+			penalty = big.Add(penalty, out.MinerPenalty)
+		}
+
+		if err := v.applyBlockReward(blk.Miner, blk.WinCount, gasReward, penalty); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := v.applyCron(); err != nil {
+		return nil, nil, err
+	}
+	return v, receipts, nil
+}
+
+func (vm *VM) applyBlockReward(miner address.Address, winCount int64, gasReward, penalty abi.TokenAmount) error {
+	params := reward.AwardBlockRewardParams{
+		Miner:     miner,
+		Penalty:   penalty,
+		GasReward: gasReward,
+		WinCount:  winCount,
+	}
+	return vm.applyImplicitMessage(builtin.RewardActorAddr, builtin.MethodsReward.AwardBlockReward, &params)
+}
+
+func (vm *VM) applyCron() error {
+	return vm.applyImplicitMessage(builtin.CronActorAddr, builtin.MethodsCron.EpochTick, nil)
+}
+
+func (vm *VM) applyImplicitMessage(to address.Address, method abi.MethodNum, params cbor.Marshaler) error {
+	_, code, _ := vm.ApplyMessage(builtin.SystemActorAddr, to, big.Zero(), method, params)
+	if code != exitcode.Ok {
+		return errors.Errorf("exitcode %d: implicit message to %s method %d failed at epoch %d:\n%s\n",
+			code, to, method, vm.currentEpoch, strings.Join(vm.GetLogs(), "\n"))
+	}
+	return nil
+}
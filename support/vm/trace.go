@@ -0,0 +1,297 @@
+package vm_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"reflect"
+	"runtime"
+	"strings"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-state-types/abi"
+	"github.com/filecoin-project/go-state-types/cbor"
+	"github.com/filecoin-project/go-state-types/exitcode"
+	"github.com/ipfs/go-cid"
+	"github.com/pkg/errors"
+
+	"github.com/filecoin-project/specs-actors/v4/actors/builtin"
+)
+
+// Trace is a serializable record of the invocation trees of messages applied to a VM at an epoch.
+// Traces may be written and read as JSON, for review, or as compact CBOR.
+type Trace struct {
+	Epoch abi.ChainEpoch
+	Calls []*TraceCall
+}
+
+// TraceCall is a serializable record of an invocation and its sub-invocations.
+type TraceCall struct {
+	Caller     address.Address
+	Receiver   address.Address
+	Code       *cid.Cid // Code of the receiving actor, nil if the receiver could not be resolved
+	ActorName  string   // Name of the receiving actor's code
+	Method     abi.MethodNum
+	MethodName string // Name of the method invoked, empty if the method could not be found
+	Value      abi.TokenAmount
+	Params     []byte // CBOR-encoded parameters
+	Return     []byte // CBOR-encoded return value, empty if the call failed
+	ExitCode   exitcode.ExitCode
+	GasUsed    int64
+	Logs       []TraceLog
+	Reads      []cid.Cid
+	Writes     []cid.Cid
+	SubCalls   []*TraceCall
+}
+
+// TraceLog is a line logged by a call.
+type TraceLog struct {
+	Level   int64 // An rt.LogLevel
+	Message string
+}
+
+// NewTrace records the invocations of all messages applied to a VM since it was created at its current epoch.
+func NewTrace(v *VM) (*Trace, error) {
+	calls, err := traceCalls(v.ActorImpls, v.Invocations())
+	if err != nil {
+		return nil, err
+	}
+	return &Trace{Epoch: v.GetEpoch(), Calls: calls}, nil
+}
+
+func traceCalls(actors ActorImplLookup, invocations []*Invocation) ([]*TraceCall, error) {
+	calls := make([]*TraceCall, 0, len(invocations))
+	for _, inv := range invocations {
+		params, err := serializeTraceValue(inv.Msg.params)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to serialize params of call to %s method %d", inv.Msg.to, inv.Msg.method)
+		}
+		var ret []byte
+		if inv.Exitcode.IsSuccess() {
+			if ret, err = serializeTraceValue(inv.Ret); err != nil {
+				return nil, errors.Wrapf(err, "failed to serialize return of call to %s method %d", inv.Msg.to, inv.Msg.method)
+			}
+		}
+		subCalls, err := traceCalls(actors, inv.SubInvocations)
+		if err != nil {
+			return nil, err
+		}
+
+		call := &TraceCall{
+			Caller:     inv.Msg.from,
+			Receiver:   inv.Msg.to,
+			ActorName:  builtin.ActorNameByCode(inv.Code),
+			Method:     inv.Msg.method,
+			MethodName: methodName(actors, inv.Code, inv.Msg.method),
+			Value:      inv.Msg.value,
+			Params:     params,
+			Return:     ret,
+			ExitCode:   inv.Exitcode,
+			GasUsed:    inv.GasUsed,
+			Logs:       traceLogs(inv.Logs),
+			Reads:      inv.Reads,
+			Writes:     inv.Writes,
+			SubCalls:   subCalls,
+		}
+		if inv.Code.Defined() {
+			code := inv.Code
+			call.Code = &code
+		}
+		calls = append(calls, call)
+	}
+	return calls, nil
+}
+
+func traceLogs(logs []LogEntry) []TraceLog {
+	out := make([]TraceLog, len(logs))
+	for i, l := range logs {
+		out[i] = TraceLog{Level: int64(l.Level), Message: l.Message}
+	}
+	return out
+}
+
+// WriteCBOR writes the trace in its compact CBOR format.
+func (t *Trace) WriteCBOR(w io.Writer) error {
+	return t.MarshalCBOR(w)
+}
+
+// ReadTraceCBOR reads a trace written by WriteCBOR.
+func ReadTraceCBOR(r io.Reader) (*Trace, error) {
+	var t Trace
+	if err := t.UnmarshalCBOR(r); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// WriteJSON writes the trace as indented JSON.
+// Alongside the CBOR-encoded params and return value of each call, their decoded values are written if
+// the call's method can be found in the given actor implementations (which may be nil).
+func (t *Trace) WriteJSON(w io.Writer, actors ActorImplLookup) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(jsonTrace{
+		Epoch: t.Epoch,
+		Calls: toJSONTraceCalls(actors, t.Calls),
+	})
+}
+
+// ReadTraceJSON reads a trace written by WriteJSON. Decoded params and return values are ignored.
+func ReadTraceJSON(r io.Reader) (*Trace, error) {
+	var jt jsonTrace
+	if err := json.NewDecoder(r).Decode(&jt); err != nil {
+		return nil, err
+	}
+	return &Trace{Epoch: jt.Epoch, Calls: fromJSONTraceCalls(jt.Calls)}, nil
+}
+
+type jsonTrace struct {
+	Epoch abi.ChainEpoch
+	Calls []*jsonTraceCall
+}
+
+type jsonTraceCall struct {
+	Caller        address.Address
+	Receiver      address.Address
+	Code          *cid.Cid `json:",omitempty"`
+	ActorName     string
+	Method        abi.MethodNum
+	MethodName    string
+	Value         abi.TokenAmount
+	Params        []byte
+	DecodedParams json.RawMessage `json:",omitempty"`
+	Return        []byte
+	DecodedReturn json.RawMessage `json:",omitempty"`
+	ExitCode      exitcode.ExitCode
+	GasUsed       int64
+	Logs          []TraceLog
+	Reads         []cid.Cid
+	Writes        []cid.Cid
+	SubCalls      []*jsonTraceCall
+}
+
+func toJSONTraceCalls(actors ActorImplLookup, calls []*TraceCall) []*jsonTraceCall {
+	out := make([]*jsonTraceCall, 0, len(calls))
+	for _, call := range calls {
+		jc := &jsonTraceCall{
+			Caller:     call.Caller,
+			Receiver:   call.Receiver,
+			Code:       call.Code,
+			ActorName:  call.ActorName,
+			Method:     call.Method,
+			MethodName: call.MethodName,
+			Value:      call.Value,
+			Params:     call.Params,
+			Return:     call.Return,
+			ExitCode:   call.ExitCode,
+			GasUsed:    call.GasUsed,
+			Logs:       call.Logs,
+			Reads:      call.Reads,
+			Writes:     call.Writes,
+			SubCalls:   toJSONTraceCalls(actors, call.SubCalls),
+		}
+		if call.Code != nil {
+			if method, ok := methodFunc(actors, *call.Code, call.Method); ok {
+				jc.DecodedParams = decodeTraceValue(method.Type().In(1), call.Params)
+				if method.Type().NumOut() > 0 {
+					jc.DecodedReturn = decodeTraceValue(method.Type().Out(0), call.Return)
+				}
+			}
+		}
+		out = append(out, jc)
+	}
+	return out
+}
+
+func fromJSONTraceCalls(calls []*jsonTraceCall) []*TraceCall {
+	out := make([]*TraceCall, 0, len(calls))
+	for _, jc := range calls {
+		call := &TraceCall{
+			Caller:     jc.Caller,
+			Receiver:   jc.Receiver,
+			Code:       jc.Code,
+			ActorName:  jc.ActorName,
+			Method:     jc.Method,
+			MethodName: jc.MethodName,
+			Value:      jc.Value,
+			Params:     jc.Params,
+			Return:     jc.Return,
+			ExitCode:   jc.ExitCode,
+			GasUsed:    jc.GasUsed,
+			Logs:       jc.Logs,
+			Reads:      jc.Reads,
+			Writes:     jc.Writes,
+			SubCalls:   fromJSONTraceCalls(jc.SubCalls),
+		}
+		out = append(out, call)
+	}
+	return out
+}
+
+// Serializes a parameter or return value to CBOR. Nil values serialize to nothing.
+func serializeTraceValue(v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case []byte:
+		return v, nil
+	case cbor.Marshaler:
+		if rv := reflect.ValueOf(v); rv.Kind() == reflect.Ptr && rv.IsNil() {
+			return nil, nil
+		}
+		var buf bytes.Buffer
+		if err := v.MarshalCBOR(&buf); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, errors.Errorf("value of type %T is not CBOR marshalable", v)
+	}
+}
+
+// Decodes a CBOR value of the given type and re-encodes it as JSON, returning nil if either fails.
+func decodeTraceValue(t reflect.Type, data []byte) json.RawMessage {
+	if len(data) == 0 || t.Kind() != reflect.Ptr {
+		return nil
+	}
+	obj, err := decodeBytes(t, data)
+	if err != nil {
+		return nil
+	}
+	out, err := json.Marshal(obj)
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+// Returns the exported method of an actor implementation, if it exists.
+func methodFunc(actors ActorImplLookup, code cid.Cid, method abi.MethodNum) (reflect.Value, bool) {
+	impl, ok := actors[code]
+	if !ok || method == builtin.MethodSend {
+		return reflect.Value{}, false
+	}
+	exports := impl.Exports()
+	if uint64(method) >= uint64(len(exports)) || exports[method] == nil {
+		return reflect.Value{}, false
+	}
+	return reflect.ValueOf(exports[method]), true
+}
+
+// Returns the name of an actor's method, taken from the name of the function implementing it.
+func methodName(actors ActorImplLookup, code cid.Cid, method abi.MethodNum) string {
+	if method == builtin.MethodSend {
+		return "Send"
+	}
+	f, ok := methodFunc(actors, code, method)
+	if !ok {
+		return ""
+	}
+	fn := runtime.FuncForPC(f.Pointer())
+	if fn == nil {
+		return ""
+	}
+	// Exports are method values, named e.g. "<package path>.Actor.Constructor-fm"
+	name := strings.TrimSuffix(fn.Name(), "-fm")
+	return name[strings.LastIndex(name, ".")+1:]
+}
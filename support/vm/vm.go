@@ -1,6 +1,7 @@
 package vm_test
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 
@@ -24,8 +25,8 @@ import (
 
 // VM is a simplified message execution framework for the purposes of testing inter-actor communication.
 // The VM maintains actor state and can be used to simulate message validation for a single block or tipset.
-// The VM does not track gas charges, provide working syscalls, validate message nonces and many other things
-// that a compliant VM needs to do.
+// The VM charges gas according to a configurable price list, and validates nonces and charges fees for chain messages,
+// but does not provide working syscalls, validate signatures and many other things that a compliant VM needs to do.
 type VM struct {
 	ctx   context.Context
 	store adt.Store
@@ -48,7 +49,15 @@ type VM struct {
 	statsSource   StatsSource
 	statsByMethod StatsByCall
 
+	priceList PriceList
+	gasLimit  int64
+
+	randomness RandomnessSource
+	syscalls   SyscallsProvider
+
 	circSupply abi.TokenAmount
+	baseFee    abi.TokenAmount
+	recorder   *Recorder
 }
 
 // VM types
@@ -66,13 +75,18 @@ type InternalMessage struct {
 
 type Invocation struct {
 	Msg            *InternalMessage
+	Code           cid.Cid // Code of the receiving actor, undefined if the receiver could not be resolved.
 	Exitcode       exitcode.ExitCode
 	Ret            cbor.Marshaler
+	GasUsed        int64 // Gas charged by this invocation and its sub-invocations.
+	Logs           []LogEntry
+	Reads          []cid.Cid // Blocks read from the store by this invocation, excluding sub-invocations.
+	Writes         []cid.Cid // Blocks written to the store by this invocation, excluding sub-invocations.
 	SubInvocations []*Invocation
 }
 
 // NewVM creates a new runtime for executing messages.
-func NewVM(ctx context.Context, actorImpls ActorImplLookup, store adt.Store) *VM {
+func NewVM(ctx context.Context, actorImpls ActorImplLookup, store adt.Store, opts ...VMOption) *VM {
 	actors, err := adt.MakeEmptyMap(store, builtin.DefaultHamtBitwidth)
 	if err != nil {
 		panic(err)
@@ -87,7 +101,7 @@ func NewVM(ctx context.Context, actorImpls ActorImplLookup, store adt.Store) *VM
 		panic(err)
 	}
 
-	return &VM{
+	vm := &VM{
 		ctx:            ctx,
 		ActorImpls:     actorImpls,
 		store:          store,
@@ -97,12 +111,21 @@ func NewVM(ctx context.Context, actorImpls ActorImplLookup, store adt.Store) *VM
 		emptyObject:    emptyObject,
 		networkVersion: network.VersionMax,
 		statsByMethod:  make(StatsByCall),
+		priceList:      DefaultPriceList(),
+		gasLimit:       DefaultGasLimit,
+		randomness:     NewDeterministicRandomness(DefaultRandomnessSeed),
+		syscalls:       DefaultSyscalls,
 		circSupply:     big.Mul(big.NewInt(1e9), big.NewInt(1e18)),
+		baseFee:        DefaultBaseFee,
+	}
+	for _, opt := range opts {
+		opt(vm)
 	}
+	return vm
 }
 
 // NewVM creates a new runtime for executing messages.
-func NewVMAtEpoch(ctx context.Context, actorImpls ActorImplLookup, store adt.Store, stateRoot cid.Cid, epoch abi.ChainEpoch) (*VM, error) {
+func NewVMAtEpoch(ctx context.Context, actorImpls ActorImplLookup, store adt.Store, stateRoot cid.Cid, epoch abi.ChainEpoch, opts ...VMOption) (*VM, error) {
 	actors, err := adt.AsMap(store, stateRoot, builtin.DefaultHamtBitwidth)
 	if err != nil {
 		return nil, err
@@ -113,7 +136,7 @@ func NewVMAtEpoch(ctx context.Context, actorImpls ActorImplLookup, store adt.Sto
 		panic(err)
 	}
 
-	return &VM{
+	vm := &VM{
 		ctx:            ctx,
 		ActorImpls:     actorImpls,
 		currentEpoch:   epoch,
@@ -124,8 +147,17 @@ func NewVMAtEpoch(ctx context.Context, actorImpls ActorImplLookup, store adt.Sto
 		emptyObject:    emptyObject,
 		networkVersion: network.VersionMax,
 		statsByMethod:  make(StatsByCall),
+		priceList:      DefaultPriceList(),
+		gasLimit:       DefaultGasLimit,
+		randomness:     NewDeterministicRandomness(DefaultRandomnessSeed),
+		syscalls:       DefaultSyscalls,
 		circSupply:     big.Mul(big.NewInt(1e9), big.NewInt(1e18)),
-	}, nil
+		baseFee:        DefaultBaseFee,
+	}
+	for _, opt := range opts {
+		opt(vm)
+	}
+	return vm, nil
 }
 
 func (vm *VM) WithEpoch(epoch abi.ChainEpoch) (*VM, error) {
@@ -151,7 +183,13 @@ func (vm *VM) WithEpoch(epoch abi.ChainEpoch) (*VM, error) {
 		networkVersion: vm.networkVersion,
 		statsSource:    vm.statsSource,
 		statsByMethod:  make(StatsByCall),
+		priceList:      vm.priceList,
+		gasLimit:       vm.gasLimit,
+		randomness:     vm.randomness,
+		syscalls:       vm.syscalls,
 		circSupply:     vm.circSupply,
+		baseFee:        vm.baseFee,
+		recorder:       vm.recorder,
 	}, nil
 }
 
@@ -178,7 +216,13 @@ func (vm *VM) WithNetworkVersion(nv network.Version) (*VM, error) {
 		networkVersion: nv,
 		statsSource:    vm.statsSource,
 		statsByMethod:  make(StatsByCall),
+		priceList:      vm.priceList,
+		gasLimit:       vm.gasLimit,
+		randomness:     vm.randomness,
+		syscalls:       vm.syscalls,
 		circSupply:     vm.circSupply,
+		baseFee:        vm.baseFee,
+		recorder:       vm.recorder,
 	}, nil
 }
 
@@ -285,15 +329,26 @@ func (vm *VM) NormalizeAddress(addr address.Address) (address.Address, bool) {
 }
 
 // ApplyMessage applies the message to the current state.
-func (vm *VM) ApplyMessage(from, to address.Address, value abi.TokenAmount, method abi.MethodNum, params interface{}) (cbor.Marshaler, exitcode.ExitCode) {
-	// This method does not actually execute the message itself,
-	// but rather deals with the pre/post processing of a message.
-	// (see: `invocationContext.invoke()` for the dispatch and execution)
+// Gas is charged against the VM's gas limit, or ImplicitMessageGasLimit for messages from the system actor.
+// A message exhausting its gas fails with SysErrOutOfGas and all its state changes are rolled back.
+// Returns the gas used, which is also recorded on the message's top-level invocation.
+// The sender's call sequence number is neither checked nor incremented, and no gas fees are paid.
+func (vm *VM) ApplyMessage(from, to address.Address, value abi.TokenAmount, method abi.MethodNum, params interface{}) (cbor.Marshaler, exitcode.ExitCode, int64) {
+	if vm.recorder == nil {
+		return vm.applyUncheckedMessage(from, to, value, method, params)
+	}
 
+	vm.recorder.begin(vm)
+	ret, code, gasUsed := vm.applyUncheckedMessage(from, to, value, method, params)
+	vm.recorder.record(vm, &Message{From: from, To: to, Value: value, Method: method, Params: params}, false, code, ret)
+	return ret, code, gasUsed
+}
+
+func (vm *VM) applyUncheckedMessage(from, to address.Address, value abi.TokenAmount, method abi.MethodNum, params interface{}) (cbor.Marshaler, exitcode.ExitCode, int64) {
 	// load actor from global state
 	fromID, ok := vm.NormalizeAddress(from)
 	if !ok {
-		return nil, exitcode.SysErrSenderInvalid
+		return nil, exitcode.SysErrSenderInvalid, 0
 	}
 
 	fromActor, found, err := vm.GetActor(fromID)
@@ -302,9 +357,125 @@ func (vm *VM) ApplyMessage(from, to address.Address, value abi.TokenAmount, meth
 	}
 	if !found {
 		// Execution error; sender does not exist at time of message execution.
-		return nil, exitcode.SysErrSenderInvalid
+		return nil, exitcode.SysErrSenderInvalid, 0
+	}
+
+	gasLimit := vm.gasLimit
+	if fromID == builtin.SystemActorAddr {
+		gasLimit = ImplicitMessageGasLimit
+	}
+
+	// Unchecked messages have no nonce, so take a call sequence that only makes new actor addresses unique.
+	callSeq := vm.callSequence
+	vm.callSequence++
+	return vm.applyMessage(from, fromID, fromActor, callSeq, to, value, method, params, gasLimit)
+}
+
+// ApplyChainMessage applies a message as it would be applied by a node after inclusion in a block.
+// The message nonce must match the sender's call sequence number, which is incremented, and the sender
+// must be able to cover the message's gas limit at its fee cap.
+// Gas is charged against the message's gas limit and paid for by the sender at the VM's base fee.
+// The base fee and overestimation burn are sent to the burnt funds actor, and the miner tip to the reward actor.
+func (vm *VM) ApplyChainMessage(msg *Message) Receipt {
+	receipt, _ := vm.applyChainMessage(msg)
+	return receipt
+}
+
+func (vm *VM) applyChainMessage(msg *Message) (Receipt, GasOutputs) {
+	if vm.recorder == nil {
+		return vm.executeChainMessage(msg)
+	}
+
+	vm.recorder.begin(vm)
+	receipt, out := vm.executeChainMessage(msg)
+	vm.recorder.record(vm, msg, true, receipt.ExitCode, receipt.Return)
+	return receipt, out
+}
+
+func (vm *VM) executeChainMessage(msg *Message) (Receipt, GasOutputs) {
+	// An undefined fee cap or premium is zero, as decoded from an empty big integer.
+	// The caller's message is not modified.
+	if msg.GasFeeCap.Nil() || msg.GasPremium.Nil() {
+		defined := *msg
+		if defined.GasFeeCap.Nil() {
+			defined.GasFeeCap = big.Zero()
+		}
+		if defined.GasPremium.Nil() {
+			defined.GasPremium = big.Zero()
+		}
+		msg = &defined
 	}
 
+	// A message that fails validation is not executed. The block miner is penalised for its inclusion.
+	msgGas := vm.priceList.OnChainMessage(messageSize(msg.From, msg.To, msg.Value, msg.Method, msg.Params)).Total()
+	invalid := func(code exitcode.ExitCode) (Receipt, GasOutputs) {
+		out := ZeroGasOutputs()
+		out.MinerPenalty = big.Mul(vm.baseFee, big.NewInt(msgGas))
+		return Receipt{ExitCode: code}, out
+	}
+
+	if msgGas > msg.GasLimit {
+		return invalid(exitcode.SysErrOutOfGas)
+	}
+
+	fromID, ok := vm.NormalizeAddress(msg.From)
+	if !ok {
+		return invalid(exitcode.SysErrSenderInvalid)
+	}
+	fromActor, found, err := vm.GetActor(fromID)
+	if err != nil {
+		panic(err)
+	}
+	if !found {
+		return invalid(exitcode.SysErrSenderInvalid)
+	}
+	if msg.Nonce != fromActor.CallSeqNum {
+		return invalid(exitcode.SysErrSenderStateInvalid)
+	}
+	gasCost := big.Mul(msg.GasFeeCap, big.NewInt(msg.GasLimit))
+	if fromActor.Balance.LessThan(gasCost) {
+		return invalid(exitcode.SysErrSenderStateInvalid)
+	}
+
+	// Prepay gas and increment the sequence number. These changes persist even if the message fails.
+	fromActor.Balance = big.Sub(fromActor.Balance, gasCost)
+	fromActor.CallSeqNum++
+	if err := vm.setActor(vm.ctx, fromID, fromActor); err != nil {
+		panic(err)
+	}
+
+	ret, code, gasUsed := vm.applyMessage(msg.From, fromID, fromActor, msg.Nonce, msg.To, msg.Value, msg.Method, msg.Params, msg.GasLimit)
+
+	receipt := Receipt{ExitCode: code, GasUsed: gasUsed}
+	if ret != nil && code == exitcode.Ok {
+		var buf bytes.Buffer
+		if err := ret.MarshalCBOR(&buf); err != nil {
+			panic(errors.Wrapf(err, "failed to serialize return value of message to %s", msg.To))
+		}
+		receipt.Return = buf.Bytes()
+	}
+
+	// Pay for gas. The sender's prepayment covers the burn, tip and refund exactly.
+	out := ComputeGasOutputs(gasUsed, msg.GasLimit, vm.baseFee, msg.GasFeeCap, msg.GasPremium)
+	vm.creditActor(builtin.BurntFundsActorAddr, big.Add(out.BaseFeeBurn, out.OverEstimationBurn))
+	vm.creditActor(builtin.RewardActorAddr, out.MinerTip)
+	vm.creditActor(fromID, out.Refund)
+	if _, err := vm.checkpoint(); err != nil {
+		panic(err)
+	}
+
+	return receipt, out
+}
+
+// Applies a message from a sender that has been loaded from state, returning the gas used.
+// The sender's state is checkpointed before execution, so any prior changes to it persist if the message fails.
+// The call sequence number is the message's nonce, from which the addresses of actors it creates are derived.
+func (vm *VM) applyMessage(from, fromID address.Address, fromActor *states.Actor, callSeq uint64, to address.Address,
+	value abi.TokenAmount, method abi.MethodNum, params interface{}, gasLimit int64) (cbor.Marshaler, exitcode.ExitCode, int64) {
+	// This method does not actually execute the message itself,
+	// but rather deals with the pre/post processing of a message.
+	// (see: `invocationContext.invoke()` for the dispatch and execution)
+
 	// checkpoint state
 	// Even if the message fails, the following accumulated changes will be applied:
 	// - CallSeqNumber increment
@@ -321,13 +492,20 @@ func (vm *VM) ApplyMessage(from, to address.Address, value abi.TokenAmount, meth
 
 	topLevel := topLevelContext{
 		originatorStableAddress: from,
-		// this should be nonce, but we only care that it creates a unique stable address
-		originatorCallSeq:    vm.callSequence,
-		newActorAddressCount: 0,
-		statsSource:          vm.statsSource,
-		circSupply:           vm.circSupply,
+		originatorCallSeq:       callSeq,
+		newActorAddressCount:    0,
+		statsSource:             vm.statsSource,
+		circSupply:              vm.circSupply,
+		priceList:               vm.priceList,
+		gasLimit:                gasLimit,
 	}
-	vm.callSequence++
+
+	// charge for the inclusion of the message on chain
+	msgGas := vm.priceList.OnChainMessage(messageSize(from, to, value, method, params))
+	if msgGas.Total() > gasLimit {
+		return abi.Empty, exitcode.SysErrOutOfGas, gasLimit
+	}
+	topLevel.gasUsed = msgGas.Total()
 
 	// build internal msg
 	imsg := InternalMessage{
@@ -344,6 +522,18 @@ func (vm *VM) ApplyMessage(from, to address.Address, value abi.TokenAmount, meth
 	// 3. invoke
 	ret, exitCode := ctx.invoke()
 
+	// charge for the inclusion of the return value on chain
+	if exitCode == exitcode.Ok {
+		retGas := vm.priceList.OnChainReturnValue(returnSize(ret.inner))
+		if topLevel.gasUsed+retGas.Total() > gasLimit {
+			topLevel.gasUsed = gasLimit
+			ret, exitCode = returnWrapper{abi.Empty}, exitcode.SysErrOutOfGas
+		} else {
+			topLevel.gasUsed += retGas.Total()
+		}
+	}
+	vm.LastInvocation().GasUsed = topLevel.gasUsed
+
 	// record stats
 	vm.statsByMethod.MergeStats(ctx.toActor.Code, imsg.method, ctx.stats)
 
@@ -363,7 +553,7 @@ func (vm *VM) ApplyMessage(from, to address.Address, value abi.TokenAmount, meth
 
 	}
 
-	return ret.inner, exitCode
+	return ret.inner, exitCode, topLevel.gasUsed
 }
 
 func (vm *VM) StateRoot() cid.Cid {
@@ -420,6 +610,55 @@ func (vm *VM) GetCallStats() map[MethodKey]*CallStats {
 	return vm.statsByMethod
 }
 
+// Set the price list used to charge gas for subsequent messages
+func (vm *VM) SetPriceList(priceList PriceList) {
+	vm.priceList = priceList
+}
+
+func (vm *VM) GetPriceList() PriceList {
+	return vm.priceList
+}
+
+// Set the gas limit for subsequent messages not sent by the system actor
+func (vm *VM) SetGasLimit(limit int64) {
+	vm.gasLimit = limit
+}
+
+func (vm *VM) GetGasLimit() int64 {
+	return vm.gasLimit
+}
+
+// Set the source of randomness drawn by actors
+func (vm *VM) SetRandomnessSource(r RandomnessSource) {
+	vm.randomness = r
+}
+
+func (vm *VM) GetRandomnessSource() RandomnessSource {
+	return vm.randomness
+}
+
+func (vm *VM) GetSyscallsProvider() SyscallsProvider {
+	return vm.syscalls
+}
+
+// Set the base fee paid by subsequent chain messages
+func (vm *VM) SetBaseFee(baseFee abi.TokenAmount) {
+	vm.baseFee = baseFee
+}
+
+func (vm *VM) GetBaseFee() abi.TokenAmount {
+	return vm.baseFee
+}
+
+// Set the recorder to which subsequent messages are recorded, or nil to stop recording
+func (vm *VM) SetRecorder(r *Recorder) {
+	vm.recorder = r
+}
+
+func (vm *VM) GetRecorder() *Recorder {
+	return vm.recorder
+}
+
 // Set the FIL circulating supply passed to actors through runtime
 func (vm *VM) SetCirculatingSupply(supply abi.TokenAmount) {
 	vm.circSupply = supply
@@ -485,6 +724,25 @@ func (vm *VM) transfer(debitFrom address.Address, creditTo address.Address, amou
 	return toActor, fromActor
 }
 
+// creditActor credits funds to an existing actor, without debiting any other.
+// The caller is responsible for having debited the funds elsewhere.
+func (vm *VM) creditActor(creditTo address.Address, amount abi.TokenAmount) {
+	if amount.IsZero() {
+		return
+	}
+	toActor, found, err := vm.GetActor(creditTo)
+	if err != nil {
+		panic(err)
+	}
+	if !found {
+		panic(fmt.Errorf("unreachable: credit account %s not found", creditTo))
+	}
+	toActor.Balance = big.Add(toActor.Balance, amount)
+	if err := vm.setActor(vm.ctx, creditTo, toActor); err != nil {
+		panic(err)
+	}
+}
+
 func (vm *VM) getActorImpl(code cid.Cid) runtime.VMActor {
 	actorImpl, ok := vm.ActorImpls[code]
 	if !ok {
@@ -548,15 +806,42 @@ func (vm *VM) startInvocation(msg *InternalMessage) {
 	vm.invocationStack = append(vm.invocationStack, &invocation)
 }
 
-func (vm *VM) endInvocation(code exitcode.ExitCode, ret cbor.Marshaler) {
+func (vm *VM) endInvocation(code exitcode.ExitCode, ret cbor.Marshaler, gasUsed int64) {
 	curIndex := len(vm.invocationStack) - 1
 	current := vm.invocationStack[curIndex]
 	current.Exitcode = code
 	current.Ret = ret
+	current.GasUsed = gasUsed
 
 	vm.invocationStack = vm.invocationStack[:curIndex]
 }
 
+// LogEntry is a line logged during an invocation.
+type LogEntry struct {
+	Level   rt.LogLevel
+	Message string
+}
+
+// Returns the invocation currently executing, or nil if none is.
+func (vm *VM) currentInvocation() *Invocation {
+	if len(vm.invocationStack) == 0 {
+		return nil
+	}
+	return vm.invocationStack[len(vm.invocationStack)-1]
+}
+
+func (vm *VM) recordRead(c cid.Cid) {
+	if inv := vm.currentInvocation(); inv != nil {
+		inv.Reads = append(inv.Reads, c)
+	}
+}
+
+func (vm *VM) recordWrite(c cid.Cid) {
+	if inv := vm.currentInvocation(); inv != nil {
+		inv.Writes = append(inv.Writes, c)
+	}
+}
+
 func (vm *VM) Invocations() []*Invocation {
 	return vm.invocations
 }
@@ -569,8 +854,12 @@ func (vm *VM) LastInvocation() *Invocation {
 // implement runtime.Runtime for VM
 //
 
-func (vm *VM) Log(_ rt.LogLevel, msg string, args ...interface{}) {
-	vm.logs = append(vm.logs, fmt.Sprintf(msg, args...))
+func (vm *VM) Log(level rt.LogLevel, msg string, args ...interface{}) {
+	line := fmt.Sprintf(msg, args...)
+	vm.logs = append(vm.logs, line)
+	if inv := vm.currentInvocation(); inv != nil {
+		inv.Logs = append(inv.Logs, LogEntry{Level: level, Message: line})
+	}
 }
 
 func (vm *VM) GetLogs() []string {